@@ -4,8 +4,10 @@ go 1.14
 
 require (
 	github.com/lucsky/cuid v1.0.2
+	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/pkg/errors v0.9.1
 	github.com/rs/cors v1.7.0
 	github.com/spaolacci/murmur3 v1.1.0
 	go.mongodb.org/mongo-driver v1.3.3
+	golang.org/x/net v0.0.0-20200520004742-59133d7f0dd7
 )
@@ -4,15 +4,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/abradley2/macguffin/lib/database"
 	"github.com/abradley2/macguffin/lib/token"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 func TestCreateArticle(t *testing.T) {
@@ -28,8 +33,9 @@ func TestCreateArticle(t *testing.T) {
 	usersCollection := &database.TestCollection{}
 
 	tokenData := token.UserTokenData{
-		ClientToken: testClientToken,
-		UserID:      testUserID,
+		ClientTokenHash: token.HashClientToken(testClientToken),
+		LastSeenAt:      time.Now(),
+		UserID:          testUserID,
 	}
 
 	tokenJs, err := json.Marshal(tokenData)
@@ -57,7 +63,7 @@ func TestCreateArticle(t *testing.T) {
 
 	tokensCollection.HashQuery(
 		bson.M{
-			"clientToken": bson.M{"$eq": testClientToken},
+			"clientTokenHash": bson.M{"$eq": token.HashClientToken(testClientToken)},
 		},
 		tokenJs,
 	)
@@ -93,3 +99,1133 @@ func TestCreateArticle(t *testing.T) {
 		t.Errorf("HandleCreateArticle did not give OK status code, got: %d", w.Code)
 	}
 }
+
+func withLoggedInUser(t *testing.T, tokens *database.TestCollection, users *database.TestCollection, clientToken string, userID string, role token.Role) {
+	tokenJs, err := json.Marshal(token.UserTokenData{
+		ClientTokenHash: token.HashClientToken(clientToken),
+		LastSeenAt:      time.Now(),
+		UserID:          userID,
+	})
+
+	if err != nil {
+		t.Fatalf("Could not create token fixture: %v", err)
+	}
+
+	userJs, err := json.Marshal(token.UserData{
+		UserID: userID,
+		Role:   role,
+	})
+
+	if err != nil {
+		t.Fatalf("Could not create user fixture: %v", err)
+	}
+
+	tokens.HashQuery(
+		bson.M{
+			"clientTokenHash": bson.M{"$eq": token.HashClientToken(clientToken)},
+		},
+		tokenJs,
+	)
+
+	users.HashQuery(
+		bson.M{
+			"userID": bson.M{"$eq": userID},
+		},
+		userJs,
+	)
+}
+
+func TestUpdateArticle(t *testing.T) {
+	const (
+		testClientToken  = "test-client-token"
+		testUserID       = "test-user-id"
+		otherClientToken = "other-client-token"
+		otherUserID      = "other-user-id"
+	)
+
+	articleID := primitive.NewObjectID()
+
+	tokensCollection := &database.TestCollection{}
+	usersCollection := &database.TestCollection{}
+	articlesCollection := &database.TestCollection{}
+
+	withLoggedInUser(t, tokensCollection, usersCollection, testClientToken, testUserID, token.RoleAgent)
+	withLoggedInUser(t, tokensCollection, usersCollection, otherClientToken, otherUserID, token.RoleAgent)
+
+	artJs, _ := json.Marshal(article{
+		ID:          articleID.Hex(),
+		ItemTitle:   "some random article",
+		Content:     "markdown content goes here",
+		Creator:     testUserID,
+		Approved:    true,
+		ArticleType: "macguffins",
+	})
+
+	articlesCollection.HashQuery(
+		bson.M{
+			"_id": bson.M{"$eq": articleID},
+		},
+		artJs,
+	)
+
+	update := func(clientToken string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+
+		bodJs, _ := json.Marshal(updateArticleBody{
+			ID:          articleID.Hex(),
+			ItemTitle:   "some random article, fixed",
+			Content:     "markdown content without typos",
+			ArticleType: "macguffins",
+		})
+
+		r, _ := http.NewRequest(http.MethodPost, "", bytes.NewBuffer(bodJs))
+		r.Header.Set("Authorization", clientToken)
+
+		p := UpdateArticleParams{
+			Logger:            log.New(os.Stderr, "", log.LstdFlags),
+			TokensCollection:  tokensCollection,
+			ArticleCollection: articlesCollection,
+			UsersCollection:   usersCollection,
+		}
+
+		err := p.FromRequest(r, &database.TestDatabase{})
+
+		if err != nil {
+			t.Fatalf("Failed to create UpdateArticleParams from request: %v", err)
+		}
+
+		HandleUpdateArticle(context.Background(), w, p)
+
+		return w
+	}
+
+	w := update(otherClientToken)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("HandleUpdateArticle should forbid edits from other agents, got: %d", w.Code)
+	}
+
+	if articlesCollection.LastUpdate != nil {
+		t.Errorf("HandleUpdateArticle should not have updated the article for another agent")
+	}
+
+	w = update(testClientToken)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("HandleUpdateArticle did not give OK status code, got: %d", w.Code)
+	}
+
+	set := struct {
+		Set map[string]interface{} `json:"$set"`
+	}{}
+
+	err := json.Unmarshal(articlesCollection.LastUpdate, &set)
+
+	if err != nil {
+		t.Fatalf("Failed to unmarshal last update: %v", err)
+	}
+
+	if set.Set["approved"] != false {
+		t.Errorf("Editing an article should send it back to moderation, got approved = %v", set.Set["approved"])
+	}
+
+	if set.Set["itemTitle"] != "some random article, fixed" {
+		t.Errorf("Expected the updated title to be set, got: %v", set.Set["itemTitle"])
+	}
+}
+
+func TestModerateArticle(t *testing.T) {
+	const (
+		adminClientToken = "admin-client-token"
+		adminUserID      = "admin-user-id"
+		agentClientToken = "agent-client-token"
+		agentUserID      = "agent-user-id"
+	)
+
+	articleID := primitive.NewObjectID()
+
+	tokensCollection := &database.TestCollection{}
+	usersCollection := &database.TestCollection{}
+	articlesCollection := &database.TestCollection{}
+
+	withLoggedInUser(t, tokensCollection, usersCollection, adminClientToken, adminUserID, token.RoleModerator)
+	withLoggedInUser(t, tokensCollection, usersCollection, agentClientToken, agentUserID, token.RoleAgent)
+
+	// the article is at its second revision
+	articlesCollection.HashQuery(
+		bson.M{
+			"_id": bson.M{"$eq": articleID},
+		},
+		[]byte(`{}`),
+	)
+	articlesCollection.HashQuery(
+		bson.M{
+			"_id":      bson.M{"$eq": articleID},
+			"revision": bson.M{"$eq": 2},
+		},
+		[]byte(`{}`),
+	)
+
+	reject := func(clientToken string, reason string, revision int) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+
+		bodJs, _ := json.Marshal(moderateArticleBody{
+			ID:          articleID.Hex(),
+			ArticleType: "macguffins",
+			Revision:    &revision,
+			Reason:      reason,
+		})
+
+		r, _ := http.NewRequest(http.MethodPost, "", bytes.NewBuffer(bodJs))
+		r.Header.Set("Authorization", clientToken)
+
+		p := ModerateArticleParams{
+			Logger:            log.New(os.Stderr, "", log.LstdFlags),
+			TokensCollection:  tokensCollection,
+			ArticleCollection: articlesCollection,
+			UsersCollection:   usersCollection,
+		}
+
+		err := p.FromRequest(r, &database.TestDatabase{})
+
+		if err != nil {
+			t.Fatalf("Failed to create ModerateArticleParams from request: %v", err)
+		}
+
+		HandleRejectArticle(context.Background(), w, p)
+
+		return w
+	}
+
+	if w := reject(agentClientToken, "not classified enough", 2); w.Code != http.StatusForbidden {
+		t.Errorf("HandleRejectArticle should forbid agents who are not moderators, got: %d", w.Code)
+	}
+
+	if w := reject(adminClientToken, "", 2); w.Code != http.StatusBadRequest {
+		t.Errorf("HandleRejectArticle should require a reason, got: %d", w.Code)
+	}
+
+	// the creator edited the article after the moderator reviewed its first revision
+	if w := reject(adminClientToken, "not classified enough", 1); w.Code != http.StatusConflict {
+		t.Errorf("HandleRejectArticle should not moderate a revision that wasn't reviewed, got: %d", w.Code)
+	}
+
+	if w := reject(adminClientToken, "not classified enough", 2); w.Code != http.StatusOK {
+		t.Errorf("HandleRejectArticle did not give OK status code, got: %d", w.Code)
+	}
+
+	set := struct {
+		Set map[string]interface{} `json:"$set"`
+	}{}
+
+	err := json.Unmarshal(articlesCollection.LastUpdate, &set)
+
+	if err != nil {
+		t.Fatalf("Failed to unmarshal last update: %v", err)
+	}
+
+	if set.Set["rejectionReason"] != "not classified enough" || set.Set["moderatedBy"] != adminUserID {
+		t.Errorf("Expected the rejection reason and moderator to be recorded, got: %v", set.Set)
+	}
+}
+
+func TestCreateThenListArticles(t *testing.T) {
+	const (
+		testClientToken = "test-client-token"
+		testUserID      = "github:1"
+	)
+
+	ctx := context.Background()
+	db := database.NewMemoryDatabase()
+	tokensCollection := db.Collection(database.TokensCollection)
+	usersCollection := db.Collection(database.AgentsCollection)
+
+	_, err := tokensCollection.InsertOne(ctx, bson.M{
+		"userID":          testUserID,
+		"clientTokenHash": token.HashClientToken(testClientToken),
+		"lastSeenAt":      time.Now(),
+	}, nil)
+
+	if err != nil {
+		t.Fatalf("Could not create token fixture: %v", err)
+	}
+
+	_, err = usersCollection.InsertOne(ctx, token.UserData{UserID: testUserID, Role: token.RoleAgent, PublicAgentID: "agent-1"}, nil)
+
+	if err != nil {
+		t.Fatalf("Could not create user fixture: %v", err)
+	}
+
+	bodJs, _ := json.Marshal(createArticleBody{
+		ItemTitle:   "the maltese falcon",
+		Content:     "a black bird",
+		ArticleType: database.MacguffinsCollection,
+	})
+
+	r, _ := http.NewRequest(http.MethodPost, "", bytes.NewBuffer(bodJs))
+	r.Header.Set("Authorization", testClientToken)
+
+	createParams := CreateArticleParams{
+		Logger:           log.New(os.Stderr, "", log.LstdFlags),
+		TokensCollection: tokensCollection,
+		UsersCollection:  usersCollection,
+	}
+
+	if err := createParams.FromRequest(r, db); err != nil {
+		t.Fatalf("Failed to create CreateArticleParams from request: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	HandleCreateArticle(ctx, w, createParams)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleCreateArticle did not give OK status code, got: %d", w.Code)
+	}
+
+	list := func(query string, clientToken string) []article {
+		r, _ := http.NewRequest(http.MethodGet, "/articles?type=macguffins"+query, nil)
+
+		if clientToken != "" {
+			r.Header.Set("Authorization", clientToken)
+		}
+
+		p := GetArticleListParams{
+			Logger:           log.New(os.Stderr, "", log.LstdFlags),
+			TokensCollection: tokensCollection,
+			UsersCollection:  usersCollection,
+		}
+
+		if err := p.FromRequest(r, db); err != nil {
+			t.Fatalf("Failed to create GetArticleListParams from request: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		HandleGetArticleList(ctx, w, p)
+
+		page := articlePage{}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("Could not unmarshal article list %s: %v", w.Body.String(), err)
+		}
+
+		return page.Articles
+	}
+
+	if arts := list("", ""); len(arts) != 0 {
+		t.Errorf("Expected unapproved article to be hidden from anonymous agents, got: %v", arts)
+	}
+
+	arts := list("", testClientToken)
+
+	if len(arts) != 1 || arts[0].ItemTitle != "the maltese falcon" || arts[0].Creator != "agent-1" {
+		t.Errorf("Expected creator to see their unapproved article, got: %v", arts)
+	}
+
+	if arts := list("&creator=agent-1", testClientToken); len(arts) != 1 {
+		t.Errorf("Expected articles to be filtered by their creator's publicAgentID, got: %v", arts)
+	}
+
+	if arts := list("&creator="+testUserID, testClientToken); len(arts) != 0 {
+		t.Errorf("Expected a userID not to be accepted as a creator filter, got: %v", arts)
+	}
+}
+
+func TestArticlePages(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewMemoryDatabase()
+	macguffins := db.Collection(database.MacguffinsCollection)
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	// the second and third articles were created in the same millisecond
+	for i, offset := range []time.Duration{0, time.Minute, time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		_, err := macguffins.InsertOne(ctx, bson.M{
+			"itemTitle":   fmt.Sprintf("article %d", i),
+			"approved":    true,
+			"articleType": database.MacguffinsCollection,
+			"createdAt":   primitive.NewDateTimeFromTime(start.Add(offset)),
+		}, nil)
+
+		if err != nil {
+			t.Fatalf("Could not create article fixture: %v", err)
+		}
+	}
+
+	list := func(query string) (int, articlePage) {
+		r, _ := http.NewRequest(http.MethodGet, "/articles?type=macguffins&"+query, nil)
+
+		p := GetArticleListParams{
+			Logger:           log.New(os.Stderr, "", log.LstdFlags),
+			TokensCollection: db.Collection(database.TokensCollection),
+			UsersCollection:  db.Collection(database.AgentsCollection),
+		}
+
+		if err := p.FromRequest(r, db); err != nil {
+			return http.StatusBadRequest, articlePage{}
+		}
+
+		w := httptest.NewRecorder()
+		HandleGetArticleList(ctx, w, p)
+
+		page := articlePage{}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("Could not unmarshal article page %s: %v", w.Body.String(), err)
+		}
+
+		return w.Code, page
+	}
+
+	for _, sort := range []string{"asc", "desc"} {
+		titles := []string{}
+		query := "limit=2&sort=" + sort
+		pages := 0
+
+		for {
+			code, page := list(query)
+
+			if code != http.StatusOK || len(page.Articles) > 2 {
+				t.Fatalf("Expected a page of at most 2 articles, got %d: %v", code, page)
+			}
+
+			for _, a := range page.Articles {
+				titles = append(titles, a.ItemTitle)
+			}
+
+			pages++
+
+			if page.NextCursor == nil {
+				break
+			}
+
+			query = "limit=2&sort=" + sort + "&after=" + *page.NextCursor
+		}
+
+		expected := "[article 0 article 1 article 2 article 3 article 4]"
+		if sort == "desc" {
+			expected = "[article 4 article 3 article 2 article 1 article 0]"
+		}
+
+		if fmt.Sprint(titles) != expected || pages != 3 {
+			t.Errorf("Expected every article once in %s order over 3 pages, got %v over %d", sort, titles, pages)
+		}
+	}
+
+	_, first := list("limit=2&sort=asc")
+
+	if code, _ := list("sort=desc&after=" + *first.NextCursor); code != http.StatusBadRequest {
+		t.Errorf("Expected a cursor to be rejected with the other sort direction, got %d", code)
+	}
+
+	for _, query := range []string{"after=garbage", "limit=0", "limit=ten", "sort=sideways"} {
+		if code, _ := list(query); code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d", query, code)
+		}
+	}
+
+	if n, err := parsePageSize("1000"); n != MaxPageSize || err != nil {
+		t.Errorf("Expected large limits to be lowered to the maximum page size, got %d: %v", n, err)
+	}
+
+	if _, page := list(""); len(page.Articles) != 5 || page.NextCursor != nil {
+		t.Errorf("Expected a single page without a cursor when everything fits, got %v", page)
+	}
+}
+
+func TestSearchArticles(t *testing.T) {
+	const (
+		testClientToken = "test-client-token"
+		testUserID      = "github:1"
+	)
+
+	ctx := context.Background()
+	db := database.NewMemoryDatabase()
+	tokensCollection := db.Collection(database.TokensCollection)
+	usersCollection := db.Collection(database.AgentsCollection)
+
+	_, err := tokensCollection.InsertOne(ctx, bson.M{
+		"userID":          testUserID,
+		"clientTokenHash": token.HashClientToken(testClientToken),
+		"lastSeenAt":      time.Now(),
+	}, nil)
+
+	if err != nil {
+		t.Fatalf("Could not create token fixture: %v", err)
+	}
+
+	_, err = usersCollection.InsertOne(ctx, token.UserData{UserID: testUserID, Role: token.RoleAgent}, nil)
+
+	if err != nil {
+		t.Fatalf("Could not create user fixture: %v", err)
+	}
+
+	fixtures := []struct {
+		collection string
+		title      string
+		content    string
+		approved   bool
+		creator    string
+	}{
+		{database.MacguffinsCollection, "The Maltese Falcon", "A statuette of a <black> bird", true, "github:2"},
+		{database.SitesCollection, "San Francisco", "Where Sam Spade went looking for the falcon", true, "github:2"},
+		{database.EventsCollection, "The falcon is stolen", "Nobody saw it happen", false, "github:2"},
+		{database.EventsCollection, "A falcon sighting", "Drafted by the viewer", false, testUserID},
+	}
+
+	for _, f := range fixtures {
+		_, err := db.Collection(f.collection).InsertOne(ctx, bson.M{
+			"itemTitle":   f.title,
+			"content":     f.content,
+			"approved":    f.approved,
+			"creator":     f.creator,
+			"articleType": f.collection,
+			"createdAt":   primitive.NewDateTimeFromTime(time.Now()),
+		}, nil)
+
+		if err != nil {
+			t.Fatalf("Could not create article fixture: %v", err)
+		}
+	}
+
+	search := func(query string, clientToken string) (int, searchResults) {
+		r, _ := http.NewRequest(http.MethodGet, "/search?"+query, nil)
+
+		if clientToken != "" {
+			r.Header.Set("Authorization", clientToken)
+		}
+
+		p := SearchArticlesParams{
+			Logger:           log.New(os.Stderr, "", log.LstdFlags),
+			TokensCollection: tokensCollection,
+			UsersCollection:  usersCollection,
+		}
+
+		if err := p.FromRequest(r, db); err != nil {
+			return http.StatusBadRequest, searchResults{}
+		}
+
+		w := httptest.NewRecorder()
+		HandleSearchArticles(ctx, w, p)
+
+		results := searchResults{}
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatalf("Could not unmarshal search results %s: %v", w.Body.String(), err)
+		}
+
+		return w.Code, results
+	}
+
+	titles := func(results searchResults) []string {
+		found := []string{}
+		for _, r := range results.Results {
+			found = append(found, r.ItemTitle)
+		}
+		return found
+	}
+
+	_, results := search("q=falcon", "")
+
+	if fmt.Sprint(titles(results)) != "[The Maltese Falcon San Francisco]" {
+		t.Errorf("Expected approved articles of every type, title matches first, got %v", titles(results))
+	}
+
+	if results.Results[0].Creator != "" {
+		t.Errorf("Expected the userID of an agent without a publicAgentID to be left out, got %q", results.Results[0].Creator)
+	}
+
+	if results.Results[0].Highlights["itemTitle"] != "The Maltese <mark>Falcon</mark>" {
+		t.Errorf("Expected the matching title word to be highlighted, got %q", results.Results[0].Highlights["itemTitle"])
+	}
+
+	if results.Results[0].Highlights["content"] != "A statuette of a &lt;black&gt; bird" {
+		t.Errorf("Expected the content snippet to be escaped, got %q", results.Results[0].Highlights["content"])
+	}
+
+	if results.Results[1].Highlights["content"] != "Where Sam Spade went looking for the <mark>falcon</mark>" {
+		t.Errorf("Expected the matching content word to be highlighted, got %q", results.Results[1].Highlights["content"])
+	}
+
+	if _, results := search("q=falcon", testClientToken); len(results.Results) != 3 {
+		t.Errorf("Expected agents to also find their own unapproved articles, got %v", titles(results))
+	}
+
+	if _, results := search("q=falcon+-statuette&limit=1", ""); fmt.Sprint(titles(results)) != "[San Francisco]" {
+		t.Errorf("Expected negated words to exclude articles, got %v", titles(results))
+	}
+
+	if code, _ := search("q=+", ""); code != http.StatusBadRequest {
+		t.Errorf("Expected an empty search to be rejected, got %d", code)
+	}
+
+	long := "The bird was passed from hand to hand across the Mediterranean for centuries, " +
+		"each owner more ruthless than the last, until it finally surfaced in a pawn shop " +
+		"where a falcon of black enamel sat unnoticed on a shelf behind the counter for years on end, " +
+		"gathering dust while the men looking for it tore the city apart."
+
+	snippet := highlight(long, database.ParseTextQuery("falcon"), snippetLength)
+
+	if len(snippet) > snippetLength+20 || snippet[:3] != "…" || snippet[len(snippet)-3:] != "…" {
+		t.Errorf("Expected a snippet around the match of about %d bytes, got %q", snippetLength, snippet)
+	}
+}
+
+func TestGetArticle(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewMemoryDatabase()
+	tokensCollection := db.Collection(database.TokensCollection)
+	usersCollection := db.Collection(database.AgentsCollection)
+
+	agents := map[string]token.Role{
+		"github:1": token.RoleAgent,
+		"github:2": token.RoleAgent,
+		"github:3": token.RoleModerator,
+	}
+
+	for userID, role := range agents {
+		_, err := tokensCollection.InsertOne(ctx, bson.M{
+			"userID":          userID,
+			"clientTokenHash": token.HashClientToken("token-" + userID),
+			"lastSeenAt":      time.Now(),
+		}, nil)
+
+		if err != nil {
+			t.Fatalf("Could not create token fixture: %v", err)
+		}
+
+		_, err = usersCollection.InsertOne(ctx, token.UserData{UserID: userID, Role: role, PublicAgentID: "public-" + userID}, nil)
+
+		if err != nil {
+			t.Fatalf("Could not create user fixture: %v", err)
+		}
+	}
+
+	ids := map[bool]string{}
+
+	for _, approved := range []bool{true, false} {
+		id, err := db.Collection(database.SitesCollection).InsertOne(ctx, bson.M{
+			"itemTitle":   fmt.Sprintf("approved %t", approved),
+			"approved":    approved,
+			"creator":     "github:1",
+			"moderatedBy": "github:3",
+			"articleType": database.SitesCollection,
+			"createdAt":   primitive.NewDateTimeFromTime(time.Now()),
+		}, nil)
+
+		if err != nil {
+			t.Fatalf("Could not create article fixture: %v", err)
+		}
+
+		ids[approved] = id
+	}
+
+	get := func(path string, userID string) (int, article) {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+
+		if userID != "" {
+			r.Header.Set("Authorization", "token-"+userID)
+		}
+
+		p := GetArticleParams{
+			Logger:           log.New(os.Stderr, "", log.LstdFlags),
+			TokensCollection: tokensCollection,
+			UsersCollection:  usersCollection,
+		}
+
+		if err := p.FromRequest(r, db); err != nil {
+			return http.StatusNotFound, article{}
+		}
+
+		w := httptest.NewRecorder()
+		HandleGetArticle(ctx, w, p)
+
+		art := article{}
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &art); err != nil {
+				t.Fatalf("Could not unmarshal article %s: %v", w.Body.String(), err)
+			}
+		}
+
+		return w.Code, art
+	}
+
+	if code, art := get("/articles/sites/"+ids[true], ""); code != http.StatusOK || art.ItemTitle != "approved true" {
+		t.Errorf("Expected anyone to see an approved article, got %d: %v", code, art)
+	}
+
+	// the userID an agent logs in with is never given away, only their publicAgentID
+	if _, art := get("/articles/sites/"+ids[true], ""); art.Creator != "public-github:1" || art.ModeratedBy != "" {
+		t.Errorf("Expected the creator as a publicAgentID and no moderator, got: %v", art)
+	}
+
+	if _, art := get("/articles/sites/"+ids[true], "github:3"); art.ModeratedBy != "github:3" {
+		t.Errorf("Expected moderators to see who moderated an article, got: %v", art)
+	}
+
+	cases := []struct {
+		userID string
+		code   int
+	}{
+		{"", http.StatusNotFound},
+		{"github:2", http.StatusNotFound},
+		{"github:1", http.StatusOK},
+		{"github:3", http.StatusOK},
+	}
+
+	for _, c := range cases {
+		if code, _ := get("/articles/sites/"+ids[false], c.userID); code != c.code {
+			t.Errorf("Expected %q to get %d for an unapproved article, got %d", c.userID, c.code, code)
+		}
+	}
+
+	for _, path := range []string{
+		"/articles/sites/" + primitive.NewObjectID().Hex(),
+		"/articles/sites/not-an-id",
+		"/articles/events/" + ids[true],
+		"/articles/villains/" + ids[true],
+		"/articles/sites",
+	} {
+		if code, _ := get(path, "github:3"); code != http.StatusNotFound {
+			t.Errorf("Expected %s to not be found, got %d", path, code)
+		}
+	}
+}
+
+func TestDiffBlocks(t *testing.T) {
+	cases := []struct {
+		a, b   string
+		chunks []diffChunk
+	}{
+		{"", "", []diffChunk{}},
+		{"a\nb\n", "a\nb\n", []diffChunk{{"equal", "a\nb\n"}}},
+		{"", "a\n", []diffChunk{{"insert", "a\n"}}},
+		{
+			"a\nb\nc\n",
+			"a\nx\nc\nd\n",
+			[]diffChunk{{"equal", "a\n"}, {"delete", "b\n"}, {"insert", "x\n"}, {"equal", "c\n"}, {"insert", "d\n"}},
+		},
+		{
+			"a\nb\nc\nd\n",
+			"b\nd\n",
+			[]diffChunk{{"delete", "a\n"}, {"equal", "b\n"}, {"delete", "c\n"}, {"equal", "d\n"}},
+		},
+		{
+			"<p>a</p><ul><li>x</li><li>y</li></ul>",
+			"<p>a</p><ul><li>x</li><li>z</li></ul><p>b<br>c</p>",
+			[]diffChunk{
+				{"equal", "<p>a</p><ul><li>x</li>"},
+				{"delete", "<li>y</li>"},
+				{"insert", "<li>z</li>"},
+				{"equal", "</ul>"},
+				{"insert", "<p>b<br>c</p>"},
+			},
+		},
+		{
+			`<x-align style="display: block; text-align: left;" data-alignment="left">a</x-align><p>b</p>`,
+			`<x-align style="display: block; text-align: center;" data-alignment="center">a</x-align><p>b</p>`,
+			[]diffChunk{
+				{"delete", `<x-align style="display: block; text-align: left;" data-alignment="left">a</x-align>`},
+				{"insert", `<x-align style="display: block; text-align: center;" data-alignment="center">a</x-align>`},
+				{"equal", "<p>b</p>"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		chunks := diffBlocks(c.a, c.b)
+
+		if fmt.Sprint(chunks) != fmt.Sprint(c.chunks) {
+			t.Errorf("Expected diff of %q and %q to be %v, got %v", c.a, c.b, c.chunks, chunks)
+		}
+	}
+}
+
+func TestArticleRevisions(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewMemoryDatabase()
+	tokensCollection := db.Collection(database.TokensCollection)
+	usersCollection := db.Collection(database.AgentsCollection)
+
+	agents := map[string]token.Role{
+		"github:1": token.RoleAgent,
+		"github:2": token.RoleAgent,
+		"github:3": token.RoleModerator,
+	}
+
+	for userID, role := range agents {
+		_, err := tokensCollection.InsertOne(ctx, bson.M{
+			"userID":          userID,
+			"clientTokenHash": token.HashClientToken("token-" + userID),
+			"lastSeenAt":      time.Now(),
+		}, nil)
+
+		if err != nil {
+			t.Fatalf("Could not create token fixture: %v", err)
+		}
+
+		_, err = usersCollection.InsertOne(ctx, token.UserData{UserID: userID, Role: role, PublicAgentID: "public-" + userID}, nil)
+
+		if err != nil {
+			t.Fatalf("Could not create user fixture: %v", err)
+		}
+	}
+
+	bodJs, _ := json.Marshal(createArticleBody{
+		ItemTitle:   "the maltese falcon",
+		Content:     "a black bird\nmade of lead\n",
+		ArticleType: database.MacguffinsCollection,
+	})
+
+	r, _ := http.NewRequest(http.MethodPost, "", bytes.NewBuffer(bodJs))
+	r.Header.Set("Authorization", "token-github:1")
+
+	createParams := CreateArticleParams{
+		Logger:           log.New(os.Stderr, "", log.LstdFlags),
+		TokensCollection: tokensCollection,
+		UsersCollection:  usersCollection,
+	}
+
+	if err := createParams.FromRequest(r, db); err != nil {
+		t.Fatalf("Failed to create CreateArticleParams from request: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	HandleCreateArticle(ctx, w, createParams)
+
+	created := struct {
+		CreatedID string `json:"createdID"`
+	}{}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &created); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("HandleCreateArticle did not create the article, got %d: %s", w.Code, w.Body.String())
+	}
+
+	bodJs, _ = json.Marshal(updateArticleBody{
+		ID:          created.CreatedID,
+		ItemTitle:   "the maltese falcon",
+		Content:     "a black bird\nmade of gold\n",
+		ArticleType: database.MacguffinsCollection,
+		Summary:     "it was gold all along",
+	})
+
+	r, _ = http.NewRequest(http.MethodPost, "", bytes.NewBuffer(bodJs))
+	r.Header.Set("Authorization", "token-github:1")
+
+	updateParams := UpdateArticleParams{
+		Logger:           log.New(os.Stderr, "", log.LstdFlags),
+		TokensCollection: tokensCollection,
+		UsersCollection:  usersCollection,
+	}
+
+	if err := updateParams.FromRequest(r, db); err != nil {
+		t.Fatalf("Failed to create UpdateArticleParams from request: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	HandleUpdateArticle(ctx, w, updateParams)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleUpdateArticle did not give OK status code, got %d: %s", w.Code, w.Body.String())
+	}
+
+	path := "/articles/macguffins/" + created.CreatedID + "/revisions"
+
+	list := func(userID string) (int, []revision) {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", "token-"+userID)
+
+		p := GetRevisionsParams{
+			Logger:           log.New(os.Stderr, "", log.LstdFlags),
+			TokensCollection: tokensCollection,
+			UsersCollection:  usersCollection,
+		}
+
+		if err := p.FromRequest(r, db); err != nil {
+			t.Fatalf("Failed to create GetRevisionsParams from request: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		HandleGetRevisions(ctx, w, p)
+
+		revs := struct {
+			Revisions []revision `json:"revisions"`
+		}{}
+
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &revs); err != nil {
+				t.Fatalf("Could not unmarshal revisions %s: %v", w.Body.String(), err)
+			}
+		}
+
+		return w.Code, revs.Revisions
+	}
+
+	code, revs := list("github:1")
+
+	if code != http.StatusOK || len(revs) != 2 {
+		t.Fatalf("Expected the creator to see 2 revisions, got %d: %v", code, revs)
+	}
+
+	if revs[0].Revision != 2 || revs[0].Summary != "it was gold all along" || revs[1].Revision != 1 {
+		t.Errorf("Expected revisions newest first with their summaries, got: %v", revs)
+	}
+
+	if revs[1].Content != "a black bird\nmade of lead\n" || revs[1].Author != "public-github:1" {
+		t.Errorf("Expected the first revision to keep the created content and author, got: %v", revs[1])
+	}
+
+	if code, _ := list("github:2"); code != http.StatusNotFound {
+		t.Errorf("Expected the revisions of an unapproved article to be hidden from another agent, got %d", code)
+	}
+
+	id, _ := primitive.ObjectIDFromHex(created.CreatedID)
+	_, err := db.Collection(database.MacguffinsCollection).UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"approved": true}},
+		nil,
+	)
+
+	if err != nil {
+		t.Fatalf("Could not approve article fixture: %v", err)
+	}
+
+	if code, _ := list("github:2"); code != http.StatusForbidden {
+		t.Errorf("Expected another agent to be forbidden from the revisions, got %d", code)
+	}
+
+	if code, revs := list("github:3"); code != http.StatusOK || len(revs) != 2 {
+		t.Errorf("Expected a moderator to see 2 revisions, got %d: %v", code, revs)
+	}
+
+	r, _ = http.NewRequest(http.MethodGet, path+"/diff?from=1&to=2", nil)
+	r.Header.Set("Authorization", "token-github:1")
+
+	diffParams := GetRevisionDiffParams{
+		Logger:           log.New(os.Stderr, "", log.LstdFlags),
+		TokensCollection: tokensCollection,
+		UsersCollection:  usersCollection,
+	}
+
+	if err := diffParams.FromRequest(r, db); err != nil {
+		t.Fatalf("Failed to create GetRevisionDiffParams from request: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	HandleGetRevisionDiff(ctx, w, diffParams)
+
+	diff := struct {
+		Changes []diffChunk `json:"changes"`
+	}{}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &diff); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("Expected a diff of the revisions, got %d: %s", w.Code, w.Body.String())
+	}
+
+	expected := []diffChunk{{"equal", "a black bird\n"}, {"delete", "made of lead\n"}, {"insert", "made of gold\n"}}
+
+	if fmt.Sprint(diff.Changes) != fmt.Sprint(expected) {
+		t.Errorf("Expected diff %v, got %v", expected, diff.Changes)
+	}
+
+	restore := func(userID string, number int) (int, string) {
+		bodJs, _ := json.Marshal(restoreRevisionBody{
+			ID:          created.CreatedID,
+			ArticleType: database.MacguffinsCollection,
+			Revision:    number,
+		})
+
+		r, _ := http.NewRequest(http.MethodPost, "", bytes.NewBuffer(bodJs))
+		r.Header.Set("Authorization", "token-"+userID)
+
+		p := RestoreRevisionParams{
+			Logger:           log.New(os.Stderr, "", log.LstdFlags),
+			TokensCollection: tokensCollection,
+			UsersCollection:  usersCollection,
+		}
+
+		if err := p.FromRequest(r, db); err != nil {
+			t.Fatalf("Failed to create RestoreRevisionParams from request: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		HandleRestoreRevision(ctx, w, p)
+
+		return w.Code, w.Body.String()
+	}
+
+	if code, _ := restore("github:1", 1); code != http.StatusForbidden {
+		t.Errorf("Expected an agent to be forbidden from restoring a revision, got %d", code)
+	}
+
+	if code, _ := restore("github:3", 7); code != http.StatusNotFound {
+		t.Errorf("Expected restoring a missing revision to not be found, got %d", code)
+	}
+
+	if code, body := restore("github:3", 1); code != http.StatusOK {
+		t.Fatalf("Expected a moderator to restore a revision, got %d: %s", code, body)
+	}
+
+	art := article{}
+	err = db.Collection(database.MacguffinsCollection).FindOne(ctx, bson.M{"_id": id}, nil).Decode(&art)
+
+	if err != nil {
+		t.Fatalf("Could not read the restored article: %v", err)
+	}
+
+	if art.Content != "a black bird\nmade of lead\n" || art.Revision != 3 {
+		t.Errorf("Expected revision 1 to be restored as revision 3, got: %v", art)
+	}
+
+	_, revs = list("github:3")
+
+	if len(revs) != 3 || revs[0].RestoredFrom != 1 || revs[0].Author != "public-github:3" {
+		t.Errorf("Expected the restore to be recorded as a new revision, got: %v", revs)
+	}
+}
+
+func TestSanitizeContent(t *testing.T) {
+	cases := []struct {
+		content   string
+		sanitized string
+	}{
+		{"plain text", "plain text"},
+		{"<p>a <b>bold</b> and <i>italic</i> word<br></p>", "<p>a <b>bold</b> and <i>italic</i> word<br></p>"},
+		{"<ol><li>one</li><li>two</li></ol>", "<ol><li>one</li><li>two</li></ol>"},
+		{
+			`<x-align style="display: block; text-align: center;" data-alignment="center">centered</x-align>`,
+			`<x-align style="display: block; text-align: center;" data-alignment="center">centered</x-align>`,
+		},
+		{`<x-align style="background: url(x)" data-alignment="right">right</x-align>`, `<x-align style="display: block; text-align: right;" data-alignment="right">right</x-align>`},
+		{`<x-align data-alignment="sideways">text</x-align>`, "text"},
+		{"<p>hi<script>alert(1)</script></p>", "<p>hi</p>"},
+		{`<p onclick="alert(1)" class="x">hi</p>`, "<p>hi</p>"},
+		{`<a href="javascript:alert(1)">link</a>`, "link"},
+		{`<img src=x onerror="alert(1)">`, ""},
+		{"<style>p { color: red }</style><p>red</p>", "<p>red</p>"},
+		{"<svg><p>in svg</p><script>alert(1)</script></svg>", ""},
+		{"<!-- a comment -->1 &lt; 2 & 3 > 2", "1 &lt; 2 &amp; 3 &gt; 2"},
+		{"<b>unclosed", "<b>unclosed</b>"},
+		{`<p title="<script>">x</p>`, "<p>x</p>"},
+	}
+
+	for _, c := range cases {
+		sanitized, err := sanitizeContent(c.content)
+
+		if err != nil {
+			t.Fatalf("Failed to sanitize %q: %v", c.content, err)
+		}
+
+		if sanitized != c.sanitized {
+			t.Errorf("Expected %q to be sanitized to %q, got %q", c.content, c.sanitized, sanitized)
+		}
+	}
+}
+
+func TestArticleValidation(t *testing.T) {
+	const (
+		testClientToken = "test-client-token"
+		testUserID      = "github:1"
+	)
+
+	ctx := context.Background()
+	db := database.NewMemoryDatabase()
+	tokensCollection := db.Collection(database.TokensCollection)
+	usersCollection := db.Collection(database.AgentsCollection)
+
+	_, err := tokensCollection.InsertOne(ctx, bson.M{
+		"userID":          testUserID,
+		"clientTokenHash": token.HashClientToken(testClientToken),
+		"lastSeenAt":      time.Now(),
+	}, nil)
+
+	if err != nil {
+		t.Fatalf("Could not create token fixture: %v", err)
+	}
+
+	_, err = usersCollection.InsertOne(ctx, token.UserData{UserID: testUserID, Role: token.RoleAgent}, nil)
+
+	if err != nil {
+		t.Fatalf("Could not create user fixture: %v", err)
+	}
+
+	create := func(body createArticleBody) *httptest.ResponseRecorder {
+		body.ArticleType = database.MacguffinsCollection
+		bodJs, _ := json.Marshal(body)
+
+		r, _ := http.NewRequest(http.MethodPost, "", bytes.NewBuffer(bodJs))
+		r.Header.Set("Authorization", testClientToken)
+
+		p := CreateArticleParams{
+			Logger:           log.New(os.Stderr, "", log.LstdFlags),
+			TokensCollection: tokensCollection,
+			UsersCollection:  usersCollection,
+		}
+
+		if err := p.FromRequest(r, db); err != nil {
+			t.Fatalf("Failed to create CreateArticleParams from request: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		HandleCreateArticle(ctx, w, p)
+
+		return w
+	}
+
+	cases := []struct {
+		body   createArticleBody
+		fields []string
+	}{
+		{createArticleBody{ItemTitle: "  ", Content: "a black bird"}, []string{"itemTitle"}},
+		{createArticleBody{ItemTitle: strings.Repeat("a", maxTitleLength+1), Content: "a black bird"}, []string{"itemTitle"}},
+		{createArticleBody{ItemTitle: "the maltese falcon", Content: strings.Repeat("a", maxContentLength+1)}, []string{"content"}},
+		{createArticleBody{ItemTitle: "", Content: strings.Repeat("é", maxContentLength+1)}, []string{"content", "itemTitle"}},
+	}
+
+	for _, c := range cases {
+		w := create(c.body)
+
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for invalid article, got %d: %s", w.Code, w.Body.String())
+			continue
+		}
+
+		body := struct {
+			Errors map[string]string `json:"errors"`
+		}{}
+
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Could not unmarshal validation errors %s: %v", w.Body.String(), err)
+		}
+
+		fields := []string{}
+		for field := range body.Errors {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		if fmt.Sprint(fields) != fmt.Sprint(c.fields) {
+			t.Errorf("Expected errors for %v, got: %v", c.fields, body.Errors)
+		}
+	}
+
+	// markup doesn't count towards the limit once it is sanitized away
+	content := "<p>" + strings.Repeat("a", maxContentLength-7) + "</p>" + strings.Repeat("<span></span>", 1000) + "<script>alert(1)</script>"
+	w := create(createArticleBody{ItemTitle: "the maltese falcon", Content: content})
+
+	created := struct {
+		CreatedID string `json:"createdID"`
+	}{}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &created); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("Expected the article to be created, got %d: %s", w.Code, w.Body.String())
+	}
+
+	art := article{}
+	id, _ := primitive.ObjectIDFromHex(created.CreatedID)
+	err = db.Collection(database.MacguffinsCollection).FindOne(ctx, bson.M{"_id": id}, nil).Decode(&art)
+
+	if err != nil {
+		t.Fatalf("Could not read the created article: %v", err)
+	}
+
+	if art.Content != "<p>"+strings.Repeat("a", maxContentLength-7)+"</p>" {
+		t.Errorf("Expected the stored content to be sanitized, got %d characters", len(art.Content))
+	}
+}
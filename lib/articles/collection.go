@@ -11,38 +11,55 @@ import (
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type article struct {
-	ItemTitle   string    `json:"itemTitle" bson:"itemTitle"`
-	Thumbnail   string    `json:"string,omitempty" bson:"string,omitempty"`
-	ID          string    `json:"_id" bson:"_id"`
-	Content     string    `json:"content" bson:"content"`
-	CreatedAt   time.Time `json:"createdAt" bson:"createdAt"`
-	Approved    bool      `json:"approved" bson:"approved"`
-	Creator     string    `json:"creator" bson:"creator"`
-	ArticleType string    `json:"articleType" bson:"articleType"`
+	ItemTitle       string     `json:"itemTitle" bson:"itemTitle"`
+	Thumbnail       string     `json:"thumbnail,omitempty" bson:"thumbnail,omitempty"`
+	ID              string     `json:"_id" bson:"_id"`
+	Content         string     `json:"content" bson:"content"`
+	CreatedAt       time.Time  `json:"createdAt" bson:"createdAt"`
+	UpdatedAt       *time.Time `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+	Approved        bool       `json:"approved" bson:"approved"`
+	Rejected        bool       `json:"rejected" bson:"rejected"`
+	RejectionReason string     `json:"rejectionReason,omitempty" bson:"rejectionReason,omitempty"`
+	ModeratedBy     string     `json:"moderatedBy,omitempty" bson:"moderatedBy,omitempty"`
+	ModeratedAt     *time.Time `json:"moderatedAt,omitempty" bson:"moderatedAt,omitempty"`
+	Creator         string     `json:"creator" bson:"creator"`
+	ArticleType     string     `json:"articleType" bson:"articleType"`
+	// Revision the number of the current revision, 0 for articles written before revisions were kept
+	Revision int `json:"revision" bson:"revision"`
 }
 
 type getArticlesJSONOptions struct {
-	userID      string
+	viewer      token.UserData
 	articleType string
 	creator     string
+	// limit how many articles the page holds, DefaultPageSize when 0
+	limit int
+	// direction 1 for oldest first and -1 for newest first
+	direction int
+	// after the cursor of the previous page, nil for the first page
+	after *pageCursor
 }
 
-var admins = map[string]bool{
-	"8582764": true,
-}
-
-func (opts getArticlesJSONOptions) toQuery(userID string) (bson.M, error) {
+func (opts getArticlesJSONOptions) toQuery(viewer token.UserData) (bson.M, error) {
 	var err error
 	q := make(map[string]interface{})
 
-	if admins[userID] == false {
+	// agents can always see their own articles, so they can follow
+	// them through moderation and revise anything that was rejected
+	if viewer.UserID == "" {
 		q["approved"] = bson.M{
 			"$eq": true,
 		}
+	} else if viewer.Can(token.PermModerate) == false {
+		q["$or"] = bson.A{
+			bson.M{"approved": bson.M{"$eq": true}},
+			bson.M{"creator": bson.M{"$eq": viewer.UserID}},
+		}
 	}
 
 	q["articleType"] = bson.M{
@@ -55,6 +72,13 @@ func (opts getArticlesJSONOptions) toQuery(userID string) (bson.M, error) {
 		}
 	}
 
+	// $or is already taken by the visibility condition
+	if opts.after != nil {
+		q["$and"] = bson.A{
+			opts.after.filter(),
+		}
+	}
+
 	if opts.articleType == "" {
 		err = fmt.Errorf("getArticlesOptions missing required parameter 'articleType'")
 	}
@@ -65,6 +89,7 @@ func (opts getArticlesJSONOptions) toQuery(userID string) (bson.M, error) {
 func getArticlesJSON(
 	ctx context.Context,
 	articles database.Collection,
+	users database.Collection,
 	opts getArticlesJSONOptions,
 ) ([]byte, error) {
 	var (
@@ -75,19 +100,34 @@ func getArticlesJSON(
 	dlCtx, cancel := context.WithDeadline(ctx, time.Now().Add(5*time.Second))
 	defer cancel()
 
-	findQuery, err := opts.toQuery(opts.userID)
+	findQuery, err := opts.toQuery(opts.viewer)
 
 	if err != nil {
 		return js, errors.Wrapf(err, "Could not generate query from getArticlesJSONOptions")
 	}
 
+	limit := opts.limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+
+	direction := opts.direction
+	if direction == 0 {
+		direction = 1
+	}
+
+	// one more than the page holds, to know whether there is a next page
+	findLimit := int64(limit + 1)
+
 	res, err := articles.Find(
 		dlCtx,
 		findQuery,
 		&options.FindOptions{
-			Sort: bson.M{
-				"createdAt": 1,
+			Sort: bson.D{
+				{Key: "createdAt", Value: direction},
+				{Key: "_id", Value: direction},
 			},
+			Limit: &findLimit,
 		},
 	)
 
@@ -95,26 +135,201 @@ func getArticlesJSON(
 		return js, errors.Wrap(err, "Failed in execution of getArticles query")
 	}
 
-	artList := []article{}
-	err = res.All(dlCtx, &artList)
+	page := articlePage{Articles: []article{}}
+	err = res.All(dlCtx, &page.Articles)
 
 	if err != nil {
 		return js, errors.Wrapf(err, "Failed reading/decoding results of getArticles query")
 	}
 
-	return json.Marshal(artList)
+	if len(page.Articles) > limit {
+		page.Articles = page.Articles[:limit]
+
+		next, err := newPageCursor(page.Articles[limit-1], direction).encode()
+
+		if err != nil {
+			return js, err
+		}
+
+		page.NextCursor = &next
+	}
+
+	err = withPublicCreators(dlCtx, users, page.Articles, opts.viewer)
+
+	if err != nil {
+		return js, err
+	}
+
+	return json.Marshal(page)
+}
+
+// findVisibleArticle one article the viewer can see. Articles the viewer can't see are reported
+// as ErrArticleNotFound, the same as articles that don't exist
+func findVisibleArticle(
+	ctx context.Context,
+	articles database.Collection,
+	articleType string,
+	articleID string,
+	viewer token.UserData,
+) (article, error) {
+	art := article{}
+	id, err := primitive.ObjectIDFromHex(articleID)
+
+	if err != nil {
+		return art, ErrArticleNotFound
+	}
+
+	findQuery, err := getArticlesJSONOptions{articleType: articleType}.toQuery(viewer)
+
+	if err != nil {
+		return art, errors.Wrapf(err, "Could not generate query from getArticlesJSONOptions")
+	}
+
+	findQuery["_id"] = bson.M{
+		"$eq": id,
+	}
+
+	res := articles.FindOne(ctx, findQuery, &options.FindOneOptions{})
+
+	if res.Err() == mongo.ErrNoDocuments {
+		return art, ErrArticleNotFound
+	}
+
+	err = res.Decode(&art)
+
+	return art, errors.Wrapf(err, "Failed to decode article: %s", articleID)
+}
+
+func getArticleJSON(
+	ctx context.Context,
+	articles database.Collection,
+	users database.Collection,
+	articleType string,
+	articleID string,
+	viewer token.UserData,
+) ([]byte, error) {
+	dlCtx, cancel := context.WithDeadline(ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+
+	art, err := findVisibleArticle(dlCtx, articles, articleType, articleID, viewer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	arts := []article{art}
+	err = withPublicCreators(dlCtx, users, arts, viewer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(arts[0])
+}
+
+// withPublicCreators replaces the creator of each article with the agent's publicAgentID, so that
+// no response gives away the userID an agent logs in with. Who moderated an article is only kept
+// for moderators
+func withPublicCreators(
+	ctx context.Context,
+	users database.Collection,
+	arts []article,
+	viewer token.UserData,
+) error {
+	seen := map[string]bool{}
+	userIDs := []string{}
+
+	for _, art := range arts {
+		if seen[art.Creator] == false {
+			seen[art.Creator] = true
+			userIDs = append(userIDs, art.Creator)
+		}
+	}
+
+	ids, err := token.PublicAgentIDs(ctx, users, userIDs)
+
+	if err != nil {
+		return err
+	}
+
+	for i := range arts {
+		// an agent without a publicAgentID yet is left anonymous rather than exposed
+		arts[i].Creator = ids[arts[i].Creator]
+
+		if viewer.Can(token.PermModerate) == false {
+			arts[i].ModeratedBy = ""
+		}
+	}
+
+	return nil
+}
+
+// GetPublicArticlesJSON lists every approved article an agent has written across all article
+// collections. The creator of each article is replaced with the agent's publicAgentID
+func GetPublicArticlesJSON(
+	ctx context.Context,
+	articleCollections []database.Collection,
+	agent token.UserData,
+) ([]byte, error) {
+	dlCtx, cancel := context.WithDeadline(ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+
+	public := []article{}
+
+	for _, articles := range articleCollections {
+		res, err := articles.Find(
+			dlCtx,
+			bson.M{
+				"approved": bson.M{
+					"$eq": true,
+				},
+				"creator": bson.M{
+					"$eq": agent.UserID,
+				},
+			},
+			&options.FindOptions{
+				Sort: bson.M{
+					"createdAt": 1,
+				},
+			},
+		)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed in execution of public articles query")
+		}
+
+		artList := []article{}
+		err = res.All(dlCtx, &artList)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed reading/decoding results of public articles query")
+		}
+
+		public = append(public, artList...)
+	}
+
+	for i := range public {
+		public[i].Creator = agent.PublicAgentID
+		public[i].ModeratedBy = ""
+	}
+
+	return json.Marshal(public)
 }
 
 type createArticleParams struct {
-	tokens   database.Collection
-	articles database.Collection
-	users    database.Collection
+	tokens     database.Collection
+	articles   database.Collection
+	users      database.Collection
+	revisions  database.Collection
+	transactor database.Transactor
 }
 
+// createArticle inserts a new article along with its first revision
 func createArticle(
 	ctx context.Context,
 	clientToken string,
 	art article,
+	summary string,
 	params createArticleParams,
 ) (string, error) {
 	var err error
@@ -133,29 +348,159 @@ func createArticle(
 		return createdID, errors.Wrap(err, "Failed to get logged in user")
 	}
 
-	createdID, err = params.articles.InsertOne(
+	now := time.Now()
+
+	err = params.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		createdID, err = params.articles.InsertOne(
+			ctx,
+			bson.M{
+				"creator":     user.UserID,
+				"content":     art.Content,
+				"approved":    false,
+				"rejected":    false,
+				"createdAt":   primitive.NewDateTimeFromTime(now),
+				"itemTitle":   art.ItemTitle,
+				"thumbnail":   art.Thumbnail,
+				"articleType": art.ArticleType,
+				"revision":    1,
+			},
+			&options.InsertOneOptions{},
+		)
+
+		if err != nil {
+			return errors.Wrapf(err, "Failed to insert document into db for user: %s\n%s", user.UserID, art.ItemTitle)
+		}
+
+		art.ID = createdID
+
+		return recordRevision(ctx, params.revisions, art, 1, user.UserID, now, summary, 0)
+	})
+
+	return createdID, err
+}
+
+type errArticleNotFound struct{}
+
+// Error _
+func (errArticleNotFound) Error() string {
+	return "Article not found"
+}
+
+// ErrArticleNotFound indicates there is no article with the requested ID
+var ErrArticleNotFound errArticleNotFound
+
+type errNotArticleOwner struct{}
+
+// Error _
+func (errNotArticleOwner) Error() string {
+	return "Only the creator of an article may edit it"
+}
+
+// ErrNotArticleOwner indicates the logged in user may not edit the article
+var ErrNotArticleOwner errNotArticleOwner
+
+type updateArticleParams struct {
+	tokens     database.Collection
+	articles   database.Collection
+	users      database.Collection
+	revisions  database.Collection
+	transactor database.Transactor
+}
+
+// updateArticle edits an article, recording the edit as its next revision
+func updateArticle(
+	ctx context.Context,
+	clientToken string,
+	art article,
+	summary string,
+	params updateArticleParams,
+) error {
+	var err error
+
+	user, err := token.GetLoggedInUser(
 		ctx,
-		bson.M{
-			"creator":     user.UserID,
-			"content":     art.Content,
-			"approved":    false,
-			"createdAt":   primitive.NewDateTimeFromTime(time.Now()),
-			"itemTitle":   art.ItemTitle,
-			"thumbnail":   art.Thumbnail,
-			"articleType": art.ArticleType,
+		clientToken,
+		token.GetLoggedInUserParams{
+			Tokens: params.tokens,
+			Users:  params.users,
 		},
-		&options.InsertOneOptions{},
 	)
 
 	if err != nil {
-		return createdID, errors.Wrapf(err, "Failed to insert document into db for user: %s\n%s", user.UserID, art.ItemTitle)
+		return errors.Wrap(err, "Failed to get logged in user")
 	}
 
-	return createdID, err
-}
+	id, err := primitive.ObjectIDFromHex(art.ID)
 
-func updateArticle(ctx context.Context) {
+	if err != nil {
+		return ErrArticleNotFound
+	}
+
+	f := bson.M{
+		"_id": bson.M{
+			"$eq": id,
+		},
+	}
+
+	return params.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		res := params.articles.FindOne(ctx, f, &options.FindOneOptions{})
+
+		if res.Err() == mongo.ErrNoDocuments {
+			return ErrArticleNotFound
+		}
+
+		existing := article{}
+		err := res.Decode(&existing)
+
+		if err != nil {
+			return errors.Wrapf(err, "Failed to decode article for update: %s", art.ID)
+		}
+
+		if existing.Creator != user.UserID && user.Can(token.PermModerate) == false {
+			return ErrNotArticleOwner
+		}
 
+		number, err := nextRevision(ctx, params.revisions, existing)
+
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+
+		// edits go back through moderation before they are visible again
+		updateRes, err := params.articles.UpdateOne(
+			ctx,
+			f,
+			bson.M{
+				"$set": bson.M{
+					"content":   art.Content,
+					"approved":  false,
+					"rejected":  false,
+					"updatedAt": primitive.NewDateTimeFromTime(now),
+					"itemTitle": art.ItemTitle,
+					"thumbnail": art.Thumbnail,
+					"revision":  number,
+				},
+				"$unset": bson.M{
+					"rejectionReason": "",
+				},
+			},
+			&options.UpdateOptions{},
+		)
+
+		if err != nil {
+			return errors.Wrapf(err, "Failed to update document in db for user: %s\n%s", user.UserID, art.ID)
+		}
+
+		if updateRes.MatchedCount() == 0 {
+			return ErrArticleNotFound
+		}
+
+		art.ArticleType = existing.ArticleType
+
+		return recordRevision(ctx, params.revisions, art, number, user.UserID, now, summary, 0)
+	})
 }
 
 func getArticleCollection(
@@ -183,3 +528,20 @@ func getArticleCollection(
 
 	return c, nil
 }
+
+// GetArticleCollections every article collection, in the order of database.ArticleCollections
+func GetArticleCollections(db database.Database) ([]database.Collection, error) {
+	var collections []database.Collection
+
+	for _, artType := range database.ArticleCollections {
+		articles, err := getArticleCollection(artType, db)
+
+		if err != nil {
+			return collections, err
+		}
+
+		collections = append(collections, articles)
+	}
+
+	return collections, nil
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 
 	"github.com/abradley2/macguffin/lib/database"
+	"github.com/abradley2/macguffin/lib/request"
 	"github.com/abradley2/macguffin/lib/token"
 	"github.com/pkg/errors"
 )
@@ -32,8 +33,20 @@ type GetArticleListParams struct {
 	clientToken string
 
 	// creator: query.creator - optional
-	// filter which articles are sent back by creator's userID
+	// filter which articles are sent back by creator's publicAgentID
 	creator string
+
+	// limit: query.limit - optional
+	// how many articles to send back, DefaultPageSize unless given and never more than MaxPageSize
+	limit int
+
+	// sort: query.sort - optional
+	// asc for oldest first, the default, or desc for newest first
+	direction int
+
+	// after: query.after - optional
+	// the nextCursor of the previous page, which must have been fetched with the same sort
+	after *pageCursor
 }
 
 // FromRequest create GetArticleListParams from an http.Request
@@ -49,6 +62,32 @@ func (params *GetArticleListParams) FromRequest(r *http.Request, db database.Dat
 		return err
 	}
 
+	params.limit, err = parsePageSize(q.Get("limit"))
+
+	if err != nil {
+		return err
+	}
+
+	params.direction, err = parseSortDirection(q.Get("sort"))
+
+	if err != nil {
+		return err
+	}
+
+	if after := q.Get("after"); after != "" {
+		cursor, err := decodePageCursor(after)
+
+		if err != nil {
+			return err
+		}
+
+		if cursor.Direction != params.direction {
+			return fmt.Errorf("Parameter query.after was issued for the other sort direction")
+		}
+
+		params.after = &cursor
+	}
+
 	articles, err := getArticleCollection(params.artType, db)
 
 	params.ArticleCollection = articles
@@ -56,11 +95,12 @@ func (params *GetArticleListParams) FromRequest(r *http.Request, db database.Dat
 	return err
 }
 
-// HandleGetArticleList return the articles we want to display opn an agent's initial dashboard
+// HandleGetArticleList return the articles we want to display opn an agent's initial dashboard,
+// one page at a time as { "articles": [...], "nextCursor": string or null }
 func HandleGetArticleList(ctx context.Context, w http.ResponseWriter, params GetArticleListParams) {
 	logger := params.Logger
 
-	var userID string
+	var viewer token.UserData
 	if params.clientToken != "" {
 		userData, err := token.GetLoggedInUser(
 			ctx,
@@ -78,16 +118,41 @@ func HandleGetArticleList(ctx context.Context, w http.ResponseWriter, params Get
 			return
 		}
 
-		userID = userData.UserID
+		viewer = userData
+	}
+
+	// creators are only named by publicAgentID, filtering by a userID would tell which agent it is
+	creator := params.creator
+	if creator != "" {
+		agent, err := token.FindAgentByPublicID(ctx, params.UsersCollection, creator)
+
+		switch errors.Cause(err) {
+		case nil:
+			creator = agent.UserID
+		case token.ErrUnknownAgent:
+			js, _ := json.Marshal(articlePage{Articles: []article{}})
+			w.WriteHeader(http.StatusOK)
+			w.Write(js)
+			return
+		default:
+			logger.Printf("Failed resolving creator filter %s: %v", creator, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error"))
+			return
+		}
 	}
 
 	js, err := getArticlesJSON(
 		ctx,
 		params.ArticleCollection,
+		params.UsersCollection,
 		getArticlesJSONOptions{
 			articleType: params.artType,
-			creator:     params.creator,
-			userID:      userID,
+			creator:     creator,
+			viewer:      viewer,
+			limit:       params.limit,
+			direction:   params.direction,
+			after:       params.after,
 		})
 
 	if err != nil {
@@ -101,19 +166,118 @@ func HandleGetArticleList(ctx context.Context, w http.ResponseWriter, params Get
 	w.Write(js)
 }
 
+// getViewer the agent a request was made by, or nobody when it has no Authorization token
+func getViewer(
+	ctx context.Context,
+	clientToken string,
+	tokens database.Collection,
+	users database.Collection,
+) (token.UserData, error) {
+	if clientToken == "" {
+		return token.UserData{}, nil
+	}
+
+	return token.GetLoggedInUser(
+		ctx,
+		clientToken,
+		token.GetLoggedInUserParams{
+			Tokens: tokens,
+			Users:  users,
+		},
+	)
+}
+
+// GetArticleParams _
+type GetArticleParams struct {
+	Logger            *log.Logger
+	TokensCollection  database.Collection
+	ArticleCollection database.Collection
+	UsersCollection   database.Collection
+
+	// artType: path /articles/{type}/{id} - required
+	// can be macguffins, sites, or events
+	artType string
+
+	// articleID: path /articles/{type}/{id} - required
+	articleID string
+
+	// clientToken: headers.Authorization - optional
+	// needed for creators and moderators to see articles that aren't approved
+	clientToken string
+}
+
+// FromRequest create GetArticleParams from an http.Request
+func (params *GetArticleParams) FromRequest(r *http.Request, db database.Database) error {
+	var err error
+	params.clientToken = r.Header.Get("Authorization")
+	params.artType, params.articleID, err = parseArticlePath(r.URL.Path, "")
+
+	if err != nil {
+		return err
+	}
+
+	params.ArticleCollection, err = getArticleCollection(params.artType, db)
+
+	return err
+}
+
+// HandleGetArticle return one article. Articles the requestor may not see are not found, so
+// nobody learns that an unapproved article exists
+func HandleGetArticle(ctx context.Context, w http.ResponseWriter, params GetArticleParams) {
+	logger := params.Logger
+
+	viewer, err := getViewer(ctx, params.clientToken, params.TokensCollection, params.UsersCollection)
+
+	if err != nil {
+		logger.Printf("Error retrieving token: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Invalid Authorization token"))
+		return
+	}
+
+	js, err := getArticleJSON(
+		ctx,
+		params.ArticleCollection,
+		params.UsersCollection,
+		params.artType,
+		params.articleID,
+		viewer,
+	)
+
+	if errors.Cause(err) == ErrArticleNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Article not found"))
+		return
+	}
+
+	if err != nil {
+		logger.Printf("Failed reading article from db via getArticleJSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
+
 type createArticleBody struct {
 	ItemTitle   string `json:"itemTitle"`
-	Thumbnail   string `json:"string,omitempty"`
+	Thumbnail   string `json:"thumbnail,omitempty"`
 	Content     string `json:"content"`
 	ArticleType string `json:"articleType"`
+	// Summary describes the change in the first revision of the article
+	Summary string `json:"summary,omitempty"`
 }
 
 // CreateArticleParams _
 type CreateArticleParams struct {
-	Logger            *log.Logger
-	TokensCollection  database.Collection
-	ArticleCollection database.Collection
-	UsersCollection   database.Collection
+	Logger              *log.Logger
+	Transactor          database.Transactor
+	TokensCollection    database.Collection
+	ArticleCollection   database.Collection
+	UsersCollection     database.Collection
+	RevisionsCollection database.Collection
 
 	// clientToken: headers.Authorization - optional
 	// token of the user who is creating the article
@@ -132,7 +296,7 @@ func (params *CreateArticleParams) FromRequest(r *http.Request, db database.Data
 		return fmt.Errorf("Missing required parameter: headers.Authorization")
 	}
 
-	bodyContent, err := ioutil.ReadAll(io.LimitReader(r.Body, 50000))
+	bodyContent, err := ioutil.ReadAll(io.LimitReader(r.Body, maxArticleBody))
 
 	if err != nil {
 		return errors.Wrap(err, "Could not read request body")
@@ -144,6 +308,14 @@ func (params *CreateArticleParams) FromRequest(r *http.Request, db database.Data
 		return err
 	}
 
+	if params.Transactor == nil {
+		params.Transactor = db
+	}
+
+	if params.RevisionsCollection == nil {
+		params.RevisionsCollection = db.Collection(database.RevisionsCollection)
+	}
+
 	if params.ArticleCollection == nil {
 		articles, err := getArticleCollection(params.body.ArticleType, db)
 
@@ -161,10 +333,24 @@ func HandleCreateArticle(ctx context.Context, w http.ResponseWriter, params Crea
 
 	body := params.body
 
+	content, errs, err := validateArticle(body.ItemTitle, body.Content)
+
+	if err != nil {
+		logger.Printf("Error sanitizing article content: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	if errs != nil {
+		request.WriteValidationErrors(w, errs)
+		return
+	}
+
 	reqBodyArticle := article{
 		ItemTitle:   body.ItemTitle,
 		ArticleType: body.ArticleType,
-		Content:     body.Content,
+		Content:     content,
 		Thumbnail:   body.Thumbnail,
 	}
 
@@ -172,10 +358,13 @@ func HandleCreateArticle(ctx context.Context, w http.ResponseWriter, params Crea
 		ctx,
 		params.clientToken,
 		reqBodyArticle,
+		body.Summary,
 		createArticleParams{
-			tokens:   params.TokensCollection,
-			articles: params.ArticleCollection,
-			users:    params.UsersCollection,
+			tokens:     params.TokensCollection,
+			articles:   params.ArticleCollection,
+			users:      params.UsersCollection,
+			revisions:  params.RevisionsCollection,
+			transactor: params.Transactor,
 		},
 	)
 
@@ -191,3 +380,143 @@ func HandleCreateArticle(ctx context.Context, w http.ResponseWriter, params Crea
 		fmt.Sprintf(`{ "createdID": "%s" }`, createdID),
 	))
 }
+
+type updateArticleBody struct {
+	ID          string `json:"_id"`
+	ItemTitle   string `json:"itemTitle"`
+	Thumbnail   string `json:"thumbnail,omitempty"`
+	Content     string `json:"content"`
+	ArticleType string `json:"articleType"`
+	// Summary describes the change in the revision the edit is recorded as
+	Summary string `json:"summary,omitempty"`
+}
+
+// UpdateArticleParams _
+type UpdateArticleParams struct {
+	Logger              *log.Logger
+	Transactor          database.Transactor
+	TokensCollection    database.Collection
+	ArticleCollection   database.Collection
+	UsersCollection     database.Collection
+	RevisionsCollection database.Collection
+
+	// clientToken: headers.Authorization - required
+	// token of the user who is editing the article
+	clientToken string
+
+	// body - required
+	// the new content of the article, identified by its _id and articleType
+	body updateArticleBody
+}
+
+// FromRequest get UpdateArticleParams from an http.Request
+func (params *UpdateArticleParams) FromRequest(r *http.Request, db database.Database) error {
+	params.clientToken = r.Header.Get("Authorization")
+
+	if params.clientToken == "" {
+		return fmt.Errorf("Missing required parameter: headers.Authorization")
+	}
+
+	bodyContent, err := ioutil.ReadAll(io.LimitReader(r.Body, maxArticleBody))
+
+	if err != nil {
+		return errors.Wrap(err, "Could not read request body")
+	}
+
+	err = json.Unmarshal(bodyContent, &params.body)
+
+	if err != nil {
+		return err
+	}
+
+	if params.body.ID == "" {
+		return fmt.Errorf("Body missing required parameter: '_id'")
+	}
+
+	if params.Transactor == nil {
+		params.Transactor = db
+	}
+
+	if params.RevisionsCollection == nil {
+		params.RevisionsCollection = db.Collection(database.RevisionsCollection)
+	}
+
+	if params.ArticleCollection == nil {
+		articles, err := getArticleCollection(params.body.ArticleType, db)
+
+		params.ArticleCollection = articles
+
+		return err
+	}
+
+	return err
+}
+
+// HandleUpdateArticle edits the title, content and thumbnail of an existing article
+func HandleUpdateArticle(ctx context.Context, w http.ResponseWriter, params UpdateArticleParams) {
+	logger := params.Logger
+
+	body := params.body
+
+	content, errs, err := validateArticle(body.ItemTitle, body.Content)
+
+	if err != nil {
+		logger.Printf("Error sanitizing article content: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	if errs != nil {
+		request.WriteValidationErrors(w, errs)
+		return
+	}
+
+	reqBodyArticle := article{
+		ID:          body.ID,
+		ItemTitle:   body.ItemTitle,
+		ArticleType: body.ArticleType,
+		Content:     content,
+		Thumbnail:   body.Thumbnail,
+	}
+
+	err = updateArticle(
+		ctx,
+		params.clientToken,
+		reqBodyArticle,
+		body.Summary,
+		updateArticleParams{
+			tokens:     params.TokensCollection,
+			articles:   params.ArticleCollection,
+			users:      params.UsersCollection,
+			revisions:  params.RevisionsCollection,
+			transactor: params.Transactor,
+		},
+	)
+
+	switch errors.Cause(err) {
+	case nil:
+	case token.ErrTokenExpired:
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Invalid Authorization token"))
+		return
+	case ErrArticleNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Article not found"))
+		return
+	case ErrNotArticleOwner:
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Forbidden"))
+		return
+	default:
+		logger.Printf("Error calling updateArticle: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(
+		fmt.Sprintf(`{ "updatedID": "%s" }`, body.ID),
+	))
+}
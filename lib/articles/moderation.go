@@ -0,0 +1,389 @@
+package articles
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/abradley2/macguffin/lib/database"
+	"github.com/abradley2/macguffin/lib/token"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func getPendingArticlesJSON(
+	ctx context.Context,
+	articleCollections []database.Collection,
+	users database.Collection,
+	viewer token.UserData,
+) ([]byte, error) {
+	var err error
+
+	dlCtx, cancel := context.WithDeadline(ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+
+	pending := []article{}
+
+	for _, articles := range articleCollections {
+		res, err := articles.Find(
+			dlCtx,
+			bson.M{
+				"approved": bson.M{
+					"$eq": false,
+				},
+				"rejected": bson.M{
+					"$ne": true,
+				},
+			},
+			&options.FindOptions{
+				Sort: bson.M{
+					"createdAt": 1,
+				},
+			},
+		)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed in execution of pending articles query")
+		}
+
+		artList := []article{}
+		err = res.All(dlCtx, &artList)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed reading/decoding results of pending articles query")
+		}
+
+		pending = append(pending, artList...)
+	}
+
+	// oldest submissions first, regardless of which collection they live in
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].CreatedAt.Before(pending[j].CreatedAt)
+	})
+
+	err = withPublicCreators(dlCtx, users, pending, viewer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(pending)
+}
+
+type errRevisionChanged struct{}
+
+// Error _
+func (errRevisionChanged) Error() string {
+	return "Article was edited after the revision being moderated"
+}
+
+// ErrRevisionChanged indicates the article was edited after the moderator reviewed it
+var ErrRevisionChanged errRevisionChanged
+
+type moderationDecision struct {
+	approve  bool
+	reason   string
+	revision int
+}
+
+type moderateArticleParams struct {
+	tokens   database.Collection
+	articles database.Collection
+	users    database.Collection
+}
+
+func moderateArticle(
+	ctx context.Context,
+	clientToken string,
+	articleID string,
+	decision moderationDecision,
+	params moderateArticleParams,
+) error {
+	user, err := token.GetAuthorizedUser(
+		ctx,
+		clientToken,
+		token.GetLoggedInUserParams{
+			Tokens: params.tokens,
+			Users:  params.users,
+		},
+		token.PermModerate,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	id, err := primitive.ObjectIDFromHex(articleID)
+
+	if err != nil {
+		return ErrArticleNotFound
+	}
+
+	set := bson.M{
+		"approved":    decision.approve,
+		"rejected":    decision.approve == false,
+		"moderatedBy": user.UserID,
+		"moderatedAt": primitive.NewDateTimeFromTime(time.Now()),
+	}
+
+	update := bson.M{
+		"$set": set,
+	}
+
+	if decision.approve {
+		update["$unset"] = bson.M{
+			"rejectionReason": "",
+		}
+	} else {
+		set["rejectionReason"] = decision.reason
+	}
+
+	// only the revision the moderator reviewed is moderated. Articles written before revisions
+	// were kept have no revision, which is revision 0
+	revision := bson.M{"$eq": decision.revision}
+	if decision.revision == 0 {
+		revision = bson.M{"$in": bson.A{0, nil}}
+	}
+
+	res, err := params.articles.UpdateOne(
+		ctx,
+		bson.M{
+			"_id": bson.M{
+				"$eq": id,
+			},
+			"revision": revision,
+		},
+		update,
+		&options.UpdateOptions{},
+	)
+
+	if err != nil {
+		return errors.Wrapf(err, "Failed to record moderation decision for article: %s", articleID)
+	}
+
+	if res.MatchedCount() == 1 {
+		return nil
+	}
+
+	n, err := params.articles.CountDocuments(
+		ctx,
+		bson.M{
+			"_id": bson.M{
+				"$eq": id,
+			},
+		},
+		&options.CountOptions{},
+	)
+
+	if err != nil {
+		return errors.Wrapf(err, "Failed to find moderated article: %s", articleID)
+	}
+
+	if n == 0 {
+		return ErrArticleNotFound
+	}
+
+	return ErrRevisionChanged
+}
+
+// GetModerationQueueParams _
+type GetModerationQueueParams struct {
+	Logger             *log.Logger
+	TokensCollection   database.Collection
+	UsersCollection    database.Collection
+	ArticleCollections []database.Collection
+
+	// clientToken: headers.Authorization - required
+	// token of the moderator requesting the queue
+	clientToken string
+}
+
+// FromRequest get GetModerationQueueParams from an http.Request
+func (params *GetModerationQueueParams) FromRequest(r *http.Request, db database.Database) error {
+	params.clientToken = r.Header.Get("Authorization")
+
+	if params.clientToken == "" {
+		return fmt.Errorf("Missing required parameter: headers.Authorization")
+	}
+
+	if params.ArticleCollections == nil {
+		articles, err := GetArticleCollections(db)
+
+		params.ArticleCollections = articles
+
+		return err
+	}
+
+	return nil
+}
+
+// HandleGetModerationQueue lists every article across all collections that is waiting on moderation
+func HandleGetModerationQueue(ctx context.Context, w http.ResponseWriter, params GetModerationQueueParams) {
+	logger := params.Logger
+
+	moderator, err := token.GetAuthorizedUser(
+		ctx,
+		params.clientToken,
+		token.GetLoggedInUserParams{
+			Tokens: params.TokensCollection,
+			Users:  params.UsersCollection,
+		},
+		token.PermModerate,
+	)
+
+	if err != nil {
+		writeModerationError(logger, w, err)
+		return
+	}
+
+	js, err := getPendingArticlesJSON(ctx, params.ArticleCollections, params.UsersCollection, moderator)
+
+	if err != nil {
+		logger.Printf("Failed reading pending articles from db via getPendingArticlesJSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
+
+type moderateArticleBody struct {
+	ID          string `json:"_id"`
+	ArticleType string `json:"articleType"`
+	Revision    *int   `json:"revision"`
+	Reason      string `json:"reason"`
+}
+
+// ModerateArticleParams _
+type ModerateArticleParams struct {
+	Logger            *log.Logger
+	TokensCollection  database.Collection
+	ArticleCollection database.Collection
+	UsersCollection   database.Collection
+
+	// clientToken: headers.Authorization - required
+	// token of the moderator approving or rejecting the article
+	clientToken string
+
+	// body - required
+	// the article being moderated and the revision of it the moderator reviewed, and the reason
+	// when rejecting it
+	body moderateArticleBody
+}
+
+// FromRequest get ModerateArticleParams from an http.Request
+func (params *ModerateArticleParams) FromRequest(r *http.Request, db database.Database) error {
+	params.clientToken = r.Header.Get("Authorization")
+
+	if params.clientToken == "" {
+		return fmt.Errorf("Missing required parameter: headers.Authorization")
+	}
+
+	bodyContent, err := ioutil.ReadAll(io.LimitReader(r.Body, 50000))
+
+	if err != nil {
+		return errors.Wrap(err, "Could not read request body")
+	}
+
+	err = json.Unmarshal(bodyContent, &params.body)
+
+	if err != nil {
+		return err
+	}
+
+	if params.body.ID == "" {
+		return fmt.Errorf("Body missing required parameter: '_id'")
+	}
+
+	if params.body.Revision == nil {
+		return fmt.Errorf("Body missing required parameter: 'revision'")
+	}
+
+	if params.ArticleCollection == nil {
+		articles, err := getArticleCollection(params.body.ArticleType, db)
+
+		params.ArticleCollection = articles
+
+		return err
+	}
+
+	return err
+}
+
+// HandleApproveArticle marks an article as approved so every agent can see it
+func HandleApproveArticle(ctx context.Context, w http.ResponseWriter, params ModerateArticleParams) {
+	handleModerateArticle(ctx, w, params, moderationDecision{approve: true, revision: *params.body.Revision})
+}
+
+// HandleRejectArticle marks an article as rejected, leaving it visible only to its creator
+func HandleRejectArticle(ctx context.Context, w http.ResponseWriter, params ModerateArticleParams) {
+	if params.body.Reason == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Body missing required parameter: 'reason'"))
+		return
+	}
+
+	handleModerateArticle(ctx, w, params, moderationDecision{reason: params.body.Reason, revision: *params.body.Revision})
+}
+
+func handleModerateArticle(
+	ctx context.Context,
+	w http.ResponseWriter,
+	params ModerateArticleParams,
+	decision moderationDecision,
+) {
+	logger := params.Logger
+
+	err := moderateArticle(
+		ctx,
+		params.clientToken,
+		params.body.ID,
+		decision,
+		moderateArticleParams{
+			tokens:   params.TokensCollection,
+			articles: params.ArticleCollection,
+			users:    params.UsersCollection,
+		},
+	)
+
+	if err != nil {
+		writeModerationError(logger, w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(
+		fmt.Sprintf(`{ "moderatedID": "%s" }`, params.body.ID),
+	))
+}
+
+func writeModerationError(logger *log.Logger, w http.ResponseWriter, err error) {
+	switch errors.Cause(err) {
+	case token.ErrTokenExpired:
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Invalid Authorization token"))
+	case token.ErrForbidden:
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Forbidden"))
+	case ErrArticleNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Article not found"))
+	case ErrRevisionChanged:
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+	default:
+		logger.Printf("Error moderating articles: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+	}
+}
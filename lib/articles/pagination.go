@@ -0,0 +1,128 @@
+package articles
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DefaultPageSize how many articles a page holds when no limit is given
+const DefaultPageSize = 20
+
+// MaxPageSize the most articles a page holds, larger limits are lowered to it
+const MaxPageSize = 100
+
+// pageCursor the last article of a page, the next page starts right after it. Articles are
+// ordered by createdAt and then _id, so articles created in the same millisecond are never
+// skipped or repeated
+type pageCursor struct {
+	// CreatedAt milliseconds since the epoch, the precision createdAt is stored with
+	CreatedAt int64  `json:"c"`
+	ID        string `json:"i"`
+	// Direction 1 for oldest first and -1 for newest first
+	Direction int `json:"d"`
+}
+
+func newPageCursor(last article, direction int) pageCursor {
+	return pageCursor{
+		CreatedAt: last.CreatedAt.UnixNano() / int64(time.Millisecond),
+		ID:        last.ID,
+		Direction: direction,
+	}
+}
+
+// encode the cursor as an opaque string clients pass back unchanged
+func (c pageCursor) encode() (string, error) {
+	js, err := json.Marshal(c)
+
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to encode page cursor")
+	}
+
+	return base64.RawURLEncoding.EncodeToString(js), nil
+}
+
+func decodePageCursor(s string) (pageCursor, error) {
+	c := pageCursor{}
+	js, err := base64.RawURLEncoding.DecodeString(s)
+
+	if err == nil {
+		err = json.Unmarshal(js, &c)
+	}
+
+	if err != nil || c.ID == "" || (c.Direction != 1 && c.Direction != -1) {
+		return c, fmt.Errorf("Invalid parameter query.after: %s", s)
+	}
+
+	return c, nil
+}
+
+// filter matches the articles that come after the cursor in its direction
+func (c pageCursor) filter() bson.M {
+	op := "$gt"
+	if c.Direction < 0 {
+		op = "$lt"
+	}
+
+	createdAt := primitive.DateTime(c.CreatedAt)
+
+	var id interface{} = c.ID
+	if oid, err := primitive.ObjectIDFromHex(c.ID); err == nil {
+		id = oid
+	}
+
+	return bson.M{
+		"$or": bson.A{
+			bson.M{
+				"createdAt": bson.M{op: createdAt},
+			},
+			bson.M{
+				"createdAt": bson.M{"$eq": createdAt},
+				"_id":       bson.M{op: id},
+			},
+		},
+	}
+}
+
+// parseSortDirection the direction named by query.sort, oldest first unless it is "desc"
+func parseSortDirection(s string) (int, error) {
+	switch s {
+	case "", "asc":
+		return 1, nil
+	case "desc":
+		return -1, nil
+	}
+
+	return 0, fmt.Errorf("Invalid parameter query.sort, must be asc or desc: %s", s)
+}
+
+// parsePageSize the page size asked for by query.limit, no larger than MaxPageSize
+func parsePageSize(s string) (int, error) {
+	if s == "" {
+		return DefaultPageSize, nil
+	}
+
+	n, err := strconv.Atoi(s)
+
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("Invalid parameter query.limit, must be a positive integer: %s", s)
+	}
+
+	if n > MaxPageSize {
+		return MaxPageSize, nil
+	}
+
+	return n, nil
+}
+
+// articlePage one page of articles, nextCursor is null on the last page
+type articlePage struct {
+	Articles   []article `json:"articles"`
+	NextCursor *string   `json:"nextCursor"`
+}
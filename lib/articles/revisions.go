@@ -0,0 +1,798 @@
+package articles
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abradley2/macguffin/lib/database"
+	"github.com/abradley2/macguffin/lib/token"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// revision one version of an article. Revisions are never changed once they are recorded
+type revision struct {
+	ID          string    `json:"_id" bson:"_id"`
+	ArticleID   string    `json:"articleID" bson:"articleID"`
+	ArticleType string    `json:"articleType" bson:"articleType"`
+	Revision    int       `json:"revision" bson:"revision"`
+	Author      string    `json:"author" bson:"author"`
+	CreatedAt   time.Time `json:"createdAt" bson:"createdAt"`
+	ItemTitle   string    `json:"itemTitle" bson:"itemTitle"`
+	Thumbnail   string    `json:"thumbnail,omitempty" bson:"thumbnail,omitempty"`
+	Content     string    `json:"content" bson:"content"`
+	Summary     string    `json:"summary,omitempty" bson:"summary,omitempty"`
+	// RestoredFrom the revision a moderator restored to make this one
+	RestoredFrom int `json:"restoredFrom,omitempty" bson:"restoredFrom,omitempty"`
+}
+
+type errRevisionNotFound struct{}
+
+// Error _
+func (errRevisionNotFound) Error() string {
+	return "Revision not found"
+}
+
+// ErrRevisionNotFound indicates the article has no revision with the requested number
+var ErrRevisionNotFound errRevisionNotFound
+
+type errNotRevisionViewer struct{}
+
+// Error _
+func (errNotRevisionViewer) Error() string {
+	return "Only the creator of an article and moderators may see its revisions"
+}
+
+// ErrNotRevisionViewer indicates the logged in user may see the article but not its revisions
+var ErrNotRevisionViewer errNotRevisionViewer
+
+// baselineSummary the summary of the revision recorded for an article written before revisions were
+var baselineSummary = "Recorded when revision history began"
+
+// recordRevision stores the title, thumbnail and content of art as revision number of it
+func recordRevision(
+	ctx context.Context,
+	revisions database.Collection,
+	art article,
+	number int,
+	author string,
+	createdAt time.Time,
+	summary string,
+	restoredFrom int,
+) error {
+	rev := bson.M{
+		"articleID":   art.ID,
+		"articleType": art.ArticleType,
+		"revision":    number,
+		"author":      author,
+		"createdAt":   primitive.NewDateTimeFromTime(createdAt),
+		"itemTitle":   art.ItemTitle,
+		"thumbnail":   art.Thumbnail,
+		"content":     art.Content,
+	}
+
+	if summary != "" {
+		rev["summary"] = summary
+	}
+
+	if restoredFrom != 0 {
+		rev["restoredFrom"] = restoredFrom
+	}
+
+	_, err := revisions.InsertOne(ctx, rev, &options.InsertOneOptions{})
+
+	return errors.Wrapf(err, "Failed to record revision %d of article: %s", number, art.ID)
+}
+
+// nextRevision the number the next revision of an article gets. Articles written before
+// revisions were kept get their current version recorded first, so it can still be restored
+func nextRevision(ctx context.Context, revisions database.Collection, existing article) (int, error) {
+	if existing.Revision > 0 {
+		return existing.Revision + 1, nil
+	}
+
+	createdAt := existing.CreatedAt
+	if existing.UpdatedAt != nil {
+		createdAt = *existing.UpdatedAt
+	}
+
+	err := recordRevision(ctx, revisions, existing, 1, existing.Creator, createdAt, baselineSummary, 0)
+
+	return 2, err
+}
+
+// findRevision one revision of an article
+func findRevision(ctx context.Context, revisions database.Collection, articleID string, number int) (revision, error) {
+	rev := revision{}
+
+	res := revisions.FindOne(
+		ctx,
+		bson.M{
+			"articleID": bson.M{"$eq": articleID},
+			"revision":  bson.M{"$eq": number},
+		},
+		&options.FindOneOptions{},
+	)
+
+	if res.Err() == mongo.ErrNoDocuments {
+		return rev, ErrRevisionNotFound
+	}
+
+	err := res.Decode(&rev)
+
+	return rev, errors.Wrapf(err, "Failed to decode revision %d of article: %s", number, articleID)
+}
+
+// findRevisionsArticle the article whose revisions the viewer asked for. Only its creator and
+// moderators may see them
+func findRevisionsArticle(
+	ctx context.Context,
+	articles database.Collection,
+	articleType string,
+	articleID string,
+	viewer token.UserData,
+) (article, error) {
+	art, err := findVisibleArticle(ctx, articles, articleType, articleID, viewer)
+
+	if err != nil {
+		return art, err
+	}
+
+	if viewer.UserID == "" || (art.Creator != viewer.UserID && viewer.Can(token.PermModerate) == false) {
+		return art, ErrNotRevisionViewer
+	}
+
+	return art, nil
+}
+
+// getRevisionsJSON every revision of an article, newest first
+func getRevisionsJSON(
+	ctx context.Context,
+	articles database.Collection,
+	revisions database.Collection,
+	users database.Collection,
+	articleType string,
+	articleID string,
+	viewer token.UserData,
+) ([]byte, error) {
+	dlCtx, cancel := context.WithDeadline(ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+
+	_, err := findRevisionsArticle(dlCtx, articles, articleType, articleID, viewer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := revisions.Find(
+		dlCtx,
+		bson.M{
+			"articleID": bson.M{"$eq": articleID},
+		},
+		&options.FindOptions{
+			Sort: bson.M{
+				"revision": -1,
+			},
+		},
+	)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed in execution of revisions query")
+	}
+
+	revs := []revision{}
+	err = res.All(dlCtx, &revs)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed reading/decoding results of revisions query")
+	}
+
+	// authors are known by their publicAgentID, the same as the creators of articles
+	authors := []string{}
+	for _, rev := range revs {
+		authors = append(authors, rev.Author)
+	}
+
+	ids, err := token.PublicAgentIDs(dlCtx, users, authors)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range revs {
+		revs[i].Author = ids[revs[i].Author]
+	}
+
+	return json.Marshal(struct {
+		Revisions []revision `json:"revisions"`
+	}{revs})
+}
+
+// diffChunk blocks of content that are the same in both revisions, or only in one of them
+type diffChunk struct {
+	// Op equal, delete for blocks only in the older revision, or insert for blocks only in the newer one
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// maxDiffCells the most block pairs diffBlocks compares, past it the blocks that differ are shown
+// as deleted and inserted wholesale
+const maxDiffCells = 1 << 22
+
+// diffBlocks the changes that turn a into b, block by block
+func diffBlocks(a string, b string) []diffChunk {
+	al, bl := splitBlocks(a), splitBlocks(b)
+
+	prefix := 0
+	for prefix < len(al) && prefix < len(bl) && al[prefix] == bl[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(al)-prefix && suffix < len(bl)-prefix && al[len(al)-1-suffix] == bl[len(bl)-1-suffix] {
+		suffix++
+	}
+
+	am, bm := al[prefix:len(al)-suffix], bl[prefix:len(bl)-suffix]
+
+	chunks := []diffChunk{}
+	add := func(op string, line string) {
+		if n := len(chunks); n > 0 && chunks[n-1].Op == op {
+			chunks[n-1].Text += line
+			return
+		}
+
+		chunks = append(chunks, diffChunk{Op: op, Text: line})
+	}
+
+	for _, line := range al[:prefix] {
+		add("equal", line)
+	}
+
+	if len(am)*len(bm) > maxDiffCells {
+		for _, line := range am {
+			add("delete", line)
+		}
+
+		for _, line := range bm {
+			add("insert", line)
+		}
+	} else {
+		// lcs[i][j] the length of the longest common subsequence of am[i:] and bm[j:]
+		lcs := make([][]int, len(am)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(bm)+1)
+		}
+
+		for i := len(am) - 1; i >= 0; i-- {
+			for j := len(bm) - 1; j >= 0; j-- {
+				switch {
+				case am[i] == bm[j]:
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				case lcs[i+1][j] >= lcs[i][j+1]:
+					lcs[i][j] = lcs[i+1][j]
+				default:
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+
+		i, j := 0, 0
+
+		for i < len(am) || j < len(bm) {
+			switch {
+			case i < len(am) && j < len(bm) && am[i] == bm[j]:
+				add("equal", am[i])
+				i++
+				j++
+			case j >= len(bm) || (i < len(am) && lcs[i+1][j] >= lcs[i][j+1]):
+				add("delete", am[i])
+				i++
+			default:
+				add("insert", bm[j])
+				j++
+			}
+		}
+	}
+
+	for _, line := range al[len(al)-suffix:] {
+		add("equal", line)
+	}
+
+	return chunks
+}
+
+// blockEnds the markup that ends a block of content from the editor, which is stored without line
+// breaks, and a line break for content that has them
+var blockEnds = []string{"</p>", "</li>", "<br>", "</x-align>", "<ol>", "</ol>", "<ul>", "</ul>", "\n"}
+
+// splitBlocks the blocks of s, each with the markup or line break that ends it
+func splitBlocks(s string) []string {
+	blocks := []string{}
+	start := 0
+
+	for i := 0; i < len(s); i++ {
+		for _, end := range blockEnds {
+			if strings.HasPrefix(s[i:], end) {
+				i += len(end) - 1
+				blocks = append(blocks, s[start:i+1])
+				start = i + 1
+				break
+			}
+		}
+	}
+
+	if start < len(s) {
+		blocks = append(blocks, s[start:])
+	}
+
+	return blocks
+}
+
+// getRevisionDiffJSON the changes to the content of an article from one revision to another
+func getRevisionDiffJSON(
+	ctx context.Context,
+	articles database.Collection,
+	revisions database.Collection,
+	articleType string,
+	articleID string,
+	from int,
+	to int,
+	viewer token.UserData,
+) ([]byte, error) {
+	dlCtx, cancel := context.WithDeadline(ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+
+	_, err := findRevisionsArticle(dlCtx, articles, articleType, articleID, viewer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fromRev, err := findRevision(dlCtx, revisions, articleID, from)
+
+	if err != nil {
+		return nil, err
+	}
+
+	toRev, err := findRevision(dlCtx, revisions, articleID, to)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(struct {
+		From    int         `json:"from"`
+		To      int         `json:"to"`
+		Changes []diffChunk `json:"changes"`
+	}{from, to, diffBlocks(fromRev.Content, toRev.Content)})
+}
+
+type restoreRevisionParams struct {
+	tokens     database.Collection
+	articles   database.Collection
+	users      database.Collection
+	revisions  database.Collection
+	transactor database.Transactor
+}
+
+// restoreRevision makes an earlier revision the current version of an article, as a new revision
+func restoreRevision(
+	ctx context.Context,
+	clientToken string,
+	articleID string,
+	number int,
+	params restoreRevisionParams,
+) (int, error) {
+	var restored int
+
+	user, err := token.GetAuthorizedUser(
+		ctx,
+		clientToken,
+		token.GetLoggedInUserParams{
+			Tokens: params.tokens,
+			Users:  params.users,
+		},
+		token.PermModerate,
+	)
+
+	if err != nil {
+		return restored, err
+	}
+
+	id, err := primitive.ObjectIDFromHex(articleID)
+
+	if err != nil {
+		return restored, ErrArticleNotFound
+	}
+
+	f := bson.M{
+		"_id": bson.M{
+			"$eq": id,
+		},
+	}
+
+	err = params.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		res := params.articles.FindOne(ctx, f, &options.FindOneOptions{})
+
+		if res.Err() == mongo.ErrNoDocuments {
+			return ErrArticleNotFound
+		}
+
+		existing := article{}
+		err := res.Decode(&existing)
+
+		if err != nil {
+			return errors.Wrapf(err, "Failed to decode article for restore: %s", articleID)
+		}
+
+		rev, err := findRevision(ctx, params.revisions, articleID, number)
+
+		if err != nil {
+			return err
+		}
+
+		// revisions recorded before content was sanitized may hold any html
+		content, err := sanitizeContent(rev.Content)
+
+		if err != nil {
+			return err
+		}
+
+		restored = existing.Revision + 1
+		now := time.Now()
+
+		_, err = params.articles.UpdateOne(
+			ctx,
+			f,
+			bson.M{
+				"$set": bson.M{
+					"itemTitle": rev.ItemTitle,
+					"thumbnail": rev.Thumbnail,
+					"content":   content,
+					"revision":  restored,
+					"updatedAt": primitive.NewDateTimeFromTime(now),
+				},
+			},
+			&options.UpdateOptions{},
+		)
+
+		if err != nil {
+			return errors.Wrapf(err, "Failed to restore revision %d of article: %s", number, articleID)
+		}
+
+		existing.ItemTitle = rev.ItemTitle
+		existing.Thumbnail = rev.Thumbnail
+		existing.Content = content
+
+		return recordRevision(
+			ctx,
+			params.revisions,
+			existing,
+			restored,
+			user.UserID,
+			now,
+			fmt.Sprintf("Restored revision %d", number),
+			number,
+		)
+	})
+
+	return restored, err
+}
+
+// parseArticlePath the type and id of the article a path such as /articles/{type}/{id}/revisions is about
+func parseArticlePath(path string, suffix string) (string, string, error) {
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(path, "/articles/"), suffix)
+	parts := strings.Split(trimmed, "/")
+
+	if strings.HasSuffix(path, suffix) == false || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid article path: %s", path)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// parseRevisionNumber a revision number given as a query parameter
+func parseRevisionNumber(name string, s string) (int, error) {
+	n, err := strconv.Atoi(s)
+
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("Invalid parameter query.%s, must be a revision number: %s", name, s)
+	}
+
+	return n, nil
+}
+
+func writeRevisionsError(logger *log.Logger, w http.ResponseWriter, err error) {
+	switch errors.Cause(err) {
+	case ErrArticleNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Article not found"))
+	case ErrRevisionNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Revision not found"))
+	case ErrNotRevisionViewer:
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Forbidden"))
+	default:
+		logger.Printf("Error reading article revisions: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+	}
+}
+
+// GetRevisionsParams _
+type GetRevisionsParams struct {
+	Logger              *log.Logger
+	TokensCollection    database.Collection
+	ArticleCollection   database.Collection
+	UsersCollection     database.Collection
+	RevisionsCollection database.Collection
+
+	// artType: path /articles/{type}/{id}/revisions - required
+	artType string
+
+	// articleID: path /articles/{type}/{id}/revisions - required
+	articleID string
+
+	// clientToken: headers.Authorization - optional
+	// only the creator of the article and moderators may see its revisions
+	clientToken string
+}
+
+// FromRequest get GetRevisionsParams from an http.Request
+func (params *GetRevisionsParams) FromRequest(r *http.Request, db database.Database) error {
+	var err error
+	params.clientToken = r.Header.Get("Authorization")
+	params.artType, params.articleID, err = parseArticlePath(r.URL.Path, "/revisions")
+
+	if err != nil {
+		return err
+	}
+
+	if params.RevisionsCollection == nil {
+		params.RevisionsCollection = db.Collection(database.RevisionsCollection)
+	}
+
+	params.ArticleCollection, err = getArticleCollection(params.artType, db)
+
+	return err
+}
+
+// HandleGetRevisions lists every revision of an article, newest first, as { "revisions": [...] }
+func HandleGetRevisions(ctx context.Context, w http.ResponseWriter, params GetRevisionsParams) {
+	logger := params.Logger
+
+	viewer, err := getViewer(ctx, params.clientToken, params.TokensCollection, params.UsersCollection)
+
+	if err != nil {
+		logger.Printf("Error retrieving token: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Invalid Authorization token"))
+		return
+	}
+
+	js, err := getRevisionsJSON(
+		ctx,
+		params.ArticleCollection,
+		params.RevisionsCollection,
+		params.UsersCollection,
+		params.artType,
+		params.articleID,
+		viewer,
+	)
+
+	if err != nil {
+		writeRevisionsError(logger, w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
+
+// GetRevisionDiffParams _
+type GetRevisionDiffParams struct {
+	Logger              *log.Logger
+	TokensCollection    database.Collection
+	ArticleCollection   database.Collection
+	UsersCollection     database.Collection
+	RevisionsCollection database.Collection
+
+	// artType: path /articles/{type}/{id}/revisions/diff - required
+	artType string
+
+	// articleID: path /articles/{type}/{id}/revisions/diff - required
+	articleID string
+
+	// from: query.from - required
+	// the revision the changes are from
+	from int
+
+	// to: query.to - required
+	// the revision the changes are to
+	to int
+
+	// clientToken: headers.Authorization - optional
+	// only the creator of the article and moderators may see its revisions
+	clientToken string
+}
+
+// FromRequest get GetRevisionDiffParams from an http.Request
+func (params *GetRevisionDiffParams) FromRequest(r *http.Request, db database.Database) error {
+	var err error
+	q := r.URL.Query()
+	params.clientToken = r.Header.Get("Authorization")
+	params.artType, params.articleID, err = parseArticlePath(r.URL.Path, "/revisions/diff")
+
+	if err != nil {
+		return err
+	}
+
+	params.from, err = parseRevisionNumber("from", q.Get("from"))
+
+	if err != nil {
+		return err
+	}
+
+	params.to, err = parseRevisionNumber("to", q.Get("to"))
+
+	if err != nil {
+		return err
+	}
+
+	if params.RevisionsCollection == nil {
+		params.RevisionsCollection = db.Collection(database.RevisionsCollection)
+	}
+
+	params.ArticleCollection, err = getArticleCollection(params.artType, db)
+
+	return err
+}
+
+// HandleGetRevisionDiff the block by block changes to the content of an article between two revisions,
+// as { "from": 1, "to": 2, "changes": [{ "op": "equal" | "delete" | "insert", "text": "..." }] }
+func HandleGetRevisionDiff(ctx context.Context, w http.ResponseWriter, params GetRevisionDiffParams) {
+	logger := params.Logger
+
+	viewer, err := getViewer(ctx, params.clientToken, params.TokensCollection, params.UsersCollection)
+
+	if err != nil {
+		logger.Printf("Error retrieving token: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Invalid Authorization token"))
+		return
+	}
+
+	js, err := getRevisionDiffJSON(
+		ctx,
+		params.ArticleCollection,
+		params.RevisionsCollection,
+		params.artType,
+		params.articleID,
+		params.from,
+		params.to,
+		viewer,
+	)
+
+	if err != nil {
+		writeRevisionsError(logger, w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
+
+type restoreRevisionBody struct {
+	ID          string `json:"_id"`
+	ArticleType string `json:"articleType"`
+	Revision    int    `json:"revision"`
+}
+
+// RestoreRevisionParams _
+type RestoreRevisionParams struct {
+	Logger              *log.Logger
+	Transactor          database.Transactor
+	TokensCollection    database.Collection
+	ArticleCollection   database.Collection
+	UsersCollection     database.Collection
+	RevisionsCollection database.Collection
+
+	// clientToken: headers.Authorization - required
+	// token of the moderator restoring the revision
+	clientToken string
+
+	// body - required
+	// the article and the number of the revision to restore
+	body restoreRevisionBody
+}
+
+// FromRequest get RestoreRevisionParams from an http.Request
+func (params *RestoreRevisionParams) FromRequest(r *http.Request, db database.Database) error {
+	params.clientToken = r.Header.Get("Authorization")
+
+	if params.clientToken == "" {
+		return fmt.Errorf("Missing required parameter: headers.Authorization")
+	}
+
+	bodyContent, err := ioutil.ReadAll(io.LimitReader(r.Body, 50000))
+
+	if err != nil {
+		return errors.Wrap(err, "Could not read request body")
+	}
+
+	err = json.Unmarshal(bodyContent, &params.body)
+
+	if err != nil {
+		return err
+	}
+
+	if params.body.ID == "" {
+		return fmt.Errorf("Body missing required parameter: '_id'")
+	}
+
+	if params.body.Revision < 1 {
+		return fmt.Errorf("Body missing required parameter: 'revision'")
+	}
+
+	if params.Transactor == nil {
+		params.Transactor = db
+	}
+
+	if params.RevisionsCollection == nil {
+		params.RevisionsCollection = db.Collection(database.RevisionsCollection)
+	}
+
+	if params.ArticleCollection == nil {
+		params.ArticleCollection, err = getArticleCollection(params.body.ArticleType, db)
+	}
+
+	return err
+}
+
+// HandleRestoreRevision makes an earlier revision of an article its current version again
+func HandleRestoreRevision(ctx context.Context, w http.ResponseWriter, params RestoreRevisionParams) {
+	logger := params.Logger
+
+	restored, err := restoreRevision(
+		ctx,
+		params.clientToken,
+		params.body.ID,
+		params.body.Revision,
+		restoreRevisionParams{
+			tokens:     params.TokensCollection,
+			articles:   params.ArticleCollection,
+			users:      params.UsersCollection,
+			revisions:  params.RevisionsCollection,
+			transactor: params.Transactor,
+		},
+	)
+
+	if errors.Cause(err) == ErrRevisionNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Revision not found"))
+		return
+	}
+
+	if err != nil {
+		writeModerationError(logger, w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(
+		fmt.Sprintf(`{ "restoredID": "%s", "revision": %d }`, params.body.ID, restored),
+	))
+}
@@ -0,0 +1,170 @@
+package articles
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/abradley2/macguffin/lib/request"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	maxTitleLength   = 120
+	maxContentLength = 20000
+)
+
+// maxArticleBody how many bytes of an article request body are read. It leaves room for content
+// of maxContentLength characters, which may be escaped in the json, so that longer content is
+// answered with a validation error instead of failing to decode
+const maxArticleBody = 200000
+
+// allowedElements the elements the editor (Page.Editor) produces for its paragraphs, lists, hard
+// breaks and bold and italic marks. Every other element is left out, but its text is kept
+var allowedElements = map[string]bool{
+	"p":      true,
+	"br":     true,
+	"b":      true,
+	"strong": true,
+	"i":      true,
+	"em":     true,
+	"ol":     true,
+	"ul":     true,
+	"li":     true,
+}
+
+// droppedElements elements that are left out along with everything inside them, as their text
+// was never meant to be read
+var droppedElements = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"template": true,
+	"iframe":   true,
+	"frame":    true,
+	"frameset": true,
+	"object":   true,
+	"embed":    true,
+	"noscript": true,
+	"noembed":  true,
+	"noframes": true,
+	"textarea": true,
+	"select":   true,
+	"title":    true,
+	"head":     true,
+	"svg":      true,
+	"math":     true,
+}
+
+// alignElement the element the editor wraps aligned text in, see Page.Editor.Transforms
+const alignElement = "x-align"
+
+// alignments the text-align style of each alignment the editor supports
+var alignments = map[string]string{
+	"left":   "display: block; text-align: left;",
+	"center": "display: block; text-align: center;",
+	"right":  "display: block; text-align: right;",
+}
+
+// sanitizeContent the content of an article with only the elements and attributes the editor
+// produces, so that it is safe for the browsers of other agents to render
+func sanitizeContent(content string) (string, error) {
+	nodes, err := html.ParseFragment(
+		strings.NewReader(content),
+		&html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div},
+	)
+
+	if err != nil {
+		return "", errors.Wrap(err, "Could not parse article content")
+	}
+
+	b := strings.Builder{}
+
+	for _, n := range nodes {
+		sanitizeNode(&b, n)
+	}
+
+	return b.String(), nil
+}
+
+func sanitizeNode(b *strings.Builder, n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		b.WriteString(html.EscapeString(n.Data))
+		return
+	case html.ElementNode:
+	default:
+		// comments and doctypes
+		return
+	}
+
+	if droppedElements[n.Data] {
+		return
+	}
+
+	// elements inside svg or math are never allowed, even when they share a name with one that is
+	allowed := n.Namespace == "" && allowedElements[n.Data]
+	attrs := ""
+
+	if n.Namespace == "" && n.Data == alignElement {
+		alignment := ""
+
+		for _, a := range n.Attr {
+			if a.Namespace == "" && a.Key == "data-alignment" {
+				alignment = a.Val
+			}
+		}
+
+		style, ok := alignments[alignment]
+		allowed = ok
+		attrs = fmt.Sprintf(` style="%s" data-alignment="%s"`, style, alignment)
+	}
+
+	if allowed == false {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			sanitizeNode(b, c)
+		}
+		return
+	}
+
+	b.WriteString("<" + n.Data + attrs + ">")
+
+	if n.Data == "br" {
+		return
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sanitizeNode(b, c)
+	}
+
+	b.WriteString("</" + n.Data + ">")
+}
+
+// validateArticle sanitizes the content of an article and checks the length of its title and
+// content, returning the sanitized content and nil errors when it is valid
+func validateArticle(itemTitle string, content string) (string, request.ValidationErrors, error) {
+	errs := request.ValidationErrors{}
+
+	sanitized, err := sanitizeContent(content)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	if strings.TrimSpace(itemTitle) == "" {
+		errs["itemTitle"] = "is required"
+	} else if utf8.RuneCountInString(itemTitle) > maxTitleLength {
+		errs["itemTitle"] = fmt.Sprintf("must be at most %d characters", maxTitleLength)
+	}
+
+	if utf8.RuneCountInString(sanitized) > maxContentLength {
+		errs["content"] = fmt.Sprintf("must be at most %d characters", maxContentLength)
+	}
+
+	if len(errs) == 0 {
+		return sanitized, nil, nil
+	}
+
+	return sanitized, errs, nil
+}
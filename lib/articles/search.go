@@ -0,0 +1,299 @@
+package articles
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/abradley2/macguffin/lib/database"
+	"github.com/abradley2/macguffin/lib/token"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// snippetLength about how many bytes of content a search result shows around its first match
+const snippetLength = 160
+
+// scoredArticle an article as a text search finds it, with its score
+type scoredArticle struct {
+	Article article `bson:",inline"`
+	Score   float64 `bson:"score"`
+}
+
+// searchResult an article found by a search, with its matches wrapped in <mark> in highlights
+type searchResult struct {
+	article
+	Score float64 `json:"score"`
+	// Highlights the escaped itemTitle, and a snippet of the content, by field
+	Highlights map[string]string `json:"highlights"`
+}
+
+type searchResults struct {
+	Results []searchResult `json:"results"`
+}
+
+type searchArticlesOptions struct {
+	viewer token.UserData
+	search string
+	limit  int
+}
+
+// searchArticlesJSON searches the title and content of the articles of every collection the
+// viewer can see, best matches first
+func searchArticlesJSON(
+	ctx context.Context,
+	articleCollections []database.Collection,
+	users database.Collection,
+	opts searchArticlesOptions,
+) ([]byte, error) {
+	dlCtx, cancel := context.WithDeadline(ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+
+	limit := int64(opts.limit)
+	found := []scoredArticle{}
+
+	for i, articles := range articleCollections {
+		// the same articles the viewer could list
+		q, err := getArticlesJSONOptions{articleType: database.ArticleCollections[i]}.toQuery(opts.viewer)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not generate query for article search")
+		}
+
+		q["$text"] = bson.M{
+			"$search": opts.search,
+		}
+
+		res, err := articles.Find(
+			dlCtx,
+			q,
+			&options.FindOptions{
+				Projection: bson.M{
+					"score": bson.M{"$meta": "textScore"},
+				},
+				Sort: bson.M{
+					"score": bson.M{"$meta": "textScore"},
+				},
+				Limit: &limit,
+			},
+		)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed in execution of article search")
+		}
+
+		scored := []scoredArticle{}
+		err = res.All(dlCtx, &scored)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed reading/decoding results of article search")
+		}
+
+		found = append(found, scored...)
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Score > found[j].Score
+	})
+
+	if len(found) > opts.limit {
+		found = found[:opts.limit]
+	}
+
+	arts := make([]article, len(found))
+	for i, f := range found {
+		arts[i] = f.Article
+	}
+
+	err := withPublicCreators(dlCtx, users, arts, opts.viewer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	query := database.ParseTextQuery(opts.search)
+	results := searchResults{Results: []searchResult{}}
+
+	for i, f := range found {
+		results.Results = append(results.Results, searchResult{
+			article: arts[i],
+			Score:   f.Score,
+			Highlights: map[string]string{
+				"itemTitle": highlight(f.Article.ItemTitle, query, len(f.Article.ItemTitle)),
+				"content":   highlight(f.Article.Content, query, snippetLength),
+			},
+		})
+	}
+
+	return json.Marshal(results)
+}
+
+// highlight escapes a snippet of about length bytes of text, starting a little before the first
+// word matching the query, and wraps every matching word in <mark>
+func highlight(text string, q database.TextQuery, length int) string {
+	matches := map[string]bool{}
+
+	for _, term := range q.Terms {
+		matches[term] = true
+	}
+
+	for _, phrase := range q.Phrases {
+		for _, t := range database.TextTokens(phrase) {
+			matches[t.Term] = true
+		}
+	}
+
+	tokens := database.TextTokens(text)
+	first := 0
+
+	for i, t := range tokens {
+		if matches[t.Term] {
+			first = i
+			break
+		}
+	}
+
+	// a few words of context before the first match
+	for matched := first; first > 0 && tokens[matched].Start-tokens[first-1].Start < length/3; {
+		first--
+	}
+
+	start := 0
+	if first > 0 && len(text) > length {
+		start = tokens[first].Start
+	}
+
+	end := start + length
+	if end > len(text) {
+		end = len(text)
+	}
+
+	b := strings.Builder{}
+	pos := start
+
+	for _, t := range tokens {
+		if t.Start < start || matches[t.Term] == false {
+			continue
+		}
+
+		// never cut a word in half
+		if t.End > end {
+			break
+		}
+
+		b.WriteString(html.EscapeString(text[pos:t.Start]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(text[t.Start:t.End]))
+		b.WriteString("</mark>")
+		pos = t.End
+	}
+
+	for _, t := range tokens {
+		if t.Start >= pos && t.Start < end && t.End > end {
+			end = t.Start
+		}
+	}
+
+	if pos < end {
+		b.WriteString(html.EscapeString(text[pos:end]))
+	}
+
+	snippet := strings.TrimSpace(b.String())
+
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+
+	if end < len(text) {
+		snippet = snippet + "…"
+	}
+
+	return snippet
+}
+
+// SearchArticlesParams _
+type SearchArticlesParams struct {
+	Logger             *log.Logger
+	TokensCollection   database.Collection
+	UsersCollection    database.Collection
+	ArticleCollections []database.Collection
+
+	// search: query.q - required
+	// words to search for, "quoted phrases" must all be found and -words must not be
+	search string
+
+	// clientToken: headers.Authorization - optional
+	// needed to also search the viewer's own unapproved articles, or every article for moderators
+	clientToken string
+
+	// limit: query.limit - optional
+	// how many results to send back, DefaultPageSize unless given and never more than MaxPageSize
+	limit int
+}
+
+// FromRequest get SearchArticlesParams from an http.Request
+func (params *SearchArticlesParams) FromRequest(r *http.Request, db database.Database) error {
+	var err error
+	q := r.URL.Query()
+	params.search = strings.TrimSpace(q.Get("q"))
+	params.clientToken = r.Header.Get("Authorization")
+
+	if params.search == "" {
+		return fmt.Errorf("Missing required parameter query.q")
+	}
+
+	params.limit, err = parsePageSize(q.Get("limit"))
+
+	if err != nil {
+		return err
+	}
+
+	if params.ArticleCollections == nil {
+		params.ArticleCollections, err = GetArticleCollections(db)
+	}
+
+	return err
+}
+
+// HandleSearchArticles searches the articles of every type the requestor can see, best matches
+// first, as { "results": [...] }. Each result has the highlights of its title and content
+func HandleSearchArticles(ctx context.Context, w http.ResponseWriter, params SearchArticlesParams) {
+	logger := params.Logger
+
+	viewer, err := getViewer(ctx, params.clientToken, params.TokensCollection, params.UsersCollection)
+
+	if err != nil {
+		logger.Printf("Error retrieving token: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Invalid Authorization token"))
+		return
+	}
+
+	js, err := searchArticlesJSON(
+		ctx,
+		params.ArticleCollections,
+		params.UsersCollection,
+		searchArticlesOptions{
+			viewer: viewer,
+			search: params.search,
+			limit:  params.limit,
+		},
+	)
+
+	if err != nil {
+		logger.Printf("Failed searching articles via searchArticlesJSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
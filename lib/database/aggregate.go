@@ -0,0 +1,489 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// pipelineStages the stages of an aggregation pipeline, which may be a mongo.Pipeline, a bson.A
+// or any other slice of documents
+func pipelineStages(pipeline interface{}) ([]primitive.E, error) {
+	wrapped, err := normalize(bson.D{{Key: "pipeline", Value: pipeline}})
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid pipeline")
+	}
+
+	arr, ok := wrapped[0].Value.(primitive.A)
+
+	if ok == false {
+		return nil, fmt.Errorf("Pipeline must be an array of stages")
+	}
+
+	stages := make([]primitive.E, 0, len(arr))
+
+	for _, s := range arr {
+		d, ok := s.(primitive.D)
+
+		if ok == false || len(d) != 1 {
+			return nil, fmt.Errorf("Each pipeline stage must be a document with exactly one field")
+		}
+
+		stages = append(stages, d[0])
+	}
+
+	return stages, nil
+}
+
+// aggregateDocuments runs an aggregation pipeline over documents, leaving them unchanged
+func aggregateDocuments(docs []primitive.D, pipeline interface{}) ([]bson.Raw, error) {
+	stages, err := pipelineStages(pipeline)
+
+	if err != nil {
+		return nil, err
+	}
+
+	current := make([]primitive.D, len(docs))
+	copy(current, docs)
+
+	for _, stage := range stages {
+		current, err = applyStage(current, stage)
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to apply %s", stage.Key)
+		}
+	}
+
+	results := make([]bson.Raw, 0, len(current))
+
+	for _, doc := range current {
+		raw, err := marshalDocument(doc)
+
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, raw)
+	}
+
+	return results, nil
+}
+
+func applyStage(docs []primitive.D, stage primitive.E) ([]primitive.D, error) {
+	switch stage.Key {
+	case "$match":
+		f, ok := stage.Value.(primitive.D)
+
+		if ok == false {
+			return nil, fmt.Errorf("$match needs a document")
+		}
+
+		matched := []primitive.D{}
+
+		for _, doc := range docs {
+			m, err := matchFilter(doc, f)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if m {
+				matched = append(matched, doc)
+			}
+		}
+
+		return matched, nil
+
+	case "$sort":
+		return docs, sortDocuments(docs, stage.Value)
+
+	case "$skip":
+		n, ok := toFloat(stage.Value)
+
+		if ok == false || n < 0 || n != math.Trunc(n) {
+			return nil, fmt.Errorf("$skip needs a non-negative integer")
+		}
+
+		if int(n) > len(docs) {
+			return []primitive.D{}, nil
+		}
+
+		return docs[int(n):], nil
+
+	case "$limit":
+		n, ok := toFloat(stage.Value)
+
+		if ok == false || n <= 0 || n != math.Trunc(n) {
+			return nil, fmt.Errorf("$limit needs a positive integer")
+		}
+
+		if int(n) < len(docs) {
+			return docs[:int(n)], nil
+		}
+
+		return docs, nil
+
+	case "$project":
+		projected := make([]primitive.D, len(docs))
+
+		for i, doc := range docs {
+			p, err := applyProjection(doc, stage.Value)
+
+			if err != nil {
+				return nil, err
+			}
+
+			projected[i] = p
+		}
+
+		return projected, nil
+
+	case "$count":
+		name, ok := stage.Value.(string)
+
+		if ok == false || name == "" || strings.HasPrefix(name, "$") {
+			return nil, fmt.Errorf("$count needs a field name")
+		}
+
+		if len(docs) == 0 {
+			return []primitive.D{}, nil
+		}
+
+		return []primitive.D{{{Key: name, Value: int32(len(docs))}}}, nil
+
+	case "$unwind":
+		return unwindDocuments(docs, stage.Value)
+
+	case "$group":
+		return groupDocuments(docs, stage.Value)
+	}
+
+	return nil, fmt.Errorf("Unsupported aggregation stage: %s", stage.Key)
+}
+
+// unwindDocuments outputs a copy of each document for every element of an array field
+func unwindDocuments(docs []primitive.D, spec interface{}) ([]primitive.D, error) {
+	var (
+		path     string
+		preserve bool
+	)
+
+	switch t := spec.(type) {
+	case string:
+		path = t
+	case primitive.D:
+		for _, e := range t {
+			switch e.Key {
+			case "path":
+				path, _ = e.Value.(string)
+			case "preserveNullAndEmptyArrays":
+				preserve = truthy(e.Value)
+			}
+		}
+	}
+
+	if strings.HasPrefix(path, "$") == false {
+		return nil, fmt.Errorf("$unwind needs a field path starting with $")
+	}
+
+	fieldPath := splitPath(path[1:])
+	unwound := []primitive.D{}
+
+	for _, doc := range docs {
+		v, exists := valueAt(doc, fieldPath)
+		arr, isArray := v.(primitive.A)
+
+		switch {
+		case isArray && len(arr) > 0:
+			for _, el := range arr {
+				clone, err := cloneDocument(doc)
+
+				if err == nil {
+					clone, err = setPath(clone, fieldPath, el)
+				}
+
+				if err != nil {
+					return nil, err
+				}
+
+				unwound = append(unwound, clone)
+			}
+
+		case isArray:
+			if preserve {
+				clone, err := cloneDocument(doc)
+
+				if err != nil {
+					return nil, err
+				}
+
+				unwound = append(unwound, unsetPath(clone, fieldPath))
+			}
+
+		case exists == false || v == nil:
+			if preserve {
+				unwound = append(unwound, doc)
+			}
+
+		default:
+			// a value that isn't an array is treated as an array of one element
+			unwound = append(unwound, doc)
+		}
+	}
+
+	return unwound, nil
+}
+
+// evalExpression the value of an aggregation expression for a document, which is a "$field"
+// path, a document of expressions or a literal. exists is false for a path that is missing
+func evalExpression(doc primitive.D, expr interface{}) (interface{}, bool, error) {
+	switch t := expr.(type) {
+	case string:
+		if strings.HasPrefix(t, "$") {
+			v, exists := valueAt(doc, splitPath(t[1:]))
+			return v, exists, nil
+		}
+
+	case primitive.D:
+		if isOperatorDocument(t) {
+			if len(t) == 1 && t[0].Key == "$literal" {
+				return t[0].Value, true, nil
+			}
+
+			return nil, false, fmt.Errorf("Unsupported expression operator: %s", t[0].Key)
+		}
+
+		evaluated := primitive.D{}
+
+		for _, e := range t {
+			v, exists, err := evalExpression(doc, e.Value)
+
+			if err != nil {
+				return nil, false, err
+			}
+
+			if exists {
+				evaluated = append(evaluated, primitive.E{Key: e.Key, Value: v})
+			}
+		}
+
+		return evaluated, true, nil
+	}
+
+	return expr, true, nil
+}
+
+var groupAccumulators = map[string]bool{
+	"$sum":      true,
+	"$avg":      true,
+	"$min":      true,
+	"$max":      true,
+	"$first":    true,
+	"$last":     true,
+	"$push":     true,
+	"$addToSet": true,
+}
+
+type groupValue struct {
+	value  interface{}
+	exists bool
+}
+
+// groupDocuments groups documents by the _id expression of a $group stage, in the order each
+// group is first seen, and computes its accumulators for every group
+func groupDocuments(docs []primitive.D, spec interface{}) ([]primitive.D, error) {
+	s, ok := spec.(primitive.D)
+
+	if ok == false {
+		return nil, fmt.Errorf("$group needs a document")
+	}
+
+	type accumulatorField struct {
+		name string
+		op   string
+		expr interface{}
+	}
+
+	var (
+		idExpr interface{}
+		hasID  bool
+		fields = []accumulatorField{}
+	)
+
+	for _, e := range s {
+		if e.Key == "_id" {
+			idExpr, hasID = e.Value, true
+			continue
+		}
+
+		acc, ok := e.Value.(primitive.D)
+
+		if ok == false || len(acc) != 1 {
+			return nil, fmt.Errorf("The field '%s' must be an accumulator object", e.Key)
+		}
+
+		if groupAccumulators[acc[0].Key] == false {
+			return nil, fmt.Errorf("Unsupported accumulator: %s", acc[0].Key)
+		}
+
+		fields = append(fields, accumulatorField{name: e.Key, op: acc[0].Key, expr: acc[0].Value})
+	}
+
+	if hasID == false {
+		return nil, fmt.Errorf("$group needs an _id")
+	}
+
+	type group struct {
+		id     interface{}
+		values [][]groupValue
+	}
+
+	groups := []*group{}
+
+	for _, doc := range docs {
+		id, _, err := evalExpression(doc, idExpr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var g *group
+
+		for _, existing := range groups {
+			if valuesEqual(existing.id, id) {
+				g = existing
+				break
+			}
+		}
+
+		if g == nil {
+			g = &group{id: id, values: make([][]groupValue, len(fields))}
+			groups = append(groups, g)
+		}
+
+		for i, f := range fields {
+			v, exists, err := evalExpression(doc, f.expr)
+
+			if err != nil {
+				return nil, err
+			}
+
+			g.values[i] = append(g.values[i], groupValue{value: v, exists: exists})
+		}
+	}
+
+	results := make([]primitive.D, 0, len(groups))
+
+	for _, g := range groups {
+		out := primitive.D{{Key: "_id", Value: g.id}}
+
+		for i, f := range fields {
+			out = append(out, primitive.E{Key: f.name, Value: accumulate(f.op, g.values[i])})
+		}
+
+		results = append(results, out)
+	}
+
+	return results, nil
+}
+
+func accumulate(op string, values []groupValue) interface{} {
+	switch op {
+	case "$sum", "$avg":
+		var (
+			sum      float64
+			intSum   int64
+			count    int
+			integral = true
+			small    = true
+		)
+
+		for _, v := range values {
+			f, ok := toFloat(v.value)
+
+			if ok == false {
+				continue
+			}
+
+			sum += f
+			count++
+
+			switch n := v.value.(type) {
+			case int32:
+				intSum += int64(n)
+			case int64:
+				intSum += n
+				small = false
+			default:
+				integral = false
+			}
+		}
+
+		if op == "$avg" {
+			if count == 0 {
+				return nil
+			}
+			return sum / float64(count)
+		}
+
+		switch {
+		case integral && small && intSum >= math.MinInt32 && intSum <= math.MaxInt32:
+			return int32(intSum)
+		case integral:
+			return intSum
+		}
+
+		return sum
+
+	case "$min", "$max":
+		var best interface{}
+
+		for _, v := range values {
+			if v.exists == false || v.value == nil {
+				continue
+			}
+
+			c := compareForSort(v.value, best)
+
+			if best == nil || (op == "$min" && c < 0) || (op == "$max" && c > 0) {
+				best = v.value
+			}
+		}
+
+		return best
+
+	case "$first":
+		if len(values) > 0 {
+			return values[0].value
+		}
+		return nil
+
+	case "$last":
+		if len(values) > 0 {
+			return values[len(values)-1].value
+		}
+		return nil
+	}
+
+	// $push and $addToSet leave out documents the expression is missing from
+	arr := primitive.A{}
+
+	for _, v := range values {
+		if v.exists == false {
+			continue
+		}
+
+		if op == "$addToSet" && matchEq([]interface{}(arr), v.value) {
+			continue
+		}
+
+		arr = append(arr, v.value)
+	}
+
+	return arr
+}
@@ -2,9 +2,7 @@ package database
 
 import (
 	"context"
-	"fmt"
 
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -18,6 +16,13 @@ type Collection interface {
 	Find(context.Context, interface{}, *options.FindOptions) (Cursor, error)
 	FindOne(context.Context, interface{}, *options.FindOneOptions) SingleResult
 	InsertOne(context.Context, interface{}, *options.InsertOneOptions) (string, error)
+	UpdateOne(context.Context, interface{}, interface{}, *options.UpdateOptions) (UpdateResult, error)
+	UpdateMany(context.Context, interface{}, interface{}, *options.UpdateOptions) (UpdateResult, error)
+	FindOneAndUpdate(context.Context, interface{}, interface{}, *options.FindOneAndUpdateOptions) SingleResult
+	DeleteOne(context.Context, interface{}, *options.DeleteOptions) (int64, error)
+	DeleteMany(context.Context, interface{}, *options.DeleteOptions) (int64, error)
+	CountDocuments(context.Context, interface{}, *options.CountOptions) (int64, error)
+	Aggregate(context.Context, interface{}, *options.AggregateOptions) (Cursor, error)
 }
 
 func (c *mongoCollection) Find(ctx context.Context, filter interface{}, opts *options.FindOptions) (Cursor, error) {
@@ -32,18 +37,58 @@ func (c *mongoCollection) FindOne(ctx context.Context, filter interface{}, opts
 }
 
 func (c *mongoCollection) InsertOne(ctx context.Context, doc interface{}, opts *options.InsertOneOptions) (string, error) {
-	var insertedID string
-	var err error
-
 	res, err := c.collection.InsertOne(ctx, doc, opts)
 
 	if err != nil {
-		return insertedID, err
+		return "", err
+	}
+
+	// documents inserted with their own _id, such as the migration lock, keep it
+	return idString(res.InsertedID), err
+}
+
+func (c *mongoCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts *options.UpdateOptions) (UpdateResult, error) {
+	res, err := c.collection.UpdateOne(ctx, filter, update, opts)
+
+	return &mongoUpdateResult{result: res}, err
+}
+
+func (c *mongoCollection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts *options.UpdateOptions) (UpdateResult, error) {
+	res, err := c.collection.UpdateMany(ctx, filter, update, opts)
+
+	return &mongoUpdateResult{result: res}, err
+}
+
+func (c *mongoCollection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts *options.FindOneAndUpdateOptions) SingleResult {
+	return &mongoSingleResult{result: c.collection.FindOneAndUpdate(ctx, filter, update, opts)}
+}
+
+func (c *mongoCollection) DeleteOne(ctx context.Context, filter interface{}, opts *options.DeleteOptions) (int64, error) {
+	res, err := c.collection.DeleteOne(ctx, filter, opts)
+
+	if err != nil {
+		return 0, err
 	}
 
-	if id, ok := res.InsertedID.(primitive.ObjectID); ok {
-		return id.Hex(), err
+	return res.DeletedCount, err
+}
+
+func (c *mongoCollection) DeleteMany(ctx context.Context, filter interface{}, opts *options.DeleteOptions) (int64, error) {
+	res, err := c.collection.DeleteMany(ctx, filter, opts)
+
+	if err != nil {
+		return 0, err
 	}
 
-	return insertedID, fmt.Errorf("Failed to get ID for inserted document")
+	return res.DeletedCount, err
+}
+
+func (c *mongoCollection) CountDocuments(ctx context.Context, filter interface{}, opts *options.CountOptions) (int64, error) {
+	return c.collection.CountDocuments(ctx, filter, opts)
+}
+
+func (c *mongoCollection) Aggregate(ctx context.Context, pipeline interface{}, opts *options.AggregateOptions) (Cursor, error) {
+	curs, err := c.collection.Aggregate(ctx, pipeline, opts)
+
+	return &mongoCursor{cursor: curs}, err
 }
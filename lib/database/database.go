@@ -1,13 +1,42 @@
 package database
 
-import "go.mongodb.org/mongo-driver/mongo"
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
 
 type Database interface {
 	Collection(string) Collection
+	Transactor
+	// Ping checks the database can be reached, for readiness checks
+	Ping(ctx context.Context) error
+}
+
+// Transactor runs a group of writes as one transaction. fn must do all of its reads and writes
+// with the context it is given, and the transaction is rolled back if it returns an error.
+// Calling WithTransaction again with that context joins the transaction already running.
+// Backends that can't run transactions call fn directly, so its writes are neither isolated nor
+// rolled back: MongoDB standalone servers and the in-memory backend
+type Transactor interface {
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
 }
 
 type mongoDatabase struct {
 	db *mongo.Database
+
+	mu sync.Mutex
+	// transactions whether the server supports transactions, nil until it has been asked
+	transactions *bool
+}
+
+// NewMongoDatabase wraps a database on a connected mongo client
+func NewMongoDatabase(db *mongo.Database) Database {
+	return &mongoDatabase{db: db}
 }
 
 func (d *mongoDatabase) Collection(collectionName string) Collection {
@@ -16,3 +45,70 @@ func (d *mongoDatabase) Collection(collectionName string) Collection {
 
 	return c
 }
+
+// Ping asks the primary to respond, since writes fail without one
+func (d *mongoDatabase) Ping(ctx context.Context) error {
+	return errors.Wrap(d.db.Client().Ping(ctx, readpref.Primary()), "Failed to ping mongo")
+}
+
+// supportsTransactions whether the server is a replica set member or a mongos, which are the
+// only deployments MongoDB runs transactions on
+func (d *mongoDatabase) supportsTransactions(ctx context.Context) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.transactions != nil {
+		return *d.transactions, nil
+	}
+
+	res := struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}{}
+
+	err := d.db.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&res)
+
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to check whether mongo supports transactions")
+	}
+
+	supported := res.SetName != "" || res.Msg == "isdbgrid"
+	d.transactions = &supported
+
+	if supported == false {
+		logger.Printf("Mongo is a standalone server, writes grouped in transactions will not be atomic")
+	}
+
+	return supported, nil
+}
+
+// mongoTxKey the context key marking the contexts WithTransaction calls fn with, the session
+// itself is found by the driver from the context
+type mongoTxKey struct{}
+
+// WithTransaction runs fn in a session transaction, which the driver retries on transient errors.
+// Collections can't be created inside a transaction before MongoDB 4.4, so fn should only write to
+// collections that already exist, such as the ones reconciling indexes creates
+func (d *mongoDatabase) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if ctx.Value(mongoTxKey{}) == d {
+		return fn(ctx)
+	}
+
+	supported, err := d.supportsTransactions(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if supported == false {
+		return fn(ctx)
+	}
+
+	return d.db.Client().UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			return nil, fn(context.WithValue(sc, mongoTxKey{}, d))
+		})
+
+		return err
+	})
+}
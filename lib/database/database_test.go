@@ -0,0 +1,728 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abradley2/macguffin/lib/env"
+	"github.com/abradley2/macguffin/lib/request"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type testAgent struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserID    string             `bson:"userID"`
+	Role      string             `bson:"role,omitempty"`
+	Clearance int                `bson:"clearance"`
+	Tags      []string           `bson:"tags,omitempty"`
+	CreatedAt time.Time          `bson:"createdAt"`
+}
+
+func seedAgents(t *testing.T, c Collection) {
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	agents := []testAgent{
+		{UserID: "github:1", Role: "admin", Clearance: 5, Tags: []string{"field", "desk"}, CreatedAt: start},
+		{UserID: "github:2", Role: "moderator", Clearance: 3, Tags: []string{"desk"}, CreatedAt: start.Add(time.Hour)},
+		{UserID: "github:3", Clearance: 1, CreatedAt: start.Add(2 * time.Hour)},
+		{UserID: "gitlab:4", Role: "agent", Clearance: 0, Tags: []string{"field"}, CreatedAt: start.Add(3 * time.Hour)},
+	}
+
+	for _, a := range agents {
+		_, err := c.InsertOne(context.Background(), a, &options.InsertOneOptions{})
+
+		if err != nil {
+			t.Fatalf("Failed to insert agent fixture: %v", err)
+		}
+	}
+}
+
+func findUserIDs(t *testing.T, c Collection, filter interface{}, opts *options.FindOptions) []string {
+	res, err := c.Find(context.Background(), filter, opts)
+
+	if err != nil {
+		t.Fatalf("Find failed for %v: %v", filter, err)
+	}
+
+	agents := []testAgent{}
+	err = res.All(context.Background(), &agents)
+
+	if err != nil {
+		t.Fatalf("Failed decoding results for %v: %v", filter, err)
+	}
+
+	ids := []string{}
+	for _, a := range agents {
+		ids = append(ids, a.UserID)
+	}
+
+	return ids
+}
+
+func sameIDs(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestSQLiteTTL(t *testing.T) {
+	db, err := OpenSQLiteDatabase(":memory:")
+
+	if err != nil {
+		t.Fatalf("Failed to open sqlite database: %v", err)
+	}
+
+	tokens := db.Collection(TokensCollection)
+	ctx := context.Background()
+
+	for userID, lastSeenAt := range map[string]time.Time{
+		"github:idle":   time.Now().Add(-2 * env.SessionLifetime),
+		"github:active": time.Now(),
+	} {
+		// clientTokenHash is uniquely indexed, so every token needs its own
+		_, err = tokens.InsertOne(
+			ctx,
+			bson.M{"userID": userID, "clientTokenHash": "hash-" + userID, "lastSeenAt": lastSeenAt},
+			&options.InsertOneOptions{},
+		)
+
+		if err != nil {
+			t.Fatalf("Failed to insert token fixture: %v", err)
+		}
+	}
+
+	if ids := findUserIDs(t, tokens, bson.M{}, &options.FindOptions{}); sameIDs(ids, []string{"github:active"}) == false {
+		t.Errorf("Expected tokens past their TTL to be gone, got: %v", ids)
+	}
+
+	_, err = tokens.UpdateOne(
+		ctx,
+		bson.M{"userID": "github:active"},
+		bson.M{"$set": bson.M{"lastSeenAt": time.Now().Add(-2 * env.SessionLifetime)}},
+		&options.UpdateOptions{},
+	)
+
+	if err != nil {
+		t.Fatalf("Failed to update token fixture: %v", err)
+	}
+
+	if ids := findUserIDs(t, tokens, bson.M{}, &options.FindOptions{}); len(ids) != 0 {
+		t.Errorf("Expected TTL to follow updates to the expiry field, got: %v", ids)
+	}
+}
+
+func TestSQLitePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macguffin")
+
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "macguffin.db")
+
+	db, err := OpenSQLiteDatabase(path)
+
+	if err != nil {
+		t.Fatalf("Failed to open sqlite database: %v", err)
+	}
+
+	seedAgents(t, db.Collection(AgentsCollection))
+
+	_, err = db.Collection(MacguffinsCollection).InsertOne(
+		context.Background(),
+		testArticle{ItemTitle: "Briefcase", Content: "It glows"},
+		&options.InsertOneOptions{},
+	)
+
+	if err != nil {
+		t.Fatalf("Failed to insert article fixture: %v", err)
+	}
+
+	// as if the article was written before macguffins had a text index
+	_, err = db.(*sqliteDatabase).db.Exec("DELETE FROM document_fields WHERE path = ?", textTermsPath)
+
+	if err != nil {
+		t.Fatalf("Failed to clear text terms: %v", err)
+	}
+
+	db, err = OpenSQLiteDatabase(path)
+
+	if err != nil {
+		t.Fatalf("Failed to reopen sqlite database: %v", err)
+	}
+
+	ids := findUserIDs(t, db.Collection(AgentsCollection), bson.M{"clearance": bson.M{"$gte": 3}}, &options.FindOptions{})
+
+	if sameIDs(ids, []string{"github:1", "github:2"}) == false {
+		t.Errorf("Expected agents to still be there after reopening, got: %v", ids)
+	}
+
+	if titles, _ := searchTitles(t, db.Collection(MacguffinsCollection), "glow"); sameIDs(titles, []string{"Briefcase"}) == false {
+		t.Errorf("Expected articles to be text indexed when reopening, got: %v", titles)
+	}
+}
+
+func TestSQLiteTransaction(t *testing.T) {
+	db, err := OpenSQLiteDatabase(":memory:")
+
+	if err != nil {
+		t.Fatalf("Failed to open sqlite database: %v", err)
+	}
+
+	agents := db.Collection(AgentsCollection)
+	ctx := context.Background()
+
+	err = db.WithTransaction(ctx, func(ctx context.Context) error {
+		_, err := agents.InsertOne(ctx, bson.M{"userID": "github:1"}, &options.InsertOneOptions{})
+
+		if err != nil {
+			return err
+		}
+
+		// reads inside the transaction see its own writes
+		if n, err := agents.CountDocuments(ctx, bson.M{}, &options.CountOptions{}); n != 1 || err != nil {
+			t.Errorf("Expected the transaction to see the agent it inserted, got %d: %v", n, err)
+		}
+
+		return fmt.Errorf("login failed")
+	})
+
+	if err == nil || err.Error() != "login failed" {
+		t.Errorf("Expected the error of the transaction to be returned, got: %v", err)
+	}
+
+	if ids := findUserIDs(t, agents, bson.M{}, &options.FindOptions{}); len(ids) != 0 {
+		t.Errorf("Expected the failed transaction to be rolled back, got: %v", ids)
+	}
+
+	err = db.WithTransaction(ctx, func(ctx context.Context) error {
+		_, err := agents.InsertOne(ctx, bson.M{"userID": "github:2"}, &options.InsertOneOptions{})
+
+		if err != nil {
+			return err
+		}
+
+		// a nested transaction joins the one already running
+		return db.WithTransaction(ctx, func(ctx context.Context) error {
+			_, err := agents.UpdateOne(ctx, bson.M{"userID": "github:2"}, bson.M{"$set": bson.M{"clearance": 2}}, &options.UpdateOptions{})
+			return err
+		})
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to commit transaction: %v", err)
+	}
+
+	if ids := findUserIDs(t, agents, bson.M{"clearance": 2}, &options.FindOptions{}); sameIDs(ids, []string{"github:2"}) == false {
+		t.Errorf("Expected the committed transaction to be kept, got: %v", ids)
+	}
+}
+
+type testArticle struct {
+	ItemTitle string  `bson:"itemTitle"`
+	Content   string  `bson:"content"`
+	Score     float64 `bson:"score,omitempty"`
+}
+
+func searchTitles(t *testing.T, c Collection, search string) ([]string, []float64) {
+	res, err := c.Find(
+		context.Background(),
+		bson.M{"$text": bson.M{"$search": search}},
+		&options.FindOptions{
+			Projection: bson.M{"score": bson.M{"$meta": "textScore"}},
+			Sort:       bson.M{"score": bson.M{"$meta": "textScore"}},
+		},
+	)
+
+	if err != nil {
+		t.Fatalf("Text search failed for %s: %v", search, err)
+	}
+
+	found := []testArticle{}
+	err = res.All(context.Background(), &found)
+
+	if err != nil {
+		t.Fatalf("Failed decoding text search results for %s: %v", search, err)
+	}
+
+	titles, scores := []string{}, []float64{}
+	for _, a := range found {
+		titles = append(titles, a.ItemTitle)
+		scores = append(scores, a.Score)
+	}
+
+	return titles, scores
+}
+
+func TestTextSearch(t *testing.T) {
+	sqlite, err := OpenSQLiteDatabase(":memory:")
+
+	if err != nil {
+		t.Fatalf("Failed to open sqlite database: %v", err)
+	}
+
+	for name, db := range map[string]Database{"memory": NewMemoryDatabase(), "sqlite": sqlite} {
+		c := db.Collection(MacguffinsCollection)
+
+		for _, a := range []testArticle{
+			{ItemTitle: "The Maltese Falcon", Content: "A statuette of a bird, wanted by everyone."},
+			{ItemTitle: "Briefcase", Content: "Nobody knows what glows inside. Some say it holds a falcon."},
+			{ItemTitle: "Rosebud", Content: "A sled, burned in the furnace."},
+		} {
+			_, err := c.InsertOne(context.Background(), a, &options.InsertOneOptions{})
+
+			if err != nil {
+				t.Fatalf("%s: Failed to insert article fixture: %v", name, err)
+			}
+		}
+
+		titles, scores := searchTitles(t, c, "falcons")
+
+		if sameIDs(titles, []string{"The Maltese Falcon", "Briefcase"}) == false || scores[0] <= scores[1] {
+			t.Errorf("%s: Expected the title match to rank first, got %v %v", name, titles, scores)
+		}
+
+		if titles, _ := searchTitles(t, c, "falcon -statuette"); sameIDs(titles, []string{"Briefcase"}) == false {
+			t.Errorf("%s: Expected negated terms to exclude articles, got %v", name, titles)
+		}
+
+		if titles, _ := searchTitles(t, c, `"holds a falcon" briefcase`); sameIDs(titles, []string{"Briefcase"}) == false {
+			t.Errorf("%s: Expected phrases to be required, got %v", name, titles)
+		}
+
+		_, err = c.UpdateOne(
+			context.Background(),
+			bson.M{"itemTitle": "Rosebud"},
+			bson.M{"$set": bson.M{"content": "A falcon carved into a sled."}},
+			&options.UpdateOptions{},
+		)
+
+		if err != nil {
+			t.Fatalf("%s: Failed to update article: %v", name, err)
+		}
+
+		_, err = c.DeleteOne(context.Background(), bson.M{"itemTitle": "Briefcase"}, &options.DeleteOptions{})
+
+		if err != nil {
+			t.Fatalf("%s: Failed to delete article: %v", name, err)
+		}
+
+		if titles, _ := searchTitles(t, c, "falcon"); sameIDs(titles, []string{"The Maltese Falcon", "Rosebud"}) == false {
+			t.Errorf("%s: Expected updates and deletes to be searchable, got %v", name, titles)
+		}
+
+		_, err = db.Collection(AgentsCollection).Find(context.Background(), bson.M{"$text": bson.M{"$search": "falcon"}}, nil)
+
+		if err == nil {
+			t.Errorf("%s: Expected a text search without a text index to fail", name)
+		}
+	}
+}
+
+// fakeIndexDatabase keeps indexes the way MongoDB lists them
+type fakeIndexDatabase struct {
+	Database
+	indexes map[string][]existingIndex
+}
+
+func (d *fakeIndexDatabase) listIndexes(ctx context.Context, collectionName string) ([]existingIndex, error) {
+	return d.indexes[collectionName], nil
+}
+
+func (d *fakeIndexDatabase) createIndex(ctx context.Context, collectionName string, spec IndexSpec) error {
+	e := existingIndex{Name: spec.Name(), Key: spec.Keys, Unique: spec.Unique, Sparse: spec.Sparse}
+
+	if spec.ExpireAfter != nil {
+		seconds := int64(spec.ExpireAfter.Seconds())
+		e.ExpireAfterSeconds = &seconds
+	}
+
+	// text indexes are listed by their weights, every field without one weighs 1
+	if spec.isText() {
+		e.Key = bson.D{{Key: "_fts", Value: "text"}, {Key: "_ftsx", Value: int32(1)}}
+		e.Weights = bson.M{}
+
+		for _, k := range spec.Keys {
+			e.Weights[k.Key] = int32(1)
+		}
+
+		for _, w := range spec.Weights {
+			e.Weights[w.Key] = w.Value
+		}
+	}
+
+	d.indexes[collectionName] = append(d.indexes[collectionName], e)
+
+	return nil
+}
+
+func (d *fakeIndexDatabase) dropIndex(ctx context.Context, collectionName string, name string) error {
+	kept := []existingIndex{}
+
+	for _, e := range d.indexes[collectionName] {
+		if e.Name != name {
+			kept = append(kept, e)
+		}
+	}
+
+	d.indexes[collectionName] = kept
+
+	return nil
+}
+
+func TestReconcileIndexes(t *testing.T) {
+	oneHour := int64(3600)
+	db := &fakeIndexDatabase{
+		Database: NewMemoryDatabase(),
+		indexes: map[string][]existingIndex{
+			TokensCollection: {
+				{Name: "_id_", Key: bson.D{{Key: "_id", Value: int32(1)}}},
+				{Name: "createdAt_1", Key: bson.D{{Key: "createdAt", Value: int32(1)}}, ExpireAfterSeconds: &oneHour},
+				{Name: "lastSeenAt_1", Key: bson.D{{Key: "lastSeenAt", Value: int32(1)}}, ExpireAfterSeconds: &oneHour},
+				{Name: "userID_1", Key: bson.D{{Key: "userID", Value: int32(1)}}},
+				{Name: "legacy_1", Key: bson.D{{Key: "legacy", Value: int32(1)}}},
+			},
+			SitesCollection: {
+				{
+					Name:    "itemTitle_text_content_text",
+					Key:     bson.D{{Key: "_fts", Value: "text"}, {Key: "_ftsx", Value: int32(1)}},
+					Weights: bson.M{"itemTitle": int32(1), "content": int32(1)},
+				},
+			},
+		},
+	}
+
+	defer func(lifetime time.Duration) {
+		env.SessionLifetime = lifetime
+	}(env.SessionLifetime)
+
+	env.SessionLifetime = 90 * time.Minute
+
+	changes, err := PlanIndexes(context.Background(), db, false)
+
+	if err != nil {
+		t.Fatalf("Failed to plan indexes: %v", err)
+	}
+
+	actions := map[string]IndexAction{}
+	for _, c := range changes {
+		actions[c.Collection+"."+c.Index] = c.Action
+	}
+
+	expected := map[string]IndexAction{
+		"tokens.clientTokenHash_1":               IndexCreate,
+		"tokens.lastSeenAt_1":                    IndexRecreate,
+		"tokens.createdAt_1":                     IndexDrop,
+		"tokens.legacy_1":                        IndexUnknown,
+		"agents.userID_1":                        IndexCreate,
+		"macguffins.creator_1_createdAt_1__id_1": IndexCreate,
+		"macguffins.itemTitle_text_content_text": IndexCreate,
+		"sites.itemTitle_text_content_text":      IndexRecreate,
+	}
+
+	for name, action := range expected {
+		if actions[name] != action {
+			t.Errorf("Expected %s to be planned as %s, got %q", name, action, actions[name])
+		}
+	}
+
+	if _, ok := actions["tokens.userID_1"]; ok {
+		t.Errorf("Expected an index matching its spec to be left alone")
+	}
+
+	// decorated databases have the indexes of the database they decorate reconciled
+	_, err = ReconcileIndexes(context.Background(), Instrument(db, NewMetrics(), 0), false)
+
+	if err != nil {
+		t.Fatalf("Failed to reconcile indexes: %v", err)
+	}
+
+	changes, err = PlanIndexes(context.Background(), db, true)
+
+	if err != nil || len(changes) != 1 || changes[0].Index != "legacy_1" || changes[0].Action != IndexDrop {
+		t.Errorf("Expected only the unknown index to be left to drop, got %v: %v", changes, err)
+	}
+
+	changes, err = PlanIndexes(context.Background(), NewMemoryDatabase(), true)
+
+	if err != nil || len(changes) != 0 {
+		t.Errorf("Expected backends that keep their own indexes to need no changes, got %v: %v", changes, err)
+	}
+
+	if ttl := sqliteTTLs()[TokensCollection]; ttl.field != "lastSeenAt" || ttl.expireAfter != 90*time.Minute {
+		t.Errorf("Expected sqlite to expire tokens by the declared TTL index, got %v", ttl)
+	}
+}
+
+func TestMongoConfig(t *testing.T) {
+	opts, dbName, err := MongoConfig{URI: "mongodb://db1:27017,db2:27017/reports?replicaSet=rs0"}.clientOptions()
+
+	if err != nil || dbName != "reports" || len(opts.Hosts) != 2 || opts.ReplicaSet == nil || *opts.ReplicaSet != "rs0" {
+		t.Errorf("Expected the hosts, replica set and database to come from the URI, got %s %v: %v", dbName, opts, err)
+	}
+
+	opts, dbName, err = MongoConfig{
+		URI:         "mongodb://localhost:27017/reports",
+		Database:    "macguffin_staging",
+		Username:    "agent",
+		Password:    "secret",
+		AuthSource:  "users",
+		MaxPoolSize: 20,
+	}.clientOptions()
+
+	if err != nil || dbName != "macguffin_staging" {
+		t.Errorf("Expected the database to override the one in the URI, got %s: %v", dbName, err)
+	}
+
+	if opts.Auth == nil || opts.Auth.Username != "agent" || opts.Auth.AuthSource != "users" {
+		t.Errorf("Expected credentials to be set, got %v", opts.Auth)
+	}
+
+	if opts.MaxPoolSize == nil || *opts.MaxPoolSize != 20 || opts.MinPoolSize != nil {
+		t.Errorf("Expected only the max pool size to be set, got %v %v", opts.MaxPoolSize, opts.MinPoolSize)
+	}
+
+	_, dbName, err = MongoConfig{URI: "mongodb://localhost:27017"}.clientOptions()
+
+	if err != nil || dbName != DefaultMongoDatabase {
+		t.Errorf("Expected the default database when none is named, got %s: %v", dbName, err)
+	}
+
+	_, _, err = MongoConfig{URI: "localhost:27017"}.clientOptions()
+
+	if err == nil {
+		t.Errorf("Expected a URI without a scheme to be rejected")
+	}
+
+	_, _, err = MongoConfig{URI: "mongodb://localhost:27017", TLSCAFile: filepath.Join(os.TempDir(), "missing-ca.pem")}.clientOptions()
+
+	if err == nil {
+		t.Errorf("Expected a missing TLS CA file to be an error")
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	metrics := NewMetrics()
+	db := Instrument(NewMemoryDatabase(), metrics, time.Nanosecond)
+	agents := db.Collection(AgentsCollection)
+
+	out := &strings.Builder{}
+	ctx := context.WithValue(context.Background(), request.LoggerKey, log.New(out, "rid123 ", 0))
+
+	seedAgents(t, agents)
+
+	_ = findUserIDs(t, agents, bson.M{"userID": "github:1"}, &options.FindOptions{})
+
+	if err := agents.FindOne(ctx, bson.M{"userID": "github:9"}, &options.FindOneOptions{}).Err(); err != mongo.ErrNoDocuments {
+		t.Fatalf("Expected no agent to be found, got: %v", err)
+	}
+
+	if _, err := agents.CountDocuments(ctx, bson.M{"userID": bson.M{"$nope": 1}}, &options.CountOptions{}); err == nil {
+		t.Fatalf("Expected an unknown operator to fail")
+	}
+
+	logged := out.String()
+
+	if strings.HasPrefix(logged, "rid123 Slow query: agents.FindOne took ") == false ||
+		strings.Contains(logged, `{"userID":"?"}`) == false ||
+		strings.Contains(logged, "github:9") {
+		t.Errorf("Expected slow queries to be logged with the request id and without their values, got: %s", logged)
+	}
+
+	b := &strings.Builder{}
+	metrics.WriteTo(b)
+	text := b.String()
+
+	for _, line := range []string{
+		`macguffin_db_operation_duration_seconds_count{collection="agents",operation="InsertOne"} 4`,
+		`macguffin_db_operation_duration_seconds_bucket{collection="agents",operation="Find",le="+Inf"} 1`,
+		`macguffin_db_operation_errors_total{collection="agents",operation="FindOne"} 0`,
+		`macguffin_db_operation_errors_total{collection="agents",operation="CountDocuments"} 1`,
+	} {
+		if strings.Contains(text, line+"\n") == false {
+			t.Errorf("Expected metrics to contain %s, got:\n%s", line, text)
+		}
+	}
+}
+
+// flakyDatabase fails operations with a primary step down while failures is above 0
+type flakyDatabase struct {
+	Database
+	failures int
+	calls    int
+}
+
+func (d *flakyDatabase) Collection(collectionName string) Collection {
+	return &flakyCollection{Collection: d.Database.Collection(collectionName), db: d}
+}
+
+type flakyCollection struct {
+	Collection
+	db *flakyDatabase
+}
+
+func (c *flakyCollection) fail() error {
+	c.db.calls++
+
+	if c.db.failures > 0 {
+		c.db.failures--
+		return mongo.CommandError{Code: 10107, Name: "NotMaster", Message: "not master"}
+	}
+
+	return nil
+}
+
+func (c *flakyCollection) CountDocuments(ctx context.Context, filter interface{}, opts *options.CountOptions) (int64, error) {
+	if err := c.fail(); err != nil {
+		return 0, err
+	}
+
+	return c.Collection.CountDocuments(ctx, filter, opts)
+}
+
+func (c *flakyCollection) InsertOne(ctx context.Context, doc interface{}, opts *options.InsertOneOptions) (string, error) {
+	if err := c.fail(); err != nil {
+		return "", err
+	}
+
+	return c.Collection.InsertOne(ctx, doc, opts)
+}
+
+func TestResilient(t *testing.T) {
+	flaky := &flakyDatabase{Database: NewMemoryDatabase()}
+	breaker := NewBreaker(3, 50*time.Millisecond)
+	db := Resilient(flaky, RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}, breaker)
+	agents := db.Collection(AgentsCollection)
+	ctx := context.Background()
+
+	flaky.failures = 2
+
+	if n, err := agents.CountDocuments(ctx, bson.M{}, &options.CountOptions{}); err != nil || n != 0 || flaky.calls != 3 {
+		t.Errorf("Expected a read to succeed on its third attempt, got %d after %d calls: %v", n, flaky.calls, err)
+	}
+
+	flaky.failures, flaky.calls = 1, 0
+
+	if _, err := agents.InsertOne(ctx, bson.M{"userID": "github:1"}, &options.InsertOneOptions{}); isRetryable(err) == false || flaky.calls != 1 {
+		t.Errorf("Expected a write to be attempted once, got %d calls: %v", flaky.calls, err)
+	}
+
+	// a write that succeeds resets the count of failures in a row
+	if _, err := agents.InsertOne(ctx, bson.M{"userID": "github:1"}, &options.InsertOneOptions{}); err != nil {
+		t.Fatalf("Expected a write to succeed once the database is back: %v", err)
+	}
+
+	flaky.failures, flaky.calls = 10, 0
+
+	if _, err := agents.CountDocuments(ctx, bson.M{}, &options.CountOptions{}); isRetryable(err) == false {
+		t.Errorf("Expected the read to fail once it ran out of attempts, got: %v", err)
+	}
+
+	if _, err := agents.CountDocuments(ctx, bson.M{}, &options.CountOptions{}); err != ErrCircuitOpen || flaky.calls != 3 {
+		t.Errorf("Expected the breaker to fail fast after 3 failures in a row, got %d calls: %v", flaky.calls, err)
+	}
+
+	if wait := breaker.RetryAfter(); wait <= 0 || wait > 50*time.Millisecond {
+		t.Errorf("Expected to be told to retry within the cooldown, got %s", wait)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	flaky.failures, flaky.calls = 0, 0
+
+	if breaker.RetryAfter() != 0 {
+		t.Errorf("Expected operations to be let through once the cooldown has passed")
+	}
+
+	if n, err := agents.CountDocuments(ctx, bson.M{}, &options.CountOptions{}); err != nil || n != 1 {
+		t.Errorf("Expected the breaker to let a read through after its cooldown, got %d: %v", n, err)
+	}
+
+	if _, err := agents.CountDocuments(ctx, bson.M{}, &options.CountOptions{}); err != nil || breaker.RetryAfter() != 0 {
+		t.Errorf("Expected the breaker to close once the database answered again: %v", err)
+	}
+}
+
+func TestBreakerHandler(t *testing.T) {
+	flaky := &flakyDatabase{Database: NewMemoryDatabase()}
+	breaker := NewBreaker(1, 50*time.Millisecond)
+	db := Resilient(flaky, RetryPolicy{Attempts: 1}, breaker)
+	agents := db.Collection(AgentsCollection)
+
+	// probe lets the operation of another request through first, as the one finding out whether
+	// the database is back
+	probe := false
+
+	// answers the way the handlers of the server do, with a 500 for any database error
+	handler := breaker.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probe {
+			breaker.allow()
+		}
+
+		n, err := agents.CountDocuments(r.Context(), bson.M{}, &options.CountOptions{})
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprint(n)))
+	}))
+
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(http.MethodGet, "/agents", nil)
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	flaky.failures = 1
+
+	if w := serve(); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected the failure that opens the breaker to be answered by the handler, got %d", w.Code)
+	}
+
+	if w := serve(); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 503 with Retry-After while the breaker is open, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	probe = true
+
+	w := serve()
+
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" || w.Body.String() != "Database unavailable" {
+		t.Errorf("Expected 503 for a request let through while another probes the database, got %d %q: %s", w.Code, w.Header().Get("Retry-After"), w.Body.String())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	breaker.record(nil)
+	probe = false
+
+	if w := serve(); w.Code != http.StatusOK || w.Body.String() != "0" {
+		t.Errorf("Expected requests to be served once the breaker closed, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,89 @@
+package databasetest
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/abradley2/macguffin/lib/database"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const collectionName = "conformance"
+
+func TestMemoryCollection(t *testing.T) {
+	RunCollectionSuite(t, func(t *testing.T) database.Collection {
+		return database.NewMemoryDatabase().Collection(collectionName)
+	})
+}
+
+func TestSQLiteCollection(t *testing.T) {
+	RunCollectionSuite(t, func(t *testing.T) database.Collection {
+		db, err := database.OpenSQLiteDatabase(":memory:")
+
+		if err != nil {
+			t.Fatalf("Failed to open sqlite database: %v", err)
+		}
+
+		return db.Collection(collectionName)
+	})
+}
+
+func TestMemoryDatabase(t *testing.T) {
+	RunDatabaseSuite(t, func(t *testing.T) database.Database {
+		return database.NewMemoryDatabase()
+	})
+}
+
+func TestSQLiteDatabase(t *testing.T) {
+	RunDatabaseSuite(t, func(t *testing.T) database.Database {
+		db, err := database.OpenSQLiteDatabase(":memory:")
+
+		if err != nil {
+			t.Fatalf("Failed to open sqlite database: %v", err)
+		}
+
+		return db
+	})
+}
+
+// TestMongoCollection only runs when MONGO_TEST_URI points at a server it can create databases on
+func TestMongoCollection(t *testing.T) {
+	uri := os.Getenv("MONGO_TEST_URI")
+
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+
+	client, err := mongo.NewClient(options.Client().ApplyURI(uri))
+
+	if err != nil {
+		t.Fatalf("Failed to create mongo client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err = client.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect to %s: %v", uri, err)
+	}
+
+	defer client.Disconnect(context.Background())
+
+	db := client.Database("macguffin_test_" + primitive.NewObjectID().Hex())
+	defer db.Drop(context.Background())
+
+	RunCollectionSuite(t, func(t *testing.T) database.Collection {
+		return database.NewMongoDatabase(db).Collection(collectionName + "_" + primitive.NewObjectID().Hex())
+	})
+
+	RunDatabaseSuite(t, func(t *testing.T) database.Database {
+		mdb := client.Database("macguffin_test_" + primitive.NewObjectID().Hex())
+		t.Cleanup(func() { mdb.Drop(context.Background()) })
+
+		return database.NewMongoDatabase(mdb)
+	})
+}
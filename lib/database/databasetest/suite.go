@@ -0,0 +1,757 @@
+// Package databasetest is a conformance suite for database.Collection implementations. Every
+// backend is expected to behave the way MongoDB does for the queries the server makes
+package databasetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/abradley2/macguffin/lib/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Factory creates a new, empty collection. It is called once for every test in the suite
+type Factory func(t *testing.T) database.Collection
+
+// RunCollectionSuite runs every conformance test against collections made by factory
+func RunCollectionSuite(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, c database.Collection)
+	}{
+		{"InsertOne", testInsertOne},
+		{"Filters", testFilters},
+		{"Sort", testSort},
+		{"EmptyResults", testEmptyResults},
+		{"ErrNoDocuments", testErrNoDocuments},
+		{"CursorIteration", testCursorIteration},
+		{"ContextCancellation", testContextCancellation},
+		{"UpdateOne", testUpdateOne},
+		{"UpdateMany", testUpdateMany},
+		{"FindOneAndUpdate", testFindOneAndUpdate},
+		{"Delete", testDelete},
+		{"CountDocuments", testCountDocuments},
+		{"Aggregate", testAggregate},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, factory(t))
+		})
+	}
+}
+
+// DatabaseFactory creates a new, empty database. It is called once for every test in the
+// database suite
+type DatabaseFactory func(t *testing.T) database.Database
+
+// RunDatabaseSuite runs the conformance tests that depend on the indexes declared in
+// database.CollectionIndexes against databases made by factory
+func RunDatabaseSuite(t *testing.T, factory DatabaseFactory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, db database.Database)
+	}{
+		{"UniqueIndexes", testUniqueIndexes},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			db := factory(t)
+
+			if _, err := database.ReconcileIndexes(context.Background(), db, false); err != nil {
+				t.Fatalf("Failed to create indexes: %v", err)
+			}
+
+			tc.test(t, db)
+		})
+	}
+}
+
+type agent struct {
+	UserID    string    `bson:"userID"`
+	Role      string    `bson:"role,omitempty"`
+	Clearance int       `bson:"clearance"`
+	Tags      []string  `bson:"tags,omitempty"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+var start = time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func seedAgents(t *testing.T, c database.Collection) {
+	agents := []agent{
+		{UserID: "github:1", Role: "admin", Clearance: 5, Tags: []string{"field", "desk"}, CreatedAt: start},
+		{UserID: "github:2", Role: "moderator", Clearance: 3, Tags: []string{"desk"}, CreatedAt: start.Add(time.Hour)},
+		{UserID: "github:3", Clearance: 1, CreatedAt: start.Add(2 * time.Hour)},
+		{UserID: "gitlab:4", Role: "agent", Clearance: 0, Tags: []string{"field"}, CreatedAt: start.Add(3 * time.Hour)},
+	}
+
+	for _, a := range agents {
+		_, err := c.InsertOne(context.Background(), a, &options.InsertOneOptions{})
+
+		if err != nil {
+			t.Fatalf("Failed to insert agent fixture: %v", err)
+		}
+	}
+}
+
+func findUserIDs(t *testing.T, c database.Collection, filter interface{}, opts *options.FindOptions) []string {
+	res, err := c.Find(context.Background(), filter, opts)
+
+	if err != nil {
+		t.Fatalf("Find failed for %v: %v", filter, err)
+	}
+
+	agents := []agent{}
+	err = res.All(context.Background(), &agents)
+
+	if err != nil {
+		t.Fatalf("Failed decoding results for %v: %v", filter, err)
+	}
+
+	ids := []string{}
+	for _, a := range agents {
+		ids = append(ids, a.UserID)
+	}
+
+	return ids
+}
+
+func sameIDs(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func testInsertOne(t *testing.T, c database.Collection) {
+	id, err := c.InsertOne(context.Background(), bson.M{"userID": "github:1"}, &options.InsertOneOptions{})
+
+	if err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+
+	if err != nil {
+		t.Fatalf("Expected an ObjectID to be generated, got: %s", id)
+	}
+
+	res := c.FindOne(context.Background(), bson.M{"_id": objectID}, &options.FindOneOptions{})
+
+	if res.Err() != nil {
+		t.Errorf("Expected inserted document to be found by its _id: %v", res.Err())
+	}
+
+	id, err = c.InsertOne(context.Background(), bson.M{"_id": "agent-2", "userID": "github:2"}, &options.InsertOneOptions{})
+
+	if err != nil || id != "agent-2" {
+		t.Errorf("Expected a string _id to be kept, got %s: %v", id, err)
+	}
+
+	// migration records are inserted with their version as their _id
+	id, err = c.InsertOne(context.Background(), bson.M{"_id": 3, "userID": "github:4"}, &options.InsertOneOptions{})
+
+	if err != nil || id != "3" {
+		t.Errorf("Expected an int _id to be kept, got %s: %v", id, err)
+	}
+
+	_, err = c.InsertOne(context.Background(), bson.M{"_id": objectID, "userID": "github:3"}, &options.InsertOneOptions{})
+
+	if database.IsDuplicateKeyError(err) == false {
+		t.Errorf("Expected a duplicate key error inserting the same _id twice, got: %v", err)
+	}
+
+	if ids := findUserIDs(t, c, bson.M{}, &options.FindOptions{}); sameIDs(ids, []string{"github:1", "github:2", "github:4"}) == false {
+		t.Errorf("Expected the duplicate not to be stored, got: %v", ids)
+	}
+}
+
+func testFilters(t *testing.T, c database.Collection) {
+	seedAgents(t, c)
+
+	cases := []struct {
+		filter   interface{}
+		expected []string
+	}{
+		{bson.M{}, []string{"github:1", "github:2", "github:3", "gitlab:4"}},
+		{bson.M{"userID": "github:2"}, []string{"github:2"}},
+		{bson.M{"userID": bson.M{"$eq": "github:3"}}, []string{"github:3"}},
+		{bson.M{"role": bson.M{"$ne": "admin"}}, []string{"github:2", "github:3", "gitlab:4"}},
+		{bson.M{"role": bson.M{"$in": bson.A{"admin", "moderator"}}}, []string{"github:1", "github:2"}},
+		{bson.M{"role": bson.M{"$nin": bson.A{"admin", "moderator"}}}, []string{"github:3", "gitlab:4"}},
+		{bson.M{"role": bson.M{"$exists": false}}, []string{"github:3"}},
+		{bson.M{"role": nil}, []string{"github:3"}},
+		{bson.M{"clearance": bson.M{"$gt": 1}}, []string{"github:1", "github:2"}},
+		{bson.M{"clearance": bson.M{"$gte": 1, "$lt": 5}}, []string{"github:2", "github:3"}},
+		{bson.M{"clearance": bson.M{"$lte": int64(0)}}, []string{"gitlab:4"}},
+		{bson.M{"createdAt": bson.M{"$gte": start.Add(2 * time.Hour)}}, []string{"github:3", "gitlab:4"}},
+		{bson.M{"tags": "field"}, []string{"github:1", "gitlab:4"}},
+		{bson.M{"tags": bson.M{"$all": bson.A{"field", "desk"}}}, []string{"github:1"}},
+		{bson.M{"tags": bson.M{"$size": 1}}, []string{"github:2", "gitlab:4"}},
+		{bson.M{"userID": bson.M{"$regex": "^github:[12]$"}}, []string{"github:1", "github:2"}},
+		{bson.M{"userID": bson.M{"$regex": "^GITLAB", "$options": "i"}}, []string{"gitlab:4"}},
+		{bson.M{"clearance": bson.M{"$not": bson.M{"$gt": 1}}}, []string{"github:3", "gitlab:4"}},
+		{bson.M{"$or": bson.A{bson.M{"role": "admin"}, bson.M{"clearance": 1}}}, []string{"github:1", "github:3"}},
+		{bson.M{"$and": bson.A{bson.M{"tags": "desk"}, bson.M{"clearance": bson.M{"$lt": 5}}}}, []string{"github:2"}},
+		{bson.M{"$nor": bson.A{bson.M{"tags": "desk"}, bson.M{"role": "agent"}}}, []string{"github:3"}},
+	}
+
+	for _, tc := range cases {
+		ids := findUserIDs(t, c, tc.filter, &options.FindOptions{})
+
+		if sameIDs(ids, tc.expected) == false {
+			t.Errorf("Find(%v) = %v, expected %v", tc.filter, ids, tc.expected)
+		}
+	}
+
+	_, err := c.Find(context.Background(), bson.M{"clearance": bson.M{"$notAnOperator": 1}}, &options.FindOptions{})
+
+	if err == nil {
+		t.Errorf("Expected an unknown query operator to be an error")
+	}
+}
+
+func testSort(t *testing.T, c database.Collection) {
+	seedAgents(t, c)
+
+	ids := findUserIDs(t, c, bson.M{}, options.Find().SetSort(bson.M{"createdAt": -1}))
+
+	if sameIDs(ids, []string{"gitlab:4", "github:3", "github:2", "github:1"}) == false {
+		t.Errorf("Expected agents newest first, got: %v", ids)
+	}
+
+	ids = findUserIDs(t, c, bson.M{}, options.Find().SetSort(bson.D{{Key: "role", Value: 1}, {Key: "clearance", Value: -1}}))
+
+	// a missing field sorts before every string
+	if sameIDs(ids, []string{"github:3", "github:1", "gitlab:4", "github:2"}) == false {
+		t.Errorf("Expected agents sorted by role then clearance, got: %v", ids)
+	}
+
+	ids = findUserIDs(t, c, bson.M{}, options.Find().SetSort(bson.M{"clearance": 1}).SetSkip(1).SetLimit(2))
+
+	if sameIDs(ids, []string{"github:3", "github:2"}) == false {
+		t.Errorf("Expected the second and third lowest clearances, got: %v", ids)
+	}
+
+	res := c.FindOne(context.Background(), bson.M{"tags": "desk"}, options.FindOne().SetSort(bson.M{"clearance": 1}))
+	a := agent{}
+
+	if err := res.Decode(&a); err != nil || a.UserID != "github:2" {
+		t.Errorf("Expected FindOne to respect sort, got: %v %v", a.UserID, err)
+	}
+}
+
+func testEmptyResults(t *testing.T, c database.Collection) {
+	if ids := findUserIDs(t, c, bson.M{}, &options.FindOptions{}); len(ids) != 0 {
+		t.Errorf("Expected an empty collection to have no documents, got: %v", ids)
+	}
+
+	seedAgents(t, c)
+
+	res, err := c.Find(context.Background(), bson.M{"role": "director"}, &options.FindOptions{})
+
+	if err != nil {
+		t.Fatalf("Expected a filter matching nothing not to be an error, got: %v", err)
+	}
+
+	if res.Next(context.Background()) {
+		t.Errorf("Expected a cursor with no results to have no next document")
+	}
+
+	if ids := findUserIDs(t, c, bson.M{"clearance": bson.M{"$gt": 5}}, &options.FindOptions{}); len(ids) != 0 {
+		t.Errorf("Expected no agents above clearance 5, got: %v", ids)
+	}
+}
+
+func testErrNoDocuments(t *testing.T, c database.Collection) {
+	res := c.FindOne(context.Background(), bson.M{"userID": "nobody"}, &options.FindOneOptions{})
+
+	if res.Err() != mongo.ErrNoDocuments {
+		t.Errorf("Expected ErrNoDocuments from an empty collection, got: %v", res.Err())
+	}
+
+	seedAgents(t, c)
+
+	res = c.FindOne(context.Background(), bson.M{"userID": "nobody"}, &options.FindOneOptions{})
+
+	if res.Err() != mongo.ErrNoDocuments {
+		t.Errorf("Expected ErrNoDocuments when nothing matches, got: %v", res.Err())
+	}
+
+	if err := res.Decode(&agent{}); err != mongo.ErrNoDocuments {
+		t.Errorf("Expected Decode to return ErrNoDocuments, got: %v", err)
+	}
+
+	if _, err := res.DecodeBytes(); err != mongo.ErrNoDocuments {
+		t.Errorf("Expected DecodeBytes to return ErrNoDocuments, got: %v", err)
+	}
+}
+
+func testCursorIteration(t *testing.T, c database.Collection) {
+	seedAgents(t, c)
+
+	res, err := c.Find(context.Background(), bson.M{}, options.Find().SetSort(bson.M{"clearance": -1}))
+
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+
+	ids := []string{}
+
+	for res.Next(context.Background()) {
+		a := agent{}
+
+		if err := res.Decode(&a); err != nil {
+			t.Fatalf("Failed to decode the current document: %v", err)
+		}
+
+		ids = append(ids, a.UserID)
+	}
+
+	if sameIDs(ids, []string{"github:1", "github:2", "github:3", "gitlab:4"}) == false {
+		t.Errorf("Expected to iterate agents by clearance, got: %v", ids)
+	}
+
+	if res.Next(context.Background()) {
+		t.Errorf("Expected an exhausted cursor to stay exhausted")
+	}
+
+	res, err = c.Find(context.Background(), bson.M{}, options.Find().SetSort(bson.M{"clearance": 1}))
+
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+
+	if res.Next(context.Background()) == false {
+		t.Fatalf("Expected a first document")
+	}
+
+	rest := []agent{}
+
+	if err := res.All(context.Background(), &rest); err != nil {
+		t.Fatalf("Failed to decode the remaining documents: %v", err)
+	}
+
+	if len(rest) != 3 || rest[0].UserID != "github:3" {
+		t.Errorf("Expected All to decode the documents after the current one, got: %v", rest)
+	}
+}
+
+func testContextCancellation(t *testing.T, c database.Collection) {
+	seedAgents(t, c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := c.Find(ctx, bson.M{}, &options.FindOptions{}); err == nil {
+		t.Errorf("Expected Find with a cancelled context to fail")
+	}
+
+	if res := c.FindOne(ctx, bson.M{}, &options.FindOneOptions{}); res.Err() == nil {
+		t.Errorf("Expected FindOne with a cancelled context to fail")
+	}
+
+	if _, err := c.InsertOne(ctx, bson.M{"userID": "github:5"}, &options.InsertOneOptions{}); err == nil {
+		t.Errorf("Expected InsertOne with a cancelled context to fail")
+	}
+
+	_, err := c.UpdateOne(ctx, bson.M{"userID": "github:1"}, bson.M{"$set": bson.M{"role": "agent"}}, &options.UpdateOptions{})
+
+	if err == nil {
+		t.Errorf("Expected UpdateOne with a cancelled context to fail")
+	}
+
+	if _, err := c.DeleteMany(ctx, bson.M{}, &options.DeleteOptions{}); err == nil {
+		t.Errorf("Expected DeleteMany with a cancelled context to fail")
+	}
+
+	ids := findUserIDs(t, c, bson.M{"role": "admin"}, &options.FindOptions{})
+
+	if sameIDs(ids, []string{"github:1"}) == false {
+		t.Errorf("Expected cancelled operations to leave the collection alone, got admins: %v", ids)
+	}
+
+	if ids := findUserIDs(t, c, bson.M{}, &options.FindOptions{}); len(ids) != 4 {
+		t.Errorf("Expected cancelled operations to leave the collection alone, got: %v", ids)
+	}
+}
+
+func testUpdateOne(t *testing.T, c database.Collection) {
+	seedAgents(t, c)
+
+	res, err := c.UpdateOne(
+		context.Background(),
+		bson.M{"userID": bson.M{"$eq": "github:3"}},
+		bson.M{
+			"$set":   bson.M{"role": "moderator", "profile.bio": "new recruit"},
+			"$inc":   bson.M{"clearance": 2},
+			"$push":  bson.M{"tags": "desk"},
+			"$unset": bson.M{"createdAt": ""},
+		},
+		&options.UpdateOptions{},
+	)
+
+	if err != nil || res.MatchedCount() != 1 || res.ModifiedCount() != 1 {
+		t.Fatalf("Expected one document to be updated, got: %v", err)
+	}
+
+	raw, err := c.FindOne(context.Background(), bson.M{"userID": "github:3"}, &options.FindOneOptions{}).DecodeBytes()
+
+	if err != nil {
+		t.Fatalf("Failed to find updated agent: %v", err)
+	}
+
+	doc := bson.Raw(raw)
+
+	if doc.Lookup("role").StringValue() != "moderator" ||
+		doc.Lookup("clearance").Int32() != 3 ||
+		doc.Lookup("profile", "bio").StringValue() != "new recruit" ||
+		doc.Lookup("tags", "0").StringValue() != "desk" {
+		t.Errorf("Update operators were not applied, got: %s", doc)
+	}
+
+	if _, err := doc.LookupErr("createdAt"); err == nil {
+		t.Errorf("Expected createdAt to be unset, got: %s", doc)
+	}
+
+	res, err = c.UpdateOne(context.Background(), bson.M{"userID": "nobody"}, bson.M{"$set": bson.M{"role": "admin"}}, &options.UpdateOptions{})
+
+	if err != nil || res.MatchedCount() != 0 || res.UpsertedID() != "" {
+		t.Errorf("Expected an update matching nothing to change nothing, got: %v", err)
+	}
+
+	res, err = c.UpdateOne(
+		context.Background(),
+		bson.M{"userID": bson.M{"$eq": "github:9"}},
+		bson.M{"$set": bson.M{"role": "admin"}, "$setOnInsert": bson.M{"clearance": 0}},
+		options.Update().SetUpsert(true),
+	)
+
+	if err != nil || res.MatchedCount() != 0 || res.UpsertedID() == "" {
+		t.Fatalf("Expected upsert to insert a new agent, got: %v", err)
+	}
+
+	ids := findUserIDs(t, c, bson.M{"role": "admin", "clearance": 0}, &options.FindOptions{})
+
+	if sameIDs(ids, []string{"github:9"}) == false {
+		t.Errorf("Expected upserted agent to be built from the filter and update, got: %v", ids)
+	}
+
+	_, err = c.UpdateOne(context.Background(), bson.M{"userID": "github:9"}, bson.M{"role": "agent"}, &options.UpdateOptions{})
+
+	if err == nil {
+		t.Errorf("Expected an update without operators to be an error")
+	}
+
+	_, err = c.UpdateOne(context.Background(), bson.M{"userID": "github:9"}, bson.M{"$set": bson.M{"_id": "other"}}, &options.UpdateOptions{})
+
+	if err == nil {
+		t.Errorf("Expected changing _id to be an error")
+	}
+}
+
+func testDelete(t *testing.T, c database.Collection) {
+	seedAgents(t, c)
+
+	deleted, err := c.DeleteOne(context.Background(), bson.M{"tags": "desk"}, &options.DeleteOptions{})
+
+	if err != nil || deleted != 1 {
+		t.Errorf("Expected DeleteOne to delete one document, got %d: %v", deleted, err)
+	}
+
+	deleted, err = c.DeleteMany(context.Background(), bson.M{"userID": bson.M{"$regex": "^github:"}}, &options.DeleteOptions{})
+
+	if err != nil || deleted != 2 {
+		t.Errorf("Expected DeleteMany to delete the remaining github agents, got %d: %v", deleted, err)
+	}
+
+	if ids := findUserIDs(t, c, bson.M{}, &options.FindOptions{}); sameIDs(ids, []string{"gitlab:4"}) == false {
+		t.Errorf("Expected only the gitlab agent to be left, got: %v", ids)
+	}
+
+	deleted, err = c.DeleteMany(context.Background(), bson.M{"role": "director"}, &options.DeleteOptions{})
+
+	if err != nil || deleted != 0 {
+		t.Errorf("Expected deleting nothing to report 0, got %d: %v", deleted, err)
+	}
+}
+
+func testUpdateMany(t *testing.T, c database.Collection) {
+	seedAgents(t, c)
+
+	for _, expectedModified := range []int64{2, 0} {
+		res, err := c.UpdateMany(context.Background(), bson.M{"tags": "desk"}, bson.M{"$set": bson.M{"reviewed": true}}, &options.UpdateOptions{})
+
+		if err != nil || res.MatchedCount() != 2 || res.ModifiedCount() != expectedModified {
+			t.Errorf("Expected both desk agents to match and %d to be modified, got: %v", expectedModified, err)
+		}
+	}
+
+	if ids := findUserIDs(t, c, bson.M{"reviewed": true}, &options.FindOptions{}); sameIDs(ids, []string{"github:1", "github:2"}) == false {
+		t.Errorf("Expected every matching document to be updated, got: %v", ids)
+	}
+
+	res, err := c.UpdateMany(context.Background(), bson.M{"userID": "github:9"}, bson.M{"$set": bson.M{"role": "agent"}}, options.Update().SetUpsert(true))
+
+	if err != nil || res.MatchedCount() != 0 || res.UpsertedID() == "" {
+		t.Errorf("Expected UpdateMany to upsert when nothing matches, got: %v", err)
+	}
+}
+
+func testFindOneAndUpdate(t *testing.T, c database.Collection) {
+	seedAgents(t, c)
+
+	a := agent{}
+	res := c.FindOneAndUpdate(context.Background(), bson.M{"userID": "github:2"}, bson.M{"$inc": bson.M{"clearance": 1}}, &options.FindOneAndUpdateOptions{})
+
+	if err := res.Decode(&a); err != nil || a.Clearance != 3 {
+		t.Errorf("Expected the document from before the update, got %v: %v", a, err)
+	}
+
+	if ids := findUserIDs(t, c, bson.M{"clearance": 4}, &options.FindOptions{}); sameIDs(ids, []string{"github:2"}) == false {
+		t.Errorf("Expected the update to be stored, got: %v", ids)
+	}
+
+	res = c.FindOneAndUpdate(
+		context.Background(),
+		bson.M{"tags": "desk"},
+		bson.M{"$set": bson.M{"role": "director"}},
+		options.FindOneAndUpdate().SetSort(bson.M{"clearance": -1}).SetReturnDocument(options.After),
+	)
+
+	a = agent{}
+
+	if err := res.Decode(&a); err != nil || a.UserID != "github:1" || a.Role != "director" {
+		t.Errorf("Expected the highest clearance desk agent after the update, got %v: %v", a, err)
+	}
+
+	res = c.FindOneAndUpdate(context.Background(), bson.M{"userID": "nobody"}, bson.M{"$set": bson.M{"role": "agent"}}, &options.FindOneAndUpdateOptions{})
+
+	if res.Err() != mongo.ErrNoDocuments {
+		t.Errorf("Expected ErrNoDocuments when nothing matches, got: %v", res.Err())
+	}
+
+	res = c.FindOneAndUpdate(
+		context.Background(),
+		bson.M{"userID": "github:9"},
+		bson.M{"$set": bson.M{"role": "agent"}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	)
+
+	a = agent{}
+
+	if err := res.Decode(&a); err != nil || a.UserID != "github:9" || a.Role != "agent" {
+		t.Errorf("Expected the upserted document, got %v: %v", a, err)
+	}
+
+	res = c.FindOneAndUpdate(context.Background(), bson.M{"userID": "github:10"}, bson.M{"$set": bson.M{"role": "agent"}}, options.FindOneAndUpdate().SetUpsert(true))
+
+	if res.Err() != mongo.ErrNoDocuments {
+		t.Errorf("Expected an upsert to have no document from before it, got: %v", res.Err())
+	}
+
+	if ids := findUserIDs(t, c, bson.M{"userID": "github:10"}, &options.FindOptions{}); len(ids) != 1 {
+		t.Errorf("Expected the upsert to be stored, got: %v", ids)
+	}
+}
+
+func testCountDocuments(t *testing.T, c database.Collection) {
+	seedAgents(t, c)
+
+	cases := []struct {
+		filter   interface{}
+		opts     *options.CountOptions
+		expected int64
+	}{
+		{bson.M{}, &options.CountOptions{}, 4},
+		{bson.M{"tags": "desk"}, &options.CountOptions{}, 2},
+		{bson.M{"tags": "desk"}, options.Count().SetSkip(1), 1},
+		{bson.M{}, options.Count().SetLimit(3), 3},
+		{bson.M{"role": "director"}, &options.CountOptions{}, 0},
+	}
+
+	for _, tc := range cases {
+		n, err := c.CountDocuments(context.Background(), tc.filter, tc.opts)
+
+		if err != nil || n != tc.expected {
+			t.Errorf("CountDocuments(%v) = %d, expected %d: %v", tc.filter, n, tc.expected, err)
+		}
+	}
+}
+
+func testAggregate(t *testing.T, c database.Collection) {
+	seedAgents(t, c)
+
+	type tagStats struct {
+		Tag       string   `bson:"_id"`
+		Agents    int      `bson:"agents"`
+		Clearance int      `bson:"clearance"`
+		UserIDs   []string `bson:"userIDs"`
+	}
+
+	res, err := c.Aggregate(context.Background(), mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "clearance", Value: bson.D{{Key: "$gte", Value: 1}}}}}},
+		{{Key: "$unwind", Value: "$tags"}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$tags"},
+			{Key: "agents", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "clearance", Value: bson.D{{Key: "$max", Value: "$clearance"}}},
+			{Key: "userIDs", Value: bson.D{{Key: "$push", Value: "$userID"}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}, &options.AggregateOptions{})
+
+	if err != nil {
+		t.Fatalf("Aggregate failed: %v", err)
+	}
+
+	stats := []tagStats{}
+
+	if err := res.All(context.Background(), &stats); err != nil {
+		t.Fatalf("Failed decoding aggregate results: %v", err)
+	}
+
+	if len(stats) != 2 ||
+		stats[0].Tag != "desk" || stats[0].Agents != 2 || stats[0].Clearance != 5 || sameIDs(stats[0].UserIDs, []string{"github:1", "github:2"}) == false ||
+		stats[1].Tag != "field" || stats[1].Agents != 1 || sameIDs(stats[1].UserIDs, []string{"github:1"}) == false {
+		t.Errorf("Unexpected tag stats: %v", stats)
+	}
+
+	res, err = c.Aggregate(context.Background(), bson.A{
+		bson.M{"$match": bson.M{"role": bson.M{"$exists": true}}},
+		bson.M{"$count": "agents"},
+	}, &options.AggregateOptions{})
+
+	if err != nil {
+		t.Fatalf("Aggregate failed: %v", err)
+	}
+
+	counts := []struct {
+		Agents int `bson:"agents"`
+	}{}
+
+	if err := res.All(context.Background(), &counts); err != nil || len(counts) != 1 || counts[0].Agents != 3 {
+		t.Errorf("Expected $count to count the agents with a role, got %v: %v", counts, err)
+	}
+
+	_, err = c.Aggregate(context.Background(), bson.A{bson.M{"$notAStage": bson.M{}}}, &options.AggregateOptions{})
+
+	if err == nil {
+		t.Errorf("Expected an unknown pipeline stage to be an error")
+	}
+}
+
+func testUniqueIndexes(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	agents := db.Collection(database.AgentsCollection)
+
+	insert := func(c database.Collection, doc bson.M) error {
+		_, err := c.InsertOne(ctx, doc, &options.InsertOneOptions{})
+		return err
+	}
+
+	if err := insert(agents, bson.M{"userID": "github:1", "publicAgentID": "agent-1"}); err != nil {
+		t.Fatalf("Failed to insert agent: %v", err)
+	}
+
+	if err := insert(agents, bson.M{"userID": "github:1"}); database.IsDuplicateKeyError(err) == false {
+		t.Errorf("Expected a duplicate key error inserting the same userID twice, got: %v", err)
+	}
+
+	// a sparse index holds any number of documents without its fields
+	for _, userID := range []string{"github:2", "github:3"} {
+		if err := insert(agents, bson.M{"userID": userID}); err != nil {
+			t.Errorf("Expected agents without a publicAgentID to be inserted, got: %v", err)
+		}
+	}
+
+	if err := insert(agents, bson.M{"userID": "github:4", "publicAgentID": "agent-1"}); database.IsDuplicateKeyError(err) == false {
+		t.Errorf("Expected a duplicate key error inserting the same publicAgentID twice, got: %v", err)
+	}
+
+	_, err := agents.UpdateOne(
+		ctx,
+		bson.M{"userID": "github:2"},
+		bson.M{"$set": bson.M{"userID": "github:1"}},
+		&options.UpdateOptions{},
+	)
+
+	if database.IsDuplicateKeyError(err) == false {
+		t.Errorf("Expected a duplicate key error updating to a taken userID, got: %v", err)
+	}
+
+	upsert := true
+	_, err = agents.UpdateOne(
+		ctx,
+		bson.M{"userID": "github:5"},
+		bson.M{"$set": bson.M{"publicAgentID": "agent-1"}},
+		&options.UpdateOptions{Upsert: &upsert},
+	)
+
+	if database.IsDuplicateKeyError(err) == false {
+		t.Errorf("Expected a duplicate key error upserting a taken publicAgentID, got: %v", err)
+	}
+
+	_, err = agents.UpdateMany(
+		ctx,
+		bson.M{"publicAgentID": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"publicAgentID": "agent-2"}},
+		&options.UpdateOptions{},
+	)
+
+	if database.IsDuplicateKeyError(err) == false {
+		t.Errorf("Expected a duplicate key error giving several agents the same publicAgentID, got: %v", err)
+	}
+
+	res := agents.FindOneAndUpdate(
+		ctx,
+		bson.M{"userID": "github:3"},
+		bson.M{"$set": bson.M{"publicAgentID": "agent-1"}},
+		&options.FindOneAndUpdateOptions{},
+	)
+
+	if database.IsDuplicateKeyError(res.Err()) == false {
+		t.Errorf("Expected a duplicate key error from FindOneAndUpdate to a taken publicAgentID, got: %v", res.Err())
+	}
+
+	if ids := findUserIDs(t, agents, bson.M{"userID": "github:1"}, &options.FindOptions{}); len(ids) != 1 {
+		t.Errorf("Expected only one agent with the userID, got: %v", ids)
+	}
+
+	if ids := findUserIDs(t, agents, bson.M{"publicAgentID": "agent-1"}, &options.FindOptions{}); len(ids) != 1 {
+		t.Errorf("Expected only one agent with the publicAgentID, got: %v", ids)
+	}
+
+	// only the combination of the fields of a compound index has to be unique
+	revisions := db.Collection(database.RevisionsCollection)
+
+	for _, rev := range []bson.M{
+		{"articleID": "a", "revision": 1},
+		{"articleID": "a", "revision": 2},
+		{"articleID": "b", "revision": 1},
+	} {
+		if err := insert(revisions, rev); err != nil {
+			t.Errorf("Expected revision %v to be inserted, got: %v", rev, err)
+		}
+	}
+
+	if err := insert(revisions, bson.M{"articleID": "a", "revision": int64(2)}); database.IsDuplicateKeyError(err) == false {
+		t.Errorf("Expected a duplicate key error inserting the same revision twice, got: %v", err)
+	}
+}
@@ -0,0 +1,799 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// normalize marshals a document, filter, update or sort into a bson.D, so that structs,
+// bson.M and bson.D values can all be inspected the same way they would be by MongoDB
+func normalize(v interface{}) (bson.D, error) {
+	d := bson.D{}
+
+	if v == nil {
+		return d, nil
+	}
+
+	b, err := bson.Marshal(v)
+
+	if err != nil {
+		return d, errors.Wrap(err, "Failed to marshal document")
+	}
+
+	err = bson.Unmarshal(b, &d)
+
+	if err != nil {
+		return d, errors.Wrap(err, "Failed to unmarshal document")
+	}
+
+	return d, err
+}
+
+// lookup finds every value at a dotted path. Arrays along the path are searched element by
+// element the way MongoDB does, and an array at the end of the path is returned followed by
+// each of its elements. A missing path returns no values
+func lookup(v interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		if arr, ok := v.(primitive.A); ok {
+			return append([]interface{}{arr}, arr...)
+		}
+		return []interface{}{v}
+	}
+
+	switch t := v.(type) {
+	case primitive.D:
+		for _, e := range t {
+			if e.Key == path[0] {
+				return lookup(e.Value, path[1:])
+			}
+		}
+	case primitive.A:
+		if i, err := strconv.Atoi(path[0]); err == nil {
+			if i >= 0 && i < len(t) {
+				return lookup(t[i], path[1:])
+			}
+			return nil
+		}
+
+		var found []interface{}
+		for _, el := range t {
+			if _, ok := el.(primitive.D); ok {
+				found = append(found, lookup(el, path)...)
+			}
+		}
+		return found
+	}
+
+	return nil
+}
+
+func splitPath(key string) []string {
+	return strings.Split(key, ".")
+}
+
+// isOperatorDocument whether a value is a document of query operators, like {"$gt": 1}
+func isOperatorDocument(v interface{}) bool {
+	d, ok := v.(primitive.D)
+
+	return ok && len(d) > 0 && strings.HasPrefix(d[0].Key, "$")
+}
+
+// matchFilter reports whether a document matches a MongoDB query filter
+func matchFilter(doc primitive.D, filter primitive.D) (bool, error) {
+	for _, e := range filter {
+		var (
+			matched bool
+			err     error
+		)
+
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			matched, err = matchLogical(doc, e.Key, e.Value)
+		default:
+			if strings.HasPrefix(e.Key, "$") {
+				return false, fmt.Errorf("Unsupported query operator: %s", e.Key)
+			}
+			matched, err = matchField(lookup(doc, splitPath(e.Key)), e.Value)
+		}
+
+		if err != nil || matched == false {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func matchLogical(doc primitive.D, op string, clauses interface{}) (bool, error) {
+	arr, ok := clauses.(primitive.A)
+
+	if ok == false || len(arr) == 0 {
+		return false, fmt.Errorf("%s must be a nonempty array", op)
+	}
+
+	for _, clause := range arr {
+		sub, ok := clause.(primitive.D)
+
+		if ok == false {
+			return false, fmt.Errorf("%s entries must be documents", op)
+		}
+
+		matched, err := matchFilter(doc, sub)
+
+		if err != nil {
+			return false, err
+		}
+
+		switch {
+		case op == "$and" && matched == false:
+			return false, nil
+		case op == "$or" && matched:
+			return true, nil
+		case op == "$nor" && matched:
+			return false, nil
+		}
+	}
+
+	return op != "$or", nil
+}
+
+// matchField checks the values found at a path against either a plain value or a document of operators
+func matchField(values []interface{}, cond interface{}) (bool, error) {
+	if isOperatorDocument(cond) == false {
+		if re, ok := cond.(primitive.Regex); ok {
+			return matchRegex(values, re.Pattern, re.Options)
+		}
+		return matchEq(values, cond), nil
+	}
+
+	ops := cond.(primitive.D)
+
+	for _, op := range ops {
+		matched, err := matchOperator(values, op.Key, op.Value, ops)
+
+		if err != nil || matched == false {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func matchOperator(values []interface{}, op string, arg interface{}, ops primitive.D) (bool, error) {
+	switch op {
+	case "$eq":
+		return matchEq(values, arg), nil
+
+	case "$ne":
+		return matchEq(values, arg) == false, nil
+
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, v := range values {
+			c, ok := compareValues(v, arg)
+
+			if ok == false {
+				continue
+			}
+
+			if (op == "$gt" && c > 0) || (op == "$gte" && c >= 0) || (op == "$lt" && c < 0) || (op == "$lte" && c <= 0) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "$in", "$nin":
+		arr, ok := arg.(primitive.A)
+
+		if ok == false {
+			return false, fmt.Errorf("%s needs an array", op)
+		}
+
+		in := false
+		for _, el := range arr {
+			if matchEq(values, el) {
+				in = true
+				break
+			}
+		}
+		return in == (op == "$in"), nil
+
+	case "$exists":
+		return (len(values) > 0) == truthy(arg), nil
+
+	case "$regex":
+		var options string
+		for _, o := range ops {
+			if o.Key == "$options" {
+				options, _ = o.Value.(string)
+			}
+		}
+
+		switch re := arg.(type) {
+		case string:
+			return matchRegex(values, re, options)
+		case primitive.Regex:
+			return matchRegex(values, re.Pattern, re.Options+options)
+		}
+		return false, fmt.Errorf("$regex needs a string")
+
+	case "$options":
+		// read along with $regex
+		return true, nil
+
+	case "$not":
+		matched, err := matchField(values, arg)
+		return matched == false, err
+
+	case "$size":
+		size, ok := toFloat(arg)
+
+		if ok == false {
+			return false, fmt.Errorf("$size needs a number")
+		}
+
+		for _, v := range values {
+			if arr, ok := v.(primitive.A); ok && float64(len(arr)) == size {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "$all":
+		arr, ok := arg.(primitive.A)
+
+		if ok == false {
+			return false, fmt.Errorf("$all needs an array")
+		}
+
+		for _, el := range arr {
+			if matchEq(values, el) == false {
+				return false, nil
+			}
+		}
+		return len(arr) > 0, nil
+
+	case "$elemMatch":
+		cond, ok := arg.(primitive.D)
+
+		if ok == false {
+			return false, fmt.Errorf("$elemMatch needs a document")
+		}
+
+		for _, v := range values {
+			arr, ok := v.(primitive.A)
+
+			if ok == false {
+				continue
+			}
+
+			for _, el := range arr {
+				var (
+					matched bool
+					err     error
+				)
+
+				if isOperatorDocument(cond) {
+					matched, err = matchField([]interface{}{el}, cond)
+				} else if sub, ok := el.(primitive.D); ok {
+					matched, err = matchFilter(sub, cond)
+				}
+
+				if err != nil {
+					return false, err
+				}
+
+				if matched {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+
+	return false, fmt.Errorf("Unsupported query operator: %s", op)
+}
+
+// matchEq equality as MongoDB does it, where null also matches a missing field
+func matchEq(values []interface{}, target interface{}) bool {
+	if target == nil && len(values) == 0 {
+		return true
+	}
+
+	for _, v := range values {
+		if valuesEqual(v, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchRegex(values []interface{}, pattern string, options string) (bool, error) {
+	flags := ""
+	for _, o := range options {
+		if strings.ContainsRune("ims", o) {
+			flags += string(o)
+		}
+	}
+
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+
+	re, err := regexp.Compile(pattern)
+
+	if err != nil {
+		return false, errors.Wrap(err, "Invalid $regex")
+	}
+
+	for _, v := range values {
+		if s, ok := v.(string); ok && re.MatchString(s) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	}
+
+	if f, ok := toFloat(v); ok {
+		return f != 0
+	}
+
+	return true
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case int:
+		return float64(t), true
+	case float64:
+		return t, true
+	}
+
+	return 0, false
+}
+
+// valuesEqual equality of two normalized values. Numbers of different types are equal when
+// their values are, and documents are only equal when their fields are in the same order
+func valuesEqual(a interface{}, b interface{}) bool {
+	switch at := a.(type) {
+	case primitive.D:
+		bt, ok := b.(primitive.D)
+
+		if ok == false || len(at) != len(bt) {
+			return false
+		}
+
+		for i := range at {
+			if at[i].Key != bt[i].Key || valuesEqual(at[i].Value, bt[i].Value) == false {
+				return false
+			}
+		}
+		return true
+
+	case primitive.A:
+		bt, ok := b.(primitive.A)
+
+		if ok == false || len(at) != len(bt) {
+			return false
+		}
+
+		for i := range at {
+			if valuesEqual(at[i], bt[i]) == false {
+				return false
+			}
+		}
+		return true
+	}
+
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// compareValues orders two values of the same kind, it reports false if they can't be compared
+func compareValues(a interface{}, b interface{}) (int, bool) {
+	if af, ok := toFloat(a); ok {
+		bf, ok := toFloat(b)
+
+		if ok == false {
+			return 0, false
+		}
+
+		switch {
+		case af < bf:
+			return -1, true
+		case af > bf:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch at := a.(type) {
+	case nil:
+		return 0, b == nil
+	case string:
+		if bt, ok := b.(string); ok {
+			return strings.Compare(at, bt), true
+		}
+	case bool:
+		if bt, ok := b.(bool); ok {
+			switch {
+			case at == bt:
+				return 0, true
+			case bt:
+				return -1, true
+			}
+			return 1, true
+		}
+	case primitive.ObjectID:
+		if bt, ok := b.(primitive.ObjectID); ok {
+			return bytes.Compare(at[:], bt[:]), true
+		}
+	case primitive.DateTime:
+		if bt, ok := b.(primitive.DateTime); ok {
+			switch {
+			case at < bt:
+				return -1, true
+			case at > bt:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+
+	return 0, false
+}
+
+// typeRank the order MongoDB sorts values of different types in
+func typeRank(v interface{}) int {
+	if _, ok := toFloat(v); ok {
+		return 2
+	}
+
+	switch v.(type) {
+	case nil:
+		return 1
+	case string:
+		return 3
+	case primitive.D:
+		return 4
+	case primitive.A:
+		return 5
+	case primitive.Binary:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime:
+		return 9
+	}
+
+	return 10
+}
+
+func compareForSort(a interface{}, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+
+	if ra != rb {
+		return ra - rb
+	}
+
+	c, _ := compareValues(a, b)
+
+	return c
+}
+
+func sortKey(doc primitive.D, path []string) interface{} {
+	values := lookup(doc, path)
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	return values[0]
+}
+
+// documentOrder compiles a MongoDB sort specification such as {"createdAt": -1} into a less function
+func documentOrder(spec interface{}) (func(a primitive.D, b primitive.D) bool, error) {
+	s, err := normalize(spec)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid sort")
+	}
+
+	type sortField struct {
+		path []string
+		dir  int
+	}
+
+	fields := []sortField{}
+
+	for _, e := range s {
+		dir, ok := toFloat(e.Value)
+
+		if ok == false || dir == 0 {
+			return nil, fmt.Errorf("Unsupported sort direction for %s: %v", e.Key, e.Value)
+		}
+
+		f := sortField{path: splitPath(e.Key), dir: 1}
+		if dir < 0 {
+			f.dir = -1
+		}
+
+		fields = append(fields, f)
+	}
+
+	return func(a primitive.D, b primitive.D) bool {
+		for _, f := range fields {
+			c := compareForSort(sortKey(a, f.path), sortKey(b, f.path))
+
+			if c != 0 {
+				return c*f.dir < 0
+			}
+		}
+		return false
+	}, nil
+}
+
+// sortDocuments sorts documents in place by a MongoDB sort specification
+func sortDocuments(docs []primitive.D, spec interface{}) error {
+	less, err := documentOrder(spec)
+
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		return less(docs[i], docs[j])
+	})
+
+	return nil
+}
+
+// applyProjection keeps or removes top level fields of a document. _id is kept unless it is excluded
+func applyProjection(doc primitive.D, spec interface{}) (primitive.D, error) {
+	p, err := normalize(spec)
+
+	if err != nil || len(p) == 0 {
+		return doc, errors.Wrap(err, "Invalid projection")
+	}
+
+	fields := map[string]bool{}
+	include := false
+
+	for _, e := range p {
+		fields[e.Key] = truthy(e.Value)
+
+		if e.Key != "_id" && truthy(e.Value) {
+			include = true
+		}
+	}
+
+	projected := primitive.D{}
+
+	for _, e := range doc {
+		keep, listed := fields[e.Key]
+
+		switch {
+		case e.Key == "_id" && listed == false:
+			keep = true
+		case listed == false:
+			keep = include == false
+		}
+
+		if keep {
+			projected = append(projected, e)
+		}
+	}
+
+	return projected, nil
+}
+
+// textScoreSpecs rewrites the sort and projection of a find for the text score, which is put in
+// the fields they ask for it in. A text score sorts highest first, and is only kept in the results
+// when the projection asks for it
+func textScoreSpecs(opts *options.FindOptions) (fields []string, sortSpec primitive.D, projection primitive.D, strip []string, err error) {
+	sortFields, _, err := textScoreFields(opts.Sort)
+
+	if err != nil {
+		return nil, nil, nil, nil, errors.Wrap(err, "Invalid sort")
+	}
+
+	projFields, projRest, err := textScoreFields(opts.Projection)
+
+	if err != nil {
+		return nil, nil, nil, nil, errors.Wrap(err, "Invalid projection")
+	}
+
+	projected := map[string]bool{}
+	for _, f := range projFields {
+		projected[f] = true
+	}
+
+	fields = append(fields, projFields...)
+
+	for _, f := range sortFields {
+		if projected[f] == false {
+			fields = append(fields, f)
+			strip = append(strip, f)
+		}
+	}
+
+	if opts.Sort != nil {
+		s, _ := normalize(opts.Sort)
+
+		for _, e := range s {
+			if isTextScore(e.Value) {
+				e = primitive.E{Key: e.Key, Value: int32(-1)}
+			}
+
+			sortSpec = append(sortSpec, e)
+		}
+	}
+
+	// a projection of only text scores keeps every other field
+	include := false
+	for _, e := range projRest {
+		include = include || (e.Key != "_id" && truthy(e.Value))
+	}
+
+	projection = projRest
+
+	if include {
+		for _, f := range projFields {
+			projection = append(projection, primitive.E{Key: f, Value: int32(1)})
+		}
+	}
+
+	return fields, sortSpec, projection, strip, nil
+}
+
+// queryDocuments runs a find over candidate documents of a collection, filtering, sorting,
+// skipping, limiting and projecting them the way MongoDB would. A $text condition is scored
+// against the text index the collection has in CollectionIndexes
+func queryDocuments(collectionName string, candidates []primitive.D, filter interface{}, opts *options.FindOptions) ([]bson.Raw, error) {
+	f, err := normalize(filter)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid filter")
+	}
+
+	text, f, err := textSearch(f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if opts == nil {
+		opts = &options.FindOptions{}
+	}
+
+	scoreFields, sortSpec, projection, strip, err := textScoreSpecs(opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	weights := textWeights(collectionName)
+
+	if (text != nil || len(scoreFields) > 0) && weights == nil {
+		return nil, fmt.Errorf("text index required for $text query on %s", collectionName)
+	}
+
+	if text == nil && len(scoreFields) > 0 {
+		return nil, fmt.Errorf("$meta textScore needs a $text query")
+	}
+
+	docs := []primitive.D{}
+
+	for _, doc := range candidates {
+		matched, err := matchFilter(doc, f)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if matched && text != nil {
+			score := textScore(doc, weights, *text)
+			matched = score > 0
+			doc = withTextScore(doc, score, scoreFields)
+		}
+
+		if matched {
+			docs = append(docs, doc)
+		}
+	}
+
+	if sortSpec != nil {
+		err = sortDocuments(docs, sortSpec)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Skip != nil {
+		skip := int(*opts.Skip)
+
+		if skip > len(docs) {
+			skip = len(docs)
+		}
+
+		docs = docs[skip:]
+	}
+
+	if opts.Limit != nil && *opts.Limit != 0 {
+		limit := int(*opts.Limit)
+
+		// a negative limit means the same as a positive one, in a single batch
+		if limit < 0 {
+			limit = -limit
+		}
+
+		if limit < len(docs) {
+			docs = docs[:limit]
+		}
+	}
+
+	results := make([]bson.Raw, 0, len(docs))
+
+	for _, doc := range docs {
+		if len(strip) > 0 {
+			doc, _ = applyProjection(doc, textScoreExclusion(strip))
+		}
+
+		if len(projection) > 0 {
+			doc, err = applyProjection(doc, projection)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		raw, err := marshalDocument(doc)
+
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, raw)
+	}
+
+	return results, nil
+}
+
+func textScoreExclusion(fields []string) primitive.D {
+	exclude := primitive.D{}
+
+	for _, f := range fields {
+		exclude = append(exclude, primitive.E{Key: f, Value: int32(0)})
+	}
+
+	return exclude
+}
@@ -2,29 +2,398 @@ package database
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/abradley2/macguffin/lib/env"
+	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func setupTokenIndexes(db *mongo.Database) {
-	tc := db.Collection(TokensCollection, nil)
+// IndexSpec an index a collection should have
+type IndexSpec struct {
+	// Keys the indexed fields in order, 1 for ascending and -1 for descending
+	Keys   bson.D
+	Unique bool
+	// Sparse leaves out documents without the indexed fields, so a unique index allows any number of them
+	Sparse bool
+	// ExpireAfter makes this a TTL index on a date field, documents are deleted this long after that date
+	ExpireAfter *time.Duration
+	// Weights how much each field of a text index counts towards the score, 1 for fields left out
+	Weights bson.D
+}
+
+// isText whether this is a text index, which has "text" for the value of its keys
+func (s IndexSpec) isText() bool {
+	for _, k := range s.Keys {
+		if k.Value == "text" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Name the name MongoDB gives an index on these keys when none is set, such as "createdAt_-1"
+func (s IndexSpec) Name() string {
+	parts := []string{}
+
+	for _, k := range s.Keys {
+		parts = append(parts, fmt.Sprintf("%s_%v", k.Key, k.Value))
+	}
+
+	return strings.Join(parts, "_")
+}
+
+func expireAfter(d time.Duration) *time.Duration {
+	return &d
+}
+
+func ascending(fields ...string) bson.D {
+	keys := bson.D{}
+
+	for _, f := range fields {
+		keys = append(keys, bson.E{Key: f, Value: int32(1)})
+	}
+
+	return keys
+}
+
+// CollectionIndexes the indexes every collection should have, by collection name. Collections
+// without an entry only need the _id index
+func CollectionIndexes() map[string][]IndexSpec {
+	articleIndexes := []IndexSpec{
+		// the article list of each type, for agents who can only see approved articles. Pages of
+		// the list are ordered by createdAt and then _id
+		{Keys: ascending("articleType", "approved", "createdAt", "_id")},
+		// an agent's own articles and the public list of their approved ones
+		{Keys: ascending("creator", "createdAt", "_id")},
+		// the moderation queue
+		{Keys: ascending("approved", "rejected", "createdAt")},
+		// searching articles, a match in the title counts for more than one in the content
+		{
+			Keys:    bson.D{{Key: "itemTitle", Value: "text"}, {Key: "content", Value: "text"}},
+			Weights: bson.D{{Key: "itemTitle", Value: int32(10)}, {Key: "content", Value: int32(1)}},
+		},
+	}
+
+	return map[string][]IndexSpec{
+		TokensCollection: {
+			{Keys: ascending("clientTokenHash"), Unique: true},
+			// logging out of every session looks tokens up by the agent they belong to
+			{Keys: ascending("userID")},
+			{Keys: ascending("familyID")},
+			// sessions expire once they have gone unused for the session lifetime
+			{Keys: ascending("lastSeenAt"), ExpireAfter: expireAfter(env.SessionLifetime)},
+		},
+		RefreshTokensCollection: {
+			{Keys: ascending("tokenHash"), Unique: true},
+			{Keys: ascending("familyID")},
+			{Keys: ascending("expiresAt"), ExpireAfter: expireAfter(0)},
+		},
+		LoginStatesCollection: {
+			{Keys: ascending("expiresAt"), ExpireAfter: expireAfter(0)},
+		},
+		AgentsCollection: {
+			{Keys: ascending("userID"), Unique: true},
+			// agents created before public ids existed don't have one until they are migrated
+			{Keys: ascending("publicAgentID"), Unique: true, Sparse: true},
+		},
+		ProfileCollection: {
+			{Keys: ascending("userID"), Unique: true},
+		},
+		// two edits saved at once can't both become the next revision
+		RevisionsCollection: {
+			{Keys: ascending("articleID", "revision"), Unique: true},
+		},
+		MacguffinsCollection: articleIndexes,
+		SitesCollection:      articleIndexes,
+		EventsCollection:     articleIndexes,
+	}
+}
+
+// retiredIndexes indexes that are always dropped, because keeping them would change behaviour
+var retiredIndexes = map[string][]string{
+	// sessions used to expire a fixed hour after they were created
+	TokensCollection: {"createdAt_1"},
+	// replaced by the same indexes with _id added, which pages of articles are also ordered by
+	MacguffinsCollection: retiredArticleIndexes,
+	SitesCollection:      retiredArticleIndexes,
+	EventsCollection:     retiredArticleIndexes,
+}
+
+var retiredArticleIndexes = []string{"articleType_1_approved_1_createdAt_1", "creator_1_createdAt_1"}
+
+// IndexAction what reconciling does about one index
+type IndexAction string
+
+const (
+	// IndexCreate a declared index that doesn't exist yet
+	IndexCreate IndexAction = "create"
+	// IndexRecreate a declared index that exists with different keys or options
+	IndexRecreate IndexAction = "recreate"
+	// IndexDrop a retired index, or an index that isn't declared when unknown indexes are dropped
+	IndexDrop IndexAction = "drop"
+	// IndexUnknown an index that isn't declared, which is only reported
+	IndexUnknown IndexAction = "unknown"
+)
+
+// IndexChange one difference between the declared indexes of a collection and the ones it has
+type IndexChange struct {
+	Collection string
+	Index      string
+	Action     IndexAction
+	// Reason what differs, for recreated indexes
+	Reason string
+	spec   IndexSpec
+}
+
+func (c IndexChange) String() string {
+	s := fmt.Sprintf("%s %s.%s", c.Action, c.Collection, c.Index)
+
+	if c.Reason != "" {
+		s = s + ": " + c.Reason
+	}
+
+	return s
+}
+
+// existingIndex an index as MongoDB lists it
+type existingIndex struct {
+	Name               string `bson:"name"`
+	Key                bson.D `bson:"key"`
+	Unique             bool   `bson:"unique"`
+	Sparse             bool   `bson:"sparse"`
+	ExpireAfterSeconds *int64 `bson:"expireAfterSeconds"`
+	// Weights of a text index, whose key is always {_fts: "text", _ftsx: 1}
+	Weights bson.M `bson:"weights"`
+}
+
+// indexer a database that keeps the indexes it is told to. The memory and sqlite backends keep
+// their own, and only read the TTLs of CollectionIndexes
+type indexer interface {
+	listIndexes(ctx context.Context, collectionName string) ([]existingIndex, error)
+	createIndex(ctx context.Context, collectionName string, spec IndexSpec) error
+	dropIndex(ctx context.Context, collectionName string, name string) error
+}
+
+// drift how an existing index differs from its spec, empty if it doesn't
+func drift(existing existingIndex, spec IndexSpec) string {
+	if spec.isText() {
+		return textDrift(existing, spec)
+	}
+
+	keys, err := normalize(spec.Keys)
+
+	if err != nil || valuesEqual(primitive.D(existing.Key), keys) == false {
+		return fmt.Sprintf("keys %v, declared %v", existing.Key, spec.Keys)
+	}
+
+	if existing.Unique != spec.Unique {
+		return fmt.Sprintf("unique %t, declared %t", existing.Unique, spec.Unique)
+	}
+
+	if existing.Sparse != spec.Sparse {
+		return fmt.Sprintf("sparse %t, declared %t", existing.Sparse, spec.Sparse)
+	}
+
+	switch {
+	case existing.ExpireAfterSeconds == nil && spec.ExpireAfter == nil:
+		return ""
+	case existing.ExpireAfterSeconds == nil:
+		return fmt.Sprintf("no TTL, declared %s", *spec.ExpireAfter)
+	case spec.ExpireAfter == nil:
+		return fmt.Sprintf("TTL %ds, declared none", *existing.ExpireAfterSeconds)
+	case *existing.ExpireAfterSeconds != int64(spec.ExpireAfter.Seconds()):
+		return fmt.Sprintf("TTL %ds, declared %s", *existing.ExpireAfterSeconds, *spec.ExpireAfter)
+	}
+
+	return ""
+}
 
-	exp := int32(3600)
-	bg := true
-	v := int32(1)
+// textDrift how an existing text index differs from its spec. The fields of a text index are only
+// listed in its weights
+func textDrift(existing existingIndex, spec IndexSpec) string {
+	declared := map[string]float64{}
 
-	tc.Indexes().CreateOne(
-		context.Background(),
+	for _, k := range spec.Keys {
+		declared[k.Key] = 1
+	}
+
+	for _, w := range spec.Weights {
+		declared[w.Key], _ = toFloat(w.Value)
+	}
+
+	differs := len(existing.Weights) != len(declared)
+
+	for field, w := range existing.Weights {
+		weight, ok := toFloat(w)
+		differs = differs || ok == false || weight != declared[field]
+	}
+
+	if differs {
+		return fmt.Sprintf("weights %v, declared %v", existing.Weights, declared)
+	}
+
+	if existing.Unique != spec.Unique || existing.Sparse != spec.Sparse || existing.ExpireAfterSeconds != nil {
+		return "text index options differ from the declared ones"
+	}
+
+	return ""
+}
+
+// PlanIndexes compares the indexes in CollectionIndexes with the ones that exist. Indexes that
+// aren't declared are dropped when dropUnknown is true, and only reported otherwise. Backends
+// that keep their own indexes never need any changes
+func PlanIndexes(ctx context.Context, db Database, dropUnknown bool) ([]IndexChange, error) {
+	changes := []IndexChange{}
+	ix, ok := underlying(db).(indexer)
+
+	if ok == false {
+		return changes, nil
+	}
+
+	declared := CollectionIndexes()
+	names := make([]string, 0, len(declared))
+
+	for name := range declared {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, collectionName := range names {
+		existing, err := ix.listIndexes(ctx, collectionName)
+
+		if err != nil {
+			return changes, err
+		}
+
+		byName := make(map[string]existingIndex, len(existing))
+		for _, e := range existing {
+			byName[e.Name] = e
+		}
+
+		wanted := map[string]bool{"_id_": true}
+
+		for _, spec := range declared[collectionName] {
+			name := spec.Name()
+			wanted[name] = true
+			e, exists := byName[name]
+
+			if exists == false {
+				changes = append(changes, IndexChange{Collection: collectionName, Index: name, Action: IndexCreate, spec: spec})
+				continue
+			}
+
+			if reason := drift(e, spec); reason != "" {
+				changes = append(changes, IndexChange{Collection: collectionName, Index: name, Action: IndexRecreate, Reason: reason, spec: spec})
+			}
+		}
+
+		retired := map[string]bool{}
+		for _, name := range retiredIndexes[collectionName] {
+			retired[name] = true
+		}
+
+		for _, e := range existing {
+			switch {
+			case wanted[e.Name]:
+			case retired[e.Name] || dropUnknown:
+				changes = append(changes, IndexChange{Collection: collectionName, Index: e.Name, Action: IndexDrop})
+			default:
+				changes = append(changes, IndexChange{Collection: collectionName, Index: e.Name, Action: IndexUnknown})
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+// ReconcileIndexes makes the indexes of every collection match CollectionIndexes, returning the
+// changes it made along with the unknown indexes it left alone
+func ReconcileIndexes(ctx context.Context, db Database, dropUnknown bool) ([]IndexChange, error) {
+	changes, err := PlanIndexes(ctx, db, dropUnknown)
+
+	if err != nil || len(changes) == 0 {
+		return changes, err
+	}
+
+	ix := underlying(db).(indexer)
+
+	for i, c := range changes {
+		switch c.Action {
+		case IndexCreate:
+			err = ix.createIndex(ctx, c.Collection, c.spec)
+		case IndexRecreate:
+			err = ix.dropIndex(ctx, c.Collection, c.Index)
+
+			if err == nil {
+				err = ix.createIndex(ctx, c.Collection, c.spec)
+			}
+		case IndexDrop:
+			err = ix.dropIndex(ctx, c.Collection, c.Index)
+		}
+
+		if err != nil {
+			return changes[:i], errors.Wrapf(err, "Failed to %s", c)
+		}
+	}
+
+	return changes, err
+}
+
+func (d *mongoDatabase) listIndexes(ctx context.Context, collectionName string) ([]existingIndex, error) {
+	existing := []existingIndex{}
+
+	res, err := d.db.Collection(collectionName).Indexes().List(ctx)
+
+	if err != nil {
+		return existing, errors.Wrapf(err, "Failed to list indexes of %s", collectionName)
+	}
+
+	err = res.All(ctx, &existing)
+
+	return existing, errors.Wrapf(err, "Failed to decode indexes of %s", collectionName)
+}
+
+func (d *mongoDatabase) createIndex(ctx context.Context, collectionName string, spec IndexSpec) error {
+	opts := options.Index().SetName(spec.Name()).SetBackground(true)
+
+	if spec.Unique {
+		opts.SetUnique(true)
+	}
+
+	if spec.Sparse {
+		opts.SetSparse(true)
+	}
+
+	if spec.ExpireAfter != nil {
+		opts.SetExpireAfterSeconds(int32(spec.ExpireAfter.Seconds()))
+	}
+
+	if len(spec.Weights) > 0 {
+		opts.SetWeights(spec.Weights)
+	}
+
+	_, err := d.db.Collection(collectionName).Indexes().CreateOne(
+		ctx,
 		mongo.IndexModel{
-			Keys: bson.M{"createdAt": 1},
-			Options: &options.IndexOptions{
-				ExpireAfterSeconds: &exp,
-				Background:         &bg,
-				Version:            &v,
-			},
-		},
-		nil,
+			Keys:    spec.Keys,
+			Options: opts,
+		},
 	)
+
+	return err
+}
+
+func (d *mongoDatabase) dropIndex(ctx context.Context, collectionName string, name string) error {
+	_, err := d.db.Collection(collectionName).Indexes().DropOne(ctx, name)
+
+	return err
 }
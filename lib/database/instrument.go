@@ -0,0 +1,343 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abradley2/macguffin/lib/request"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LatencyBuckets the upper bounds, in seconds, of the buckets of the operation latency histograms
+var LatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type operationKey struct {
+	collection string
+	operation  string
+}
+
+type operationStats struct {
+	// buckets the number of operations that took at most each of LatencyBuckets
+	buckets []uint64
+	count   uint64
+	seconds float64
+	errors  uint64
+}
+
+// Metrics latency histograms and error counts of database operations, by collection and operation
+type Metrics struct {
+	mu         sync.Mutex
+	operations map[operationKey]*operationStats
+}
+
+// NewMetrics creates Metrics without any operations recorded
+func NewMetrics() *Metrics {
+	return &Metrics{
+		operations: make(map[operationKey]*operationStats),
+	}
+}
+
+func (m *Metrics) observe(collection string, operation string, took time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := operationKey{collection: collection, operation: operation}
+	stats, ok := m.operations[key]
+
+	if ok == false {
+		stats = &operationStats{buckets: make([]uint64, len(LatencyBuckets))}
+		m.operations[key] = stats
+	}
+
+	seconds := took.Seconds()
+	stats.count++
+	stats.seconds += seconds
+
+	for i, le := range LatencyBuckets {
+		if seconds <= le {
+			stats.buckets[i]++
+		}
+	}
+
+	if err != nil {
+		stats.errors++
+	}
+}
+
+// WriteTo writes every histogram and error count in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]operationKey, 0, len(m.operations))
+
+	for key := range m.operations {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].collection != keys[j].collection {
+			return keys[i].collection < keys[j].collection
+		}
+		return keys[i].operation < keys[j].operation
+	})
+
+	b := &strings.Builder{}
+
+	b.WriteString("# HELP macguffin_db_operation_duration_seconds How long database operations took\n")
+	b.WriteString("# TYPE macguffin_db_operation_duration_seconds histogram\n")
+
+	for _, key := range keys {
+		stats := m.operations[key]
+		labels := fmt.Sprintf("collection=%q,operation=%q", key.collection, key.operation)
+
+		for i, le := range LatencyBuckets {
+			fmt.Fprintf(b, "macguffin_db_operation_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, le, stats.buckets[i])
+		}
+
+		fmt.Fprintf(b, "macguffin_db_operation_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, stats.count)
+		fmt.Fprintf(b, "macguffin_db_operation_duration_seconds_sum{%s} %g\n", labels, stats.seconds)
+		fmt.Fprintf(b, "macguffin_db_operation_duration_seconds_count{%s} %d\n", labels, stats.count)
+	}
+
+	b.WriteString("# HELP macguffin_db_operation_errors_total Database operations that failed\n")
+	b.WriteString("# TYPE macguffin_db_operation_errors_total counter\n")
+
+	for _, key := range keys {
+		fmt.Fprintf(
+			b,
+			"macguffin_db_operation_errors_total{collection=%q,operation=%q} %d\n",
+			key.collection,
+			key.operation,
+			m.operations[key].errors,
+		)
+	}
+
+	n, err := io.WriteString(w, b.String())
+
+	return int64(n), err
+}
+
+// ServeHTTP responds with the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not allowed"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	m.WriteTo(w)
+}
+
+// wrapper a Database that decorates another one, which is where indexes are reconciled
+type wrapper interface {
+	unwrap() Database
+}
+
+// underlying the Database db decorates, or db itself
+func underlying(db Database) Database {
+	for {
+		w, ok := db.(wrapper)
+
+		if ok == false {
+			return db
+		}
+
+		db = w.unwrap()
+	}
+}
+
+type instrumentedDatabase struct {
+	Database
+	metrics   *Metrics
+	slowQuery time.Duration
+}
+
+// Instrument records the latency and errors of every operation on the collections of db in
+// metrics, and logs operations that take longer than slowQuery. Slow operations are logged with
+// the logger stored in their context under request.LoggerKey, so they carry its request id. A
+// slowQuery of 0 logs nothing
+func Instrument(db Database, metrics *Metrics, slowQuery time.Duration) Database {
+	return &instrumentedDatabase{Database: db, metrics: metrics, slowQuery: slowQuery}
+}
+
+func (d *instrumentedDatabase) unwrap() Database {
+	return d.Database
+}
+
+func (d *instrumentedDatabase) Collection(collectionName string) Collection {
+	return &instrumentedCollection{
+		collection: d.Database.Collection(collectionName),
+		name:       collectionName,
+		db:         d,
+	}
+}
+
+// instrumentedCollection times each operation of a collection. Find and Aggregate are timed
+// until the cursor is returned, which for MongoDB includes the first batch of results
+type instrumentedCollection struct {
+	collection Collection
+	name       string
+	db         *instrumentedDatabase
+}
+
+// done records an operation that started at start. Finding no document isn't counted as an error
+func (c *instrumentedCollection) done(ctx context.Context, operation string, start time.Time, query interface{}, err error) {
+	took := time.Since(start)
+
+	if err == mongo.ErrNoDocuments {
+		err = nil
+	}
+
+	c.db.metrics.observe(c.name, operation, took, err)
+
+	if c.db.slowQuery <= 0 || took < c.db.slowQuery {
+		return
+	}
+
+	l, ok := ctx.Value(request.LoggerKey).(*log.Logger)
+
+	if ok == false {
+		l = logger
+	}
+
+	l.Printf("Slow query: %s.%s took %s: %s", c.name, operation, took, queryShape(query))
+}
+
+// queryShape a filter, update or pipeline with its values left out, so it can be logged
+// without the tokens and personal details it may hold
+func queryShape(query interface{}) string {
+	d, err := normalize(bson.D{{Key: "q", Value: query}})
+
+	if err != nil {
+		return "unknown"
+	}
+
+	shape, err := bson.MarshalExtJSON(bson.D{{Key: "q", Value: redactValues(d[0].Value)}}, false, false)
+
+	if err != nil {
+		return "unknown"
+	}
+
+	// drop the {"q": wrapper
+	s := string(shape)
+
+	return strings.TrimSuffix(strings.TrimPrefix(s, `{"q":`), "}")
+}
+
+func redactValues(v interface{}) interface{} {
+	switch t := v.(type) {
+	case primitive.D:
+		redacted := primitive.D{}
+
+		for _, e := range t {
+			redacted = append(redacted, primitive.E{Key: e.Key, Value: redactValues(e.Value)})
+		}
+
+		return redacted
+
+	case primitive.A:
+		redacted := primitive.A{}
+
+		for _, el := range t {
+			redacted = append(redacted, redactValues(el))
+		}
+
+		return redacted
+	}
+
+	return "?"
+}
+
+func (c *instrumentedCollection) Find(ctx context.Context, filter interface{}, opts *options.FindOptions) (Cursor, error) {
+	start := time.Now()
+	curs, err := c.collection.Find(ctx, filter, opts)
+	c.done(ctx, "Find", start, filter, err)
+
+	return curs, err
+}
+
+func (c *instrumentedCollection) FindOne(ctx context.Context, filter interface{}, opts *options.FindOneOptions) SingleResult {
+	start := time.Now()
+	res := c.collection.FindOne(ctx, filter, opts)
+	c.done(ctx, "FindOne", start, filter, res.Err())
+
+	return res
+}
+
+func (c *instrumentedCollection) InsertOne(ctx context.Context, doc interface{}, opts *options.InsertOneOptions) (string, error) {
+	start := time.Now()
+	id, err := c.collection.InsertOne(ctx, doc, opts)
+	// the document itself is never logged
+	c.done(ctx, "InsertOne", start, bson.D{}, err)
+
+	return id, err
+}
+
+func (c *instrumentedCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts *options.UpdateOptions) (UpdateResult, error) {
+	start := time.Now()
+	res, err := c.collection.UpdateOne(ctx, filter, update, opts)
+	c.done(ctx, "UpdateOne", start, filter, err)
+
+	return res, err
+}
+
+func (c *instrumentedCollection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts *options.UpdateOptions) (UpdateResult, error) {
+	start := time.Now()
+	res, err := c.collection.UpdateMany(ctx, filter, update, opts)
+	c.done(ctx, "UpdateMany", start, filter, err)
+
+	return res, err
+}
+
+func (c *instrumentedCollection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts *options.FindOneAndUpdateOptions) SingleResult {
+	start := time.Now()
+	res := c.collection.FindOneAndUpdate(ctx, filter, update, opts)
+	c.done(ctx, "FindOneAndUpdate", start, filter, res.Err())
+
+	return res
+}
+
+func (c *instrumentedCollection) DeleteOne(ctx context.Context, filter interface{}, opts *options.DeleteOptions) (int64, error) {
+	start := time.Now()
+	n, err := c.collection.DeleteOne(ctx, filter, opts)
+	c.done(ctx, "DeleteOne", start, filter, err)
+
+	return n, err
+}
+
+func (c *instrumentedCollection) DeleteMany(ctx context.Context, filter interface{}, opts *options.DeleteOptions) (int64, error) {
+	start := time.Now()
+	n, err := c.collection.DeleteMany(ctx, filter, opts)
+	c.done(ctx, "DeleteMany", start, filter, err)
+
+	return n, err
+}
+
+func (c *instrumentedCollection) CountDocuments(ctx context.Context, filter interface{}, opts *options.CountOptions) (int64, error) {
+	start := time.Now()
+	n, err := c.collection.CountDocuments(ctx, filter, opts)
+	c.done(ctx, "CountDocuments", start, filter, err)
+
+	return n, err
+}
+
+func (c *instrumentedCollection) Aggregate(ctx context.Context, pipeline interface{}, opts *options.AggregateOptions) (Cursor, error) {
+	start := time.Now()
+	curs, err := c.collection.Aggregate(ctx, pipeline, opts)
+	c.done(ctx, "Aggregate", start, pipeline, err)
+
+	return curs, err
+}
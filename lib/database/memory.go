@@ -0,0 +1,571 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// duplicateKeyCode the code MongoDB reports for a unique index violation
+const duplicateKeyCode = 11000
+
+// IsDuplicateKeyError whether an insert or upsert failed because of a duplicate key, for any backend
+func IsDuplicateKeyError(err error) bool {
+	we, ok := errors.Cause(err).(mongo.WriteException)
+
+	if ok == false {
+		return false
+	}
+
+	for _, e := range we.WriteErrors {
+		if e.Code == duplicateKeyCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+func duplicateKeyError(collectionName string, id interface{}) error {
+	return mongo.WriteException{
+		WriteErrors: mongo.WriteErrors{
+			{
+				Code:    duplicateKeyCode,
+				Message: fmt.Sprintf("E11000 duplicate key error collection: %s dup key: { _id: %v }", collectionName, id),
+			},
+		},
+	}
+}
+
+type memoryDatabase struct {
+	mu          sync.Mutex
+	collections map[string]*memoryCollection
+}
+
+// NewMemoryDatabase creates an empty Database that keeps every document in memory. It evaluates
+// filters, sorts and updates the way MongoDB does, for tests and for running the server without MongoDB
+func NewMemoryDatabase() Database {
+	return &memoryDatabase{
+		collections: make(map[string]*memoryCollection),
+	}
+}
+
+func (d *memoryDatabase) Collection(collectionName string) Collection {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.collections[collectionName]
+
+	if ok == false {
+		c = &memoryCollection{name: collectionName, unique: uniqueIndexes(collectionName)}
+
+		if weights := textWeights(collectionName); weights != nil {
+			c.text = newTextIndex(weights)
+		}
+		d.collections[collectionName] = c
+	}
+
+	return c
+}
+
+// Ping always succeeds
+func (d *memoryDatabase) Ping(ctx context.Context) error {
+	return nil
+}
+
+// WithTransaction calls fn directly. Each write is atomic on its own, but the writes of fn are
+// neither isolated from other callers nor rolled back when it fails
+func (d *memoryDatabase) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+type memoryCollection struct {
+	mu   sync.RWMutex
+	name string
+	// in insertion order, which is the order a collection scan in MongoDB returns them in
+	documents []primitive.D
+	// text the inverted index of collections with a text index, nil for the others
+	text *textIndex
+	// unique the unique indexes of the collection, which every write is checked against
+	unique []IndexSpec
+}
+
+// checkUnique whether storing docs, in place of the documents at the indexes in replaced, would
+// hold two documents under the same values of a unique index. The caller must hold the write lock
+func (c *memoryCollection) checkUnique(docs []primitive.D, replaced map[int]bool) error {
+	for _, spec := range c.unique {
+		for i, doc := range docs {
+			values, ok := spec.indexedValues(doc)
+
+			if ok == false {
+				continue
+			}
+
+			for _, other := range docs[:i] {
+				if spec.holdsUnder(other, values) {
+					return uniqueKeyError(c.name, spec, values)
+				}
+			}
+
+			for j, existing := range c.documents {
+				if replaced[j] == false && spec.holdsUnder(existing, values) {
+					return uniqueKeyError(c.name, spec, values)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// indexText adds a document to the text index, the caller must hold the write lock
+func (c *memoryCollection) indexText(doc primitive.D) {
+	if c.text == nil {
+		return
+	}
+
+	id, _ := documentID(doc)
+
+	if key, err := documentKey(id); err == nil {
+		c.text.add(key, doc)
+	}
+}
+
+// unindexText takes a document out of the text index, the caller must hold the write lock
+func (c *memoryCollection) unindexText(doc primitive.D) {
+	if c.text == nil {
+		return
+	}
+
+	id, _ := documentID(doc)
+
+	if key, err := documentKey(id); err == nil {
+		c.text.remove(key)
+	}
+}
+
+// matching every stored document that matches a filter, the caller must hold the lock
+func (c *memoryCollection) matching(filter interface{}) ([]int, error) {
+	f, err := normalize(filter)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid filter")
+	}
+
+	matches := []int{}
+
+	for i, doc := range c.documents {
+		matched, err := matchFilter(doc, f)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if matched {
+			matches = append(matches, i)
+		}
+	}
+
+	return matches, nil
+}
+
+func (c *memoryCollection) find(filter interface{}, opts *options.FindOptions) ([]bson.Raw, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	f, err := normalize(filter)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid filter")
+	}
+
+	text, _, err := textSearch(f)
+
+	if err != nil || text == nil || c.text == nil {
+		return queryDocuments(c.name, c.documents, f, opts)
+	}
+
+	return queryDocuments(c.name, textCandidates(c.text, c.documents, *text), f, opts)
+}
+
+func (c *memoryCollection) Find(ctx context.Context, filter interface{}, opts *options.FindOptions) (Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return &rawCursor{index: -1}, err
+	}
+
+	docs, err := c.find(filter, opts)
+
+	return &rawCursor{documents: docs, index: -1}, err
+}
+
+func (c *memoryCollection) FindOne(ctx context.Context, filter interface{}, opts *options.FindOneOptions) SingleResult {
+	if err := ctx.Err(); err != nil {
+		return &rawSingleResult{err: err}
+	}
+
+	limit := int64(1)
+	findOpts := &options.FindOptions{Limit: &limit}
+
+	if opts != nil {
+		findOpts.Sort = opts.Sort
+		findOpts.Skip = opts.Skip
+		findOpts.Projection = opts.Projection
+	}
+
+	docs, err := c.find(filter, findOpts)
+
+	if err != nil {
+		return &rawSingleResult{err: err}
+	}
+
+	if len(docs) == 0 {
+		return &rawSingleResult{err: mongo.ErrNoDocuments}
+	}
+
+	return &rawSingleResult{raw: docs[0]}
+}
+
+// insert stores a document, the caller must hold the write lock
+func (c *memoryCollection) insert(doc primitive.D) (interface{}, error) {
+	doc, id := ensureID(doc)
+
+	for _, existing := range c.documents {
+		if existingID, _ := documentID(existing); valuesEqual(existingID, id) {
+			return id, duplicateKeyError(c.name, id)
+		}
+	}
+
+	if err := c.checkUnique([]primitive.D{doc}, nil); err != nil {
+		return id, err
+	}
+
+	c.documents = append(c.documents, doc)
+	c.indexText(doc)
+
+	return id, nil
+}
+
+func (c *memoryCollection) InsertOne(ctx context.Context, document interface{}, opts *options.InsertOneOptions) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	doc, err := normalize(document)
+
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, err := c.insert(doc)
+
+	if err != nil {
+		return "", err
+	}
+
+	return idString(id), err
+}
+
+// update applies an update to the first document matching a filter, or to every one when many
+// is true, the caller must hold the write lock. It also returns the first updated document from
+// before and after the update, which FindOneAndUpdate reports
+func (c *memoryCollection) update(
+	filter interface{},
+	update interface{},
+	upsert bool,
+	many bool,
+	sortSpec interface{},
+) (*updateResult, primitive.D, primitive.D, error) {
+	res := &updateResult{}
+
+	matches, err := c.matching(filter)
+
+	if err != nil {
+		return res, nil, nil, err
+	}
+
+	if len(matches) == 0 {
+		if upsert == false {
+			return res, nil, nil, nil
+		}
+
+		doc, err := upsertDocument(filter, update)
+
+		if err != nil {
+			return res, nil, nil, err
+		}
+
+		id, err := c.insert(doc)
+
+		if err != nil {
+			return res, nil, nil, err
+		}
+
+		res.upsertedID = idString(id)
+
+		return res, nil, c.documents[len(c.documents)-1], nil
+	}
+
+	if sortSpec != nil {
+		less, err := documentOrder(sortSpec)
+
+		if err != nil {
+			return res, nil, nil, err
+		}
+
+		sort.SliceStable(matches, func(i, j int) bool {
+			return less(c.documents[matches[i]], c.documents[matches[j]])
+		})
+	}
+
+	if many == false {
+		matches = matches[:1]
+	}
+
+	// every update is applied before any is stored, so a failure leaves the collection unchanged
+	updated := make([]primitive.D, len(matches))
+
+	for i, m := range matches {
+		updated[i], err = applyUpdate(c.documents[m], update, false)
+
+		if err != nil {
+			return &updateResult{}, nil, nil, err
+		}
+	}
+
+	replaced := make(map[int]bool, len(matches))
+	for _, m := range matches {
+		replaced[m] = true
+	}
+
+	if err := c.checkUnique(updated, replaced); err != nil {
+		return &updateResult{}, nil, nil, err
+	}
+
+	before := c.documents[matches[0]]
+
+	for i, m := range matches {
+		res.matched++
+
+		if valuesEqual(updated[i], c.documents[m]) == false {
+			res.modified++
+			c.documents[m] = updated[i]
+			c.indexText(updated[i])
+		}
+	}
+
+	return res, before, updated[0], nil
+}
+
+func (c *memoryCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts *options.UpdateOptions) (UpdateResult, error) {
+	if err := ctx.Err(); err != nil {
+		return &updateResult{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res, _, _, err := c.update(filter, update, opts != nil && isUpsert(opts.Upsert), false, nil)
+
+	return res, err
+}
+
+func (c *memoryCollection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts *options.UpdateOptions) (UpdateResult, error) {
+	if err := ctx.Err(); err != nil {
+		return &updateResult{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res, _, _, err := c.update(filter, update, opts != nil && isUpsert(opts.Upsert), true, nil)
+
+	return res, err
+}
+
+func (c *memoryCollection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts *options.FindOneAndUpdateOptions) SingleResult {
+	if err := ctx.Err(); err != nil {
+		return &rawSingleResult{err: err}
+	}
+
+	if opts == nil {
+		opts = &options.FindOneAndUpdateOptions{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, before, after, err := c.update(filter, update, isUpsert(opts.Upsert), false, opts.Sort)
+
+	if err != nil {
+		return &rawSingleResult{err: err}
+	}
+
+	return returnedDocument(before, after, opts)
+}
+
+func (c *memoryCollection) CountDocuments(ctx context.Context, filter interface{}, opts *options.CountOptions) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	matches, err := c.matching(filter)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return countWithOptions(int64(len(matches)), opts), nil
+}
+
+func (c *memoryCollection) Aggregate(ctx context.Context, pipeline interface{}, opts *options.AggregateOptions) (Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return &rawCursor{index: -1}, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	docs, err := aggregateDocuments(c.documents, pipeline)
+
+	return &rawCursor{documents: docs, index: -1}, err
+}
+
+// delete removes matching documents, at most one unless many is true
+func (c *memoryCollection) delete(ctx context.Context, filter interface{}, many bool) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	matches, err := c.matching(filter)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if many == false && len(matches) > 1 {
+		matches = matches[:1]
+	}
+
+	deleted := make(map[int]bool, len(matches))
+	for _, m := range matches {
+		deleted[m] = true
+	}
+
+	kept := make([]primitive.D, 0, len(c.documents)-len(matches))
+	for i, doc := range c.documents {
+		if deleted[i] == false {
+			kept = append(kept, doc)
+			continue
+		}
+
+		c.unindexText(doc)
+	}
+
+	c.documents = kept
+
+	return int64(len(matches)), nil
+}
+
+func (c *memoryCollection) DeleteOne(ctx context.Context, filter interface{}, opts *options.DeleteOptions) (int64, error) {
+	return c.delete(ctx, filter, false)
+}
+
+func (c *memoryCollection) DeleteMany(ctx context.Context, filter interface{}, opts *options.DeleteOptions) (int64, error) {
+	return c.delete(ctx, filter, true)
+}
+
+// rawCursor a Cursor over documents that have already been read, used by every backend
+// that evaluates queries itself
+type rawCursor struct {
+	documents []bson.Raw
+	index     int
+}
+
+func (c *rawCursor) Next(ctx context.Context) bool {
+	if ctx.Err() != nil || c.index+1 >= len(c.documents) {
+		return false
+	}
+
+	c.index = c.index + 1
+
+	return true
+}
+
+func (c *rawCursor) Decode(ref interface{}) error {
+	if c.index < 0 || c.index >= len(c.documents) {
+		return fmt.Errorf("Decode called without a current document, call Next first")
+	}
+
+	return bson.Unmarshal(c.documents[c.index], ref)
+}
+
+// All decodes every remaining document into ref, which must be a pointer to a slice
+func (c *rawCursor) All(ctx context.Context, ref interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sliceVal := reflect.ValueOf(ref)
+
+	if sliceVal.Kind() != reflect.Ptr || sliceVal.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("All needs a pointer to a slice, got %T", ref)
+	}
+
+	sliceVal = sliceVal.Elem()
+	elemType := sliceVal.Type().Elem()
+	results := reflect.MakeSlice(sliceVal.Type(), 0, len(c.documents))
+
+	for c.Next(ctx) {
+		elem := reflect.New(elemType)
+
+		err := c.Decode(elem.Interface())
+
+		if err != nil {
+			return err
+		}
+
+		results = reflect.Append(results, elem.Elem())
+	}
+
+	sliceVal.Set(results)
+
+	return ctx.Err()
+}
+
+type rawSingleResult struct {
+	raw bson.Raw
+	err error
+}
+
+func (r *rawSingleResult) Decode(ref interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	return bson.Unmarshal(r.raw, ref)
+}
+
+func (r *rawSingleResult) DecodeBytes() ([]byte, error) {
+	return r.raw, r.err
+}
+
+func (r *rawSingleResult) Err() error {
+	return r.err
+}
@@ -2,16 +2,21 @@ package database
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"time"
 
 	"log"
 
 	"github.com/abradley2/macguffin/lib/env"
+	"github.com/pkg/errors"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
 )
 
 var logger *log.Logger = log.New(os.Stderr, "mongo.go ", log.LstdFlags)
@@ -35,38 +40,184 @@ var ArticleCollections = [3]string{
 // TokensCollection where we store tokens
 const TokensCollection = "tokens"
 
+// RefreshTokensCollection where we store refresh tokens, including rotated ones so reuse can be detected
+const RefreshTokensCollection = "refreshtokens"
+
+// LoginStatesCollection where redeemed oauth states are kept until they expire, so each is used once
+const LoginStatesCollection = "loginstates"
+
 // AgentsCollection where we store agent data
 const AgentsCollection = "agents"
 
+// MigrationsCollection where applied migrations are recorded, along with the lock held while migrating
+const MigrationsCollection = "migrations"
+
 // ProfileCollection where we store profile data describing agents- this is mostly their stats
 const ProfileCollection = "agentprofiles"
 
+// RevisionsCollection where every version of every article is kept, oldest first for each article
+const RevisionsCollection = "articlerevisions"
+
+// DefaultMongoDatabase the database used when neither MONGO_DATABASE nor MONGO_URI names one
+const DefaultMongoDatabase = "macguffin_main"
+
+// MongoConfig how to connect to MongoDB
+type MongoConfig struct {
+	// URI a mongodb:// or mongodb+srv:// connection string, which may name the database and set
+	// any option the driver supports, such as replicaSet, authSource or tls
+	URI string
+	// Database overrides the database named in URI
+	Database string
+	// Username is authenticated with Password against AuthSource when set, instead of any
+	// credentials in URI
+	Username   string
+	Password   string
+	AuthSource string
+	// TLSCAFile a PEM file of the certificate authorities to trust, setting it turns TLS on
+	TLSCAFile string
+	// MaxPoolSize and MinPoolSize bound the connections kept open to each server, 0 leaves the
+	// driver defaults
+	MaxPoolSize            uint64
+	MinPoolSize            uint64
+	ConnectTimeout         time.Duration
+	ServerSelectionTimeout time.Duration
+}
+
+// MongoConfigFromEnv the MongoConfig set by the MONGO_ environment variables. MONGO_HOST and
+// MONGO_PORT are only used when MONGO_URI isn't set
+func MongoConfigFromEnv() MongoConfig {
+	uri := env.MongoURI
+
+	if uri == "" {
+		uri = fmt.Sprintf("mongodb://%s:%s", env.MongoHost, env.MongoPort)
+	}
+
+	return MongoConfig{
+		URI:                    uri,
+		Database:               env.MongoDatabase,
+		Username:               env.MongoUsername,
+		Password:               env.MongoPassword,
+		AuthSource:             env.MongoAuthSource,
+		TLSCAFile:              env.MongoTLSCAFile,
+		MaxPoolSize:            uint64(env.MongoMaxPoolSize),
+		MinPoolSize:            uint64(env.MongoMinPoolSize),
+		ConnectTimeout:         env.MongoConnectTimeout,
+		ServerSelectionTimeout: env.MongoServerSelectionTimeout,
+	}
+}
+
+// clientOptions the driver options for the config, and the name of the database to use
+func (c MongoConfig) clientOptions() (*options.ClientOptions, string, error) {
+	opts := options.Client().ApplyURI(c.URI)
+
+	if err := opts.Validate(); err != nil {
+		return nil, "", errors.Wrap(err, "Invalid MONGO_URI")
+	}
+
+	dbName := c.Database
+
+	if dbName == "" {
+		cs, err := connstring.Parse(c.URI)
+
+		if err != nil {
+			return nil, "", errors.Wrap(err, "Invalid MONGO_URI")
+		}
+
+		dbName = cs.Database
+	}
+
+	if dbName == "" {
+		dbName = DefaultMongoDatabase
+	}
+
+	if c.Username != "" {
+		opts.SetAuth(options.Credential{
+			Username:   c.Username,
+			Password:   c.Password,
+			AuthSource: c.AuthSource,
+		})
+	}
+
+	if c.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(c.TLSCAFile)
+
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "Failed to read mongo TLS CA file: %s", c.TLSCAFile)
+		}
+
+		roots := x509.NewCertPool()
+
+		if roots.AppendCertsFromPEM(pem) == false {
+			return nil, "", fmt.Errorf("No certificates found in mongo TLS CA file: %s", c.TLSCAFile)
+		}
+
+		opts.SetTLSConfig(&tls.Config{RootCAs: roots})
+	}
+
+	if c.MaxPoolSize > 0 {
+		opts.SetMaxPoolSize(c.MaxPoolSize)
+	}
+
+	if c.MinPoolSize > 0 {
+		opts.SetMinPoolSize(c.MinPoolSize)
+	}
+
+	if c.ConnectTimeout > 0 {
+		opts.SetConnectTimeout(c.ConnectTimeout)
+	}
+
+	if c.ServerSelectionTimeout > 0 {
+		opts.SetServerSelectionTimeout(c.ServerSelectionTimeout)
+	}
+
+	return opts, dbName, nil
+}
+
+// OpenDatabase opens the database backend named by env.DatabaseBackend
 func OpenDatabase() (Database, error) {
-	var err error
+	switch env.DatabaseBackend {
+	case "mongo", "":
+		return OpenMongoDatabase(context.Background(), MongoConfigFromEnv())
+	case "sqlite":
+		return OpenSQLiteDatabase(env.SQLitePath)
+	case "memory":
+		logger.Printf("Using the in-memory database, nothing will be kept when the server stops")
+		return NewMemoryDatabase(), nil
+	}
+
+	return nil, fmt.Errorf("Unknown DATABASE_BACKEND: %s", env.DatabaseBackend)
+}
 
-	mongoURI := fmt.Sprintf("mongodb://%s:%s", env.MongoHost, env.MongoPort)
-	mClient, err := mongo.NewClient(options.Client().ApplyURI(mongoURI))
+// OpenMongoDatabase connects to MongoDB, failing unless a server answers a ping before the
+// server selection timeout
+func OpenMongoDatabase(ctx context.Context, c MongoConfig) (Database, error) {
+	opts, dbName, err := c.clientOptions()
 
 	if err != nil {
-		logger.Fatalf("Error creating mongo client: %v", err)
+		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
-	err = mClient.Connect(ctx)
+	client, err := mongo.NewClient(opts)
 
 	if err != nil {
-		logger.Fatalf("Error connecting to mongo instance: %v", err)
+		return nil, errors.Wrap(err, "Failed to create mongo client")
 	}
 
-	db := mClient.Database("macguffin_main", nil)
+	err = client.Connect(ctx)
 
-	setupTokenIndexes(db)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to connect to mongo")
+	}
+
+	d := &mongoDatabase{db: client.Database(dbName)}
+	err = d.Ping(ctx)
 
-	select {
-	case <-ctx.Done():
-		return &mongoDatabase{}, fmt.Errorf("Failed to initialize database before timeout")
-	default:
-		return &mongoDatabase{db: db}, err
+	if err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
 	}
+
+	logger.Printf("Connected to mongo database %s", dbName)
+
+	return d, nil
 }
@@ -0,0 +1,508 @@
+package database
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type errCircuitOpen struct{}
+
+// Error _
+func (errCircuitOpen) Error() string {
+	return "Database is unavailable, the circuit breaker is open"
+}
+
+// ErrCircuitOpen indicates an operation wasn't attempted because the database recently kept failing
+var ErrCircuitOpen errCircuitOpen
+
+// retryableCodes server error codes of a primary stepping down or a server shutting down, after
+// which the same operation succeeds once a new primary is elected
+var retryableCodes = map[int32]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	9001:  true, // SocketException
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+	13436: true, // NotMasterOrSecondary
+}
+
+// isRetryable whether an operation that failed with err is expected to succeed when tried again
+func isRetryable(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case mongo.CommandError:
+		return e.HasErrorLabel("NetworkError") || e.HasErrorLabel("RetryableWriteError") || retryableCodes[e.Code]
+	case mongo.WriteException:
+		return e.WriteConcernError != nil && retryableCodes[int32(e.WriteConcernError.Code)]
+	}
+
+	return false
+}
+
+// isUnhealthy whether err means the database can't be reached. The driver returns server
+// selection errors once it has already waited for a server, so they aren't worth retrying
+func isUnhealthy(err error) bool {
+	return isRetryable(err) || strings.HasPrefix(errors.Cause(err).Error(), "server selection error")
+}
+
+// RetryPolicy how many times reads are attempted, and how long to wait between attempts
+type RetryPolicy struct {
+	// Attempts how many times a read is attempted in all, 1 never retries
+	Attempts int
+	// BaseDelay the longest wait before the second attempt, which doubles for each attempt after it
+	BaseDelay time.Duration
+	// MaxDelay the longest wait before any attempt
+	MaxDelay time.Duration
+}
+
+// backoff the wait before the attempt after the given one, a random duration between half and
+// all of the exponential delay so that instances retrying together don't stay in step
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay << uint(attempt-1)
+
+	if d > p.MaxDelay || d <= 0 {
+		d = p.MaxDelay
+	}
+
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	// breakerHalfOpen one operation is let through to find out whether the database is back
+	breakerHalfOpen
+)
+
+// Breaker stops operations from being attempted once the database has failed too many times in a
+// row, so requests fail fast instead of each waiting on a database that can't answer. Once the
+// cooldown has passed, one operation is let through. The breaker closes if it succeeds, and opens
+// for another cooldown if it fails
+type Breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	state     breakerState
+	openedAt  time.Time
+}
+
+// NewBreaker creates a Breaker that opens after threshold failures in a row, for cooldown. A
+// threshold of 0 never opens
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow ErrCircuitOpen unless an operation may be attempted now
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+
+		b.state = breakerHalfOpen
+		return nil
+
+	case breakerHalfOpen:
+		return ErrCircuitOpen
+	}
+
+	return nil
+}
+
+// record the outcome of an operation allow let through
+func (b *Breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case err == nil:
+		b.reset()
+
+	case err == ErrCircuitOpen:
+		return
+
+	case isUnhealthy(err):
+		b.failures++
+
+		if b.state == breakerHalfOpen || (b.threshold > 0 && b.failures >= b.threshold) {
+			if b.state != breakerOpen {
+				logger.Printf("Database failed %d times in a row, failing fast for %s: %v", b.failures, b.cooldown, err)
+			}
+
+			b.state = breakerOpen
+			b.openedAt = time.Now()
+		}
+
+	case err == context.Canceled || err == context.DeadlineExceeded:
+		// says nothing about the database, but lets another operation find out
+		if b.state == breakerHalfOpen {
+			b.state = breakerOpen
+		}
+
+	default:
+		// the database answered, even if only to say the operation was wrong
+		b.reset()
+	}
+}
+
+func (b *Breaker) reset() {
+	if b.state != breakerClosed {
+		logger.Printf("Database is available again")
+	}
+
+	b.failures = 0
+	b.state = breakerClosed
+}
+
+// RetryAfter how long until operations are attempted again, 0 unless the breaker is open or one
+// operation is already finding out whether the database is back
+func (b *Breaker) RetryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if wait := b.cooldown - time.Since(b.openedAt); wait > 0 {
+			return wait
+		}
+
+	case breakerHalfOpen:
+		return time.Second
+	}
+
+	return 0
+}
+
+// circuitTripKey the context key of the circuitTrip of a request served by Breaker.Handler
+type circuitTripKey struct{}
+
+// circuitTrip whether an operation of a request failed with ErrCircuitOpen, set by any goroutine
+// the request runs operations in
+type circuitTrip struct {
+	tripped int32
+}
+
+// tripCircuit records on the request ctx belongs to that an operation failed with ErrCircuitOpen
+func tripCircuit(ctx context.Context) {
+	if trip, ok := ctx.Value(circuitTripKey{}).(*circuitTrip); ok {
+		atomic.StoreInt32(&trip.tripped, 1)
+	}
+}
+
+// writeUnavailable responds with 503, telling the client how long to wait before trying again
+func writeUnavailable(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Del("Content-Type")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("Database unavailable"))
+}
+
+// circuitWriter answers with 503 in place of any error response of a request that had an
+// operation fail with ErrCircuitOpen, whatever status its handler chose for that error
+type circuitWriter struct {
+	http.ResponseWriter
+	breaker     *Breaker
+	trip        *circuitTrip
+	wroteHeader bool
+	unavailable bool
+}
+
+func (w *circuitWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+
+	if code >= http.StatusBadRequest && atomic.LoadInt32(&w.trip.tripped) == 1 {
+		w.unavailable = true
+		writeUnavailable(w.ResponseWriter, w.breaker.RetryAfter())
+		return
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *circuitWriter) Write(b []byte) (int, error) {
+	if w.wroteHeader == false {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	// the body the handler meant for the error is left out
+	if w.unavailable {
+		return len(b), nil
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Handler serves requests with next while the breaker is closed, and answers them with 503 and a
+// Retry-After header while it is open. A request let through that still has an operation fail
+// with ErrCircuitOpen, because the breaker opened or another request is finding out whether the
+// database is back, is answered the same way in place of the error response of next
+func (b *Breaker) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait := b.RetryAfter(); wait > 0 {
+			writeUnavailable(w, wait)
+			return
+		}
+
+		trip := &circuitTrip{}
+		ctx := context.WithValue(r.Context(), circuitTripKey{}, trip)
+
+		next.ServeHTTP(&circuitWriter{ResponseWriter: w, breaker: b, trip: trip}, r.WithContext(ctx))
+	})
+}
+
+type resilientDatabase struct {
+	Database
+	policy  RetryPolicy
+	breaker *Breaker
+}
+
+// Resilient retries reads on db that fail while a primary steps down or the network drops,
+// waiting according to policy for as long as their context allows. Writes are never retried,
+// the MongoDB driver already retries them once where it is safe to. Every operation goes through
+// breaker, and fails with ErrCircuitOpen while it is open
+func Resilient(db Database, policy RetryPolicy, breaker *Breaker) Database {
+	return &resilientDatabase{Database: db, policy: policy, breaker: breaker}
+}
+
+func (d *resilientDatabase) unwrap() Database {
+	return d.Database
+}
+
+func (d *resilientDatabase) Collection(collectionName string) Collection {
+	return &resilientCollection{
+		collection: d.Database.Collection(collectionName),
+		db:         d,
+	}
+}
+
+type resilientCollection struct {
+	collection Collection
+	db         *resilientDatabase
+}
+
+// inTransaction whether ctx belongs to a transaction, which has to be retried as a whole
+func inTransaction(ctx context.Context) bool {
+	return ctx.Value(mongoTxKey{}) != nil || ctx.Value(sqliteTxKey{}) != nil
+}
+
+// write runs a write once, if the breaker allows it
+func (c *resilientCollection) write(ctx context.Context, fn func() error) error {
+	err := c.db.breaker.allow()
+
+	if err != nil {
+		tripCircuit(ctx)
+		return err
+	}
+
+	err = fn()
+	c.db.breaker.record(err)
+
+	return err
+}
+
+// read runs a read until it succeeds, fails in a way retrying won't help with, runs out of
+// attempts or its context is done
+func (c *resilientCollection) read(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := c.write(ctx, fn)
+
+		if err == nil || attempt >= c.db.policy.Attempts || isRetryable(err) == false || inTransaction(ctx) {
+			return err
+		}
+
+		t := time.NewTimer(c.db.policy.backoff(attempt))
+
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+func (c *resilientCollection) Find(ctx context.Context, filter interface{}, opts *options.FindOptions) (Cursor, error) {
+	var curs Cursor
+
+	err := c.read(ctx, func() error {
+		var err error
+		curs, err = c.collection.Find(ctx, filter, opts)
+		return err
+	})
+
+	return curs, err
+}
+
+func (c *resilientCollection) FindOne(ctx context.Context, filter interface{}, opts *options.FindOneOptions) SingleResult {
+	var res SingleResult
+
+	err := c.read(ctx, func() error {
+		res = c.collection.FindOne(ctx, filter, opts)
+
+		// finding nothing is an answer
+		if res.Err() == mongo.ErrNoDocuments {
+			return nil
+		}
+
+		return res.Err()
+	})
+
+	if res == nil {
+		return &rawSingleResult{err: err}
+	}
+
+	return res
+}
+
+func (c *resilientCollection) InsertOne(ctx context.Context, doc interface{}, opts *options.InsertOneOptions) (string, error) {
+	var id string
+
+	err := c.write(ctx, func() error {
+		var err error
+		id, err = c.collection.InsertOne(ctx, doc, opts)
+		return err
+	})
+
+	return id, err
+}
+
+func (c *resilientCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts *options.UpdateOptions) (UpdateResult, error) {
+	var res UpdateResult
+
+	err := c.write(ctx, func() error {
+		var err error
+		res, err = c.collection.UpdateOne(ctx, filter, update, opts)
+		return err
+	})
+
+	return res, err
+}
+
+func (c *resilientCollection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts *options.UpdateOptions) (UpdateResult, error) {
+	var res UpdateResult
+
+	err := c.write(ctx, func() error {
+		var err error
+		res, err = c.collection.UpdateMany(ctx, filter, update, opts)
+		return err
+	})
+
+	return res, err
+}
+
+func (c *resilientCollection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts *options.FindOneAndUpdateOptions) SingleResult {
+	var res SingleResult
+
+	err := c.write(ctx, func() error {
+		res = c.collection.FindOneAndUpdate(ctx, filter, update, opts)
+
+		if res.Err() == mongo.ErrNoDocuments {
+			return nil
+		}
+
+		return res.Err()
+	})
+
+	if res == nil {
+		return &rawSingleResult{err: err}
+	}
+
+	return res
+}
+
+func (c *resilientCollection) DeleteOne(ctx context.Context, filter interface{}, opts *options.DeleteOptions) (int64, error) {
+	var n int64
+
+	err := c.write(ctx, func() error {
+		var err error
+		n, err = c.collection.DeleteOne(ctx, filter, opts)
+		return err
+	})
+
+	return n, err
+}
+
+func (c *resilientCollection) DeleteMany(ctx context.Context, filter interface{}, opts *options.DeleteOptions) (int64, error) {
+	var n int64
+
+	err := c.write(ctx, func() error {
+		var err error
+		n, err = c.collection.DeleteMany(ctx, filter, opts)
+		return err
+	})
+
+	return n, err
+}
+
+func (c *resilientCollection) CountDocuments(ctx context.Context, filter interface{}, opts *options.CountOptions) (int64, error) {
+	var n int64
+
+	err := c.read(ctx, func() error {
+		var err error
+		n, err = c.collection.CountDocuments(ctx, filter, opts)
+		return err
+	})
+
+	return n, err
+}
+
+// Aggregate retries pipelines unless they write their results with $out or $merge
+func (c *resilientCollection) Aggregate(ctx context.Context, pipeline interface{}, opts *options.AggregateOptions) (Cursor, error) {
+	var curs Cursor
+
+	aggregate := func() error {
+		var err error
+		curs, err = c.collection.Aggregate(ctx, pipeline, opts)
+		return err
+	}
+
+	stages, err := pipelineStages(pipeline)
+
+	// a pipeline that can't be read is left for the database to reject
+	writes := err != nil
+
+	for _, s := range stages {
+		writes = writes || s.Key == "$out" || s.Key == "$merge"
+	}
+
+	if writes {
+		return curs, c.write(ctx, aggregate)
+	}
+
+	return curs, c.read(ctx, aggregate)
+}
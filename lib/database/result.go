@@ -1,6 +1,9 @@
 package database
 
-import "go.mongodb.org/mongo-driver/mongo"
+import (
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
 
 // SingleResult wrapper of mongo.SingleResult
 type SingleResult interface {
@@ -24,3 +27,78 @@ func (r *mongoSingleResult) DecodeBytes() ([]byte, error) {
 func (r *mongoSingleResult) Err() error {
 	return r.result.Err()
 }
+
+// UpdateResult wrapper of mongo.UpdateResult
+type UpdateResult interface {
+	MatchedCount() int64
+	ModifiedCount() int64
+	UpsertedID() string
+}
+
+type mongoUpdateResult struct {
+	result *mongo.UpdateResult
+}
+
+func (r *mongoUpdateResult) MatchedCount() int64 {
+	if r.result == nil {
+		return 0
+	}
+	return r.result.MatchedCount
+}
+
+func (r *mongoUpdateResult) ModifiedCount() int64 {
+	if r.result == nil {
+		return 0
+	}
+	return r.result.ModifiedCount
+}
+
+func (r *mongoUpdateResult) UpsertedID() string {
+	if r.result == nil {
+		return ""
+	}
+	if r.result.UpsertedID == nil {
+		return ""
+	}
+	return idString(r.result.UpsertedID)
+}
+
+// updateResult the UpdateResult of backends that count matches themselves
+type updateResult struct {
+	matched    int64
+	modified   int64
+	upsertedID string
+}
+
+func (r *updateResult) MatchedCount() int64 {
+	return r.matched
+}
+
+func (r *updateResult) ModifiedCount() int64 {
+	return r.modified
+}
+
+func (r *updateResult) UpsertedID() string {
+	return r.upsertedID
+}
+
+// countWithOptions applies the skip and limit of CountDocuments to the number of matching documents
+func countWithOptions(matched int64, opts *options.CountOptions) int64 {
+	if opts == nil {
+		return matched
+	}
+
+	if opts.Skip != nil {
+		matched = matched - *opts.Skip
+
+		if matched < 0 {
+			matched = 0
+		}
+	}
+
+	if opts.Limit != nil && *opts.Limit > 0 && *opts.Limit < matched {
+		matched = *opts.Limit
+	}
+
+	return matched
+}
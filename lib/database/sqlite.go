@@ -0,0 +1,1009 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// documents are stored as canonical extended JSON so every bson type survives a round trip.
+// document_fields holds every scalar value of each document by its dotted path, so equality
+// conditions can be narrowed down by an index before the full filter is evaluated in Go. The
+// terms of the text indexed fields are kept there too, under textTermsPath, as an inverted index
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS documents (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	collection TEXT NOT NULL,
+	id TEXT NOT NULL,
+	body TEXT NOT NULL,
+	expires_at INTEGER,
+	UNIQUE (collection, id)
+);
+CREATE INDEX IF NOT EXISTS documents_expires_at ON documents (collection, expires_at);
+CREATE TABLE IF NOT EXISTS document_fields (
+	seq INTEGER NOT NULL,
+	collection TEXT NOT NULL,
+	path TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	value NOT NULL
+);
+CREATE INDEX IF NOT EXISTS document_fields_value ON document_fields (collection, path, kind, value);
+CREATE INDEX IF NOT EXISTS document_fields_seq ON document_fields (seq);
+`
+
+// sqliteTTL a date field that expires documents, the same as a MongoDB TTL index
+type sqliteTTL struct {
+	field       string
+	expireAfter time.Duration
+}
+
+// sqliteTTLs the TTL indexes declared in CollectionIndexes, which sqlite enforces itself
+func sqliteTTLs() map[string]sqliteTTL {
+	ttls := map[string]sqliteTTL{}
+
+	for collectionName, specs := range CollectionIndexes() {
+		for _, spec := range specs {
+			if spec.ExpireAfter != nil && len(spec.Keys) == 1 {
+				ttls[collectionName] = sqliteTTL{field: spec.Keys[0].Key, expireAfter: *spec.ExpireAfter}
+			}
+		}
+	}
+
+	return ttls
+}
+
+// textTermsPath the path the terms of the text indexed fields of a document are stored under in
+// document_fields, which no field of a document can have
+const textTermsPath = "$text"
+
+type sqliteDatabase struct {
+	db   *sql.DB
+	ttls map[string]sqliteTTL
+}
+
+// OpenSQLiteDatabase opens, creating if needed, a SQLite database file as a Database.
+// A path of ":memory:" keeps the database in memory for as long as it is open
+func OpenSQLiteDatabase(path string) (Database, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open sqlite database: %s", path)
+	}
+
+	// sqlite only allows one writer at a time, and each connection to ":memory:" is its own database
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(sqliteSchema)
+
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "Failed to create sqlite schema")
+	}
+
+	d := &sqliteDatabase{db: db, ttls: sqliteTTLs()}
+
+	err = d.indexText(context.Background())
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return d, err
+}
+
+// indexText stores the terms of documents written before their collection had a text index
+func (d *sqliteDatabase) indexText(ctx context.Context) error {
+	for collectionName := range CollectionIndexes() {
+		c := d.Collection(collectionName).(*sqliteCollection)
+
+		if c.text == nil {
+			continue
+		}
+
+		err := c.withTx(ctx, func(tx *sql.Tx) error {
+			rows, err := c.unindexed(ctx, tx)
+
+			for i := 0; err == nil && i < len(rows); i++ {
+				err = c.writeFields(ctx, tx, rows[i].seq, rows[i].doc)
+			}
+
+			return err
+		})
+
+		if err != nil {
+			return errors.Wrapf(err, "Failed to index text of %s", collectionName)
+		}
+	}
+
+	return nil
+}
+
+func (d *sqliteDatabase) Collection(collectionName string) Collection {
+	c := &sqliteCollection{
+		db:     d.db,
+		name:   collectionName,
+		text:   textWeights(collectionName),
+		unique: uniqueIndexes(collectionName),
+	}
+
+	if ttl, ok := d.ttls[collectionName]; ok {
+		c.ttl = &ttl
+	}
+
+	return c
+}
+
+type sqliteCollection struct {
+	db   *sql.DB
+	name string
+	ttl  *sqliteTTL
+	// text the weights of the text index of the collection, nil if it has none
+	text map[string]float64
+	// unique the unique indexes of the collection, which every write is checked against
+	unique []IndexSpec
+}
+
+type sqliteRow struct {
+	seq int64
+	doc primitive.D
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+type extractedField struct {
+	path  string
+	kind  string
+	value interface{}
+}
+
+// fieldKey how a scalar value is stored in document_fields, numbers of every type share a kind
+// so that they compare the way MongoDB compares them
+func fieldKey(v interface{}) (string, interface{}, bool) {
+	if f, ok := toFloat(v); ok {
+		return "n", f, true
+	}
+
+	switch t := v.(type) {
+	case string:
+		return "s", t, true
+	case bool:
+		if t {
+			return "b", 1, true
+		}
+		return "b", 0, true
+	case primitive.ObjectID:
+		return "o", t.Hex(), true
+	case primitive.DateTime:
+		return "d", int64(t), true
+	}
+
+	return "", nil, false
+}
+
+// extractFields every scalar in a document by the path a filter would use to reach it.
+// Array elements are stored under the path of the array, as that is how MongoDB matches them
+func extractFields(path string, v interface{}, fields []extractedField) []extractedField {
+	switch t := v.(type) {
+	case primitive.D:
+		for _, e := range t {
+			p := e.Key
+			if path != "" {
+				p = path + "." + e.Key
+			}
+			fields = extractFields(p, e.Value, fields)
+		}
+	case primitive.A:
+		for _, el := range t {
+			fields = extractFields(path, el, fields)
+		}
+	default:
+		if kind, value, ok := fieldKey(t); ok {
+			fields = append(fields, extractedField{path: path, kind: kind, value: value})
+		}
+	}
+
+	return fields
+}
+
+// indexedConditions the equality and $in conditions of a filter that can be looked up in
+// document_fields. Anything else is left for matchFilter
+func indexedConditions(filter primitive.D) map[string][]extractedField {
+	conds := map[string][]extractedField{}
+
+	for _, e := range filter {
+		if strings.HasPrefix(e.Key, "$") {
+			continue
+		}
+
+		// positional paths like "tags.0" are not extracted
+		numeric := false
+		for _, p := range splitPath(e.Key) {
+			if _, err := strconv.Atoi(p); err == nil {
+				numeric = true
+			}
+		}
+
+		if numeric {
+			continue
+		}
+
+		values := primitive.A{e.Value}
+
+		if isOperatorDocument(e.Value) {
+			values = nil
+
+			for _, op := range e.Value.(primitive.D) {
+				switch op.Key {
+				case "$eq":
+					values = primitive.A{op.Value}
+				case "$in":
+					if in, ok := op.Value.(primitive.A); ok && values == nil {
+						values = in
+					}
+				}
+			}
+		}
+
+		keys := []extractedField{}
+
+		for _, v := range values {
+			kind, value, ok := fieldKey(v)
+
+			if ok == false {
+				keys = nil
+				break
+			}
+
+			keys = append(keys, extractedField{path: e.Key, kind: kind, value: value})
+		}
+
+		if len(keys) > 0 {
+			conds[e.Key] = keys
+		}
+	}
+
+	return conds
+}
+
+func documentKey(id interface{}) (string, error) {
+	b, err := bson.MarshalExtJSON(bson.D{{Key: "_id", Value: id}}, true, false)
+
+	return string(b), errors.Wrap(err, "Failed to marshal document _id")
+}
+
+func (c *sqliteCollection) expiresAt(doc primitive.D) interface{} {
+	if c.ttl == nil {
+		return nil
+	}
+
+	v, ok := valueAt(doc, splitPath(c.ttl.field))
+	date, isDate := v.(primitive.DateTime)
+
+	if ok == false || isDate == false {
+		return nil
+	}
+
+	return int64(date) + c.ttl.expireAfter.Milliseconds()
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// candidates every unexpired document that could match a filter, in insertion order
+func (c *sqliteCollection) candidates(ctx context.Context, q queryer, filter primitive.D) ([]sqliteRow, error) {
+	query := strings.Builder{}
+	query.WriteString("SELECT seq, body FROM documents WHERE collection = ? AND (expires_at IS NULL OR expires_at > ?)")
+	args := []interface{}{c.name, nowMillis()}
+
+	// a text search only reads documents holding at least one of its terms
+	if text, _, err := textSearch(filter); err == nil && text != nil && c.text != nil {
+		query.WriteString(" AND seq IN (SELECT seq FROM document_fields WHERE collection = ? AND path = ? AND kind = ? AND value IN (NULL")
+		args = append(args, c.name, textTermsPath, "term")
+
+		for _, term := range text.Terms {
+			query.WriteString(", ?")
+			args = append(args, term)
+		}
+
+		query.WriteString("))")
+	}
+
+	for path, keys := range indexedConditions(filter) {
+		query.WriteString(" AND seq IN (SELECT seq FROM document_fields WHERE collection = ? AND path = ? AND (")
+		args = append(args, c.name, path)
+
+		for i, k := range keys {
+			if i > 0 {
+				query.WriteString(" OR ")
+			}
+			query.WriteString("(kind = ? AND value = ?)")
+			args = append(args, k.kind, k.value)
+		}
+
+		query.WriteString("))")
+	}
+
+	query.WriteString(" ORDER BY seq")
+
+	return scanRows(ctx, q, query.String(), args...)
+}
+
+// unindexed the documents of a text indexed collection whose terms aren't stored
+func (c *sqliteCollection) unindexed(ctx context.Context, q queryer) ([]sqliteRow, error) {
+	return scanRows(
+		ctx,
+		q,
+		"SELECT seq, body FROM documents WHERE collection = ? AND seq NOT IN "+
+			"(SELECT seq FROM document_fields WHERE collection = ? AND path = ?) ORDER BY seq",
+		c.name,
+		c.name,
+		textTermsPath,
+	)
+}
+
+func scanRows(ctx context.Context, q queryer, query string, args ...interface{}) ([]sqliteRow, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query sqlite documents")
+	}
+
+	defer rows.Close()
+
+	results := []sqliteRow{}
+
+	for rows.Next() {
+		var (
+			row  sqliteRow
+			body string
+		)
+
+		err = rows.Scan(&row.seq, &body)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read sqlite document")
+		}
+
+		err = bson.UnmarshalExtJSON([]byte(body), true, &row.doc)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to unmarshal sqlite document")
+		}
+
+		results = append(results, row)
+	}
+
+	return results, errors.Wrap(rows.Err(), "Failed reading sqlite documents")
+}
+
+// matching the stored documents that match a filter
+func (c *sqliteCollection) matching(ctx context.Context, q queryer, filter interface{}) ([]sqliteRow, error) {
+	f, err := normalize(filter)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid filter")
+	}
+
+	rows, err := c.candidates(ctx, q, f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []sqliteRow{}
+
+	for _, row := range rows {
+		matched, err := matchFilter(row.doc, f)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if matched {
+			matches = append(matches, row)
+		}
+	}
+
+	return matches, nil
+}
+
+// sqliteTxKey the context key of the transaction started by WithTransaction
+type sqliteTxKey struct{}
+
+type sqliteTx struct {
+	db *sql.DB
+	tx *sql.Tx
+}
+
+// currentTx the transaction of db that ctx was given by WithTransaction, if any
+func currentTx(ctx context.Context, db *sql.DB) *sql.Tx {
+	t, ok := ctx.Value(sqliteTxKey{}).(*sqliteTx)
+
+	if ok == false || t.db != db {
+		return nil
+	}
+
+	return t.tx
+}
+
+// Ping checks the database file can still be used
+func (d *sqliteDatabase) Ping(ctx context.Context) error {
+	return errors.Wrap(d.db.PingContext(ctx), "Failed to ping sqlite database")
+}
+
+// WithTransaction runs fn in a sqlite transaction, which every collection of this database uses
+// when it is given the context fn is called with
+func (d *sqliteDatabase) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if currentTx(ctx, d.db) != nil {
+		return fn(ctx)
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to begin sqlite transaction")
+	}
+
+	err = fn(context.WithValue(ctx, sqliteTxKey{}, &sqliteTx{db: d.db, tx: tx}))
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return errors.Wrap(tx.Commit(), "Failed to commit sqlite transaction")
+}
+
+// queryer the transaction ctx belongs to, or the database. Only one connection is ever open, so
+// reading outside of a running transaction would wait for it forever
+func (c *sqliteCollection) queryer(ctx context.Context) queryer {
+	if tx := currentTx(ctx, c.db); tx != nil {
+		return tx
+	}
+
+	return c.db
+}
+
+// withTx runs fn in a transaction of its own, or in a savepoint of the transaction ctx belongs to,
+// so a write that fails part way leaves nothing behind either way
+func (c *sqliteCollection) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if tx := currentTx(ctx, c.db); tx != nil {
+		_, err := tx.ExecContext(ctx, "SAVEPOINT write")
+
+		if err != nil {
+			return errors.Wrap(err, "Failed to begin sqlite savepoint")
+		}
+
+		err = c.purgeExpired(ctx, tx)
+
+		if err == nil {
+			err = fn(tx)
+		}
+
+		if err != nil {
+			tx.ExecContext(ctx, "ROLLBACK TO write")
+			tx.ExecContext(ctx, "RELEASE write")
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "RELEASE write")
+
+		return errors.Wrap(err, "Failed to release sqlite savepoint")
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to begin sqlite transaction")
+	}
+
+	err = c.purgeExpired(ctx, tx)
+
+	if err == nil {
+		err = fn(tx)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return errors.Wrap(tx.Commit(), "Failed to commit sqlite transaction")
+}
+
+// purgeExpired deletes expired documents, they are already hidden from reads
+func (c *sqliteCollection) purgeExpired(ctx context.Context, tx *sql.Tx) error {
+	if c.ttl == nil {
+		return nil
+	}
+
+	now := nowMillis()
+
+	_, err := tx.ExecContext(
+		ctx,
+		"DELETE FROM document_fields WHERE seq IN (SELECT seq FROM documents WHERE collection = ? AND expires_at <= ?)",
+		c.name,
+		now,
+	)
+
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM documents WHERE collection = ? AND expires_at <= ?", c.name, now)
+	}
+
+	return errors.Wrap(err, "Failed to purge expired sqlite documents")
+}
+
+func (c *sqliteCollection) writeFields(ctx context.Context, tx *sql.Tx, seq int64, doc primitive.D) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM document_fields WHERE seq = ?", seq)
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to clear sqlite document fields")
+	}
+
+	fields := extractFields("", doc, nil)
+
+	if c.text != nil {
+		for _, term := range documentTerms(doc, c.text) {
+			fields = append(fields, extractedField{path: textTermsPath, kind: "term", value: term})
+		}
+	}
+
+	for _, f := range fields {
+		_, err = tx.ExecContext(
+			ctx,
+			"INSERT INTO document_fields (seq, collection, path, kind, value) VALUES (?, ?, ?, ?, ?)",
+			seq,
+			c.name,
+			f.path,
+			f.kind,
+			f.value,
+		)
+
+		if err != nil {
+			return errors.Wrap(err, "Failed to store sqlite document fields")
+		}
+	}
+
+	return nil
+}
+
+// checkUnique whether a unique index holds any other document under the same values as the one
+// just written at seq. It runs in the transaction of the write, which fails with it
+func (c *sqliteCollection) checkUnique(ctx context.Context, tx *sql.Tx, seq int64, doc primitive.D) error {
+	for _, spec := range c.unique {
+		values, ok := spec.indexedValues(doc)
+
+		if ok == false {
+			continue
+		}
+
+		rows, err := c.candidates(ctx, tx, spec.uniqueFilter(values))
+
+		if err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			if row.seq != seq && spec.holdsUnder(row.doc, values) {
+				return uniqueKeyError(c.name, spec, values)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *sqliteCollection) insert(ctx context.Context, tx *sql.Tx, doc primitive.D) (interface{}, error) {
+	doc, id := ensureID(doc)
+
+	key, err := documentKey(id)
+
+	if err != nil {
+		return id, err
+	}
+
+	body, err := bson.MarshalExtJSON(doc, true, false)
+
+	if err != nil {
+		return id, errors.Wrap(err, "Failed to marshal sqlite document")
+	}
+
+	res, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO documents (collection, id, body, expires_at) VALUES (?, ?, ?, ?)",
+		c.name,
+		key,
+		string(body),
+		c.expiresAt(doc),
+	)
+
+	if se, ok := err.(sqlite3.Error); ok && se.Code == sqlite3.ErrConstraint {
+		return id, duplicateKeyError(c.name, id)
+	}
+
+	if err != nil {
+		return id, errors.Wrap(err, "Failed to insert sqlite document")
+	}
+
+	seq, err := res.LastInsertId()
+
+	if err != nil {
+		return id, errors.Wrap(err, "Failed to get seq of inserted sqlite document")
+	}
+
+	err = c.writeFields(ctx, tx, seq, doc)
+
+	if err != nil {
+		return id, err
+	}
+
+	return id, c.checkUnique(ctx, tx, seq, doc)
+}
+
+func (c *sqliteCollection) Find(ctx context.Context, filter interface{}, opts *options.FindOptions) (Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return &rawCursor{index: -1}, err
+	}
+
+	docs, err := c.find(ctx, filter, opts)
+
+	return &rawCursor{documents: docs, index: -1}, err
+}
+
+func (c *sqliteCollection) find(ctx context.Context, filter interface{}, opts *options.FindOptions) ([]bson.Raw, error) {
+	f, err := normalize(filter)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid filter")
+	}
+
+	rows, err := c.candidates(ctx, c.queryer(ctx), f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]primitive.D, len(rows))
+	for i, row := range rows {
+		docs[i] = row.doc
+	}
+
+	return queryDocuments(c.name, docs, f, opts)
+}
+
+func (c *sqliteCollection) FindOne(ctx context.Context, filter interface{}, opts *options.FindOneOptions) SingleResult {
+	if err := ctx.Err(); err != nil {
+		return &rawSingleResult{err: err}
+	}
+
+	limit := int64(1)
+	findOpts := &options.FindOptions{Limit: &limit}
+
+	if opts != nil {
+		findOpts.Sort = opts.Sort
+		findOpts.Skip = opts.Skip
+		findOpts.Projection = opts.Projection
+	}
+
+	docs, err := c.find(ctx, filter, findOpts)
+
+	if err != nil {
+		return &rawSingleResult{err: err}
+	}
+
+	if len(docs) == 0 {
+		return &rawSingleResult{err: mongo.ErrNoDocuments}
+	}
+
+	return &rawSingleResult{raw: docs[0]}
+}
+
+func (c *sqliteCollection) InsertOne(ctx context.Context, document interface{}, opts *options.InsertOneOptions) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	doc, err := normalize(document)
+
+	if err != nil {
+		return "", err
+	}
+
+	var id interface{}
+
+	err = c.withTx(ctx, func(tx *sql.Tx) error {
+		id, err = c.insert(ctx, tx, doc)
+		return err
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return idString(id), err
+}
+
+// replace stores a new version of a document in place
+func (c *sqliteCollection) replace(ctx context.Context, tx *sql.Tx, seq int64, doc primitive.D) error {
+	body, err := bson.MarshalExtJSON(doc, true, false)
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal sqlite document")
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"UPDATE documents SET body = ?, expires_at = ? WHERE seq = ?",
+		string(body),
+		c.expiresAt(doc),
+		seq,
+	)
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to update sqlite document")
+	}
+
+	err = c.writeFields(ctx, tx, seq, doc)
+
+	if err != nil {
+		return err
+	}
+
+	return c.checkUnique(ctx, tx, seq, doc)
+}
+
+// update applies an update to the first document matching a filter, or to every one when many
+// is true. It also returns the first updated document from before and after the update, which
+// FindOneAndUpdate reports
+func (c *sqliteCollection) update(
+	ctx context.Context,
+	tx *sql.Tx,
+	filter interface{},
+	update interface{},
+	upsert bool,
+	many bool,
+	sortSpec interface{},
+) (*updateResult, primitive.D, primitive.D, error) {
+	res := &updateResult{}
+
+	matches, err := c.matching(ctx, tx, filter)
+
+	if err != nil {
+		return res, nil, nil, err
+	}
+
+	if len(matches) == 0 {
+		if upsert == false {
+			return res, nil, nil, nil
+		}
+
+		doc, err := upsertDocument(filter, update)
+
+		if err != nil {
+			return res, nil, nil, err
+		}
+
+		doc, id := ensureID(doc)
+		_, err = c.insert(ctx, tx, doc)
+
+		if err != nil {
+			return res, nil, nil, err
+		}
+
+		res.upsertedID = idString(id)
+
+		return res, nil, doc, nil
+	}
+
+	if sortSpec != nil {
+		less, err := documentOrder(sortSpec)
+
+		if err != nil {
+			return res, nil, nil, err
+		}
+
+		sort.SliceStable(matches, func(i, j int) bool {
+			return less(matches[i].doc, matches[j].doc)
+		})
+	}
+
+	if many == false {
+		matches = matches[:1]
+	}
+
+	var before, after primitive.D
+
+	for i, row := range matches {
+		updated, err := applyUpdate(row.doc, update, false)
+
+		if err != nil {
+			return res, nil, nil, err
+		}
+
+		if i == 0 {
+			before, after = row.doc, updated
+		}
+
+		res.matched++
+
+		if valuesEqual(updated, row.doc) {
+			continue
+		}
+
+		res.modified++
+
+		err = c.replace(ctx, tx, row.seq, updated)
+
+		if err != nil {
+			return res, nil, nil, err
+		}
+	}
+
+	return res, before, after, nil
+}
+
+func (c *sqliteCollection) updateWithOptions(ctx context.Context, filter interface{}, update interface{}, opts *options.UpdateOptions, many bool) (UpdateResult, error) {
+	res := &updateResult{}
+
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+
+	err := c.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		res, _, _, err = c.update(ctx, tx, filter, update, opts != nil && isUpsert(opts.Upsert), many, nil)
+		return err
+	})
+
+	if err != nil {
+		return &updateResult{}, err
+	}
+
+	return res, err
+}
+
+func (c *sqliteCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts *options.UpdateOptions) (UpdateResult, error) {
+	return c.updateWithOptions(ctx, filter, update, opts, false)
+}
+
+func (c *sqliteCollection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts *options.UpdateOptions) (UpdateResult, error) {
+	return c.updateWithOptions(ctx, filter, update, opts, true)
+}
+
+func (c *sqliteCollection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts *options.FindOneAndUpdateOptions) SingleResult {
+	if err := ctx.Err(); err != nil {
+		return &rawSingleResult{err: err}
+	}
+
+	if opts == nil {
+		opts = &options.FindOneAndUpdateOptions{}
+	}
+
+	var before, after primitive.D
+
+	err := c.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		_, before, after, err = c.update(ctx, tx, filter, update, isUpsert(opts.Upsert), false, opts.Sort)
+		return err
+	})
+
+	if err != nil {
+		return &rawSingleResult{err: err}
+	}
+
+	return returnedDocument(before, after, opts)
+}
+
+func (c *sqliteCollection) CountDocuments(ctx context.Context, filter interface{}, opts *options.CountOptions) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	matches, err := c.matching(ctx, c.queryer(ctx), filter)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return countWithOptions(int64(len(matches)), opts), nil
+}
+
+func (c *sqliteCollection) Aggregate(ctx context.Context, pipeline interface{}, opts *options.AggregateOptions) (Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return &rawCursor{index: -1}, err
+	}
+
+	stages, err := pipelineStages(pipeline)
+
+	if err != nil {
+		return &rawCursor{index: -1}, err
+	}
+
+	// a leading $match narrows down the documents read the same way a find does
+	prefilter := primitive.D{}
+
+	if len(stages) > 0 && stages[0].Key == "$match" {
+		if f, ok := stages[0].Value.(primitive.D); ok {
+			prefilter = f
+		}
+	}
+
+	rows, err := c.candidates(ctx, c.queryer(ctx), prefilter)
+
+	if err != nil {
+		return &rawCursor{index: -1}, err
+	}
+
+	docs := make([]primitive.D, len(rows))
+	for i, row := range rows {
+		docs[i] = row.doc
+	}
+
+	results, err := aggregateDocuments(docs, pipeline)
+
+	return &rawCursor{documents: results, index: -1}, err
+}
+
+func (c *sqliteCollection) delete(ctx context.Context, filter interface{}, many bool) (int64, error) {
+	var deleted int64
+
+	if err := ctx.Err(); err != nil {
+		return deleted, err
+	}
+
+	err := c.withTx(ctx, func(tx *sql.Tx) error {
+		matches, err := c.matching(ctx, tx, filter)
+
+		if err != nil {
+			return err
+		}
+
+		if many == false && len(matches) > 1 {
+			matches = matches[:1]
+		}
+
+		for _, row := range matches {
+			_, err = tx.ExecContext(ctx, "DELETE FROM document_fields WHERE seq = ?", row.seq)
+
+			if err == nil {
+				_, err = tx.ExecContext(ctx, "DELETE FROM documents WHERE seq = ?", row.seq)
+			}
+
+			if err != nil {
+				return errors.Wrap(err, "Failed to delete sqlite document")
+			}
+
+			deleted++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return deleted, err
+}
+
+func (c *sqliteCollection) DeleteOne(ctx context.Context, filter interface{}, opts *options.DeleteOptions) (int64, error) {
+	return c.delete(ctx, filter, false)
+}
+
+func (c *sqliteCollection) DeleteMany(ctx context.Context, filter interface{}, opts *options.DeleteOptions) (int64, error) {
+	return c.delete(ctx, filter, true)
+}
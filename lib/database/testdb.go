@@ -33,9 +33,21 @@ func (db *TestDatabase) Collection(collectionName string) Collection {
 	}
 }
 
+// Ping always succeeds
+func (db *TestDatabase) Ping(ctx context.Context) error {
+	return nil
+}
+
+// WithTransaction calls fn directly
+func (db *TestDatabase) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
 type TestCollection struct {
 	name       string
 	LastInsert []byte
+	LastUpdate []byte
+	LastDelete []byte
 	queries    map[string]*[]byte
 }
 
@@ -63,6 +75,96 @@ func (c *TestCollection) InsertOne(ctx context.Context, q interface{}, opts *opt
 	return s, err
 }
 
+func (c *TestCollection) UpdateOne(ctx context.Context, q interface{}, update interface{}, opts *options.UpdateOptions) (UpdateResult, error) {
+	var res = &TestUpdateResult{}
+
+	h, err := GetQueryHash(q)
+
+	if err != nil {
+		return res, err
+	}
+
+	js, err := json.Marshal(update)
+
+	c.LastUpdate = js
+
+	if c.queries[h] != nil {
+		res.matched = 1
+		res.modified = 1
+	}
+
+	return res, err
+}
+
+func (c *TestCollection) UpdateMany(ctx context.Context, q interface{}, update interface{}, opts *options.UpdateOptions) (UpdateResult, error) {
+	return c.UpdateOne(ctx, q, update, opts)
+}
+
+// FindOneAndUpdate records the update and returns the document hashed for the query
+func (c *TestCollection) FindOneAndUpdate(ctx context.Context, q interface{}, update interface{}, opts *options.FindOneAndUpdateOptions) SingleResult {
+	js, err := json.Marshal(update)
+
+	if err != nil {
+		return &TestSingleResult{err: err}
+	}
+
+	c.LastUpdate = js
+
+	return c.FindOne(ctx, q, &options.FindOneOptions{})
+}
+
+// CountDocuments the length of the array hashed for the query, 1 for any other document
+func (c *TestCollection) CountDocuments(ctx context.Context, q interface{}, opts *options.CountOptions) (int64, error) {
+	h, err := GetQueryHash(q)
+
+	if err != nil || c.queries[h] == nil {
+		return 0, err
+	}
+
+	var col []*json.RawMessage
+
+	if json.Unmarshal(*c.queries[h], &col) != nil {
+		return 1, nil
+	}
+
+	return int64(len(col)), nil
+}
+
+// Aggregate the documents hashed for the pipeline, the same way Find looks up a query
+func (c *TestCollection) Aggregate(ctx context.Context, pipeline interface{}, opts *options.AggregateOptions) (Cursor, error) {
+	return c.Find(ctx, pipeline, &options.FindOptions{})
+}
+
+func (c *TestCollection) DeleteOne(ctx context.Context, q interface{}, opts *options.DeleteOptions) (int64, error) {
+	return c.delete(q)
+}
+
+func (c *TestCollection) DeleteMany(ctx context.Context, q interface{}, opts *options.DeleteOptions) (int64, error) {
+	return c.delete(q)
+}
+
+// delete forgets the document hashed for a query, so it can no longer be found
+func (c *TestCollection) delete(q interface{}) (int64, error) {
+	var deleted int64
+
+	h, err := GetQueryHash(q)
+
+	if err != nil {
+		return deleted, err
+	}
+
+	js, err := json.Marshal(q)
+
+	c.LastDelete = js
+
+	if c.queries[h] != nil {
+		deleted = 1
+		delete(c.queries, h)
+	}
+
+	return deleted, err
+}
+
 func (c *TestCollection) Find(ctx context.Context, q interface{}, opts *options.FindOptions) (Cursor, error) {
 	j, err := json.Marshal(q)
 
@@ -154,3 +256,20 @@ func (r *TestSingleResult) Decode(ref interface{}) error {
 func (r *TestSingleResult) DecodeBytes() ([]byte, error) {
 	return *r.resultBytes, r.err
 }
+
+type TestUpdateResult struct {
+	matched  int64
+	modified int64
+}
+
+func (r *TestUpdateResult) MatchedCount() int64 {
+	return r.matched
+}
+
+func (r *TestUpdateResult) ModifiedCount() int64 {
+	return r.modified
+}
+
+func (r *TestUpdateResult) UpsertedID() string {
+	return ""
+}
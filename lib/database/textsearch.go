@@ -0,0 +1,426 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// textStopWords words too common to be worth searching for, the way a MongoDB text index
+// leaves them out
+var textStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"but": true, "by": true, "for": true, "from": true, "has": true, "have": true, "he": true,
+	"her": true, "his": true, "i": true, "in": true, "is": true, "it": true, "its": true,
+	"of": true, "on": true, "or": true, "she": true, "that": true, "the": true, "their": true,
+	"them": true, "there": true, "they": true, "this": true, "to": true, "was": true,
+	"were": true, "will": true, "with": true, "you": true,
+}
+
+// TextToken a word of a text, and where it is
+type TextToken struct {
+	// Term the word as it is indexed and searched for
+	Term string
+	// Start and End the byte offsets of the word in the text
+	Start int
+	End   int
+}
+
+// stem reduces the common english endings of a word, so that "dragons" finds "dragon". It is
+// much simpler than the stemmer of MongoDB, which may match a few more words
+func stem(word string) string {
+	switch {
+	case len(word) > 4 && strings.HasSuffix(word, "ies"):
+		return word[:len(word)-3] + "y"
+	case len(word) > 5 && strings.HasSuffix(word, "ing"):
+		return word[:len(word)-3]
+	case len(word) > 4 && strings.HasSuffix(word, "ed"):
+		return word[:len(word)-2]
+	case len(word) > 4 && strings.HasSuffix(word, "es") && strings.HasSuffix(word, "ses") == false:
+		return word[:len(word)-1]
+	case len(word) > 3 && strings.HasSuffix(word, "s") && strings.HasSuffix(word, "ss") == false:
+		return word[:len(word)-1]
+	}
+
+	return word
+}
+
+// TextTokens the words of a text that are indexed, which leaves out stop words
+func TextTokens(text string) []TextToken {
+	tokens := []TextToken{}
+	start := -1
+
+	flush := func(end int) {
+		if start < 0 {
+			return
+		}
+
+		word := strings.ToLower(text[start:end])
+
+		if textStopWords[word] == false {
+			tokens = append(tokens, TextToken{Term: stem(word), Start: start, End: end})
+		}
+
+		start = -1
+	}
+
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+
+		flush(i)
+	}
+
+	flush(len(text))
+
+	return tokens
+}
+
+func textTerms(text string) []string {
+	terms := []string{}
+
+	for _, t := range TextTokens(text) {
+		terms = append(terms, t.Term)
+	}
+
+	return terms
+}
+
+// TextQuery a $search string of a $text query
+type TextQuery struct {
+	// Terms the words a document needs at least one of
+	Terms []string
+	// Phrases quoted in the search, a document needs all of them
+	Phrases []string
+	// Negated words prefixed with -, a document needs none of them
+	Negated []string
+}
+
+// ParseTextQuery reads a $search string the way MongoDB does
+func ParseTextQuery(search string) TextQuery {
+	q := TextQuery{}
+	seen := map[string]bool{}
+
+	parts := strings.Split(search, `"`)
+
+	for i, part := range parts {
+		// every other part is inside quotes, a quote that is never closed runs to the end
+		if i%2 == 1 {
+			if phrase := strings.TrimSpace(part); phrase != "" {
+				q.Phrases = append(q.Phrases, phrase)
+			}
+		}
+
+		for _, word := range strings.Fields(part) {
+			negated := i%2 == 0 && strings.HasPrefix(word, "-")
+
+			for _, term := range textTerms(word) {
+				switch {
+				case negated:
+					q.Negated = append(q.Negated, term)
+				case seen[term] == false:
+					seen[term] = true
+					q.Terms = append(q.Terms, term)
+				}
+			}
+		}
+	}
+
+	return q
+}
+
+// textWeights how much each field of a collection counts towards the score of a text search,
+// from its text index in CollectionIndexes. Nil if the collection has no text index
+func textWeights(collectionName string) map[string]float64 {
+	for _, spec := range CollectionIndexes()[collectionName] {
+		if spec.isText() == false {
+			continue
+		}
+
+		weights := map[string]float64{}
+
+		for _, k := range spec.Keys {
+			if k.Value == "text" {
+				weights[k.Key] = 1
+			}
+		}
+
+		for _, w := range spec.Weights {
+			if weight, ok := toFloat(w.Value); ok {
+				weights[w.Key] = weight
+			}
+		}
+
+		return weights
+	}
+
+	return nil
+}
+
+// documentText the text of every field of a document that is searched, by field
+func documentText(doc primitive.D, weights map[string]float64) map[string]string {
+	text := map[string]string{}
+
+	for field := range weights {
+		parts := []string{}
+
+		for _, v := range lookup(doc, splitPath(field)) {
+			if s, ok := v.(string); ok {
+				parts = append(parts, s)
+			}
+		}
+
+		text[field] = strings.Join(parts, " ")
+	}
+
+	return text
+}
+
+// documentTerms every term of the searched fields of a document
+func documentTerms(doc primitive.D, weights map[string]float64) []string {
+	seen := map[string]bool{}
+	terms := []string{}
+
+	for _, text := range documentText(doc, weights) {
+		for _, term := range textTerms(text) {
+			if seen[term] == false {
+				seen[term] = true
+				terms = append(terms, term)
+			}
+		}
+	}
+
+	sort.Strings(terms)
+
+	return terms
+}
+
+// containsPhrase whether the words of a phrase appear in a text, next to each other
+func containsPhrase(tokens []TextToken, phrase []string) bool {
+	if len(phrase) == 0 {
+		return true
+	}
+
+	for i := 0; i+len(phrase) <= len(tokens); i++ {
+		matched := true
+
+		for j, term := range phrase {
+			if tokens[i+j].Term != term {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// textScore scores a document for a text query the way MongoDB does: each field adds its weight
+// for every searched term it holds, more for terms that make up more of the field. A score of 0
+// means the document doesn't match
+func textScore(doc primitive.D, weights map[string]float64, q TextQuery) float64 {
+	score := 0.0
+	phrases := make([]bool, len(q.Phrases))
+
+	for field, text := range documentText(doc, weights) {
+		tokens := TextTokens(text)
+
+		if len(tokens) == 0 {
+			continue
+		}
+
+		counts := map[string]int{}
+		for _, t := range tokens {
+			counts[t.Term]++
+		}
+
+		for _, term := range q.Negated {
+			if counts[term] > 0 {
+				return 0
+			}
+		}
+
+		for _, term := range q.Terms {
+			if n := counts[term]; n > 0 {
+				score += weights[field] * (0.5 + 0.5*float64(n)/float64(len(tokens)))
+			}
+		}
+
+		for i, phrase := range q.Phrases {
+			phrases[i] = phrases[i] || containsPhrase(tokens, textTerms(phrase))
+		}
+	}
+
+	for _, found := range phrases {
+		if found == false {
+			return 0
+		}
+	}
+
+	return score
+}
+
+// textSearch the $search of the top level $text condition of a filter, and the filter without it
+func textSearch(filter primitive.D) (*TextQuery, primitive.D, error) {
+	rest := primitive.D{}
+	var q *TextQuery
+
+	for _, e := range filter {
+		if e.Key != "$text" {
+			rest = append(rest, e)
+			continue
+		}
+
+		text, ok := e.Value.(primitive.D)
+		search, found := "", false
+
+		for _, t := range text {
+			if t.Key == "$search" {
+				search, found = t.Value.(string)
+			}
+		}
+
+		if ok == false || found == false {
+			return nil, filter, fmt.Errorf("$text needs a $search string")
+		}
+
+		parsed := ParseTextQuery(search)
+		q = &parsed
+	}
+
+	return q, rest, nil
+}
+
+// isTextScore whether a projection or sort value is {"$meta": "textScore"}
+func isTextScore(v interface{}) bool {
+	d, ok := v.(primitive.D)
+
+	return ok && len(d) == 1 && d[0].Key == "$meta" && d[0].Value == "textScore"
+}
+
+// textScoreFields the fields a projection or sort puts the text score in, and the rest of it
+func textScoreFields(spec interface{}) ([]string, primitive.D, error) {
+	if spec == nil {
+		return nil, nil, nil
+	}
+
+	s, err := normalize(spec)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fields := []string{}
+	rest := primitive.D{}
+
+	for _, e := range s {
+		if isTextScore(e.Value) {
+			fields = append(fields, e.Key)
+			continue
+		}
+
+		rest = append(rest, e)
+	}
+
+	return fields, rest, nil
+}
+
+// textIndex an inverted index from the terms of the searched fields of a collection to the
+// documents holding them, so a text search only reads the documents that can match. It is
+// guarded by the lock of its collection
+type textIndex struct {
+	weights  map[string]float64
+	postings map[string]map[string]bool
+	// terms the terms each document was indexed under, to remove it again
+	terms map[string][]string
+}
+
+func newTextIndex(weights map[string]float64) *textIndex {
+	return &textIndex{
+		weights:  weights,
+		postings: make(map[string]map[string]bool),
+		terms:    make(map[string][]string),
+	}
+}
+
+// add indexes a document under its key, replacing what it was indexed under before
+func (ix *textIndex) add(key string, doc primitive.D) {
+	ix.remove(key)
+
+	terms := documentTerms(doc, ix.weights)
+	ix.terms[key] = terms
+
+	for _, term := range terms {
+		if ix.postings[term] == nil {
+			ix.postings[term] = make(map[string]bool)
+		}
+
+		ix.postings[term][key] = true
+	}
+}
+
+// remove takes a document out of the index
+func (ix *textIndex) remove(key string) {
+	for _, term := range ix.terms[key] {
+		delete(ix.postings[term], key)
+
+		if len(ix.postings[term]) == 0 {
+			delete(ix.postings, term)
+		}
+	}
+
+	delete(ix.terms, key)
+}
+
+// lookup the keys of the documents holding any of the terms of a query
+func (ix *textIndex) lookup(q TextQuery) map[string]bool {
+	keys := map[string]bool{}
+
+	for _, term := range q.Terms {
+		for key := range ix.postings[term] {
+			keys[key] = true
+		}
+	}
+
+	return keys
+}
+
+// textCandidates narrows documents down to the ones a text index holds under the terms of a query
+func textCandidates(ix *textIndex, docs []primitive.D, q TextQuery) []primitive.D {
+	keys := ix.lookup(q)
+	candidates := []primitive.D{}
+
+	for _, doc := range docs {
+		id, _ := valueAt(doc, []string{"_id"})
+		key, err := documentKey(id)
+
+		if err == nil && keys[key] {
+			candidates = append(candidates, doc)
+		}
+	}
+
+	return candidates
+}
+
+// withTextScore a copy of a document with its text score set in each of fields
+func withTextScore(doc primitive.D, score float64, fields []string) primitive.D {
+	scored := append(primitive.D{}, doc...)
+
+	for _, f := range fields {
+		scored = append(scored, bson.E{Key: f, Value: score})
+	}
+
+	return scored
+}
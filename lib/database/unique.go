@@ -0,0 +1,86 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// uniqueIndexes the unique indexes declared for a collection in CollectionIndexes, which the
+// backends that keep their own indexes enforce themselves. _id is always unique and not among them
+func uniqueIndexes(collectionName string) []IndexSpec {
+	unique := []IndexSpec{}
+
+	for _, spec := range CollectionIndexes()[collectionName] {
+		if spec.Unique {
+			unique = append(unique, spec)
+		}
+	}
+
+	return unique
+}
+
+// indexedValues the values of the fields of a unique index a document is held under, null for
+// each field it doesn't have. A sparse index leaves out documents that have none of its fields
+func (s IndexSpec) indexedValues(doc primitive.D) (primitive.A, bool) {
+	values := primitive.A{}
+	found := false
+
+	for _, k := range s.Keys {
+		v, ok := valueAt(doc, splitPath(k.Key))
+		found = found || ok
+		values = append(values, v)
+	}
+
+	if s.Sparse && found == false {
+		return nil, false
+	}
+
+	return values, true
+}
+
+// holdsUnder whether a unique index holds a document under the same values as another one
+func (s IndexSpec) holdsUnder(doc primitive.D, values primitive.A) bool {
+	docValues, ok := s.indexedValues(doc)
+
+	return ok && valuesEqual(docValues, values)
+}
+
+// uniqueFilter a filter that finds at least every document a unique index holds under values
+func (s IndexSpec) uniqueFilter(values primitive.A) primitive.D {
+	filter := primitive.D{}
+
+	for i, k := range s.Keys {
+		if values[i] != nil {
+			filter = append(filter, primitive.E{Key: k.Key, Value: values[i]})
+		}
+	}
+
+	return filter
+}
+
+// uniqueKeyError the error MongoDB reports when a write would hold two documents under the same
+// values of a unique index
+func uniqueKeyError(collectionName string, s IndexSpec, values primitive.A) error {
+	parts := []string{}
+
+	for i, k := range s.Keys {
+		parts = append(parts, fmt.Sprintf("%s: %v", k.Key, values[i]))
+	}
+
+	return mongo.WriteException{
+		WriteErrors: mongo.WriteErrors{
+			{
+				Code: duplicateKeyCode,
+				Message: fmt.Sprintf(
+					"E11000 duplicate key error collection: %s index: %s dup key: { %s }",
+					collectionName,
+					s.Name(),
+					strings.Join(parts, ", "),
+				),
+			},
+		},
+	}
+}
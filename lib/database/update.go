@@ -0,0 +1,497 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// cloneDocument a deep copy of a document, so an update that fails half way leaves the original alone
+func cloneDocument(doc primitive.D) (primitive.D, error) {
+	return normalize(doc)
+}
+
+func documentID(doc primitive.D) (interface{}, bool) {
+	for _, e := range doc {
+		if e.Key == "_id" {
+			return e.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// ensureID gives a document a new ObjectID if it doesn't have an _id, keeping _id as the first field
+func ensureID(doc primitive.D) (primitive.D, interface{}) {
+	if id, ok := documentID(doc); ok {
+		return doc, id
+	}
+
+	id := primitive.NewObjectID()
+
+	return append(primitive.D{{Key: "_id", Value: id}}, doc...), id
+}
+
+// idString the string InsertOne and UpsertedID report for a document's _id
+func idString(id interface{}) string {
+	switch t := id.(type) {
+	case primitive.ObjectID:
+		return t.Hex()
+	case string:
+		return t
+	}
+
+	return fmt.Sprintf("%v", id)
+}
+
+// seedFromFilter the document an upsert starts from, made of the equality conditions in its filter
+func seedFromFilter(filter primitive.D) (primitive.D, error) {
+	var (
+		seed = primitive.D{}
+		err  error
+	)
+
+	for _, e := range filter {
+		if e.Key == "$and" {
+			clauses, _ := e.Value.(primitive.A)
+
+			for _, clause := range clauses {
+				sub, ok := clause.(primitive.D)
+
+				if ok == false {
+					continue
+				}
+
+				subSeed, err := seedFromFilter(sub)
+
+				if err != nil {
+					return seed, err
+				}
+
+				for _, s := range subSeed {
+					seed, err = setPath(seed, splitPath(s.Key), s.Value)
+
+					if err != nil {
+						return seed, err
+					}
+				}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(e.Key, "$") {
+			continue
+		}
+
+		value := e.Value
+
+		if isOperatorDocument(value) {
+			eq, found := primitive.E{}, false
+
+			for _, op := range value.(primitive.D) {
+				if op.Key == "$eq" {
+					eq, found = op, true
+				}
+			}
+
+			if found == false {
+				continue
+			}
+
+			value = eq.Value
+		}
+
+		seed, err = setPath(seed, splitPath(e.Key), value)
+
+		if err != nil {
+			return seed, err
+		}
+	}
+
+	return seed, err
+}
+
+// upsertDocument the document an upsert inserts when nothing matches its filter
+func upsertDocument(filter interface{}, update interface{}) (primitive.D, error) {
+	f, err := normalize(filter)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid filter")
+	}
+
+	seed, err := seedFromFilter(f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return applyUpdate(seed, update, true)
+}
+
+// returnedDocument the result of FindOneAndUpdate, which is the document from before the update
+// unless the options ask for the one after it
+func returnedDocument(before primitive.D, after primitive.D, opts *options.FindOneAndUpdateOptions) SingleResult {
+	var err error
+	doc := before
+
+	if opts != nil && opts.ReturnDocument != nil && *opts.ReturnDocument == options.After {
+		doc = after
+	}
+
+	if doc == nil {
+		return &rawSingleResult{err: mongo.ErrNoDocuments}
+	}
+
+	if opts != nil && opts.Projection != nil {
+		doc, err = applyProjection(doc, opts.Projection)
+
+		if err != nil {
+			return &rawSingleResult{err: err}
+		}
+	}
+
+	raw, err := marshalDocument(doc)
+
+	if err != nil {
+		return &rawSingleResult{err: err}
+	}
+
+	return &rawSingleResult{raw: raw}
+}
+
+// isUpsert whether update options ask for a document to be inserted when nothing matches
+func isUpsert(upsert *bool) bool {
+	return upsert != nil && *upsert
+}
+
+// applyUpdate applies MongoDB update operators to a copy of a document. inserting is true when
+// the document is being created by an upsert, which is the only time $setOnInsert applies
+func applyUpdate(doc primitive.D, update interface{}, inserting bool) (primitive.D, error) {
+	u, err := normalize(update)
+
+	if err != nil {
+		return doc, err
+	}
+
+	if len(u) == 0 {
+		return doc, fmt.Errorf("Update document must not be empty")
+	}
+
+	updated, err := cloneDocument(doc)
+
+	if err != nil {
+		return doc, err
+	}
+
+	originalID, hadID := documentID(doc)
+
+	for _, op := range u {
+		fields, ok := op.Value.(primitive.D)
+
+		if ok == false {
+			return doc, fmt.Errorf("Update document must only contain update operators, found: %s", op.Key)
+		}
+
+		for _, f := range fields {
+			path := splitPath(f.Key)
+
+			switch op.Key {
+			case "$set":
+				updated, err = setPath(updated, path, f.Value)
+
+			case "$setOnInsert":
+				if inserting {
+					updated, err = setPath(updated, path, f.Value)
+				}
+
+			case "$unset":
+				updated = unsetPath(updated, path)
+
+			case "$inc":
+				updated, err = incPath(updated, path, f.Value)
+
+			case "$push", "$addToSet":
+				updated, err = pushPath(updated, path, f.Value, op.Key == "$addToSet")
+
+			case "$pull":
+				updated, err = pullPath(updated, path, f.Value)
+
+			case "$rename":
+				updated, err = renamePath(updated, path, f.Value)
+
+			default:
+				return doc, fmt.Errorf("Unsupported update operator: %s", op.Key)
+			}
+
+			if err != nil {
+				return doc, errors.Wrapf(err, "Failed to apply %s to %s", op.Key, f.Key)
+			}
+		}
+	}
+
+	newID, hasID := documentID(updated)
+
+	if hadID && (hasID == false || valuesEqual(originalID, newID) == false) {
+		return doc, fmt.Errorf("Performing an update on the path '_id' would modify the immutable field '_id'")
+	}
+
+	return updated, nil
+}
+
+// setPath sets the value at a dotted path, creating documents along the way
+func setPath(doc primitive.D, path []string, value interface{}) (primitive.D, error) {
+	for i, e := range doc {
+		if e.Key != path[0] {
+			continue
+		}
+
+		if len(path) == 1 {
+			doc[i].Value = value
+			return doc, nil
+		}
+
+		child, err := setChildPath(e.Value, path[1:], value)
+
+		if err != nil {
+			return doc, err
+		}
+
+		doc[i].Value = child
+
+		return doc, nil
+	}
+
+	if len(path) == 1 {
+		return append(doc, primitive.E{Key: path[0], Value: value}), nil
+	}
+
+	child, err := setPath(primitive.D{}, path[1:], value)
+
+	return append(doc, primitive.E{Key: path[0], Value: child}), err
+}
+
+func setChildPath(v interface{}, path []string, value interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case primitive.D:
+		return setPath(t, path, value)
+
+	case primitive.A:
+		i, err := strconv.Atoi(path[0])
+
+		if err != nil || i < 0 {
+			return t, fmt.Errorf("Cannot create field '%s' in an array", path[0])
+		}
+
+		for len(t) <= i {
+			t = append(t, nil)
+		}
+
+		if len(path) == 1 {
+			t[i] = value
+			return t, nil
+		}
+
+		if t[i] == nil {
+			t[i] = primitive.D{}
+		}
+
+		child, err := setChildPath(t[i], path[1:], value)
+		t[i] = child
+
+		return t, err
+	}
+
+	return v, fmt.Errorf("Cannot create field '%s' in a %T", path[0], v)
+}
+
+// unsetPath removes the value at a dotted path, if there is one
+func unsetPath(doc primitive.D, path []string) primitive.D {
+	for i, e := range doc {
+		if e.Key != path[0] {
+			continue
+		}
+
+		if len(path) == 1 {
+			return append(doc[:i:i], doc[i+1:]...)
+		}
+
+		if child, ok := e.Value.(primitive.D); ok {
+			doc[i].Value = unsetPath(child, path[1:])
+		}
+
+		return doc
+	}
+
+	return doc
+}
+
+func valueAt(doc primitive.D, path []string) (interface{}, bool) {
+	var current interface{} = doc
+
+	for _, key := range path {
+		d, ok := current.(primitive.D)
+
+		if ok == false {
+			return nil, false
+		}
+
+		found := false
+		for _, e := range d {
+			if e.Key == key {
+				current, found = e.Value, true
+				break
+			}
+		}
+
+		if found == false {
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+func incPath(doc primitive.D, path []string, by interface{}) (primitive.D, error) {
+	if _, ok := toFloat(by); ok == false {
+		return doc, fmt.Errorf("Cannot increment by a non-numeric value")
+	}
+
+	current, exists := valueAt(doc, path)
+
+	if exists == false {
+		return setPath(doc, path, by)
+	}
+
+	if _, ok := toFloat(current); ok == false {
+		return doc, fmt.Errorf("Cannot increment a non-numeric value")
+	}
+
+	var sum interface{}
+
+	switch c := current.(type) {
+	case int32:
+		if b, ok := by.(int32); ok {
+			sum = c + b
+		}
+	case int64:
+		switch b := by.(type) {
+		case int32:
+			sum = c + int64(b)
+		case int64:
+			sum = c + b
+		}
+	}
+
+	if sum == nil {
+		cf, _ := toFloat(current)
+		bf, _ := toFloat(by)
+		sum = cf + bf
+	}
+
+	return setPath(doc, path, sum)
+}
+
+func pushPath(doc primitive.D, path []string, value interface{}, unique bool) (primitive.D, error) {
+	items := primitive.A{value}
+
+	if d, ok := value.(primitive.D); ok && len(d) == 1 && d[0].Key == "$each" {
+		each, ok := d[0].Value.(primitive.A)
+
+		if ok == false {
+			return doc, fmt.Errorf("$each needs an array")
+		}
+
+		items = each
+	}
+
+	current, exists := valueAt(doc, path)
+	arr, ok := current.(primitive.A)
+
+	if exists && ok == false {
+		return doc, fmt.Errorf("Cannot push to a non-array value")
+	}
+
+	for _, item := range items {
+		if unique && matchEq([]interface{}(arr), item) {
+			continue
+		}
+		arr = append(arr, item)
+	}
+
+	if arr == nil {
+		arr = primitive.A{}
+	}
+
+	return setPath(doc, path, arr)
+}
+
+func pullPath(doc primitive.D, path []string, cond interface{}) (primitive.D, error) {
+	current, exists := valueAt(doc, path)
+
+	if exists == false {
+		return doc, nil
+	}
+
+	arr, ok := current.(primitive.A)
+
+	if ok == false {
+		return doc, fmt.Errorf("Cannot pull from a non-array value")
+	}
+
+	kept := primitive.A{}
+
+	for _, item := range arr {
+		var (
+			matched bool
+			err     error
+		)
+
+		if sub, ok := item.(primitive.D); ok && isOperatorDocument(cond) == false && cond != nil {
+			if c, ok := cond.(primitive.D); ok {
+				matched, err = matchFilter(sub, c)
+			}
+		} else {
+			matched, err = matchField([]interface{}{item}, cond)
+		}
+
+		if err != nil {
+			return doc, err
+		}
+
+		if matched == false {
+			kept = append(kept, item)
+		}
+	}
+
+	return setPath(doc, path, kept)
+}
+
+// renamePath moves the value at a dotted path to the path named by to, if there is a value to move
+func renamePath(doc primitive.D, path []string, to interface{}) (primitive.D, error) {
+	target, ok := to.(string)
+
+	if ok == false || target == "" {
+		return doc, fmt.Errorf("$rename needs the new field name as a string")
+	}
+
+	value, exists := valueAt(doc, path)
+
+	if exists == false {
+		return doc, nil
+	}
+
+	return setPath(unsetPath(doc, path), splitPath(target), value)
+}
+
+// marshalDocument the bytes handed back to callers, so they can't change what is stored
+func marshalDocument(doc primitive.D) (bson.Raw, error) {
+	b, err := bson.Marshal(doc)
+
+	return bson.Raw(b), errors.Wrap(err, "Failed to marshal document")
+}
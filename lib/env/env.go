@@ -5,7 +5,9 @@ import (
 	"log"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var logger = log.New(os.Stderr, "env.go ", log.LstdFlags)
@@ -16,12 +18,124 @@ var GHClientSecret string
 // GHClientID client id for github
 var GHClientID string
 
+// DatabaseBackend where documents are stored: mongo, sqlite, or memory to run without a database server
+var DatabaseBackend string
+
+// SQLitePath the database file used by the sqlite backend
+var SQLitePath string
+
 // MongoHost the host for the mongodb instance
 var MongoHost string
 
 // MongoPort the port number on the mongodb instance
 var MongoPort string
 
+// MongoURI full connection string of the mongodb deployment, used instead of MongoHost and
+// MongoPort when set so replica sets and connection options can be given
+var MongoURI string
+
+// MongoDatabase name of the mongodb database, defaults to the one in MongoURI or macguffin_main
+var MongoDatabase string
+
+// MongoUsername user to authenticate as, kept out of MongoURI so the password isn't logged with it
+var MongoUsername string
+
+// MongoPassword password of MongoUsername
+var MongoPassword string
+
+// MongoAuthSource database MongoUsername is defined in, the driver defaults to admin
+var MongoAuthSource string
+
+// MongoTLSCAFile PEM file of the certificate authorities trusted for TLS connections to mongodb,
+// setting it turns TLS on
+var MongoTLSCAFile string
+
+// MongoMaxPoolSize most connections kept open to each mongodb server, 0 for the driver default of 100
+var MongoMaxPoolSize int
+
+// MongoMinPoolSize connections kept open to each mongodb server even when idle
+var MongoMinPoolSize int
+
+// MongoConnectTimeout how long connecting to a mongodb server may take
+var MongoConnectTimeout = 10 * time.Second
+
+// MongoServerSelectionTimeout how long an operation waits for a suitable mongodb server, such as
+// a primary during an election, before it fails
+var MongoServerSelectionTimeout = 10 * time.Second
+
+// Env the environment the server runs in, "local" for development
+var Env string
+
+// IdentityProvider which identity provider agents log in with: github, gitlab, oidc or dev
+var IdentityProvider string
+
+// OAuthRedirectURI where providers redirect back to after login, required by gitlab and oidc
+var OAuthRedirectURI string
+
+// GitlabURL base url of the gitlab instance, defaults to https://gitlab.com
+var GitlabURL string
+
+// GitlabClientID client id for gitlab
+var GitlabClientID string
+
+// GitlabClientSecret client secret for gitlab
+var GitlabClientSecret string
+
+// OIDCName name used to namespace user ids from the oidc provider
+var OIDCName string
+
+// OIDCAuthorizeURL authorization endpoint of the oidc provider
+var OIDCAuthorizeURL string
+
+// OIDCTokenURL token endpoint of the oidc provider
+var OIDCTokenURL string
+
+// OIDCUserInfoURL userinfo endpoint of the oidc provider
+var OIDCUserInfoURL string
+
+// OIDCClientID client id for the oidc provider
+var OIDCClientID string
+
+// OIDCClientSecret client secret for the oidc provider
+var OIDCClientSecret string
+
+// OAuthStateSecret key used to sign the oauth state parameter, shared by every server instance
+var OAuthStateSecret string
+
+// TokenHashKey key for the keyed hash of client tokens stored in the tokens collection
+var TokenHashKey string
+
+// SessionLifetime how long a client token stays valid after it was last used
+var SessionLifetime = time.Hour
+
+// RefreshTokenLifetime how long a refresh token can be exchanged for a new client token
+var RefreshTokenLifetime = 30 * 24 * time.Hour
+
+// MigrateOnStartup whether the server applies pending migrations when it starts, true unless MIGRATE_ON_STARTUP=false
+var MigrateOnStartup bool
+
+// DropUnknownIndexes whether indexes that aren't declared in the database package are dropped on startup
+var DropUnknownIndexes bool
+
+// DatabaseRetryAttempts how many times a read is attempted when the database is failing over
+var DatabaseRetryAttempts = 3
+
+// DatabaseBreakerThreshold how many database operations may fail in a row before requests fail
+// fast with 503, 0 never fails fast
+var DatabaseBreakerThreshold = 5
+
+// DatabaseBreakerCooldown how long requests fail fast before the database is tried again
+var DatabaseBreakerCooldown = 10 * time.Second
+
+// QueryMetrics whether database operations are timed and served from /metrics, true unless QUERY_METRICS=false
+var QueryMetrics bool
+
+// SlowQueryThreshold database operations that take longer than this are logged
+var SlowQueryThreshold = 500 * time.Millisecond
+
+// BootstrapAdmin optional userID of an agent who is granted the admin role on startup, while there is no admin
+var BootstrapAdmin string
+
 func init() {
 	wd, err := os.Getwd()
 
@@ -63,10 +177,48 @@ func init() {
 		envMap[strings.Trim(nameVal[0], " \n")] = strings.Trim(nameVal[1], " \n")
 	}
 
-	GHClientID = checkVar(envMap, "GH_CLIENT_ID")
-	GHClientSecret = checkVar(envMap, "GH_CLIENT_SECRET")
-	MongoHost = checkVar(envMap, "MONGO_HOST")
-	MongoPort = checkVar(envMap, "MONGO_PORT")
+	DatabaseBackend = optionalVar(envMap, "DATABASE_BACKEND", "mongo")
+	SQLitePath = optionalVar(envMap, "SQLITE_PATH", "macguffin.db")
+	MongoHost = optionalVar(envMap, "MONGO_HOST", "localhost")
+	MongoPort = optionalVar(envMap, "MONGO_PORT", "27017")
+	MongoURI = optionalVar(envMap, "MONGO_URI", "")
+	MongoDatabase = optionalVar(envMap, "MONGO_DATABASE", "")
+	MongoUsername = optionalVar(envMap, "MONGO_USERNAME", "")
+	MongoPassword = optionalVar(envMap, "MONGO_PASSWORD", "")
+	MongoAuthSource = optionalVar(envMap, "MONGO_AUTH_SOURCE", "")
+	MongoTLSCAFile = optionalVar(envMap, "MONGO_TLS_CA_FILE", "")
+	MongoMaxPoolSize = intVar(envMap, "MONGO_MAX_POOL_SIZE", MongoMaxPoolSize)
+	MongoMinPoolSize = intVar(envMap, "MONGO_MIN_POOL_SIZE", MongoMinPoolSize)
+	MongoConnectTimeout = durationVar(envMap, "MONGO_CONNECT_TIMEOUT", MongoConnectTimeout)
+	MongoServerSelectionTimeout = durationVar(envMap, "MONGO_SERVER_SELECTION_TIMEOUT", MongoServerSelectionTimeout)
+	Env = optionalVar(envMap, "ENV", "")
+	TokenHashKey = checkVar(envMap, "TOKEN_HASH_KEY")
+	BootstrapAdmin = optionalVar(envMap, "BOOTSTRAP_ADMIN", "")
+	MigrateOnStartup = optionalVar(envMap, "MIGRATE_ON_STARTUP", "true") != "false"
+	DropUnknownIndexes = optionalVar(envMap, "DROP_UNKNOWN_INDEXES", "false") == "true"
+	DatabaseRetryAttempts = intVar(envMap, "DATABASE_RETRY_ATTEMPTS", DatabaseRetryAttempts)
+	DatabaseBreakerThreshold = intVar(envMap, "DATABASE_BREAKER_THRESHOLD", DatabaseBreakerThreshold)
+	DatabaseBreakerCooldown = durationVar(envMap, "DATABASE_BREAKER_COOLDOWN", DatabaseBreakerCooldown)
+	QueryMetrics = optionalVar(envMap, "QUERY_METRICS", "true") != "false"
+	SlowQueryThreshold = durationVar(envMap, "SLOW_QUERY_THRESHOLD", SlowQueryThreshold)
+	SessionLifetime = durationVar(envMap, "SESSION_LIFETIME", SessionLifetime)
+	RefreshTokenLifetime = durationVar(envMap, "REFRESH_TOKEN_LIFETIME", RefreshTokenLifetime)
+
+	// each identity provider checks for the variables it needs when it is created
+	IdentityProvider = optionalVar(envMap, "IDENTITY_PROVIDER", "github")
+	OAuthRedirectURI = optionalVar(envMap, "OAUTH_REDIRECT_URI", "")
+	OAuthStateSecret = optionalVar(envMap, "OAUTH_STATE_SECRET", "")
+	GHClientID = optionalVar(envMap, "GH_CLIENT_ID", "")
+	GHClientSecret = optionalVar(envMap, "GH_CLIENT_SECRET", "")
+	GitlabURL = optionalVar(envMap, "GITLAB_URL", "https://gitlab.com")
+	GitlabClientID = optionalVar(envMap, "GITLAB_CLIENT_ID", "")
+	GitlabClientSecret = optionalVar(envMap, "GITLAB_CLIENT_SECRET", "")
+	OIDCName = optionalVar(envMap, "OIDC_NAME", "oidc")
+	OIDCAuthorizeURL = optionalVar(envMap, "OIDC_AUTHORIZE_URL", "")
+	OIDCTokenURL = optionalVar(envMap, "OIDC_TOKEN_URL", "")
+	OIDCUserInfoURL = optionalVar(envMap, "OIDC_USERINFO_URL", "")
+	OIDCClientID = optionalVar(envMap, "OIDC_CLIENT_ID", "")
+	OIDCClientSecret = optionalVar(envMap, "OIDC_CLIENT_SECRET", "")
 }
 
 func checkVar(envMap map[string]string, varName string) string {
@@ -80,6 +232,41 @@ func checkVar(envMap map[string]string, varName string) string {
 	return v
 }
 
+func optionalVar(envMap map[string]string, varName string, defaultVal string) string {
+	if val, ok := envMap[varName]; ok {
+		os.Setenv(varName, val)
+	}
+	v := os.Getenv(varName)
+	if v == "" {
+		return defaultVal
+	}
+	return v
+}
+
+func durationVar(envMap map[string]string, varName string, defaultVal time.Duration) time.Duration {
+	v := optionalVar(envMap, varName, "")
+	if v == "" {
+		return defaultVal
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		logger.Fatalf("Environment variable %s must be a positive duration such as 90m: %s", varName, v)
+	}
+	return d
+}
+
+func intVar(envMap map[string]string, varName string, defaultVal int) int {
+	v := optionalVar(envMap, varName, "")
+	if v == "" {
+		return defaultVal
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		logger.Fatalf("Environment variable %s must be a non-negative integer: %s", varName, v)
+	}
+	return n
+}
+
 func isInTests() bool {
 	for _, arg := range os.Args {
 		if strings.HasPrefix(arg, "-test.v=") {
@@ -0,0 +1,269 @@
+// Package migrations applies versioned changes to the documents stored in the database. Each
+// applied migration is recorded in the migrations collection, so it is only ever applied once
+package migrations
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/abradley2/macguffin/lib/database"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var logger = log.New(os.Stderr, "migrations.go ", log.LstdFlags)
+
+// Migration one versioned change to the documents stored in the database
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, db database.Database) error
+}
+
+// record how an applied migration is stored in the migrations collection
+type record struct {
+	Version   int       `bson:"version"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+// lockID the _id of the document held in the migrations collection while migrating
+const lockID = "lock"
+
+// LockTimeout how long a lock is honoured before another instance may take it over, in case the
+// instance holding it stopped while migrating
+var LockTimeout = 10 * time.Minute
+
+// LockWait how long Up waits for another instance to finish migrating before giving up
+var LockWait = time.Minute
+
+var lockRetryInterval = time.Second
+
+type errLocked struct{}
+
+// Error _
+func (errLocked) Error() string {
+	return "Another server instance is running migrations"
+}
+
+// ErrLocked indicates another server instance held the migration lock for longer than LockWait
+var ErrLocked errLocked
+
+// sorted the migrations in version order, checking no version is used twice
+func sorted(migrations []Migration) ([]Migration, error) {
+	s := make([]Migration, len(migrations))
+	copy(s, migrations)
+
+	sort.SliceStable(s, func(i, j int) bool {
+		return s[i].Version < s[j].Version
+	})
+
+	for i := 1; i < len(s); i++ {
+		if s[i].Version == s[i-1].Version {
+			return s, fmt.Errorf("Migrations %s and %s both have version %d", s[i-1].Name, s[i].Name, s[i].Version)
+		}
+	}
+
+	return s, nil
+}
+
+// Pending the migrations that have not been applied yet, in the order Up would apply them
+func Pending(ctx context.Context, db database.Database, migrations []Migration) ([]Migration, error) {
+	pending := []Migration{}
+
+	all, err := sorted(migrations)
+
+	if err != nil {
+		return pending, err
+	}
+
+	res, err := db.Collection(database.MigrationsCollection).Find(
+		ctx,
+		bson.M{
+			"version": bson.M{
+				"$exists": true,
+			},
+		},
+		&options.FindOptions{},
+	)
+
+	if err != nil {
+		return pending, errors.Wrap(err, "Failed to find applied migrations")
+	}
+
+	records := []record{}
+	err = res.All(ctx, &records)
+
+	if err != nil {
+		return pending, errors.Wrap(err, "Failed to decode applied migrations")
+	}
+
+	applied := make(map[int]bool, len(records))
+	for _, r := range records {
+		applied[r.Version] = true
+	}
+
+	for _, m := range all {
+		if applied[m.Version] == false {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending, err
+}
+
+// Up applies every pending migration in version order while holding the migration lock, so two
+// server instances never migrate at the same time. It stops at the first migration that fails,
+// which is not recorded and so is tried again the next time
+func Up(ctx context.Context, db database.Database, migrations []Migration) ([]Migration, error) {
+	applied := []Migration{}
+	c := db.Collection(database.MigrationsCollection)
+
+	owner, err := newLockOwner()
+
+	if err != nil {
+		return applied, err
+	}
+
+	err = acquireLock(ctx, c, owner)
+
+	if err != nil {
+		return applied, err
+	}
+
+	defer releaseLock(c, owner)
+
+	// read after taking the lock, so migrations applied by the previous holder are skipped
+	pending, err := Pending(ctx, db, migrations)
+
+	if err != nil {
+		return applied, err
+	}
+
+	for _, m := range pending {
+		logger.Printf("Applying migration %d %s", m.Version, m.Name)
+
+		err = m.Up(ctx, db)
+
+		if err != nil {
+			return applied, errors.Wrapf(err, "Migration %d %s failed", m.Version, m.Name)
+		}
+
+		_, err = c.InsertOne(
+			ctx,
+			bson.M{
+				"_id":       m.Version,
+				"version":   m.Version,
+				"name":      m.Name,
+				"appliedAt": time.Now(),
+			},
+			&options.InsertOneOptions{},
+		)
+
+		if err != nil {
+			return applied, errors.Wrapf(err, "Failed to record migration %d %s", m.Version, m.Name)
+		}
+
+		applied = append(applied, m)
+	}
+
+	return applied, err
+}
+
+func newLockOwner() (string, error) {
+	b := make([]byte, 8)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to generate migration lock owner")
+	}
+
+	host, _ := os.Hostname()
+
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b)), err
+}
+
+// acquireLock inserts the lock document, waiting up to LockWait for another instance to release it
+func acquireLock(ctx context.Context, c database.Collection, owner string) error {
+	deadline := time.Now().Add(LockWait)
+
+	for {
+		now := time.Now()
+		lock := bson.D{
+			{Key: "owner", Value: owner},
+			{Key: "lockedAt", Value: now},
+			{Key: "expiresAt", Value: now.Add(LockTimeout)},
+		}
+
+		_, err := c.InsertOne(ctx, append(bson.D{{Key: "_id", Value: lockID}}, lock...), &options.InsertOneOptions{})
+
+		if err == nil {
+			return nil
+		}
+
+		if database.IsDuplicateKeyError(err) == false {
+			return errors.Wrap(err, "Failed to acquire migration lock")
+		}
+
+		// take over a lock left behind by an instance that stopped while migrating
+		res, err := c.UpdateOne(
+			ctx,
+			bson.M{
+				"_id": lockID,
+				"expiresAt": bson.M{
+					"$lt": now,
+				},
+			},
+			bson.M{
+				"$set": lock,
+			},
+			&options.UpdateOptions{},
+		)
+
+		if err != nil {
+			return errors.Wrap(err, "Failed to take over expired migration lock")
+		}
+
+		if res.MatchedCount() == 1 {
+			logger.Printf("Took over an expired migration lock")
+			return nil
+		}
+
+		if now.After(deadline) {
+			return ErrLocked
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// releaseLock deletes the lock document if it is still held by owner
+func releaseLock(c database.Collection, owner string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := c.DeleteOne(
+		ctx,
+		bson.M{
+			"_id":   lockID,
+			"owner": owner,
+		},
+		&options.DeleteOptions{},
+	)
+
+	if err != nil {
+		logger.Printf("Failed to release migration lock, it expires in %s: %v", LockTimeout, err)
+	}
+}
@@ -0,0 +1,292 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/abradley2/macguffin/lib/database"
+	"github.com/abradley2/macguffin/lib/token"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func recordingMigrations(log *[]string) []Migration {
+	step := func(name string) func(context.Context, database.Database) error {
+		return func(ctx context.Context, db database.Database) error {
+			*log = append(*log, name)
+			return nil
+		}
+	}
+
+	// out of order, Up sorts them by version
+	return []Migration{
+		{Version: 2, Name: "second", Up: step("second")},
+		{Version: 1, Name: "first", Up: step("first")},
+		{Version: 3, Name: "third", Up: step("third")},
+	}
+}
+
+func TestUp(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	ran := []string{}
+	all := recordingMigrations(&ran)
+
+	pending, err := Pending(context.Background(), db, all)
+
+	if err != nil || len(pending) != 3 || pending[0].Name != "first" {
+		t.Fatalf("Expected every migration to be pending in version order, got %v: %v", pending, err)
+	}
+
+	if len(ran) != 0 {
+		t.Errorf("Expected a dry run not to apply anything, ran: %v", ran)
+	}
+
+	applied, err := Up(context.Background(), db, all)
+
+	if err != nil || len(applied) != 3 {
+		t.Fatalf("Expected three migrations to be applied, got %d: %v", len(applied), err)
+	}
+
+	if fmt.Sprint(ran) != "[first second third]" {
+		t.Errorf("Expected migrations to run in version order, ran: %v", ran)
+	}
+
+	applied, err = Up(context.Background(), db, all)
+
+	if err != nil || len(applied) != 0 || len(ran) != 3 {
+		t.Errorf("Expected applied migrations not to run again, ran: %v: %v", ran, err)
+	}
+
+	n, err := db.Collection(database.MigrationsCollection).CountDocuments(context.Background(), bson.M{}, &options.CountOptions{})
+
+	if err != nil || n != 3 {
+		t.Errorf("Expected one record per migration and no lock left behind, got %d: %v", n, err)
+	}
+}
+
+func TestFailedMigration(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	ran := []string{}
+	all := recordingMigrations(&ran)
+	all[0].Up = func(ctx context.Context, db database.Database) error {
+		return fmt.Errorf("second failed")
+	}
+
+	applied, err := Up(context.Background(), db, all)
+
+	if err == nil || len(applied) != 1 || fmt.Sprint(ran) != "[first]" {
+		t.Fatalf("Expected migrating to stop at the failed migration, ran %v: %v", ran, err)
+	}
+
+	pending, err := Pending(context.Background(), db, all)
+
+	if err != nil || len(pending) != 2 || pending[0].Name != "second" {
+		t.Errorf("Expected the failed migration to still be pending, got %v: %v", pending, err)
+	}
+
+	all[0].Up = func(ctx context.Context, db database.Database) error {
+		return nil
+	}
+
+	applied, err = Up(context.Background(), db, all)
+
+	if err != nil || len(applied) != 2 {
+		t.Errorf("Expected the lock to be released after a failure, got %d: %v", len(applied), err)
+	}
+}
+
+func TestDuplicateVersions(t *testing.T) {
+	ran := []string{}
+	all := append(recordingMigrations(&ran), Migration{Version: 2, Name: "another second"})
+
+	_, err := Up(context.Background(), database.NewMemoryDatabase(), all)
+
+	if err == nil || len(ran) != 0 {
+		t.Errorf("Expected migrations sharing a version to be rejected, ran %v: %v", ran, err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	defer func(wait time.Duration, interval time.Duration) {
+		LockWait, lockRetryInterval = wait, interval
+	}(LockWait, lockRetryInterval)
+
+	LockWait, lockRetryInterval = 20*time.Millisecond, 5*time.Millisecond
+
+	db := database.NewMemoryDatabase()
+	ran := []string{}
+	all := recordingMigrations(&ran)
+
+	_, err := db.Collection(database.MigrationsCollection).InsertOne(
+		context.Background(),
+		bson.M{"_id": lockID, "owner": "other", "expiresAt": time.Now().Add(time.Minute)},
+		&options.InsertOneOptions{},
+	)
+
+	if err != nil {
+		t.Fatalf("Failed to insert lock fixture: %v", err)
+	}
+
+	_, err = Up(context.Background(), db, all)
+
+	if err != ErrLocked || len(ran) != 0 {
+		t.Fatalf("Expected Up to give up while another instance holds the lock, ran %v: %v", ran, err)
+	}
+
+	_, err = db.Collection(database.MigrationsCollection).UpdateOne(
+		context.Background(),
+		bson.M{"_id": lockID},
+		bson.M{"$set": bson.M{"expiresAt": time.Now().Add(-time.Minute)}},
+		&options.UpdateOptions{},
+	)
+
+	if err != nil {
+		t.Fatalf("Failed to expire lock fixture: %v", err)
+	}
+
+	applied, err := Up(context.Background(), db, all)
+
+	if err != nil || len(applied) != 3 {
+		t.Errorf("Expected an expired lock to be taken over, got %d: %v", len(applied), err)
+	}
+}
+
+func TestAll(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewMemoryDatabase()
+
+	fixtures := map[string][]bson.M{
+		database.AgentsCollection: {
+			{"userID": "8582764", "initialized": true},
+			{"userID": "gitlab:7", "publicAgentID": "agent-7", "role": "admin", "clearance": 3},
+		},
+		database.ProfileCollection: {
+			{"userID": "8582764", "bio": "old timer"},
+		},
+		database.TokensCollection: {
+			{"userID": "8582764", "clientToken": "plaintext", "accessToken": "gho_secret", "lastSeenAt": time.Now()},
+		},
+		database.MacguffinsCollection: {
+			{"itemTitle": "old", "creator": "8582764", "moderatedBy": "42", "string": "old.jpg"},
+			{"itemTitle": "both", "creator": "gitlab:7", "string": "stale.jpg", "thumbnail": "new.jpg"},
+		},
+	}
+
+	for name, docs := range fixtures {
+		for _, doc := range docs {
+			_, err := db.Collection(name).InsertOne(ctx, doc, &options.InsertOneOptions{})
+
+			if err != nil {
+				t.Fatalf("Failed to insert fixture into %s: %v", name, err)
+			}
+		}
+	}
+
+	_, err := Up(ctx, db, All)
+
+	if err != nil {
+		t.Fatalf("Failed to apply migrations: %v", err)
+	}
+
+	agent := token.UserData{}
+	err = db.Collection(database.AgentsCollection).FindOne(ctx, bson.M{"userID": "github:8582764"}, &options.FindOneOptions{}).Decode(&agent)
+
+	if err != nil || agent.Role != token.RoleAgent || agent.Clearance != 0 || agent.PublicAgentID == "" {
+		t.Errorf("Expected the legacy agent to be namespaced with a default role and a public id, got %v: %v", agent, err)
+	}
+
+	admin := token.UserData{}
+	err = db.Collection(database.AgentsCollection).FindOne(ctx, bson.M{"userID": "gitlab:7"}, &options.FindOneOptions{}).Decode(&admin)
+
+	if err != nil || admin.Role != token.RoleAdmin || admin.Clearance != 3 || admin.PublicAgentID != "agent-7" {
+		t.Errorf("Expected an agent that was already migrated to be left alone, got %v: %v", admin, err)
+	}
+
+	for name, filter := range map[string]bson.M{
+		database.ProfileCollection:    {"userID": "github:8582764"},
+		database.MacguffinsCollection: {"creator": "github:8582764", "moderatedBy": "github:42"},
+		database.TokensCollection: {
+			"userID":          "github:8582764",
+			"clientTokenHash": token.HashClientToken("plaintext"),
+			"clientToken":     bson.M{"$exists": false},
+			"accessToken":     bson.M{"$exists": false},
+		},
+	} {
+		if db.Collection(name).FindOne(ctx, filter, &options.FindOneOptions{}).Err() != nil {
+			t.Errorf("Expected a document in %s matching %v", name, filter)
+		}
+	}
+
+	thumbnails := []struct {
+		ItemTitle string `bson:"itemTitle"`
+		Thumbnail string `bson:"thumbnail"`
+		Old       string `bson:"string"`
+	}{}
+
+	res, err := db.Collection(database.MacguffinsCollection).Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"itemTitle": 1}))
+
+	if err == nil {
+		err = res.All(ctx, &thumbnails)
+	}
+
+	if err != nil || len(thumbnails) != 2 ||
+		thumbnails[0].Thumbnail != "new.jpg" || thumbnails[0].Old != "" ||
+		thumbnails[1].Thumbnail != "old.jpg" || thumbnails[1].Old != "" {
+		t.Errorf("Expected thumbnails to be moved out of the string field, got %v: %v", thumbnails, err)
+	}
+}
+
+// TestMongoUp only runs when MONGO_TEST_URI points at a server it can create databases on, as
+// migration records and the lock are inserted with their own _id rather than an ObjectID
+func TestMongoUp(t *testing.T) {
+	uri := os.Getenv("MONGO_TEST_URI")
+
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+
+	client, err := mongo.NewClient(options.Client().ApplyURI(uri))
+
+	if err != nil {
+		t.Fatalf("Failed to create mongo client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err = client.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect to %s: %v", uri, err)
+	}
+
+	defer client.Disconnect(context.Background())
+
+	mdb := client.Database("macguffin_test_" + primitive.NewObjectID().Hex())
+	defer mdb.Drop(context.Background())
+
+	db := database.NewMongoDatabase(mdb)
+	ran := []string{}
+	all := recordingMigrations(&ran)
+
+	applied, err := Up(ctx, db, all)
+
+	if err != nil || len(applied) != 3 {
+		t.Fatalf("Expected three migrations to be applied, got %d: %v", len(applied), err)
+	}
+
+	applied, err = Up(ctx, db, all)
+
+	if err != nil || len(applied) != 0 || len(ran) != 3 {
+		t.Errorf("Expected applied migrations not to run again, ran: %v: %v", ran, err)
+	}
+
+	n, err := db.Collection(database.MigrationsCollection).CountDocuments(ctx, bson.M{"_id": lockID}, &options.CountOptions{})
+
+	if err != nil || n != 0 {
+		t.Errorf("Expected the migration lock to be released, got %d: %v", n, err)
+	}
+}
@@ -0,0 +1,198 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/abradley2/macguffin/lib/database"
+	"github.com/abradley2/macguffin/lib/token"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// All every migration the server knows about. A released migration must never be changed or
+// have its version reused, add a new one instead
+var All = []Migration{
+	{Version: 1, Name: "hash-client-tokens", Up: hashClientTokens},
+	{Version: 2, Name: "namespace-user-ids", Up: namespaceUserIDs},
+	{Version: 3, Name: "agent-role-defaults", Up: agentRoleDefaults},
+	{Version: 4, Name: "backfill-public-agent-ids", Up: backfillPublicAgentIDs},
+	{Version: 5, Name: "rename-article-thumbnail", Up: renameArticleThumbnail},
+}
+
+// hashClientTokens replaces client tokens stored before tokens were hashed at rest
+func hashClientTokens(ctx context.Context, db database.Database) error {
+	migrated, err := token.MigrateTokenStorage(ctx, db.Collection(database.TokensCollection))
+
+	logger.Printf("Hashed %d token documents", migrated)
+
+	return err
+}
+
+// legacyUserID matches the user ids stored before they were namespaced by identity provider
+var legacyUserID = bson.M{
+	"$regex": "^[0-9]+$",
+}
+
+// namespaceField prefixes legacy user ids in one field of a collection with the provider they came from
+func namespaceField(ctx context.Context, c database.Collection, field string) error {
+	res, err := c.Find(ctx, bson.M{field: legacyUserID}, &options.FindOptions{})
+
+	if err != nil {
+		return errors.Wrapf(err, "Failed to find legacy user ids in %s", field)
+	}
+
+	docs := []bson.M{}
+	err = res.All(ctx, &docs)
+
+	if err != nil {
+		return errors.Wrapf(err, "Failed to decode documents with legacy user ids in %s", field)
+	}
+
+	for _, doc := range docs {
+		legacy, _ := doc[field].(string)
+
+		_, err = c.UpdateOne(
+			ctx,
+			bson.M{
+				"_id": doc["_id"],
+				field: legacy,
+			},
+			bson.M{
+				"$set": bson.M{
+					// only GitHub logins existed before user ids were namespaced
+					field: "github:" + legacy,
+				},
+			},
+			&options.UpdateOptions{},
+		)
+
+		if err != nil {
+			return errors.Wrapf(err, "Failed to namespace user id %s in %s", legacy, field)
+		}
+	}
+
+	return err
+}
+
+// namespaceUserIDs moves every stored user id to the provider:id form
+func namespaceUserIDs(ctx context.Context, db database.Database) error {
+	for _, name := range []string{
+		database.AgentsCollection,
+		database.ProfileCollection,
+		database.TokensCollection,
+		database.RefreshTokensCollection,
+	} {
+		err := namespaceField(ctx, db.Collection(name), "userID")
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range database.ArticleCollections {
+		for _, field := range []string{"creator", "moderatedBy"} {
+			err := namespaceField(ctx, db.Collection(name), field)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// agentRoleDefaults stores the role and clearance of agents created before roles existed
+func agentRoleDefaults(ctx context.Context, db database.Database) error {
+	agents := db.Collection(database.AgentsCollection)
+
+	defaults := bson.M{
+		"role":      token.RoleAgent,
+		"clearance": 0,
+	}
+
+	for field, value := range defaults {
+		_, err := agents.UpdateMany(
+			ctx,
+			bson.M{
+				field: bson.M{
+					"$exists": false,
+				},
+			},
+			bson.M{
+				"$set": bson.M{
+					field: value,
+				},
+			},
+			&options.UpdateOptions{},
+		)
+
+		if err != nil {
+			return errors.Wrapf(err, "Failed to set default %s of agents", field)
+		}
+	}
+
+	return nil
+}
+
+// backfillPublicAgentIDs gives agents created before public ids existed one without waiting for them to log in
+func backfillPublicAgentIDs(ctx context.Context, db database.Database) error {
+	assigned, err := token.BackfillPublicAgentIDs(ctx, db.Collection(database.AgentsCollection))
+
+	logger.Printf("Assigned public agent ids to %d agents", assigned)
+
+	return err
+}
+
+// renameArticleThumbnail moves article thumbnails from the "string" field articles were read
+// from to "thumbnail", which is where they have always been written
+func renameArticleThumbnail(ctx context.Context, db database.Database) error {
+	for _, name := range database.ArticleCollections {
+		articles := db.Collection(name)
+
+		_, err := articles.UpdateMany(
+			ctx,
+			bson.M{
+				"string": bson.M{
+					"$exists": true,
+				},
+				"thumbnail": bson.M{
+					"$exists": false,
+				},
+			},
+			bson.M{
+				"$rename": bson.M{
+					"string": "thumbnail",
+				},
+			},
+			&options.UpdateOptions{},
+		)
+
+		if err != nil {
+			return errors.Wrapf(err, "Failed to rename thumbnails in %s", name)
+		}
+
+		// the thumbnail already stored under its own name is the one that was written last
+		_, err = articles.UpdateMany(
+			ctx,
+			bson.M{
+				"string": bson.M{
+					"$exists": true,
+				},
+			},
+			bson.M{
+				"$unset": bson.M{
+					"string": "",
+				},
+			},
+			&options.UpdateOptions{},
+		)
+
+		if err != nil {
+			return errors.Wrapf(err, "Failed to remove old thumbnails in %s", name)
+		}
+	}
+
+	return nil
+}
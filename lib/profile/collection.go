@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 
+	"github.com/abradley2/macguffin/lib/articles"
 	"github.com/abradley2/macguffin/lib/database"
 	"github.com/abradley2/macguffin/lib/token"
 	"github.com/pkg/errors"
@@ -21,6 +22,7 @@ type userProfile struct {
 	Intelligence  int    `json:"intelligence" bson:"intelligence"`
 	Wisdom        int    `json:"wisdom" bson:"wisdom"`
 	Charisma      int    `json:"charisma" bson:"charisma"`
+	Bio           string `json:"bio" bson:"bio"`
 }
 
 func getUserProfileJSON(
@@ -31,13 +33,14 @@ func getUserProfileJSON(
 	var js []byte
 	var err error
 	var profile = userProfile{
-		UserID:       userData.UserID,
-		Strength:     8,
-		Constitution: 8,
-		Dexterity:    8,
-		Intelligence: 8,
-		Wisdom:       8,
-		Charisma:     8,
+		UserID:        userData.UserID,
+		PublicAgentID: userData.PublicAgentID,
+		Strength:      8,
+		Constitution:  8,
+		Dexterity:     8,
+		Intelligence:  8,
+		Wisdom:        8,
+		Charisma:      8,
 	}
 
 	q := bson.M{
@@ -65,5 +68,113 @@ func getUserProfileJSON(
 		return js, errors.Wrapf(err, "Error executing findOne query in getUserProfileJSON")
 	}
 
-	return res.DecodeBytes()
+	err = res.Decode(&profile)
+
+	if err != nil {
+		return js, errors.Wrapf(err, "Failed decoding profile for userID: %s", userData.UserID)
+	}
+
+	// the agent document is the source of truth for public ids
+	profile.PublicAgentID = userData.PublicAgentID
+
+	return json.Marshal(profile)
+}
+
+func saveUserProfile(
+	ctx context.Context,
+	profiles database.Collection,
+	userData token.UserData,
+	profile userProfile,
+) ([]byte, error) {
+	var js []byte
+
+	profile.UserID = userData.UserID
+	profile.PublicAgentID = userData.PublicAgentID
+
+	_, err := profiles.UpdateOne(
+		ctx,
+		bson.M{
+			"userID": bson.M{
+				"$eq": userData.UserID,
+			},
+		},
+		bson.M{
+			"$set": bson.M{
+				"strength":      profile.Strength,
+				"constitution":  profile.Constitution,
+				"dexterity":     profile.Dexterity,
+				"intelligence":  profile.Intelligence,
+				"wisdom":        profile.Wisdom,
+				"charisma":      profile.Charisma,
+				"bio":           profile.Bio,
+				"publicAgentID": profile.PublicAgentID,
+			},
+		},
+		options.Update().SetUpsert(true),
+	)
+
+	if err != nil {
+		return js, errors.Wrapf(err, "Failed to upsert profile for userID: %s", userData.UserID)
+	}
+
+	return json.Marshal(profile)
+}
+
+// publicProfile the parts of a userProfile any agent may see, it must never include the userID
+type publicProfile struct {
+	PublicAgentID string `json:"publicAgentID"`
+	Strength      int    `json:"strength"`
+	Constitution  int    `json:"constitution"`
+	Dexterity     int    `json:"dexterity"`
+	Intelligence  int    `json:"intelligence"`
+	Wisdom        int    `json:"wisdom"`
+	Charisma      int    `json:"charisma"`
+	Bio           string `json:"bio"`
+}
+
+type publicAgent struct {
+	Profile  publicProfile   `json:"profile"`
+	Articles json.RawMessage `json:"articles"`
+}
+
+func getPublicAgentJSON(
+	ctx context.Context,
+	profiles database.Collection,
+	articleCollections []database.Collection,
+	agent token.UserData,
+) ([]byte, error) {
+	var js []byte
+
+	profileJSON, err := getUserProfileJSON(ctx, profiles, agent)
+
+	if err != nil {
+		return js, err
+	}
+
+	profile := userProfile{}
+	err = json.Unmarshal(profileJSON, &profile)
+
+	if err != nil {
+		return js, errors.Wrapf(err, "Failed decoding profile for publicAgentID: %s", agent.PublicAgentID)
+	}
+
+	articlesJSON, err := articles.GetPublicArticlesJSON(ctx, articleCollections, agent)
+
+	if err != nil {
+		return js, errors.Wrapf(err, "Failed retrieving articles for publicAgentID: %s", agent.PublicAgentID)
+	}
+
+	return json.Marshal(publicAgent{
+		Profile: publicProfile{
+			PublicAgentID: agent.PublicAgentID,
+			Strength:      profile.Strength,
+			Constitution:  profile.Constitution,
+			Dexterity:     profile.Dexterity,
+			Intelligence:  profile.Intelligence,
+			Wisdom:        profile.Wisdom,
+			Charisma:      profile.Charisma,
+			Bio:           profile.Bio,
+		},
+		Articles: articlesJSON,
+	})
 }
@@ -2,12 +2,19 @@ package profile
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
 
+	"github.com/abradley2/macguffin/lib/articles"
 	"github.com/abradley2/macguffin/lib/database"
+	"github.com/abradley2/macguffin/lib/request"
 	"github.com/abradley2/macguffin/lib/token"
+	"github.com/pkg/errors"
 )
 
 // GetProfileParams _
@@ -71,3 +78,167 @@ func HandleGetProfile(ctx context.Context, w http.ResponseWriter, params GetProf
 	w.WriteHeader(http.StatusOK)
 	w.Write(usrJSON)
 }
+
+type updateProfileBody struct {
+	Strength     int    `json:"strength"`
+	Constitution int    `json:"constitution"`
+	Dexterity    int    `json:"dexterity"`
+	Intelligence int    `json:"intelligence"`
+	Wisdom       int    `json:"wisdom"`
+	Charisma     int    `json:"charisma"`
+	Bio          string `json:"bio"`
+}
+
+// UpdateProfileParams _
+type UpdateProfileParams struct {
+	Logger            *log.Logger
+	ProfileCollection database.Collection
+	TokensCollection  database.Collection
+	UsersCollection   database.Collection
+
+	// clientToken: Header.Authorization - required
+	clientToken string
+
+	// body - required
+	// the agent's stats and bio, stats must follow point buy rules
+	body updateProfileBody
+}
+
+// FromRequest populate UpdateProfileParams from an http.Request
+func (params *UpdateProfileParams) FromRequest(r *http.Request) error {
+	params.clientToken = r.Header.Get("Authorization")
+
+	if params.clientToken == "" {
+		return fmt.Errorf("Missing clientToken in Headers.Authorization")
+	}
+
+	bodyContent, err := ioutil.ReadAll(io.LimitReader(r.Body, 50000))
+
+	if err != nil {
+		return errors.Wrap(err, "Could not read request body")
+	}
+
+	err = json.Unmarshal(bodyContent, &params.body)
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to unmarshal body json")
+	}
+
+	return err
+}
+
+// HandleUpdateProfile creates or replaces the stats and bio of the logged in agent
+func HandleUpdateProfile(ctx context.Context, w http.ResponseWriter, params UpdateProfileParams) {
+	logger := params.Logger
+
+	userData, err := token.GetLoggedInUser(
+		ctx,
+		params.clientToken,
+		token.GetLoggedInUserParams{
+			Tokens: params.TokensCollection,
+			Users:  params.UsersCollection,
+		},
+	)
+
+	if err != nil {
+		if err == token.ErrTokenExpired {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Expired token"))
+			return
+		}
+		logger.Printf("Could not get logged in user when updating profile: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	body := params.body
+	profile := userProfile{
+		Strength:     body.Strength,
+		Constitution: body.Constitution,
+		Dexterity:    body.Dexterity,
+		Intelligence: body.Intelligence,
+		Wisdom:       body.Wisdom,
+		Charisma:     body.Charisma,
+		Bio:          body.Bio,
+	}
+
+	if errs := profile.validate(); errs != nil {
+		request.WriteValidationErrors(w, errs)
+		return
+	}
+
+	usrJSON, err := saveUserProfile(ctx, params.ProfileCollection, userData, profile)
+
+	if err != nil {
+		logger.Printf("Could not save user profile for logged in user: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(usrJSON)
+}
+
+// GetPublicAgentParams _
+type GetPublicAgentParams struct {
+	Logger             *log.Logger
+	ProfileCollection  database.Collection
+	UsersCollection    database.Collection
+	ArticleCollections []database.Collection
+
+	// publicAgentID: path /agents/{publicAgentID} - required
+	publicAgentID string
+}
+
+// FromRequest populate GetPublicAgentParams from an http.Request
+func (params *GetPublicAgentParams) FromRequest(r *http.Request, db database.Database) error {
+	params.publicAgentID = strings.TrimPrefix(r.URL.Path, "/agents/")
+
+	if params.publicAgentID == "" || strings.Contains(params.publicAgentID, "/") {
+		return fmt.Errorf("Invalid publicAgentID in path: %s", r.URL.Path)
+	}
+
+	if params.ArticleCollections == nil {
+		collections, err := articles.GetArticleCollections(db)
+
+		params.ArticleCollections = collections
+
+		return err
+	}
+
+	return nil
+}
+
+// HandleGetPublicAgent retrieves an agent's public profile and approved articles by their publicAgentID
+func HandleGetPublicAgent(ctx context.Context, w http.ResponseWriter, params GetPublicAgentParams) {
+	logger := params.Logger
+
+	agent, err := token.FindAgentByPublicID(ctx, params.UsersCollection, params.publicAgentID)
+
+	if errors.Cause(err) == token.ErrUnknownAgent {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Agent not found"))
+		return
+	}
+
+	if err != nil {
+		logger.Printf("Could not find agent by public id: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	js, err := getPublicAgentJSON(ctx, params.ProfileCollection, params.ArticleCollections, agent)
+
+	if err != nil {
+		logger.Printf("Could not get public agent json: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
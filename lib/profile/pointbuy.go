@@ -0,0 +1,71 @@
+package profile
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/abradley2/macguffin/lib/request"
+)
+
+// point buy rules from the 5th edition players handbook
+const (
+	minStat        = 8
+	maxStat        = 15
+	pointBudget    = 27
+	maxBioLength   = 2000
+	pointsErrorKey = "points"
+)
+
+// pointCosts how many points it costs to raise a stat from 8 to the given score
+var pointCosts = map[int]int{
+	8:  0,
+	9:  1,
+	10: 2,
+	11: 3,
+	12: 4,
+	13: 5,
+	14: 7,
+	15: 9,
+}
+
+func (p userProfile) stats() map[string]int {
+	return map[string]int{
+		"strength":     p.Strength,
+		"constitution": p.Constitution,
+		"dexterity":    p.Dexterity,
+		"intelligence": p.Intelligence,
+		"wisdom":       p.Wisdom,
+		"charisma":     p.Charisma,
+	}
+}
+
+// validate checks the profile against the point buy rules, returning nil when it is valid
+func (p userProfile) validate() request.ValidationErrors {
+	errs := request.ValidationErrors{}
+	spent := 0
+
+	for name, score := range p.stats() {
+		cost, ok := pointCosts[score]
+
+		if ok == false {
+			errs[name] = fmt.Sprintf("must be between %d and %d", minStat, maxStat)
+			continue
+		}
+
+		spent += cost
+	}
+
+	if spent > pointBudget {
+		errs[pointsErrorKey] = fmt.Sprintf("spent %d points but only %d are available", spent, pointBudget)
+	}
+
+	if utf8.RuneCountInString(p.Bio) > maxBioLength {
+		errs["bio"] = fmt.Sprintf("must be at most %d characters", maxBioLength)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
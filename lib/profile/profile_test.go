@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"net/http/httptest"
 
@@ -26,14 +29,15 @@ func TestGetProfile(t *testing.T) {
 	const testPublicAgentID = "test-public-agent-id"
 
 	tokenJSON, _ := json.Marshal(token.UserTokenData{
-		UserID:      testUserID,
-		ClientToken: testRequestToken,
+		UserID:          testUserID,
+		ClientTokenHash: token.HashClientToken(testRequestToken),
+		LastSeenAt:      time.Now(),
 	})
 
 	tokenCollection.HashQuery(
 		bson.M{
-			"clientToken": bson.M{
-				"$eq": testRequestToken,
+			"clientTokenHash": bson.M{
+				"$eq": token.HashClientToken(testRequestToken),
 			},
 		},
 		tokenJSON,
@@ -89,3 +93,206 @@ func TestGetProfile(t *testing.T) {
 		t.Errorf("Expected %d user strength but got %d", testUserStrength, prof.Strength)
 	}
 }
+
+func TestUpdateProfile(t *testing.T) {
+	tokenCollection := &database.TestCollection{}
+	userCollection := &database.TestCollection{}
+	profileCollection := &database.TestCollection{}
+
+	const testRequestToken = "test-request-token"
+	const testUserID = "test-user-id"
+
+	tokenJSON, _ := json.Marshal(token.UserTokenData{
+		UserID:          testUserID,
+		ClientTokenHash: token.HashClientToken(testRequestToken),
+		LastSeenAt:      time.Now(),
+	})
+
+	tokenCollection.HashQuery(
+		bson.M{
+			"clientTokenHash": bson.M{
+				"$eq": token.HashClientToken(testRequestToken),
+			},
+		},
+		tokenJSON,
+	)
+
+	userJSON, _ := json.Marshal(token.UserData{
+		UserID: testUserID,
+	})
+
+	userCollection.HashQuery(
+		bson.M{
+			"userID": bson.M{
+				"$eq": testUserID,
+			},
+		},
+		userJSON,
+	)
+
+	update := func(body updateProfileBody) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p := UpdateProfileParams{
+			Logger:            log.New(os.Stderr, "", log.LstdFlags),
+			clientToken:       testRequestToken,
+			body:              body,
+			ProfileCollection: profileCollection,
+			TokensCollection:  tokenCollection,
+			UsersCollection:   userCollection,
+		}
+		HandleUpdateProfile(context.Background(), w, p)
+
+		return w
+	}
+
+	w := update(updateProfileBody{
+		Strength:     15,
+		Constitution: 15,
+		Dexterity:    15,
+		Intelligence: 15,
+		Wisdom:       8,
+		Charisma:     20,
+	})
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected over budget profile to be rejected with 422, got %d", w.Code)
+	}
+
+	errs := struct {
+		Errors map[string]string `json:"errors"`
+	}{}
+	b, _ := ioutil.ReadAll(w.Body)
+	err := json.Unmarshal(b, &errs)
+
+	if err != nil {
+		t.Fatalf("Could not unmarshal validation errors: %v", err)
+	}
+
+	if errs.Errors["charisma"] == "" || errs.Errors["points"] == "" {
+		t.Errorf("Expected errors for charisma and points, got %v", errs.Errors)
+	}
+
+	if profileCollection.LastUpdate != nil {
+		t.Errorf("Invalid profile should not have been saved")
+	}
+
+	w = update(updateProfileBody{
+		Strength:     15,
+		Constitution: 14,
+		Dexterity:    13,
+		Intelligence: 12,
+		Wisdom:       10,
+		Charisma:     8,
+		Bio:          "Formerly of the Bureau of Plot Devices",
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected valid profile to be saved, got %d", w.Code)
+	}
+
+	saved := userProfile{}
+	b, _ = ioutil.ReadAll(w.Body)
+	err = json.Unmarshal(b, &saved)
+
+	if err != nil {
+		t.Fatalf("Could not unmarshal response json: %v", err)
+	}
+
+	if saved.UserID != testUserID || saved.Bio == "" {
+		t.Errorf("Expected saved profile for %s with bio, got %v", testUserID, saved)
+	}
+}
+
+func TestGetPublicAgent(t *testing.T) {
+	const testUserID = "8582764"
+	const testPublicAgentID = "agent-test"
+
+	userCollection := &database.TestCollection{}
+	profileCollection := &database.TestCollection{}
+
+	userJSON, _ := json.Marshal(token.UserData{
+		UserID:        testUserID,
+		PublicAgentID: testPublicAgentID,
+	})
+
+	userCollection.HashQuery(
+		bson.M{
+			"publicAgentID": bson.M{
+				"$eq": testPublicAgentID,
+			},
+		},
+		userJSON,
+	)
+
+	profileJSON, _ := json.Marshal(userProfile{
+		UserID:   testUserID,
+		Strength: 12,
+		Bio:      "Recovered the Maltese Falcon",
+	})
+
+	profileCollection.HashQuery(
+		bson.M{
+			"userID": bson.M{
+				"$eq": testUserID,
+			},
+		},
+		profileJSON,
+	)
+
+	articleCollection := &database.TestCollection{}
+	articleCollection.HashQuery(
+		bson.M{
+			"approved": bson.M{
+				"$eq": true,
+			},
+			"creator": bson.M{
+				"$eq": testUserID,
+			},
+		},
+		[]byte(`[{"_id": "some-article", "itemTitle": "The Falcon", "creator": "8582764", "approved": true}]`),
+	)
+
+	r, _ := http.NewRequest(http.MethodGet, "/agents/"+testPublicAgentID, nil)
+
+	p := GetPublicAgentParams{
+		Logger:             log.New(os.Stderr, "", log.LstdFlags),
+		ProfileCollection:  profileCollection,
+		UsersCollection:    userCollection,
+		ArticleCollections: []database.Collection{articleCollection},
+	}
+
+	err := p.FromRequest(r, &database.TestDatabase{})
+
+	if err != nil {
+		t.Fatalf("Failed to create GetPublicAgentParams from request: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	HandleGetPublicAgent(context.Background(), w, p)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected OK status for public agent, got %d", w.Code)
+	}
+
+	b, _ := ioutil.ReadAll(w.Body)
+
+	if strings.Contains(string(b), testUserID) {
+		t.Errorf("Public agent response leaked the userID: %s", b)
+	}
+
+	agent := struct {
+		Profile  publicProfile
+		Articles []struct {
+			Creator string `json:"creator"`
+		}
+	}{}
+	err = json.Unmarshal(b, &agent)
+
+	if err != nil {
+		t.Fatalf("Could not unmarshal response json: %v", err)
+	}
+
+	if agent.Profile.Strength != 12 || len(agent.Articles) != 1 || agent.Articles[0].Creator != testPublicAgentID {
+		t.Errorf("Unexpected public agent response: %s", b)
+	}
+}
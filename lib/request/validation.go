@@ -0,0 +1,42 @@
+package request
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ValidationErrors maps the name of each invalid field in a request to why it was rejected
+type ValidationErrors map[string]string
+
+// Error _
+func (errs ValidationErrors) Error() string {
+	fields := make([]string, 0, len(errs))
+	for field, msg := range errs {
+		fields = append(fields, fmt.Sprintf("%s: %s", field, msg))
+	}
+	sort.Strings(fields)
+
+	return "Validation failed: " + strings.Join(fields, ", ")
+}
+
+type validationErrorsBody struct {
+	Errors ValidationErrors `json:"errors"`
+}
+
+// WriteValidationErrors responds with 422 and a json body of the form { "errors": { field: message } }
+func WriteValidationErrors(w http.ResponseWriter, errs ValidationErrors) {
+	js, err := json.Marshal(validationErrorsBody{Errors: errs})
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	w.Write(js)
+}
@@ -0,0 +1,168 @@
+package token
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/abradley2/macguffin/lib/database"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// newPublicAgentID generates the pseudonymous identifier other agents know an agent by.
+// It is random so it can never be traced back to the agent's identity provider account
+func newPublicAgentID() (string, error) {
+	b := make([]byte, 10)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to generate public agent id")
+	}
+
+	return "agent-" + hex.EncodeToString(b), err
+}
+
+func assignPublicAgentID(ctx context.Context, agents database.Collection, userID string) error {
+	publicAgentID, err := newPublicAgentID()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = agents.UpdateOne(
+		ctx,
+		bson.M{
+			"userID": bson.M{
+				"$eq": userID,
+			},
+			"publicAgentID": bson.M{
+				"$exists": false,
+			},
+		},
+		bson.M{
+			"$set": bson.M{
+				"publicAgentID": publicAgentID,
+			},
+		},
+		&options.UpdateOptions{},
+	)
+
+	if err != nil {
+		return errors.Wrapf(err, "Failed to assign public agent id for userID: %s", userID)
+	}
+
+	return err
+}
+
+// FindAgentByPublicID looks up an agent by their publicAgentID, returning ErrUnknownAgent if there is none
+func FindAgentByPublicID(ctx context.Context, agents database.Collection, publicAgentID string) (UserData, error) {
+	var user UserData
+
+	res := agents.FindOne(
+		ctx,
+		bson.M{
+			"publicAgentID": bson.M{
+				"$eq": publicAgentID,
+			},
+		},
+		&options.FindOneOptions{},
+	)
+
+	if res.Err() == mongo.ErrNoDocuments {
+		return user, ErrUnknownAgent
+	}
+
+	if res.Err() != nil {
+		return user, errors.Wrapf(res.Err(), "Failed to find agent for publicAgentID: %s", publicAgentID)
+	}
+
+	err := res.Decode(&user)
+
+	if err != nil {
+		return user, errors.Wrapf(err, "Failed to decode agent document for publicAgentID: %s", publicAgentID)
+	}
+
+	return user, err
+}
+
+// PublicAgentIDs the publicAgentID of each of the agents with the given userIDs, by userID. Agents
+// that don't have one yet are left out
+func PublicAgentIDs(ctx context.Context, agents database.Collection, userIDs []string) (map[string]string, error) {
+	ids := map[string]string{}
+
+	if len(userIDs) == 0 {
+		return ids, nil
+	}
+
+	res, err := agents.Find(
+		ctx,
+		bson.M{
+			"userID": bson.M{
+				"$in": userIDs,
+			},
+		},
+		&options.FindOptions{},
+	)
+
+	if err != nil {
+		return ids, errors.Wrap(err, "Failed to find agents by userID")
+	}
+
+	users := []UserData{}
+	err = res.All(ctx, &users)
+
+	if err != nil {
+		return ids, errors.Wrap(err, "Failed to decode agents found by userID")
+	}
+
+	for _, user := range users {
+		if user.PublicAgentID != "" {
+			ids[user.UserID] = user.PublicAgentID
+		}
+	}
+
+	return ids, nil
+}
+
+// BackfillPublicAgentIDs assigns a public agent id to every agent created before they existed,
+// instead of waiting for each of them to log in again
+func BackfillPublicAgentIDs(ctx context.Context, agents database.Collection) (int, error) {
+	var assigned int
+
+	res, err := agents.Find(
+		ctx,
+		bson.M{
+			"publicAgentID": bson.M{
+				"$exists": false,
+			},
+		},
+		&options.FindOptions{},
+	)
+
+	if err != nil {
+		return assigned, errors.Wrap(err, "Failed to find agents without a public agent id")
+	}
+
+	users := []UserData{}
+	err = res.All(ctx, &users)
+
+	if err != nil {
+		return assigned, errors.Wrap(err, "Failed to decode agents without a public agent id")
+	}
+
+	for _, user := range users {
+		err = assignPublicAgentID(ctx, agents, user.UserID)
+
+		if err != nil {
+			return assigned, err
+		}
+
+		assigned++
+	}
+
+	return assigned, err
+}
@@ -2,72 +2,72 @@ package token
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/base64"
 	"fmt"
 	"time"
 
 	"github.com/abradley2/macguffin/lib/database"
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// UserTokenData a session as it is stored in the tokens collection. Only a keyed hash of the
+// client token is stored, and the identity provider's access token is never stored at all
 type UserTokenData struct {
-	UserID      string `json:"userID"`
-	AccessToken string `json:"accessToken"`
-	ClientToken string `json:"clientToken"`
+	UserID          string    `json:"userID" bson:"userID"`
+	ClientTokenHash string    `json:"clientTokenHash" bson:"clientTokenHash"`
+	FamilyID        string    `json:"familyID,omitempty" bson:"familyID,omitempty"`
+	CreatedAt       time.Time `json:"createdAt" bson:"createdAt"`
+	LastSeenAt      time.Time `json:"lastSeenAt" bson:"lastSeenAt"`
 }
 
 type UserData struct {
-	UserID string `json:"userID"`
+	UserID        string `json:"userID" bson:"userID"`
+	PublicAgentID string `json:"publicAgentID,omitempty" bson:"publicAgentID,omitempty"`
+	Role          Role   `json:"role,omitempty" bson:"role,omitempty"`
+	Clearance     int    `json:"clearance" bson:"clearance"`
 }
 
 type storeTokenParams struct {
-	tokensCollection database.Collection
-	agentsCollection database.Collection
+	transactor              database.Transactor
+	tokensCollection        database.Collection
+	refreshTokensCollection database.Collection
+	agentsCollection        database.Collection
 }
 
+// storeToken starts a new session for an agent who has just logged in, creating the agent
+// if this is their first login. The session and the agent are stored in one transaction, so a
+// failed login never leaves a session behind for an agent that doesn't exist
 func storeToken(
 	ctx context.Context,
-	ghUserRes githubAccessTokenResponse,
 	userID string,
 	params storeTokenParams,
-) (string, error) {
+) (session, error) {
 	var (
-		tokensCollection = params.tokensCollection
 		agentsCollection = params.agentsCollection
-		token            string
+		s                session
 		err              error
 	)
 
-	h := sha256.New()
-	h.Write(
-		[]byte(
-			fmt.Sprintf("%s:%s", ghUserRes.AccessToken, userID),
-		),
-	)
-
-	token = base64.StdEncoding.EncodeToString(h.Sum(nil))
+	familyID, err := newSessionFamilyID()
 
-	doc := bson.M{
-		"userID":      userID,
-		"accessToken": ghUserRes.AccessToken,
-		"clientToken": token,
-		"createdAt":   primitive.NewDateTimeFromTime(time.Now()),
+	if err != nil {
+		return s, err
 	}
 
-	_, err = tokensCollection.InsertOne(ctx, doc, &options.InsertOneOptions{})
+	err = params.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		s, err = issueSession(ctx, userID, familyID, params)
 
-	if err != nil {
-		return "", errors.Wrap(err, "Could not insert user document into tokens collection")
-	}
+		if err != nil {
+			return err
+		}
 
-	err = checkUser(ctx, agentsCollection, userID, false)
+		return checkUser(ctx, agentsCollection, userID, false)
+	})
 
-	return token, err
+	return s, err
 }
 
 func checkUser(ctx context.Context, agents database.Collection, userID string, retry bool) error {
@@ -86,25 +86,57 @@ func checkUser(ctx context.Context, agents database.Collection, userID string, r
 			return err
 		}
 
-		checkUser(ctx, agents, userID, true)
+		return checkUser(ctx, agents, userID, true)
 	}
 
-	return res.Err()
-}
+	if res.Err() != nil {
+		return res.Err()
+	}
 
-func createUser(ctx context.Context, userID string, agents database.Collection) error {
-	u := bson.M{
-		"userID":      userID,
-		"initialized": false,
+	user := UserData{}
+	err := res.Decode(&user)
+
+	if err != nil {
+		return errors.Wrapf(err, "Failed to decode agent document for userID: %s", userID)
 	}
 
-	_, err := agents.InsertOne(ctx, u, &options.InsertOneOptions{})
+	// agents created before public IDs existed get one the next time they log in
+	if user.PublicAgentID == "" {
+		return assignPublicAgentID(ctx, agents, userID)
+	}
+
+	return nil
+}
+
+func createUser(ctx context.Context, userID string, agents database.Collection) error {
+	publicAgentID, err := newPublicAgentID()
 
 	if err != nil {
 		return err
 	}
 
-	return nil
+	u := bson.M{
+		"userID":        userID,
+		"publicAgentID": publicAgentID,
+		"initialized":   false,
+		"role":          RoleAgent,
+		"clearance":     0,
+	}
+
+	// an upsert leaves the agent alone when another login created them first. Inserting and
+	// ignoring the duplicate key error would abort the transaction the login is stored in
+	_, err = agents.UpdateOne(
+		ctx,
+		bson.M{
+			"userID": userID,
+		},
+		bson.M{
+			"$setOnInsert": u,
+		},
+		options.Update().SetUpsert(true),
+	)
+
+	return errors.Wrapf(err, "Failed to create agent %s", userID)
 }
 
 type errTokenExpired struct{}
@@ -137,8 +169,8 @@ func GetLoggedInUser(
 	tokensRes := tokens.FindOne(
 		ctx,
 		bson.M{
-			"clientToken": bson.M{
-				"$eq": clientToken,
+			"clientTokenHash": bson.M{
+				"$eq": HashClientToken(clientToken),
 			},
 		},
 		&options.FindOneOptions{},
@@ -156,6 +188,12 @@ func GetLoggedInUser(
 		return loggedInUser, errors.Wrap(err, "Failed to decode token document from db")
 	}
 
+	err = touchSession(ctx, tokens, tokenData)
+
+	if err != nil {
+		return loggedInUser, err
+	}
+
 	userRes := users.FindOne(
 		ctx,
 		bson.M{
@@ -0,0 +1,127 @@
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+const ghURL = "https://github.com/login/oauth/access_token"
+
+const ghAuthorizeURL = "https://github.com/login/oauth/authorize"
+
+type githubAccessTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+type githubProvider struct {
+	clientID     string
+	clientSecret string
+	redirectURI  string
+	tokenURL     string
+	userURL      string
+}
+
+func newGithubProvider(clientID string, clientSecret string, redirectURI string) (*githubProvider, error) {
+	if clientID == "" || clientSecret == "" {
+		return nil, fmt.Errorf("github identity provider requires GH_CLIENT_ID and GH_CLIENT_SECRET")
+	}
+
+	return &githubProvider{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURI:  redirectURI,
+		tokenURL:     ghURL,
+		userURL:      ghUserURL,
+	}, nil
+}
+
+func (p *githubProvider) Name() string {
+	return "github"
+}
+
+func (p *githubProvider) AuthorizeURL(state string, codeChallenge string) string {
+	q := url.Values{
+		"client_id": {p.clientID},
+	}
+
+	// without a redirect_uri github uses the callback url registered for the app
+	if p.redirectURI != "" {
+		q.Set("redirect_uri", p.redirectURI)
+	}
+
+	return authorizeURL(ghAuthorizeURL, q, state, codeChallenge)
+}
+
+func (p *githubProvider) SupportsPKCE() bool {
+	return true
+}
+
+func (p *githubProvider) ExchangeCode(ctx context.Context, logger *log.Logger, code string, codeVerifier string) (string, error) {
+	var (
+		tokenRes githubAccessTokenResponse
+		err      error
+	)
+
+	q := url.Values{
+		"client_id":     {p.clientID},
+		"client_secret": {p.clientSecret},
+		"code":          {code},
+	}
+
+	if codeVerifier != "" {
+		q.Set("code_verifier", codeVerifier)
+	}
+
+	ghReq, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		fmt.Sprintf("%s?%s", p.tokenURL, q.Encode()),
+		nil,
+	)
+
+	if err != nil {
+		return "", errors.Wrap(err, "Error creating gh token request")
+	}
+
+	ghReq.Header.Set("Accept", "application/json")
+	ghRes, err := client.Do(ghReq)
+
+	if err != nil {
+		return "", errors.Wrap(err, "Error sending gh token request")
+	}
+
+	defer ghRes.Body.Close()
+
+	ghResContent, err := ioutil.ReadAll(
+		io.LimitReader(ghRes.Body, 50000),
+	)
+
+	if err != nil {
+		return "", errors.Wrap(err, "Error reading gh token response body")
+	}
+
+	if ghRes.StatusCode >= 300 {
+		err = fmt.Errorf("Unexpected status code in gh token response: \n%d\n%s", ghRes.StatusCode, ghResContent)
+		return "", err
+	}
+
+	err = json.Unmarshal(ghResContent, &tokenRes)
+
+	if err != nil {
+		return "", errors.Wrapf(err, "Could not decode gh token response content: \n%s", ghResContent)
+	}
+
+	if tokenRes.AccessToken == "" {
+		return "", fmt.Errorf("Access token missing in gh token response: \n%s", ghResContent)
+	}
+
+	return tokenRes.AccessToken, err
+}
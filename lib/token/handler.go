@@ -13,19 +13,76 @@ import (
 	"github.com/pkg/errors"
 )
 
+// LoginStateParams _
+type LoginStateParams struct {
+	Logger   *log.Logger
+	Provider IdentityProvider
+	States   *StateSigner
+}
+
+// HandleGetLoginState issues a signed state and the PKCE verifier that goes with it, which the
+// client keeps until it calls /token, and gives the url the client should redirect to for login
+func HandleGetLoginState(ctx context.Context, w http.ResponseWriter, params LoginStateParams) {
+	logger := params.Logger
+	provider := params.Provider
+
+	state, verifier, err := params.States.Issue(provider.Name())
+
+	if err != nil {
+		logger.Printf("Error issuing login state: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	var codeChallenge string
+	if provider.SupportsPKCE() {
+		codeChallenge = CodeChallenge(verifier)
+	}
+
+	js, err := json.Marshal(map[string]string{
+		"state":        state,
+		"codeVerifier": verifier,
+		"authorizeURL": provider.AuthorizeURL(state, codeChallenge),
+	})
+
+	if err != nil {
+		logger.Printf("Error marshalling login state: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
+
 type getTokenBody struct {
-	Code string `json:"code"`
+	Code         string `json:"code"`
+	State        string `json:"state"`
+	CodeVerifier string `json:"codeVerifier"`
 }
 
 // GetTokenParams _
 type GetTokenParams struct {
-	Logger          *log.Logger
-	TokenCollection database.Collection
-	UserCollection  database.Collection
+	Logger                 *log.Logger
+	Transactor             database.Transactor
+	TokenCollection        database.Collection
+	RefreshTokenCollection database.Collection
+	UserCollection         database.Collection
+	LoginStateCollection   database.Collection
+	Provider               IdentityProvider
+	States                 *StateSigner
 
 	// body - required
-	// simple json body with a "code" field for github oauth
+	// json body with the "code" and "state" fields from the identity provider's oauth redirect,
+	// and the "codeVerifier" HandleGetLoginState issued along with the state
 	body getTokenBody
+
+	// state: body.state - required
+	// the verified state, which is redeemed before the code is exchanged
+	state VerifiedState
 }
 
 // FromRequest build GetTokenParams from an http.Request
@@ -48,53 +105,205 @@ func (params *GetTokenParams) FromRequest(r *http.Request) error {
 		return fmt.Errorf("Body missing required parameter: 'code'")
 	}
 
+	if params.body.State == "" {
+		return fmt.Errorf("Body missing required parameter: 'state'")
+	}
+
+	if params.body.CodeVerifier == "" {
+		return fmt.Errorf("Body missing required parameter: 'codeVerifier'")
+	}
+
+	params.state, err = params.States.Verify(params.body.State, params.Provider.Name(), params.body.CodeVerifier)
+
 	return err
 }
 
-// HandleGetToken returns on oauth token from github
+// HandleGetToken exchanges an oauth code from the identity provider for a client token
 func HandleGetToken(ctx context.Context, w http.ResponseWriter, params GetTokenParams) {
 	logger := params.Logger
+	provider := params.Provider
+
+	err := redeemState(ctx, params.LoginStateCollection, params.state)
 
-	tokenRes, err := retrieveGithubToken(ctx, logger, params.body.Code)
+	switch errors.Cause(err) {
+	case nil:
+	case ErrInvalidState:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	default:
+		logger.Printf("Error redeeming login state: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	var codeVerifier string
+	if provider.SupportsPKCE() {
+		codeVerifier = params.body.CodeVerifier
+	}
+
+	providerToken, err := provider.ExchangeCode(ctx, logger, params.body.Code, codeVerifier)
 
 	if err != nil {
-		logger.Printf("Error retrieving access token for gh user: %v", err)
+		logger.Printf("Error retrieving access token for %s user: %v", provider.Name(), err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Internal server error"))
+		return
 	}
 
-	user, err := retrieveUser(ctx, logger, tokenRes.AccessToken)
+	providerUserID, err := provider.RetrieveUserID(ctx, logger, providerToken)
 
 	if err != nil {
-		logger.Printf("Error retrieving gh user: %v", err)
+		logger.Printf("Error retrieving %s user: %v", provider.Name(), err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Internal server error"))
 		return
 	}
 
+	user := ProviderUserID(provider, providerUserID)
+
 	// don't store the token if the request was cancelled
 	select {
 	case <-ctx.Done():
 		return
 
 	default:
-		accessToken, err := storeToken(
+		// the provider's token has done its job, it is deliberately not stored
+		s, err := storeToken(
 			ctx,
-			tokenRes,
 			user,
 			storeTokenParams{
-				tokensCollection: params.TokenCollection,
-				agentsCollection: params.UserCollection,
+				transactor:              params.Transactor,
+				tokensCollection:        params.TokenCollection,
+				refreshTokensCollection: params.RefreshTokenCollection,
+				agentsCollection:        params.UserCollection,
 			},
 		)
 
+		var js []byte
+		if err == nil {
+			js, err = json.Marshal(s)
+		}
+
 		if err != nil {
+			logger.Printf("Error storing token for %s: %v", user, err)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("Internal server error"))
 			return
 		}
 
+		w.Header().Set("Cache-Control", "no-store")
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(fmt.Sprintf(`{"access_token": "%s"}`, accessToken)))
+		w.Write(js)
+	}
+}
+
+type setRoleBody struct {
+	UserID    string `json:"userID"`
+	Role      Role   `json:"role"`
+	Clearance int    `json:"clearance"`
+}
+
+// SetRoleParams _
+type SetRoleParams struct {
+	Logger          *log.Logger
+	TokenCollection database.Collection
+	UserCollection  database.Collection
+
+	// clientToken: headers.Authorization - required
+	// token of the admin changing the role
+	clientToken string
+
+	// body - required
+	// the agent's userID and the role and clearance they should now hold.
+	// revoking a role is done by setting it back to "agent"
+	body setRoleBody
+}
+
+// FromRequest build SetRoleParams from an http.Request
+func (params *SetRoleParams) FromRequest(r *http.Request) error {
+	params.clientToken = r.Header.Get("Authorization")
+
+	if params.clientToken == "" {
+		return fmt.Errorf("Missing required parameter: headers.Authorization")
+	}
+
+	bodyContent, err := ioutil.ReadAll(
+		io.LimitReader(r.Body, 50000),
+	)
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to read bodyContent from request")
+	}
+
+	err = json.Unmarshal(bodyContent, &params.body)
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to unmarshal body json")
+	}
+
+	if params.body.UserID == "" {
+		return fmt.Errorf("Body missing required parameter: 'userID'")
 	}
+
+	if params.body.Role.Valid() == false {
+		return fmt.Errorf("Body has invalid 'role': %s", params.body.Role)
+	}
+
+	if params.body.Clearance < 0 || params.body.Clearance > MaxClearance {
+		return fmt.Errorf("Body has invalid 'clearance', must be between 0 and %d", MaxClearance)
+	}
+
+	return err
+}
+
+// HandleSetRole grants or revokes a role for an agent, only admins may do this
+func HandleSetRole(ctx context.Context, w http.ResponseWriter, params SetRoleParams) {
+	logger := params.Logger
+
+	_, err := GetAuthorizedUser(
+		ctx,
+		params.clientToken,
+		GetLoggedInUserParams{
+			Tokens: params.TokenCollection,
+			Users:  params.UserCollection,
+		},
+		PermAdminister,
+	)
+
+	if err == nil {
+		err = setRole(
+			ctx,
+			params.UserCollection,
+			params.body.UserID,
+			params.body.Role,
+			params.body.Clearance,
+			false,
+		)
+	}
+
+	switch errors.Cause(err) {
+	case nil:
+	case ErrTokenExpired:
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Invalid Authorization token"))
+		return
+	case ErrForbidden:
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Forbidden"))
+		return
+	case ErrUnknownAgent:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Agent not found"))
+		return
+	default:
+		logger.Printf("Error setting role for agent: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf(`{"userID": "%s", "role": "%s"}`, params.body.UserID, params.body.Role)))
 }
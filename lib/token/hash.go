@@ -0,0 +1,103 @@
+package token
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"time"
+
+	"github.com/abradley2/macguffin/lib/database"
+	"github.com/abradley2/macguffin/lib/env"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// newClientToken generates the random token handed to the client, which is never stored
+func newClientToken() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to generate client token")
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), err
+}
+
+// HashClientToken the keyed hash of a client token that is stored in, and looked up from, the tokens collection
+func HashClientToken(clientToken string) string {
+	h := hmac.New(sha256.New, []byte(env.TokenHashKey))
+	h.Write([]byte(clientToken))
+
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+type plaintextTokenDocument struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	ClientToken string             `bson:"clientToken"`
+}
+
+// MigrateTokenStorage replaces the plaintext client token of every token document stored before
+// tokens were hashed with its hash, and removes any stored provider access tokens.
+// It is safe to run more than once, returning how many documents were migrated
+func MigrateTokenStorage(ctx context.Context, tokens database.Collection) (int, error) {
+	var migrated int
+
+	dlCtx, cancel := context.WithDeadline(ctx, time.Now().Add(5*time.Minute))
+	defer cancel()
+
+	res, err := tokens.Find(
+		dlCtx,
+		bson.M{
+			"clientToken": bson.M{
+				"$exists": true,
+			},
+		},
+		&options.FindOptions{},
+	)
+
+	if err != nil {
+		return migrated, errors.Wrap(err, "Failed to find plaintext tokens")
+	}
+
+	docs := []plaintextTokenDocument{}
+	err = res.All(dlCtx, &docs)
+
+	if err != nil {
+		return migrated, errors.Wrap(err, "Failed to decode plaintext token documents")
+	}
+
+	for _, doc := range docs {
+		_, err = tokens.UpdateOne(
+			dlCtx,
+			bson.M{
+				"_id": bson.M{
+					"$eq": doc.ID,
+				},
+			},
+			bson.M{
+				"$set": bson.M{
+					"clientTokenHash": HashClientToken(doc.ClientToken),
+				},
+				"$unset": bson.M{
+					"clientToken": "",
+					"accessToken": "",
+				},
+			},
+			&options.UpdateOptions{},
+		)
+
+		if err != nil {
+			return migrated, errors.Wrapf(err, "Failed to hash token document %s", doc.ID.Hex())
+		}
+
+		migrated++
+	}
+
+	return migrated, nil
+}
@@ -0,0 +1,370 @@
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/abradley2/macguffin/lib/env"
+	"github.com/pkg/errors"
+)
+
+var client = http.Client{
+	Timeout: 5 * time.Second,
+}
+
+// IdentityProvider an oauth service agents log in with
+type IdentityProvider interface {
+	// Name namespaces the provider's user ids, so "github" gives userIDs like "github:8582764"
+	Name() string
+	// AuthorizeURL where to send the agent to log in. codeChallenge is empty unless SupportsPKCE
+	AuthorizeURL(state string, codeChallenge string) string
+	// SupportsPKCE whether the provider accepts a PKCE code_challenge and code_verifier
+	SupportsPKCE() bool
+	// ExchangeCode trades the code from the provider's login redirect for an access token.
+	// codeVerifier is empty unless SupportsPKCE
+	ExchangeCode(ctx context.Context, logger *log.Logger, code string, codeVerifier string) (string, error)
+	// RetrieveUserID gets the provider's id for the account that owns an access token
+	RetrieveUserID(ctx context.Context, logger *log.Logger, accessToken string) (string, error)
+}
+
+// ProviderUserID the userID we store for an account, namespaced by the provider it belongs to
+// so accounts from different providers never collide
+func ProviderUserID(p IdentityProvider, providerID string) string {
+	return fmt.Sprintf("%s:%s", p.Name(), providerID)
+}
+
+// ProviderFromEnv creates the identity provider selected by IDENTITY_PROVIDER
+func ProviderFromEnv() (IdentityProvider, error) {
+	switch env.IdentityProvider {
+	case "", "github":
+		return newGithubProvider(env.GHClientID, env.GHClientSecret, env.OAuthRedirectURI)
+	case "gitlab":
+		return newGitlabProvider(env.GitlabURL, env.GitlabClientID, env.GitlabClientSecret, env.OAuthRedirectURI)
+	case "oidc":
+		return newOIDCProvider(
+			env.OIDCName,
+			env.OIDCAuthorizeURL,
+			env.OIDCTokenURL,
+			env.OIDCUserInfoURL,
+			env.OIDCClientID,
+			env.OIDCClientSecret,
+			env.OAuthRedirectURI,
+		)
+	case "dev":
+		if env.Env != "local" {
+			return nil, fmt.Errorf("dev identity provider may only be used when ENV=local")
+		}
+		return devProvider{redirectURI: env.OAuthRedirectURI}, nil
+	default:
+		return nil, fmt.Errorf("Unknown IDENTITY_PROVIDER: %s", env.IdentityProvider)
+	}
+}
+
+type oauthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// authorizeURL builds a standard oauth2 authorization request url
+func authorizeURL(base string, query url.Values, state string, codeChallenge string) string {
+	query.Set("state", state)
+
+	if codeChallenge != "" {
+		query.Set("code_challenge", codeChallenge)
+		query.Set("code_challenge_method", "S256")
+	}
+
+	return base + "?" + query.Encode()
+}
+
+// exchangeCodeForm performs a standard oauth2 authorization_code grant
+func exchangeCodeForm(ctx context.Context, tokenURL string, form url.Values, codeVerifier string) (string, error) {
+	form.Set("grant_type", "authorization_code")
+
+	if codeVerifier != "" {
+		form.Set("code_verifier", codeVerifier)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		return "", errors.Wrap(err, "Error creating token request")
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := client.Do(req)
+
+	if err != nil {
+		return "", errors.Wrap(err, "Error sending token request")
+	}
+
+	defer res.Body.Close()
+
+	resContent, err := ioutil.ReadAll(io.LimitReader(res.Body, 50000))
+
+	if err != nil {
+		return "", errors.Wrap(err, "Error reading token response body")
+	}
+
+	if res.StatusCode >= 300 {
+		return "", fmt.Errorf("Unexpected status code in token response: \n%d\n%s", res.StatusCode, resContent)
+	}
+
+	tokenRes := oauthTokenResponse{}
+	err = json.Unmarshal(resContent, &tokenRes)
+
+	if err != nil {
+		return "", errors.Wrapf(err, "Could not decode token response content: \n%s", resContent)
+	}
+
+	if tokenRes.AccessToken == "" {
+		return "", fmt.Errorf("Access token missing in token response: \n%s", resContent)
+	}
+
+	return tokenRes.AccessToken, err
+}
+
+// getUserInfo requests a bearer token protected json document and decodes it into ref
+func getUserInfo(ctx context.Context, userInfoURL string, accessToken string, ref interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, userInfoURL, nil)
+
+	if err != nil {
+		return errors.Wrap(err, "Error creating user info request")
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+
+	res, err := client.Do(req)
+
+	if err != nil {
+		return errors.Wrap(err, "Error sending user info request")
+	}
+
+	defer res.Body.Close()
+
+	resContent, err := ioutil.ReadAll(io.LimitReader(res.Body, 50000))
+
+	if err != nil {
+		return errors.Wrap(err, "Error reading user info response body")
+	}
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected status code retrieving user info: %d \n %s", res.StatusCode, resContent)
+	}
+
+	err = json.Unmarshal(resContent, ref)
+
+	if err != nil {
+		return errors.Wrapf(err, "Error decoding user info: \n%s", resContent)
+	}
+
+	return err
+}
+
+type gitlabProvider struct {
+	baseURL      string
+	clientID     string
+	clientSecret string
+	redirectURI  string
+}
+
+func newGitlabProvider(baseURL string, clientID string, clientSecret string, redirectURI string) (*gitlabProvider, error) {
+	if clientID == "" || clientSecret == "" || redirectURI == "" {
+		return nil, fmt.Errorf("gitlab identity provider requires GITLAB_CLIENT_ID, GITLAB_CLIENT_SECRET and OAUTH_REDIRECT_URI")
+	}
+
+	if baseURL == "" {
+		baseURL = "https://gitlab.com"
+	}
+
+	return &gitlabProvider{
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURI:  redirectURI,
+	}, nil
+}
+
+func (p *gitlabProvider) Name() string {
+	return "gitlab"
+}
+
+func (p *gitlabProvider) AuthorizeURL(state string, codeChallenge string) string {
+	return authorizeURL(p.baseURL+"/oauth/authorize", url.Values{
+		"client_id":     {p.clientID},
+		"redirect_uri":  {p.redirectURI},
+		"response_type": {"code"},
+		"scope":         {"read_user"},
+	}, state, codeChallenge)
+}
+
+func (p *gitlabProvider) SupportsPKCE() bool {
+	return true
+}
+
+func (p *gitlabProvider) ExchangeCode(ctx context.Context, logger *log.Logger, code string, codeVerifier string) (string, error) {
+	return exchangeCodeForm(ctx, p.baseURL+"/oauth/token", url.Values{
+		"client_id":     {p.clientID},
+		"client_secret": {p.clientSecret},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURI},
+	}, codeVerifier)
+}
+
+type gitlabUserInfo struct {
+	ID *int `json:"id"`
+}
+
+func (p *gitlabProvider) RetrieveUserID(ctx context.Context, logger *log.Logger, accessToken string) (string, error) {
+	ui := gitlabUserInfo{}
+
+	err := getUserInfo(ctx, p.baseURL+"/api/v4/user", accessToken, &ui)
+
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to retrieve gitlab user")
+	}
+
+	if ui.ID == nil {
+		return "", fmt.Errorf("Failed to retrieve user id from gitlab user info")
+	}
+
+	return fmt.Sprintf("%d", *ui.ID), err
+}
+
+// oidcProvider any OpenID Connect provider, agents are identified by the "sub" claim of userinfo
+type oidcProvider struct {
+	name         string
+	authorizeURL string
+	tokenURL     string
+	userInfoURL  string
+	clientID     string
+	clientSecret string
+	redirectURI  string
+}
+
+func newOIDCProvider(
+	name string,
+	authorizeURL string,
+	tokenURL string,
+	userInfoURL string,
+	clientID string,
+	clientSecret string,
+	redirectURI string,
+) (*oidcProvider, error) {
+	if authorizeURL == "" || tokenURL == "" || userInfoURL == "" || clientID == "" || redirectURI == "" {
+		return nil, fmt.Errorf("oidc identity provider requires OIDC_AUTHORIZE_URL, OIDC_TOKEN_URL, OIDC_USERINFO_URL, OIDC_CLIENT_ID and OAUTH_REDIRECT_URI")
+	}
+
+	if name == "" {
+		name = "oidc"
+	}
+
+	return &oidcProvider{
+		name:         name,
+		authorizeURL: authorizeURL,
+		tokenURL:     tokenURL,
+		userInfoURL:  userInfoURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURI:  redirectURI,
+	}, nil
+}
+
+func (p *oidcProvider) Name() string {
+	return p.name
+}
+
+func (p *oidcProvider) AuthorizeURL(state string, codeChallenge string) string {
+	return authorizeURL(p.authorizeURL, url.Values{
+		"client_id":     {p.clientID},
+		"redirect_uri":  {p.redirectURI},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+	}, state, codeChallenge)
+}
+
+func (p *oidcProvider) SupportsPKCE() bool {
+	return true
+}
+
+func (p *oidcProvider) ExchangeCode(ctx context.Context, logger *log.Logger, code string, codeVerifier string) (string, error) {
+	form := url.Values{
+		"client_id":    {p.clientID},
+		"code":         {code},
+		"redirect_uri": {p.redirectURI},
+	}
+
+	if p.clientSecret != "" {
+		form.Set("client_secret", p.clientSecret)
+	}
+
+	return exchangeCodeForm(ctx, p.tokenURL, form, codeVerifier)
+}
+
+type oidcUserInfo struct {
+	Sub string `json:"sub"`
+}
+
+func (p *oidcProvider) RetrieveUserID(ctx context.Context, logger *log.Logger, accessToken string) (string, error) {
+	ui := oidcUserInfo{}
+
+	err := getUserInfo(ctx, p.userInfoURL, accessToken, &ui)
+
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to retrieve %s user", p.name)
+	}
+
+	if ui.Sub == "" {
+		return "", fmt.Errorf("Failed to retrieve sub claim from %s user info", p.name)
+	}
+
+	return ui.Sub, err
+}
+
+// devProvider logs agents in without any network access, the code is used as the agent's id.
+// Only available with ENV=local
+type devProvider struct {
+	redirectURI string
+}
+
+func (devProvider) Name() string {
+	return "dev"
+}
+
+// AuthorizeURL skips straight back to the client, logged in as "dev-agent"
+func (p devProvider) AuthorizeURL(state string, codeChallenge string) string {
+	redirectURI := p.redirectURI
+	if redirectURI == "" {
+		redirectURI = "http://localhost:1234"
+	}
+
+	return redirectURI + "?" + url.Values{
+		"code":  {"dev-agent"},
+		"state": {state},
+	}.Encode()
+}
+
+func (devProvider) SupportsPKCE() bool {
+	return false
+}
+
+func (devProvider) ExchangeCode(ctx context.Context, logger *log.Logger, code string, codeVerifier string) (string, error) {
+	return code, nil
+}
+
+func (devProvider) RetrieveUserID(ctx context.Context, logger *log.Logger, accessToken string) (string, error) {
+	if accessToken == "" {
+		return "", fmt.Errorf("dev identity provider requires a non-empty code")
+	}
+	return accessToken, nil
+}
@@ -0,0 +1,311 @@
+package token
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/abradley2/macguffin/lib/database"
+	"github.com/abradley2/macguffin/lib/env"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// session the tokens handed to the client after logging in or refreshing
+type session struct {
+	ClientToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// refreshTokenData a refresh token as it is stored in the refresh tokens collection. Every refresh
+// token issued from one login shares a familyID, and rotated tokens are kept until they expire
+// so that presenting one a second time can be detected
+type refreshTokenData struct {
+	UserID    string    `bson:"userID"`
+	FamilyID  string    `bson:"familyID"`
+	Rotated   bool      `bson:"rotated"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+type errRefreshTokenReused struct{}
+
+// Error _
+func (errRefreshTokenReused) Error() string {
+	return "Refresh token has already been used"
+}
+
+// ErrRefreshTokenReused indicates a refresh token was presented after it had been rotated, which
+// means it was stolen or replayed. Every session from the same login is revoked when this happens
+var ErrRefreshTokenReused errRefreshTokenReused
+
+func newSessionFamilyID() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to generate session family id")
+	}
+
+	return hex.EncodeToString(b), err
+}
+
+// issueSession stores a new client token and refresh token for an agent, as part of a family of sessions
+func issueSession(
+	ctx context.Context,
+	userID string,
+	familyID string,
+	params storeTokenParams,
+) (session, error) {
+	var s session
+
+	clientToken, err := newClientToken()
+
+	if err != nil {
+		return s, err
+	}
+
+	refreshToken, err := newClientToken()
+
+	if err != nil {
+		return s, err
+	}
+
+	now := time.Now()
+
+	_, err = params.tokensCollection.InsertOne(
+		ctx,
+		bson.M{
+			"userID":          userID,
+			"clientTokenHash": HashClientToken(clientToken),
+			"familyID":        familyID,
+			"createdAt":       primitive.NewDateTimeFromTime(now),
+			"lastSeenAt":      primitive.NewDateTimeFromTime(now),
+		},
+		&options.InsertOneOptions{},
+	)
+
+	if err != nil {
+		return s, errors.Wrap(err, "Could not insert user document into tokens collection")
+	}
+
+	_, err = params.refreshTokensCollection.InsertOne(
+		ctx,
+		bson.M{
+			"userID":    userID,
+			"tokenHash": HashClientToken(refreshToken),
+			"familyID":  familyID,
+			"rotated":   false,
+			"createdAt": primitive.NewDateTimeFromTime(now),
+			"expiresAt": primitive.NewDateTimeFromTime(now.Add(env.RefreshTokenLifetime)),
+		},
+		&options.InsertOneOptions{},
+	)
+
+	if err != nil {
+		return s, errors.Wrap(err, "Could not insert refresh token document into refresh tokens collection")
+	}
+
+	s = session{
+		ClientToken:  clientToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(env.SessionLifetime.Seconds()),
+	}
+
+	return s, err
+}
+
+// rotateRefreshToken exchanges a refresh token for a new session in the same family. The old
+// refresh token can never be used again, and the session it was issued with is ended
+func rotateRefreshToken(ctx context.Context, refreshToken string, params storeTokenParams) (session, error) {
+	var s session
+
+	tokenHash := HashClientToken(refreshToken)
+
+	res := params.refreshTokensCollection.FindOne(
+		ctx,
+		bson.M{
+			"tokenHash": bson.M{
+				"$eq": tokenHash,
+			},
+		},
+		&options.FindOneOptions{},
+	)
+
+	if res.Err() == mongo.ErrNoDocuments {
+		return s, ErrTokenExpired
+	}
+
+	data := refreshTokenData{}
+	err := res.Decode(&data)
+
+	if err != nil {
+		return s, errors.Wrap(err, "Failed to decode refresh token document from db")
+	}
+
+	if data.Rotated {
+		return s, revokeSessionFamily(ctx, data.FamilyID, params)
+	}
+
+	if time.Now().After(data.ExpiresAt) {
+		return s, ErrTokenExpired
+	}
+
+	updateRes, err := params.refreshTokensCollection.UpdateOne(
+		ctx,
+		bson.M{
+			"tokenHash": bson.M{
+				"$eq": tokenHash,
+			},
+			"rotated": bson.M{
+				"$eq": false,
+			},
+		},
+		bson.M{
+			"$set": bson.M{
+				"rotated":   true,
+				"rotatedAt": primitive.NewDateTimeFromTime(time.Now()),
+			},
+		},
+		&options.UpdateOptions{},
+	)
+
+	if err != nil {
+		return s, errors.Wrap(err, "Failed to mark refresh token as rotated")
+	}
+
+	// another request rotated the same token between our read and write
+	if updateRes.MatchedCount() == 0 {
+		return s, revokeSessionFamily(ctx, data.FamilyID, params)
+	}
+
+	_, err = params.tokensCollection.DeleteMany(
+		ctx,
+		bson.M{
+			"familyID": bson.M{
+				"$eq": data.FamilyID,
+			},
+		},
+		&options.DeleteOptions{},
+	)
+
+	if err != nil {
+		return s, errors.Wrap(err, "Failed to end the session a refresh token replaces")
+	}
+
+	return issueSession(ctx, data.UserID, data.FamilyID, params)
+}
+
+// revokeSessionFamily ends every session descended from one login. It always returns
+// ErrRefreshTokenReused unless the sessions could not be deleted
+func revokeSessionFamily(ctx context.Context, familyID string, params storeTokenParams) error {
+	f := bson.M{
+		"familyID": bson.M{
+			"$eq": familyID,
+		},
+	}
+
+	_, err := params.tokensCollection.DeleteMany(ctx, f, &options.DeleteOptions{})
+
+	if err != nil {
+		return errors.Wrapf(err, "Failed to revoke client tokens of reused refresh token family: %s", familyID)
+	}
+
+	_, err = params.refreshTokensCollection.DeleteMany(ctx, f, &options.DeleteOptions{})
+
+	if err != nil {
+		return errors.Wrapf(err, "Failed to revoke refresh tokens of reused refresh token family: %s", familyID)
+	}
+
+	return ErrRefreshTokenReused
+}
+
+type refreshTokenBody struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshTokenParams _
+type RefreshTokenParams struct {
+	Logger                 *log.Logger
+	TokenCollection        database.Collection
+	RefreshTokenCollection database.Collection
+
+	// body - required
+	// json body with the "refresh_token" given out with the current session
+	body refreshTokenBody
+}
+
+// FromRequest build RefreshTokenParams from an http.Request
+func (params *RefreshTokenParams) FromRequest(r *http.Request) error {
+	bodyContent, err := ioutil.ReadAll(
+		io.LimitReader(r.Body, 50000),
+	)
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to read bodyContent from request")
+	}
+
+	err = json.Unmarshal(bodyContent, &params.body)
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to unmarshal body json")
+	}
+
+	if params.body.RefreshToken == "" {
+		return fmt.Errorf("Body missing required parameter: 'refresh_token'")
+	}
+
+	return err
+}
+
+// HandleRefreshToken exchanges a refresh token for a new client token and refresh token
+func HandleRefreshToken(ctx context.Context, w http.ResponseWriter, params RefreshTokenParams) {
+	logger := params.Logger
+
+	s, err := rotateRefreshToken(
+		ctx,
+		params.body.RefreshToken,
+		storeTokenParams{
+			tokensCollection:        params.TokenCollection,
+			refreshTokensCollection: params.RefreshTokenCollection,
+		},
+	)
+
+	var js []byte
+	if err == nil {
+		js, err = json.Marshal(s)
+	}
+
+	switch errors.Cause(err) {
+	case nil:
+	case ErrTokenExpired:
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Invalid refresh token"))
+		return
+	case ErrRefreshTokenReused:
+		logger.Printf("Refresh token reused, revoked every session from the same login")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Invalid refresh token"))
+		return
+	default:
+		logger.Printf("Error refreshing token: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
@@ -0,0 +1,167 @@
+package token
+
+import (
+	"context"
+
+	"github.com/abradley2/macguffin/lib/database"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Role what an agent is allowed to do in the workstation
+type Role string
+
+const (
+	// RoleAgent the default role every agent starts with
+	RoleAgent Role = "agent"
+	// RoleModerator agents who can approve and reject articles
+	RoleModerator Role = "moderator"
+	// RoleAdmin agents who can also grant and revoke roles
+	RoleAdmin Role = "admin"
+)
+
+var roleRanks = map[Role]int{
+	RoleAgent:     0,
+	RoleModerator: 1,
+	RoleAdmin:     2,
+}
+
+// MaxClearance the highest clearance level an agent can hold
+const MaxClearance = 5
+
+// Valid whether the role is one we know about
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+func (r Role) rank() int {
+	// agents created before roles existed have no role stored
+	return roleRanks[r]
+}
+
+// Permission the role and clearance level an agent needs to perform an action
+type Permission struct {
+	Role      Role
+	Clearance int
+}
+
+// PermModerate required to approve, reject and edit other agents' articles
+var PermModerate = Permission{Role: RoleModerator}
+
+// PermAdminister required to manage the roles of other agents
+var PermAdminister = Permission{Role: RoleAdmin}
+
+type errForbidden struct{}
+
+// Error _
+func (errForbidden) Error() string {
+	return "Agent does not have permission to perform this action"
+}
+
+// ErrForbidden indicates the logged in agent lacks the role or clearance for an action
+var ErrForbidden errForbidden
+
+// Authorize returns ErrForbidden unless the agent holds at least the role and clearance of perm
+func Authorize(user UserData, perm Permission) error {
+	if user.Role.rank() < perm.Role.rank() || user.Clearance < perm.Clearance {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// Can reports whether Authorize would allow the agent to perform an action
+func (user UserData) Can(perm Permission) bool {
+	return Authorize(user, perm) == nil
+}
+
+// GetAuthorizedUser retrieves the logged in user and checks they have the given permission
+func GetAuthorizedUser(
+	ctx context.Context,
+	clientToken string,
+	params GetLoggedInUserParams,
+	perm Permission,
+) (UserData, error) {
+	user, err := GetLoggedInUser(ctx, clientToken, params)
+
+	if err != nil {
+		return user, errors.Wrap(err, "Failed to get logged in user")
+	}
+
+	return user, Authorize(user, perm)
+}
+
+type errUnknownAgent struct{}
+
+// Error _
+func (errUnknownAgent) Error() string {
+	return "No agent found with the given userID"
+}
+
+// ErrUnknownAgent indicates the agent whose role is being changed does not exist
+var ErrUnknownAgent errUnknownAgent
+
+func setRole(
+	ctx context.Context,
+	agents database.Collection,
+	userID string,
+	role Role,
+	clearance int,
+	upsert bool,
+) error {
+	res, err := agents.UpdateOne(
+		ctx,
+		bson.M{
+			"userID": bson.M{
+				"$eq": userID,
+			},
+		},
+		bson.M{
+			"$set": bson.M{
+				"role":      role,
+				"clearance": clearance,
+			},
+			"$setOnInsert": bson.M{
+				"initialized": false,
+			},
+		},
+		options.Update().SetUpsert(upsert),
+	)
+
+	if err != nil {
+		return errors.Wrapf(err, "Failed to set role %s for userID: %s", role, userID)
+	}
+
+	if upsert == false && res.MatchedCount() == 0 {
+		return ErrUnknownAgent
+	}
+
+	return err
+}
+
+// BootstrapAdmin grants the admin role and full clearance to an agent, creating them
+// if they have never logged in. Used on startup so the first admin can grant every other role.
+// Once any admin exists it does nothing, so an admin can still demote the bootstrapped agent.
+// Reports whether the role was granted
+func BootstrapAdmin(ctx context.Context, agents database.Collection, userID string) (bool, error) {
+	admins, err := agents.CountDocuments(
+		ctx,
+		bson.M{
+			"role": bson.M{
+				"$eq": RoleAdmin,
+			},
+		},
+		&options.CountOptions{},
+	)
+
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to count admins before bootstrapping one")
+	}
+
+	if admins > 0 {
+		return false, nil
+	}
+
+	return true, setRole(ctx, agents, userID, RoleAdmin, MaxClearance, true)
+}
@@ -0,0 +1,314 @@
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/abradley2/macguffin/lib/database"
+	"github.com/abradley2/macguffin/lib/env"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sessionTouchInterval how stale lastSeenAt may get before a request bumps it, so that
+// a busy agent doesn't cause a write on every request
+const sessionTouchInterval = time.Minute
+
+// touchSession returns ErrTokenExpired if the session has gone unused for longer than the
+// session lifetime, otherwise it slides the session's expiry forward
+func touchSession(ctx context.Context, tokens database.Collection, tokenData UserTokenData) error {
+	now := time.Now()
+
+	lastSeenAt := tokenData.LastSeenAt
+
+	// sessions from before sliding expiry only have a creation time
+	if lastSeenAt.IsZero() {
+		lastSeenAt = tokenData.CreatedAt
+	}
+
+	if now.Sub(lastSeenAt) > env.SessionLifetime {
+		return ErrTokenExpired
+	}
+
+	if now.Sub(lastSeenAt) < sessionTouchInterval {
+		return nil
+	}
+
+	_, err := tokens.UpdateOne(
+		ctx,
+		bson.M{
+			"clientTokenHash": bson.M{
+				"$eq": tokenData.ClientTokenHash,
+			},
+		},
+		bson.M{
+			"$set": bson.M{
+				"lastSeenAt": primitive.NewDateTimeFromTime(now),
+			},
+		},
+		&options.UpdateOptions{},
+	)
+
+	if err != nil {
+		return errors.Wrapf(err, "Failed to update lastSeenAt of session for userID: %s", tokenData.UserID)
+	}
+
+	return err
+}
+
+// revokeToken deletes the session for a client token, along with the refresh tokens that could
+// renew it. Revoked tokens are gone from the tokens collection, so GetLoggedInUser treats them
+// exactly like expired ones
+func revokeToken(
+	ctx context.Context,
+	tokens database.Collection,
+	refreshTokens database.Collection,
+	clientToken string,
+) (int64, error) {
+	f := bson.M{
+		"clientTokenHash": bson.M{
+			"$eq": HashClientToken(clientToken),
+		},
+	}
+
+	res := tokens.FindOne(ctx, f, &options.FindOneOptions{})
+
+	if res.Err() == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+
+	tokenData := UserTokenData{}
+	err := res.Decode(&tokenData)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to decode token document from db")
+	}
+
+	revoked, err := tokens.DeleteOne(ctx, f, &options.DeleteOptions{})
+
+	if err != nil {
+		return revoked, errors.Wrap(err, "Failed to delete client token")
+	}
+
+	if tokenData.FamilyID == "" {
+		return revoked, err
+	}
+
+	_, err = refreshTokens.DeleteMany(
+		ctx,
+		bson.M{
+			"familyID": bson.M{
+				"$eq": tokenData.FamilyID,
+			},
+		},
+		&options.DeleteOptions{},
+	)
+
+	if err != nil {
+		return revoked, errors.Wrap(err, "Failed to delete refresh tokens of client token")
+	}
+
+	return revoked, err
+}
+
+// revokeAllTokens deletes every session and refresh token belonging to an agent, returning how many sessions there were
+func revokeAllTokens(
+	ctx context.Context,
+	tokens database.Collection,
+	refreshTokens database.Collection,
+	userID string,
+) (int64, error) {
+	f := bson.M{
+		"userID": bson.M{
+			"$eq": userID,
+		},
+	}
+
+	revoked, err := tokens.DeleteMany(ctx, f, &options.DeleteOptions{})
+
+	if err != nil {
+		return revoked, errors.Wrapf(err, "Failed to delete client tokens for userID: %s", userID)
+	}
+
+	_, err = refreshTokens.DeleteMany(ctx, f, &options.DeleteOptions{})
+
+	if err != nil {
+		return revoked, errors.Wrapf(err, "Failed to delete refresh tokens for userID: %s", userID)
+	}
+
+	return revoked, err
+}
+
+// LogoutParams _
+type LogoutParams struct {
+	Logger                 *log.Logger
+	TokenCollection        database.Collection
+	RefreshTokenCollection database.Collection
+	UserCollection         database.Collection
+
+	// clientToken: headers.Authorization - required
+	// token of the session being ended
+	clientToken string
+}
+
+// FromRequest build LogoutParams from an http.Request
+func (params *LogoutParams) FromRequest(r *http.Request) error {
+	params.clientToken = r.Header.Get("Authorization")
+
+	if params.clientToken == "" {
+		return fmt.Errorf("Missing required parameter: headers.Authorization")
+	}
+
+	return nil
+}
+
+// HandleLogout ends the session of the presented client token. Logging out of a session
+// that has already expired or been revoked is not an error
+func HandleLogout(ctx context.Context, w http.ResponseWriter, params LogoutParams) {
+	logger := params.Logger
+
+	revoked, err := revokeToken(ctx, params.TokenCollection, params.RefreshTokenCollection, params.clientToken)
+
+	if err != nil {
+		logger.Printf("Error logging out: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf(`{"revoked": %d}`, revoked)))
+}
+
+// HandleLogoutAll ends every session of the agent the presented client token belongs to
+func HandleLogoutAll(ctx context.Context, w http.ResponseWriter, params LogoutParams) {
+	logger := params.Logger
+
+	user, err := GetLoggedInUser(
+		ctx,
+		params.clientToken,
+		GetLoggedInUserParams{
+			Tokens: params.TokenCollection,
+			Users:  params.UserCollection,
+		},
+	)
+
+	if errors.Cause(err) == ErrTokenExpired {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Invalid Authorization token"))
+		return
+	}
+
+	var revoked int64
+	if err == nil {
+		revoked, err = revokeAllTokens(ctx, params.TokenCollection, params.RefreshTokenCollection, user.UserID)
+	}
+
+	if err != nil {
+		logger.Printf("Error logging out of all sessions: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf(`{"revoked": %d}`, revoked)))
+}
+
+type revokeSessionsBody struct {
+	UserID string `json:"userID"`
+}
+
+// RevokeSessionsParams _
+type RevokeSessionsParams struct {
+	Logger                 *log.Logger
+	TokenCollection        database.Collection
+	RefreshTokenCollection database.Collection
+	UserCollection         database.Collection
+
+	// clientToken: headers.Authorization - required
+	// token of the admin revoking the sessions
+	clientToken string
+
+	// body - required
+	// the userID of the agent whose sessions are revoked
+	body revokeSessionsBody
+}
+
+// FromRequest build RevokeSessionsParams from an http.Request
+func (params *RevokeSessionsParams) FromRequest(r *http.Request) error {
+	params.clientToken = r.Header.Get("Authorization")
+
+	if params.clientToken == "" {
+		return fmt.Errorf("Missing required parameter: headers.Authorization")
+	}
+
+	bodyContent, err := ioutil.ReadAll(
+		io.LimitReader(r.Body, 50000),
+	)
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to read bodyContent from request")
+	}
+
+	err = json.Unmarshal(bodyContent, &params.body)
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to unmarshal body json")
+	}
+
+	if params.body.UserID == "" {
+		return fmt.Errorf("Body missing required parameter: 'userID'")
+	}
+
+	return err
+}
+
+// HandleRevokeSessions ends every session of another agent, only admins may do this
+func HandleRevokeSessions(ctx context.Context, w http.ResponseWriter, params RevokeSessionsParams) {
+	logger := params.Logger
+
+	_, err := GetAuthorizedUser(
+		ctx,
+		params.clientToken,
+		GetLoggedInUserParams{
+			Tokens: params.TokenCollection,
+			Users:  params.UserCollection,
+		},
+		PermAdminister,
+	)
+
+	var revoked int64
+	if err == nil {
+		revoked, err = revokeAllTokens(ctx, params.TokenCollection, params.RefreshTokenCollection, params.body.UserID)
+	}
+
+	switch errors.Cause(err) {
+	case nil:
+	case ErrTokenExpired:
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Invalid Authorization token"))
+		return
+	case ErrForbidden:
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Forbidden"))
+		return
+	default:
+		logger.Printf("Error revoking sessions for agent: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf(`{"userID": "%s", "revoked": %d}`, params.body.UserID, revoked)))
+}
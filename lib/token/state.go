@@ -0,0 +1,168 @@
+package token
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/abradley2/macguffin/lib/database"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// stateTTL how long an agent has to complete a login with the identity provider
+const stateTTL = 10 * time.Minute
+
+type errInvalidState struct{}
+
+// Error _
+func (errInvalidState) Error() string {
+	return "OAuth state is invalid or expired"
+}
+
+// ErrInvalidState indicates the state returned with an oauth code was not issued by us, or is too old
+var ErrInvalidState errInvalidState
+
+type statePayload struct {
+	Nonce     string `json:"n"`
+	Provider  string `json:"p"`
+	Challenge string `json:"c"`
+	Expires   int64  `json:"e"`
+}
+
+// VerifiedState a state that was issued by us, which can be redeemed once
+type VerifiedState struct {
+	Nonce     string
+	ExpiresAt time.Time
+}
+
+// StateSigner issues and verifies the oauth state parameter. States are signed rather than stored
+// and carry the PKCE challenge of a verifier only the client that asked for the state is given,
+// so an intercepted code and state can't be redeemed without it. Redeemed states are kept in the
+// login states collection until they expire, so each one can only be used once
+type StateSigner struct {
+	key []byte
+	now func() time.Time
+}
+
+// NewStateSigner creates a StateSigner, every server instance must share the same key
+func NewStateSigner(key []byte) *StateSigner {
+	return &StateSigner{
+		key: key,
+		now: time.Now,
+	}
+}
+
+func (s *StateSigner) sign(msg string) string {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(msg))
+
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+
+	_, err := rand.Read(b)
+
+	return base64.RawURLEncoding.EncodeToString(b), err
+}
+
+// Issue creates a new state for a login through the named identity provider, along with the PKCE
+// code_verifier the client must present with it
+func (s *StateSigner) Issue(provider string) (string, string, error) {
+	nonce, err := randomString(16)
+
+	if err != nil {
+		return "", "", errors.Wrap(err, "Failed to generate state nonce")
+	}
+
+	verifier, err := randomString(32)
+
+	if err != nil {
+		return "", "", errors.Wrap(err, "Failed to generate PKCE verifier")
+	}
+
+	js, err := json.Marshal(statePayload{
+		Nonce:     nonce,
+		Provider:  provider,
+		Challenge: CodeChallenge(verifier),
+		Expires:   s.now().Add(stateTTL).Unix(),
+	})
+
+	if err != nil {
+		return "", "", errors.Wrap(err, "Failed to marshal state payload")
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(js)
+
+	return payload + "." + s.sign(payload), verifier, err
+}
+
+// Verify returns ErrInvalidState unless the state was issued by us for the named provider along
+// with the verifier, and has not expired
+func (s *StateSigner) Verify(state string, provider string, verifier string) (VerifiedState, error) {
+	verified := VerifiedState{}
+	parts := strings.Split(state, ".")
+
+	if len(parts) != 2 {
+		return verified, ErrInvalidState
+	}
+
+	if hmac.Equal([]byte(s.sign(parts[0])), []byte(parts[1])) == false {
+		return verified, ErrInvalidState
+	}
+
+	js, err := base64.RawURLEncoding.DecodeString(parts[0])
+
+	if err != nil {
+		return verified, ErrInvalidState
+	}
+
+	payload := statePayload{}
+	err = json.Unmarshal(js, &payload)
+
+	if err != nil || payload.Provider != provider || s.now().Unix() > payload.Expires {
+		return verified, ErrInvalidState
+	}
+
+	if verifier == "" || hmac.Equal([]byte(CodeChallenge(verifier)), []byte(payload.Challenge)) == false {
+		return verified, ErrInvalidState
+	}
+
+	verified.Nonce = payload.Nonce
+	verified.ExpiresAt = time.Unix(payload.Expires, 0)
+
+	return verified, nil
+}
+
+// CodeChallenge the S256 PKCE code_challenge for a code_verifier
+func CodeChallenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// redeemState records that a state has been used, returning ErrInvalidState if it already was
+func redeemState(ctx context.Context, loginStates database.Collection, state VerifiedState) error {
+	_, err := loginStates.InsertOne(
+		ctx,
+		bson.M{
+			"_id":       state.Nonce,
+			"expiresAt": state.ExpiresAt,
+		},
+		&options.InsertOneOptions{},
+	)
+
+	if database.IsDuplicateKeyError(err) {
+		return ErrInvalidState
+	}
+
+	return errors.Wrap(err, "Failed to redeem login state")
+}
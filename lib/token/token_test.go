@@ -2,11 +2,24 @@ package token
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/abradley2/macguffin/lib/database"
+	"github.com/abradley2/macguffin/lib/env"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type tokenTestCollection struct {
@@ -21,13 +34,12 @@ func TestCreateUser(t *testing.T) {
 
 	_, err := storeToken(
 		context.Background(),
-		githubAccessTokenResponse{
-			AccessToken: "whatever",
-		},
 		testGhUserID,
 		storeTokenParams{
-			tokensCollection: tokensCollection,
-			agentsCollection: usersCollection,
+			transactor:              &database.TestDatabase{},
+			tokensCollection:        tokensCollection,
+			refreshTokensCollection: &database.TestCollection{},
+			agentsCollection:        usersCollection,
 		},
 	)
 
@@ -37,13 +49,17 @@ func TestCreateUser(t *testing.T) {
 		t.Errorf("Failed to store token: %v", err)
 	}
 
-	ud := UserData{}
-	err = json.Unmarshal(usersCollection.LastInsert, &ud)
+	update := struct {
+		SetOnInsert UserData `json:"$setOnInsert"`
+	}{}
+	err = json.Unmarshal(usersCollection.LastUpdate, &update)
 
 	if err != nil {
-		t.Errorf("Failed to unmarshal usersCollection lastinsert into user data: %v", err)
+		t.Errorf("Failed to unmarshal usersCollection lastupdate into user data: %v", err)
 	}
 
+	ud := update.SetOnInsert
+
 	if ud.UserID != testGhUserID {
 		t.Errorf(
 			"Did not find github user id in users collection after storeToken was called: %s != %s",
@@ -52,3 +68,615 @@ func TestCreateUser(t *testing.T) {
 		)
 	}
 }
+
+func TestStoreTokenForReturningAgent(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewMemoryDatabase()
+	agents := db.Collection(database.AgentsCollection)
+	params := storeTokenParams{
+		transactor:              db,
+		tokensCollection:        db.Collection(database.TokensCollection),
+		refreshTokensCollection: db.Collection(database.RefreshTokensCollection),
+		agentsCollection:        agents,
+	}
+
+	publicAgentIDs := []string{}
+
+	for i := 0; i < 2; i++ {
+		if _, err := storeToken(ctx, "github:1", params); err != nil {
+			t.Fatalf("Failed to store token for login %d: %v", i+1, err)
+		}
+
+		user := UserData{}
+
+		if err := agents.FindOne(ctx, bson.M{"userID": "github:1"}, nil).Decode(&user); err != nil {
+			t.Fatalf("Could not find agent: %v", err)
+		}
+
+		publicAgentIDs = append(publicAgentIDs, user.PublicAgentID)
+	}
+
+	n, err := agents.CountDocuments(ctx, bson.M{}, nil)
+
+	if err != nil || n != 1 || publicAgentIDs[0] == "" || publicAgentIDs[0] != publicAgentIDs[1] {
+		t.Errorf("Expected logging in again to leave the agent alone, got %d agents %v: %v", n, publicAgentIDs, err)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	cases := []struct {
+		user    UserData
+		perm    Permission
+		allowed bool
+	}{
+		{UserData{UserID: "a"}, PermModerate, false},
+		{UserData{UserID: "a", Role: RoleAgent}, PermModerate, false},
+		{UserData{UserID: "a", Role: RoleModerator}, PermModerate, true},
+		{UserData{UserID: "a", Role: RoleModerator}, PermAdminister, false},
+		{UserData{UserID: "a", Role: RoleAdmin}, PermModerate, true},
+		{UserData{UserID: "a", Role: RoleAdmin}, Permission{Role: RoleAgent, Clearance: 3}, false},
+		{UserData{UserID: "a", Role: RoleAgent, Clearance: 3}, Permission{Role: RoleAgent, Clearance: 3}, true},
+	}
+
+	for _, c := range cases {
+		if c.user.Can(c.perm) != c.allowed {
+			t.Errorf("Expected Can(%v) to be %v for %v", c.perm, c.allowed, c.user)
+		}
+	}
+}
+
+func TestSetRole(t *testing.T) {
+	const (
+		adminToken = "admin-token"
+		agentToken = "agent-token"
+	)
+
+	tokensCollection := &database.TestCollection{}
+	usersCollection := &database.TestCollection{}
+
+	for _, u := range []UserData{{UserID: "admin", Role: RoleAdmin}, {UserID: "agent", Role: RoleAgent}} {
+		tokenJSON, _ := json.Marshal(UserTokenData{UserID: u.UserID, ClientTokenHash: HashClientToken(u.UserID + "-token"), LastSeenAt: time.Now()})
+		tokensCollection.HashQuery(bson.M{"clientTokenHash": bson.M{"$eq": HashClientToken(u.UserID + "-token")}}, tokenJSON)
+
+		userJSON, _ := json.Marshal(u)
+		usersCollection.HashQuery(bson.M{"userID": bson.M{"$eq": u.UserID}}, userJSON)
+	}
+
+	setRole := func(clientToken string) int {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(
+			http.MethodPost,
+			"",
+			strings.NewReader(`{"userID": "agent", "role": "moderator", "clearance": 2}`),
+		)
+		r.Header.Set("Authorization", clientToken)
+
+		p := SetRoleParams{
+			Logger:          log.New(os.Stderr, "", log.LstdFlags),
+			TokenCollection: tokensCollection,
+			UserCollection:  usersCollection,
+		}
+
+		err := p.FromRequest(r)
+
+		if err != nil {
+			t.Fatalf("Failed to create SetRoleParams from request: %v", err)
+		}
+
+		HandleSetRole(context.Background(), w, p)
+
+		return w.Code
+	}
+
+	if code := setRole(agentToken); code != http.StatusForbidden {
+		t.Errorf("Expected agents to be forbidden from setting roles, got: %d", code)
+	}
+
+	if usersCollection.LastUpdate != nil {
+		t.Errorf("Role should not have been updated by an agent")
+	}
+
+	if code := setRole(adminToken); code != http.StatusOK {
+		t.Errorf("Expected admins to be able to set roles, got: %d", code)
+	}
+
+	if strings.Contains(string(usersCollection.LastUpdate), `"role":"moderator"`) == false {
+		t.Errorf("Expected role update to be sent to agents collection, got: %s", usersCollection.LastUpdate)
+	}
+}
+
+func TestBootstrapAdmin(t *testing.T) {
+	ctx := context.Background()
+	agents := database.NewMemoryDatabase().Collection(database.AgentsCollection)
+
+	role := func(userID string) Role {
+		user := UserData{}
+		err := agents.FindOne(ctx, bson.M{"userID": userID}, nil).Decode(&user)
+
+		if err != nil {
+			t.Fatalf("Could not find agent %s: %v", userID, err)
+		}
+
+		return user.Role
+	}
+
+	granted, err := BootstrapAdmin(ctx, agents, "github:1")
+
+	if err != nil || granted == false || role("github:1") != RoleAdmin {
+		t.Fatalf("Expected the first admin to be bootstrapped, got %t: %v", granted, err)
+	}
+
+	// an admin demoting the bootstrapped agent is not undone by the next startup
+	if err := setRole(ctx, agents, "github:1", RoleAgent, 0, false); err != nil {
+		t.Fatalf("Could not demote agent: %v", err)
+	}
+
+	if err := setRole(ctx, agents, "github:2", RoleAdmin, MaxClearance, true); err != nil {
+		t.Fatalf("Could not create admin fixture: %v", err)
+	}
+
+	granted, err = BootstrapAdmin(ctx, agents, "github:1")
+
+	if err != nil || granted || role("github:1") != RoleAgent {
+		t.Errorf("Expected bootstrapping to be skipped once an admin exists, got %t: %v", granted, err)
+	}
+}
+
+// failingCursor a cursor that fails partway through reading its results
+type failingCursor struct {
+	database.Cursor
+}
+
+func (c failingCursor) All(ctx context.Context, ref interface{}) error {
+	return errors.New("cursor failed")
+}
+
+type failingFindCollection struct {
+	database.Collection
+}
+
+func (c failingFindCollection) Find(ctx context.Context, filter interface{}, opts *options.FindOptions) (database.Cursor, error) {
+	curs, err := c.Collection.Find(ctx, filter, opts)
+
+	return failingCursor{curs}, err
+}
+
+func TestMigrateTokenStorage(t *testing.T) {
+	ctx := context.Background()
+	tokens := database.NewMemoryDatabase().Collection(database.TokensCollection)
+
+	for _, doc := range []bson.M{
+		{"clientToken": "plain-1", "accessToken": "provider-1", "userID": "github:1"},
+		{"clientTokenHash": HashClientToken("hashed-2"), "userID": "github:2"},
+	} {
+		if _, err := tokens.InsertOne(ctx, doc, nil); err != nil {
+			t.Fatalf("Could not insert token fixture: %v", err)
+		}
+	}
+
+	if _, err := MigrateTokenStorage(ctx, failingFindCollection{tokens}); err == nil {
+		t.Errorf("Expected a failed cursor to fail the migration")
+	}
+
+	migrated, err := MigrateTokenStorage(ctx, tokens)
+
+	if err != nil || migrated != 1 {
+		t.Fatalf("Expected one token to be migrated, got %d: %v", migrated, err)
+	}
+
+	doc := bson.M{}
+	err = tokens.FindOne(ctx, bson.M{"userID": "github:1"}, nil).Decode(&doc)
+
+	if err != nil || doc["clientTokenHash"] != HashClientToken("plain-1") ||
+		doc["clientToken"] != nil || doc["accessToken"] != nil {
+		t.Errorf("Expected the plaintext token to be replaced by its hash, got %v: %v", doc, err)
+	}
+
+	if migrated, err := MigrateTokenStorage(ctx, tokens); err != nil || migrated != 0 {
+		t.Errorf("Expected migrating again to do nothing, got %d: %v", migrated, err)
+	}
+}
+
+func TestGitlabProvider(t *testing.T) {
+	const testCode = "test-code"
+	const testAccessToken = "test-access-token"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != testCode || r.Form.Get("grant_type") != "authorization_code" || r.Form.Get("code_verifier") != "test-verifier" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"access_token": "` + testAccessToken + `"}`))
+	})
+	mux.HandleFunc("/api/v4/user", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testAccessToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"id": 8582764, "username": "agent"}`))
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	p, err := newGitlabProvider(srv.URL, "client-id", "client-secret", "http://localhost:1234")
+
+	if err != nil {
+		t.Fatalf("Failed to create gitlab provider: %v", err)
+	}
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+
+	accessToken, err := p.ExchangeCode(context.Background(), logger, testCode, "test-verifier")
+
+	if err != nil {
+		t.Fatalf("Failed to exchange code: %v", err)
+	}
+
+	userID, err := p.RetrieveUserID(context.Background(), logger, accessToken)
+
+	if err != nil {
+		t.Fatalf("Failed to retrieve user: %v", err)
+	}
+
+	if ProviderUserID(p, userID) != "gitlab:8582764" {
+		t.Errorf("Expected namespaced gitlab user id, got: %s", ProviderUserID(p, userID))
+	}
+}
+
+func TestProviderUserIDsDoNotCollide(t *testing.T) {
+	oidc, err := newOIDCProvider("", "http://authorize", "http://token", "http://userinfo", "client-id", "", "http://localhost:1234")
+
+	if err != nil {
+		t.Fatalf("Failed to create oidc provider: %v", err)
+	}
+
+	providers := []IdentityProvider{&githubProvider{}, &gitlabProvider{}, oidc, devProvider{}}
+	seen := make(map[string]bool)
+
+	for _, p := range providers {
+		id := ProviderUserID(p, "8582764")
+		if seen[id] {
+			t.Errorf("User id %s is not unique across providers", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestStateSigner(t *testing.T) {
+	s := NewStateSigner([]byte("test-secret"))
+
+	state, verifier, err := s.Issue("github")
+
+	if err != nil {
+		t.Fatalf("Failed to issue state: %v", err)
+	}
+
+	if _, err := s.Verify(state, "github", verifier); err != nil {
+		t.Errorf("Expected issued state to verify: %v", err)
+	}
+
+	if _, err := s.Verify(state, "gitlab", verifier); err != ErrInvalidState {
+		t.Errorf("Expected state for another provider to be rejected")
+	}
+
+	if _, err := NewStateSigner([]byte("other-secret")).Verify(state, "github", verifier); err != ErrInvalidState {
+		t.Errorf("Expected state signed with another key to be rejected")
+	}
+
+	if _, err := s.Verify("e30."+strings.Split(state, ".")[1], "github", verifier); err != ErrInvalidState {
+		t.Errorf("Expected tampered state to be rejected")
+	}
+
+	// the verifier is only given to the client that asked for the state, never derived from it
+	_, otherVerifier, _ := s.Issue("github")
+
+	if _, err := s.Verify(state, "github", otherVerifier); err != ErrInvalidState {
+		t.Errorf("Expected state presented with another verifier to be rejected")
+	}
+
+	if _, err := s.Verify(state, "github", ""); err != ErrInvalidState {
+		t.Errorf("Expected state presented without its verifier to be rejected")
+	}
+
+	s.now = func() time.Time { return time.Now().Add(stateTTL + time.Minute) }
+
+	if _, err := s.Verify(state, "github", verifier); err != ErrInvalidState {
+		t.Errorf("Expected expired state to be rejected")
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != CodeChallenge(verifier) {
+		t.Errorf("Expected code challenge to be the S256 hash of the verifier")
+	}
+
+	if len(verifier) < 43 || len(verifier) > 128 {
+		t.Errorf("PKCE verifier must be between 43 and 128 characters, got %d", len(verifier))
+	}
+}
+
+func TestGetTokenParamsVerifiesState(t *testing.T) {
+	states := NewStateSigner([]byte("test-secret"))
+	state, verifier, _ := states.Issue("dev")
+
+	fromRequest := func(body string) error {
+		r, _ := http.NewRequest(http.MethodPost, "", strings.NewReader(body))
+		p := GetTokenParams{
+			Logger:   log.New(os.Stderr, "", log.LstdFlags),
+			Provider: devProvider{},
+			States:   states,
+		}
+		return p.FromRequest(r)
+	}
+
+	if err := fromRequest(`{"code": "dev-agent"}`); err == nil {
+		t.Errorf("Expected a code without state to be rejected")
+	}
+
+	if err := fromRequest(`{"code": "dev-agent", "state": "forged", "codeVerifier": "` + verifier + `"}`); err != ErrInvalidState {
+		t.Errorf("Expected a code with a forged state to be rejected, got %v", err)
+	}
+
+	if err := fromRequest(`{"code": "dev-agent", "state": "` + state + `"}`); err == nil {
+		t.Errorf("Expected a code without the state's verifier to be rejected")
+	}
+
+	if err := fromRequest(`{"code": "dev-agent", "state": "` + state + `", "codeVerifier": "` + verifier + `"}`); err != nil {
+		t.Errorf("Expected a code with an issued state to be accepted, got %v", err)
+	}
+}
+
+func TestLoginStatesAreSingleUse(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	states := NewStateSigner([]byte("test-secret"))
+	state, verifier, _ := states.Issue("dev")
+
+	getToken := func() int {
+		r, _ := http.NewRequest(
+			http.MethodPost,
+			"",
+			strings.NewReader(`{"code": "dev-agent", "state": "`+state+`", "codeVerifier": "`+verifier+`"}`),
+		)
+		w := httptest.NewRecorder()
+		p := GetTokenParams{
+			Logger:                 log.New(os.Stderr, "", log.LstdFlags),
+			Transactor:             db,
+			TokenCollection:        db.Collection(database.TokensCollection),
+			RefreshTokenCollection: db.Collection(database.RefreshTokensCollection),
+			UserCollection:         db.Collection(database.AgentsCollection),
+			LoginStateCollection:   db.Collection(database.LoginStatesCollection),
+			Provider:               devProvider{},
+			States:                 states,
+		}
+
+		if err := p.FromRequest(r); err != nil {
+			t.Fatalf("Failed to create GetTokenParams from request: %v", err)
+		}
+
+		HandleGetToken(context.Background(), w, p)
+
+		return w.Code
+	}
+
+	if code := getToken(); code != http.StatusOK {
+		t.Fatalf("Expected the first use of a state to log in, got: %d", code)
+	}
+
+	if code := getToken(); code != http.StatusBadRequest {
+		t.Errorf("Expected a state to be rejected once it was used, got: %d", code)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	const clientToken = "agent-token"
+
+	tokensCollection := &database.TestCollection{}
+	usersCollection := &database.TestCollection{}
+
+	tokenJSON, _ := json.Marshal(UserTokenData{UserID: "agent", ClientTokenHash: HashClientToken(clientToken), LastSeenAt: time.Now()})
+	tokensCollection.HashQuery(bson.M{"clientTokenHash": bson.M{"$eq": HashClientToken(clientToken)}}, tokenJSON)
+
+	userJSON, _ := json.Marshal(UserData{UserID: "agent", Role: RoleAgent})
+	usersCollection.HashQuery(bson.M{"userID": bson.M{"$eq": "agent"}}, userJSON)
+
+	loggedInUserParams := GetLoggedInUserParams{Tokens: tokensCollection, Users: usersCollection}
+
+	_, err := GetLoggedInUser(context.Background(), clientToken, loggedInUserParams)
+
+	if err != nil {
+		t.Fatalf("Expected agent to be logged in before logout: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(http.MethodPost, "", nil)
+	r.Header.Set("Authorization", clientToken)
+
+	p := LogoutParams{
+		Logger:                 log.New(os.Stderr, "", log.LstdFlags),
+		TokenCollection:        tokensCollection,
+		RefreshTokenCollection: &database.TestCollection{},
+		UserCollection:         usersCollection,
+	}
+
+	err = p.FromRequest(r)
+
+	if err != nil {
+		t.Fatalf("Failed to create LogoutParams from request: %v", err)
+	}
+
+	HandleLogout(context.Background(), w, p)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected logout to succeed, got: %d", w.Code)
+	}
+
+	_, err = GetLoggedInUser(context.Background(), clientToken, loggedInUserParams)
+
+	if err != ErrTokenExpired {
+		t.Errorf("Expected revoked token to be treated as expired, got: %v", err)
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	tokensCollection := &database.TestCollection{}
+	usersCollection := &database.TestCollection{}
+
+	for _, u := range []UserData{{UserID: "admin", Role: RoleAdmin}, {UserID: "agent", Role: RoleAgent}} {
+		tokenJSON, _ := json.Marshal(UserTokenData{UserID: u.UserID, ClientTokenHash: HashClientToken(u.UserID + "-token"), LastSeenAt: time.Now()})
+		tokensCollection.HashQuery(bson.M{"clientTokenHash": bson.M{"$eq": HashClientToken(u.UserID + "-token")}}, tokenJSON)
+
+		userJSON, _ := json.Marshal(u)
+		usersCollection.HashQuery(bson.M{"userID": bson.M{"$eq": u.UserID}}, userJSON)
+	}
+
+	revokeSessions := func(clientToken string) int {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(http.MethodPost, "", strings.NewReader(`{"userID": "agent"}`))
+		r.Header.Set("Authorization", clientToken)
+
+		p := RevokeSessionsParams{
+			Logger:                 log.New(os.Stderr, "", log.LstdFlags),
+			TokenCollection:        tokensCollection,
+			RefreshTokenCollection: &database.TestCollection{},
+			UserCollection:         usersCollection,
+		}
+
+		err := p.FromRequest(r)
+
+		if err != nil {
+			t.Fatalf("Failed to create RevokeSessionsParams from request: %v", err)
+		}
+
+		HandleRevokeSessions(context.Background(), w, p)
+
+		return w.Code
+	}
+
+	if code := revokeSessions("agent-token"); code != http.StatusForbidden {
+		t.Errorf("Expected agents to be forbidden from revoking sessions, got: %d", code)
+	}
+
+	if tokensCollection.LastDelete != nil {
+		t.Errorf("Sessions should not have been revoked by an agent")
+	}
+
+	if code := revokeSessions("admin-token"); code != http.StatusOK {
+		t.Errorf("Expected admins to be able to revoke sessions, got: %d", code)
+	}
+
+	if strings.Contains(string(tokensCollection.LastDelete), `"userID":{"$eq":"agent"}`) == false {
+		t.Errorf("Expected every token of the agent to be deleted, got: %s", tokensCollection.LastDelete)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	tokensCollection := &database.TestCollection{}
+	usersCollection := &database.TestCollection{}
+
+	userJSON, _ := json.Marshal(UserData{UserID: "agent", Role: RoleAgent})
+	usersCollection.HashQuery(bson.M{"userID": bson.M{"$eq": "agent"}}, userJSON)
+
+	sessions := map[string]time.Time{
+		"idle-token":   time.Now().Add(-2 * env.SessionLifetime),
+		"active-token": time.Now().Add(-5 * time.Minute),
+	}
+
+	for clientToken, lastSeenAt := range sessions {
+		tokenJSON, _ := json.Marshal(UserTokenData{UserID: "agent", ClientTokenHash: HashClientToken(clientToken), LastSeenAt: lastSeenAt})
+		tokensCollection.HashQuery(bson.M{"clientTokenHash": bson.M{"$eq": HashClientToken(clientToken)}}, tokenJSON)
+	}
+
+	params := GetLoggedInUserParams{Tokens: tokensCollection, Users: usersCollection}
+
+	_, err := GetLoggedInUser(context.Background(), "idle-token", params)
+
+	if err != ErrTokenExpired {
+		t.Errorf("Expected session unused for longer than its lifetime to be expired, got: %v", err)
+	}
+
+	if tokensCollection.LastUpdate != nil {
+		t.Errorf("Expired session should not have been extended")
+	}
+
+	_, err = GetLoggedInUser(context.Background(), "active-token", params)
+
+	if err != nil {
+		t.Errorf("Expected recently used session to be valid, got: %v", err)
+	}
+
+	if strings.Contains(string(tokensCollection.LastUpdate), "lastSeenAt") == false {
+		t.Errorf("Expected using a session to extend it, got: %s", tokensCollection.LastUpdate)
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	tokensCollection := &database.TestCollection{}
+	refreshTokensCollection := &database.TestCollection{}
+
+	for refreshToken, rotated := range map[string]bool{"fresh-refresh-token": false, "rotated-refresh-token": true} {
+		refreshJSON, _ := json.Marshal(bson.M{
+			"userID":    "agent",
+			"familyID":  refreshToken + "-family",
+			"rotated":   rotated,
+			"expiresAt": time.Now().Add(time.Hour),
+		})
+		refreshTokensCollection.HashQuery(bson.M{"tokenHash": bson.M{"$eq": HashClientToken(refreshToken)}}, refreshJSON)
+		refreshTokensCollection.HashQuery(
+			bson.M{"tokenHash": bson.M{"$eq": HashClientToken(refreshToken)}, "rotated": bson.M{"$eq": false}},
+			refreshJSON,
+		)
+	}
+
+	refresh := func(refreshToken string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(
+			http.MethodPost,
+			"",
+			strings.NewReader(fmt.Sprintf(`{"refresh_token": "%s"}`, refreshToken)),
+		)
+
+		p := RefreshTokenParams{
+			Logger:                 log.New(os.Stderr, "", log.LstdFlags),
+			TokenCollection:        tokensCollection,
+			RefreshTokenCollection: refreshTokensCollection,
+		}
+
+		err := p.FromRequest(r)
+
+		if err != nil {
+			t.Fatalf("Failed to create RefreshTokenParams from request: %v", err)
+		}
+
+		HandleRefreshToken(context.Background(), w, p)
+
+		return w
+	}
+
+	w := refresh("fresh-refresh-token")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected refresh token to be exchanged for a new session, got: %d", w.Code)
+	}
+
+	s := session{}
+	err := json.Unmarshal(w.Body.Bytes(), &s)
+
+	if err != nil || s.ClientToken == "" || s.RefreshToken == "" || s.RefreshToken == "fresh-refresh-token" {
+		t.Errorf("Expected a new client token and refresh token, got: %s", w.Body.String())
+	}
+
+	if strings.Contains(string(refreshTokensCollection.LastInsert), `"familyID":"fresh-refresh-token-family"`) == false {
+		t.Errorf("Expected rotated refresh token to stay in its family, got: %s", refreshTokensCollection.LastInsert)
+	}
+
+	if w := refresh("rotated-refresh-token"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected reuse of a rotated refresh token to be rejected, got: %d", w.Code)
+	}
+
+	if strings.Contains(string(refreshTokensCollection.LastDelete), "rotated-refresh-token-family") == false {
+		t.Errorf("Expected reuse of a rotated refresh token to revoke its family, got: %s", refreshTokensCollection.LastDelete)
+	}
+}
@@ -13,28 +13,32 @@ import (
 	"github.com/pkg/errors"
 )
 
+const ghUserURL = "https://api.github.com/user"
+
 type ghUserInfo struct {
 	ID *int `json:"id"`
 }
 
-func retrieveUser(ctx context.Context, logger *log.Logger, authToken string) (string, error) {
+func (p *githubProvider) RetrieveUserID(ctx context.Context, logger *log.Logger, authToken string) (string, error) {
 	var user string
 	var err error
 
-	req, err := http.NewRequest(http.MethodGet, "https://api.github.com/user", nil)
-
-	req.Header.Add("Authorization", fmt.Sprintf("token %s", authToken))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.userURL, nil)
 
 	if err != nil {
 		return user, err
 	}
 
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", authToken))
+
 	res, err := client.Do(req)
 
 	if err != nil {
 		return user, errors.Wrap(err, "Error performing gh request to retrieve user")
 	}
 
+	defer res.Body.Close()
+
 	resContent, err := ioutil.ReadAll(
 		io.LimitReader(res.Body, 50000),
 	)
@@ -55,7 +59,7 @@ func retrieveUser(ctx context.Context, logger *log.Logger, authToken string) (st
 	}
 
 	if ui.ID == nil {
-		return user, errors.Wrap(err, "Failed to retrieve user id from github user info")
+		return user, fmt.Errorf("Failed to retrieve user id from github user info")
 	}
 
 	return strconv.Itoa(*ui.ID), err
@@ -2,15 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
+	"flag"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/abradley2/macguffin/lib/articles"
 	"github.com/abradley2/macguffin/lib/database"
+	"github.com/abradley2/macguffin/lib/env"
+	"github.com/abradley2/macguffin/lib/migrations"
 	"github.com/abradley2/macguffin/lib/profile"
 	"github.com/abradley2/macguffin/lib/request"
 	"github.com/abradley2/macguffin/lib/token"
@@ -22,34 +28,56 @@ var logger = log.New(os.Stderr, "main.go ", log.LstdFlags)
 
 type server struct {
 	multiplexer *http.ServeMux
+	routes      map[string]map[string]handler
+	breaker     *database.Breaker
 }
 
 func (s server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := context.WithValue(r.Context(), request.LoggerKey, request.NewLogger())
 
-	s.multiplexer.ServeHTTP(w, r.WithContext(ctx))
+	// metrics are still served while the database is unavailable, to show why
+	if r.URL.Path == "/metrics" {
+		s.multiplexer.ServeHTTP(w, r.WithContext(ctx))
+		return
+	}
+
+	// fail fast with 503 while the database is unavailable
+	s.breaker.Handler(s.multiplexer).ServeHTTP(w, r.WithContext(ctx))
 }
 
 type handler = func(w http.ResponseWriter, r *http.Request)
 
-func setupRoute(mux *http.ServeMux, method string, url string, h handler) {
-	mux.HandleFunc(url, func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != method {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			w.Write([]byte("Method not allowed"))
-			return
-		}
-		h(w, r)
-	})
+// setupRoute registers a handler for one method on a url, several methods may share a url
+func (s server) setupRoute(method string, url string, h handler) {
+	methods, ok := s.routes[url]
+
+	if ok == false {
+		methods = make(map[string]handler)
+		s.routes[url] = methods
+
+		s.multiplexer.HandleFunc(url, func(w http.ResponseWriter, r *http.Request) {
+			h, ok := methods[r.Method]
+
+			if ok == false {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				w.Write([]byte("Method not allowed"))
+				return
+			}
+			h(w, r)
+		})
+	}
+
+	methods[method] = h
 }
 
-func (s server) initRoutes(db database.Database) {
+func (s server) initRoutes(db database.Database, provider token.IdentityProvider, states *token.StateSigner) {
 	mux := s.multiplexer
 
 	mux.HandleFunc("/", index)
 	mux.HandleFunc("/log", clientLog)
+	mux.HandleFunc("/ready", ready(db))
 
-	setupRoute(mux, http.MethodGet, "/profile", func(w http.ResponseWriter, r *http.Request) {
+	s.setupRoute(http.MethodGet, "/profile", func(w http.ResponseWriter, r *http.Request) {
 		logger := request.NewLogger()
 
 		params := profile.GetProfileParams{
@@ -70,13 +98,71 @@ func (s server) initRoutes(db database.Database) {
 		profile.HandleGetProfile(r.Context(), w, params)
 	})
 
-	setupRoute(mux, http.MethodPost, "/token", func(w http.ResponseWriter, r *http.Request) {
+	s.setupRoute(http.MethodPost, "/profile", func(w http.ResponseWriter, r *http.Request) {
+		logger := request.NewLogger()
+
+		params := profile.UpdateProfileParams{
+			Logger:            logger,
+			ProfileCollection: db.Collection(database.ProfileCollection),
+			TokensCollection:  db.Collection(database.TokensCollection),
+			UsersCollection:   db.Collection(database.AgentsCollection),
+		}
+		err := params.FromRequest(r)
+
+		if err != nil {
+			logger.Printf("Failed to initialze params from request to POST /profile\n%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		profile.HandleUpdateProfile(r.Context(), w, params)
+	})
+
+	s.setupRoute(http.MethodGet, "/agents/", func(w http.ResponseWriter, r *http.Request) {
+		logger := request.NewLogger()
+
+		params := profile.GetPublicAgentParams{
+			Logger:            logger,
+			ProfileCollection: db.Collection(database.ProfileCollection),
+			UsersCollection:   db.Collection(database.AgentsCollection),
+		}
+		err := params.FromRequest(r, db)
+
+		if err != nil {
+			logger.Printf("Failed to initialze params from request to /agents/\n%v", err)
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Agent not found"))
+			return
+		}
+
+		profile.HandleGetPublicAgent(r.Context(), w, params)
+	})
+
+	s.setupRoute(http.MethodGet, "/login-state", func(w http.ResponseWriter, r *http.Request) {
+		logger := request.NewLogger()
+
+		params := token.LoginStateParams{
+			Logger:   logger,
+			Provider: provider,
+			States:   states,
+		}
+
+		token.HandleGetLoginState(r.Context(), w, params)
+	})
+
+	s.setupRoute(http.MethodPost, "/token", func(w http.ResponseWriter, r *http.Request) {
 		logger := request.NewLogger()
 
 		params := token.GetTokenParams{
-			Logger:          logger,
-			TokenCollection: db.Collection(database.TokensCollection),
-			UserCollection:  db.Collection(database.AgentsCollection),
+			Logger:                 logger,
+			Transactor:             db,
+			TokenCollection:        db.Collection(database.TokensCollection),
+			RefreshTokenCollection: db.Collection(database.RefreshTokensCollection),
+			UserCollection:         db.Collection(database.AgentsCollection),
+			LoginStateCollection:   db.Collection(database.LoginStatesCollection),
+			Provider:               provider,
+			States:                 states,
 		}
 		err := params.FromRequest(r)
 
@@ -90,7 +176,27 @@ func (s server) initRoutes(db database.Database) {
 		token.HandleGetToken(r.Context(), w, params)
 	})
 
-	setupRoute(mux, http.MethodGet, "/articles", func(w http.ResponseWriter, r *http.Request) {
+	s.setupRoute(http.MethodPost, "/token/refresh", func(w http.ResponseWriter, r *http.Request) {
+		logger := request.NewLogger()
+
+		params := token.RefreshTokenParams{
+			Logger:                 logger,
+			TokenCollection:        db.Collection(database.TokensCollection),
+			RefreshTokenCollection: db.Collection(database.RefreshTokensCollection),
+		}
+		err := params.FromRequest(r)
+
+		if err != nil {
+			logger.Printf("Failed to initialize params from request for /token/refresh\n%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		token.HandleRefreshToken(r.Context(), w, params)
+	})
+
+	s.setupRoute(http.MethodGet, "/articles", func(w http.ResponseWriter, r *http.Request) {
 		logger := request.NewLogger()
 
 		params := articles.GetArticleListParams{
@@ -110,12 +216,95 @@ func (s server) initRoutes(db database.Database) {
 		articles.HandleGetArticleList(r.Context(), w, params)
 	})
 
-	setupRoute(mux, http.MethodPost, "/create-article", func(w http.ResponseWriter, r *http.Request) {
+	s.setupRoute(http.MethodGet, "/articles/", func(w http.ResponseWriter, r *http.Request) {
 		logger := request.NewLogger()
 
-		params := articles.CreateArticleParams{
+		if strings.HasSuffix(r.URL.Path, "/revisions/diff") {
+			params := articles.GetRevisionDiffParams{
+				Logger:              logger,
+				TokensCollection:    db.Collection(database.TokensCollection),
+				UsersCollection:     db.Collection(database.AgentsCollection),
+				RevisionsCollection: db.Collection(database.RevisionsCollection),
+			}
+			err := params.FromRequest(r, db)
+
+			if err != nil {
+				logger.Printf("Failed to initialize params from request to /articles/ revision diff\n%v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			articles.HandleGetRevisionDiff(r.Context(), w, params)
+			return
+		}
+
+		if strings.HasSuffix(r.URL.Path, "/revisions") {
+			params := articles.GetRevisionsParams{
+				Logger:              logger,
+				TokensCollection:    db.Collection(database.TokensCollection),
+				UsersCollection:     db.Collection(database.AgentsCollection),
+				RevisionsCollection: db.Collection(database.RevisionsCollection),
+			}
+			err := params.FromRequest(r, db)
+
+			if err != nil {
+				logger.Printf("Failed to initialize params from request to /articles/ revisions\n%v", err)
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte("Article not found"))
+				return
+			}
+
+			articles.HandleGetRevisions(r.Context(), w, params)
+			return
+		}
+
+		params := articles.GetArticleParams{
+			Logger:           logger,
+			TokensCollection: db.Collection(database.TokensCollection),
+			UsersCollection:  db.Collection(database.AgentsCollection),
+		}
+		err := params.FromRequest(r, db)
+
+		if err != nil {
+			logger.Printf("Failed to initialize params from request to /articles/\n%v", err)
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Article not found"))
+			return
+		}
+
+		articles.HandleGetArticle(r.Context(), w, params)
+	})
+
+	s.setupRoute(http.MethodGet, "/search", func(w http.ResponseWriter, r *http.Request) {
+		logger := request.NewLogger()
+
+		params := articles.SearchArticlesParams{
 			Logger:           logger,
 			TokensCollection: db.Collection(database.TokensCollection),
+			UsersCollection:  db.Collection(database.AgentsCollection),
+		}
+		err := params.FromRequest(r, db)
+
+		if err != nil {
+			logger.Printf("Failed to initialize params from request for /search\n%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		articles.HandleSearchArticles(r.Context(), w, params)
+	})
+
+	s.setupRoute(http.MethodPost, "/create-article", func(w http.ResponseWriter, r *http.Request) {
+		logger := request.NewLogger()
+
+		params := articles.CreateArticleParams{
+			Logger:              logger,
+			TokensCollection:    db.Collection(database.TokensCollection),
+			UsersCollection:     db.Collection(database.AgentsCollection),
+			RevisionsCollection: db.Collection(database.RevisionsCollection),
+			Transactor:          db,
 		}
 		err := params.FromRequest(r, db)
 
@@ -128,10 +317,213 @@ func (s server) initRoutes(db database.Database) {
 
 		articles.HandleCreateArticle(r.Context(), w, params)
 	})
+
+	s.setupRoute(http.MethodPost, "/update-article", func(w http.ResponseWriter, r *http.Request) {
+		logger := request.NewLogger()
+
+		params := articles.UpdateArticleParams{
+			Logger:              logger,
+			TokensCollection:    db.Collection(database.TokensCollection),
+			UsersCollection:     db.Collection(database.AgentsCollection),
+			RevisionsCollection: db.Collection(database.RevisionsCollection),
+			Transactor:          db,
+		}
+		err := params.FromRequest(r, db)
+
+		if err != nil {
+			logger.Printf("Failed to initialize params from request for /update-article\n%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		articles.HandleUpdateArticle(r.Context(), w, params)
+	})
+
+	s.setupRoute(http.MethodGet, "/moderation/pending", func(w http.ResponseWriter, r *http.Request) {
+		logger := request.NewLogger()
+
+		params := articles.GetModerationQueueParams{
+			Logger:           logger,
+			TokensCollection: db.Collection(database.TokensCollection),
+			UsersCollection:  db.Collection(database.AgentsCollection),
+		}
+		err := params.FromRequest(r, db)
+
+		if err != nil {
+			logger.Printf("Failed to initialize params from request for /moderation/pending\n%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		articles.HandleGetModerationQueue(r.Context(), w, params)
+	})
+
+	s.setupRoute(http.MethodPost, "/moderation/approve", func(w http.ResponseWriter, r *http.Request) {
+		logger := request.NewLogger()
+
+		params := articles.ModerateArticleParams{
+			Logger:           logger,
+			TokensCollection: db.Collection(database.TokensCollection),
+			UsersCollection:  db.Collection(database.AgentsCollection),
+		}
+		err := params.FromRequest(r, db)
+
+		if err != nil {
+			logger.Printf("Failed to initialize params from request for /moderation/approve\n%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		articles.HandleApproveArticle(r.Context(), w, params)
+	})
+
+	s.setupRoute(http.MethodPost, "/moderation/reject", func(w http.ResponseWriter, r *http.Request) {
+		logger := request.NewLogger()
+
+		params := articles.ModerateArticleParams{
+			Logger:           logger,
+			TokensCollection: db.Collection(database.TokensCollection),
+			UsersCollection:  db.Collection(database.AgentsCollection),
+		}
+		err := params.FromRequest(r, db)
+
+		if err != nil {
+			logger.Printf("Failed to initialize params from request for /moderation/reject\n%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		articles.HandleRejectArticle(r.Context(), w, params)
+	})
+
+	s.setupRoute(http.MethodPost, "/moderation/restore", func(w http.ResponseWriter, r *http.Request) {
+		logger := request.NewLogger()
+
+		params := articles.RestoreRevisionParams{
+			Logger:              logger,
+			Transactor:          db,
+			TokensCollection:    db.Collection(database.TokensCollection),
+			UsersCollection:     db.Collection(database.AgentsCollection),
+			RevisionsCollection: db.Collection(database.RevisionsCollection),
+		}
+		err := params.FromRequest(r, db)
+
+		if err != nil {
+			logger.Printf("Failed to initialize params from request for /moderation/restore\n%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		articles.HandleRestoreRevision(r.Context(), w, params)
+	})
+
+	s.setupRoute(http.MethodPost, "/logout", func(w http.ResponseWriter, r *http.Request) {
+		logger := request.NewLogger()
+
+		params := token.LogoutParams{
+			Logger:                 logger,
+			TokenCollection:        db.Collection(database.TokensCollection),
+			RefreshTokenCollection: db.Collection(database.RefreshTokensCollection),
+			UserCollection:         db.Collection(database.AgentsCollection),
+		}
+		err := params.FromRequest(r)
+
+		if err != nil {
+			logger.Printf("Failed to initialize params from request for /logout\n%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		token.HandleLogout(r.Context(), w, params)
+	})
+
+	s.setupRoute(http.MethodPost, "/logout-all", func(w http.ResponseWriter, r *http.Request) {
+		logger := request.NewLogger()
+
+		params := token.LogoutParams{
+			Logger:                 logger,
+			TokenCollection:        db.Collection(database.TokensCollection),
+			RefreshTokenCollection: db.Collection(database.RefreshTokensCollection),
+			UserCollection:         db.Collection(database.AgentsCollection),
+		}
+		err := params.FromRequest(r)
+
+		if err != nil {
+			logger.Printf("Failed to initialize params from request for /logout-all\n%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		token.HandleLogoutAll(r.Context(), w, params)
+	})
+
+	s.setupRoute(http.MethodPost, "/agents/revoke-sessions", func(w http.ResponseWriter, r *http.Request) {
+		logger := request.NewLogger()
+
+		params := token.RevokeSessionsParams{
+			Logger:                 logger,
+			TokenCollection:        db.Collection(database.TokensCollection),
+			RefreshTokenCollection: db.Collection(database.RefreshTokensCollection),
+			UserCollection:         db.Collection(database.AgentsCollection),
+		}
+		err := params.FromRequest(r)
+
+		if err != nil {
+			logger.Printf("Failed to initialize params from request for /agents/revoke-sessions\n%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		token.HandleRevokeSessions(r.Context(), w, params)
+	})
+
+	s.setupRoute(http.MethodPost, "/agents/role", func(w http.ResponseWriter, r *http.Request) {
+		logger := request.NewLogger()
+
+		params := token.SetRoleParams{
+			Logger:          logger,
+			TokenCollection: db.Collection(database.TokensCollection),
+			UserCollection:  db.Collection(database.AgentsCollection),
+		}
+		err := params.FromRequest(r)
+
+		if err != nil {
+			logger.Printf("Failed to initialize params from request for /agents/role\n%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		token.HandleSetRole(r.Context(), w, params)
+	})
 }
 
 func main() {
-	err := run()
+	var err error
+
+	if len(os.Args) < 2 {
+		err = run()
+	} else {
+		switch os.Args[1] {
+		case "migrate":
+			err = migrateCommand(os.Args[2:])
+		case "indexes":
+			err = indexesCommand(os.Args[2:])
+		case "migrate-tokens":
+			logger.Printf("migrate-tokens is now the hash-client-tokens migration, running migrate")
+			err = migrateCommand(nil)
+		default:
+			err = run()
+		}
+	}
 
 	if err != nil {
 		logger.Printf("Error running server: %v", err)
@@ -139,6 +531,89 @@ func main() {
 	}
 }
 
+// migrateCommand applies pending migrations, or with -dry-run only lists them
+func migrateCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "list pending migrations without applying them")
+
+	err := flags.Parse(args)
+
+	if err != nil {
+		return err
+	}
+
+	db, err := database.OpenDatabase()
+
+	if err != nil {
+		return errors.Wrap(err, "main.go migrateCommand function failed in calling OpenDatabase")
+	}
+
+	if *dryRun {
+		pending, err := migrations.Pending(context.Background(), db, migrations.All)
+
+		for _, m := range pending {
+			logger.Printf("Pending migration %d %s", m.Version, m.Name)
+		}
+
+		logger.Printf("%d pending migrations", len(pending))
+
+		return err
+	}
+
+	return migrate(db)
+}
+
+// migrate applies pending migrations
+func migrate(db database.Database) error {
+	applied, err := migrations.Up(context.Background(), db, migrations.All)
+
+	logger.Printf("Applied %d migrations", len(applied))
+
+	return err
+}
+
+// indexesCommand prints the changes reconciling indexes would make, without making them
+func indexesCommand(args []string) error {
+	flags := flag.NewFlagSet("indexes", flag.ContinueOnError)
+	dropUnknown := flags.Bool("drop-unknown", env.DropUnknownIndexes, "plan to drop indexes that aren't declared")
+
+	err := flags.Parse(args)
+
+	if err != nil {
+		return err
+	}
+
+	db, err := database.OpenDatabase()
+
+	if err != nil {
+		return errors.Wrap(err, "main.go indexesCommand function failed in calling OpenDatabase")
+	}
+
+	changes, err := database.PlanIndexes(context.Background(), db, *dropUnknown)
+
+	for _, c := range changes {
+		logger.Printf("%s", c)
+	}
+
+	logger.Printf("%d index changes planned", len(changes))
+
+	return err
+}
+
+// reconcileIndexes creates and recreates indexes to match the ones declared in the database package
+func reconcileIndexes(db database.Database) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	changes, err := database.ReconcileIndexes(ctx, db, env.DropUnknownIndexes)
+
+	for _, c := range changes {
+		logger.Printf("Index %s", c)
+	}
+
+	return err
+}
+
 func run() error {
 	db, err := database.OpenDatabase()
 
@@ -146,8 +621,81 @@ func run() error {
 		return errors.Wrap(err, "main.go run function failed in calling OpenDatabase")
 	}
 
+	breaker := database.NewBreaker(env.DatabaseBreakerThreshold, env.DatabaseBreakerCooldown)
+	db = database.Resilient(
+		db,
+		database.RetryPolicy{
+			Attempts:  env.DatabaseRetryAttempts,
+			BaseDelay: 50 * time.Millisecond,
+			MaxDelay:  time.Second,
+		},
+		breaker,
+	)
+
+	metrics := database.NewMetrics()
+
+	if env.QueryMetrics {
+		db = database.Instrument(db, metrics, env.SlowQueryThreshold)
+	}
+
+	if env.MigrateOnStartup {
+		err = migrate(db)
+
+		if err != nil {
+			return errors.Wrap(err, "main.go run function failed in calling migrate")
+		}
+	} else {
+		pending, err := migrations.Pending(context.Background(), db, migrations.All)
+
+		if err != nil {
+			return errors.Wrap(err, "main.go run function failed in calling Pending")
+		}
+
+		if len(pending) > 0 {
+			logger.Printf("%d migrations are pending, run `go run . migrate` to apply them", len(pending))
+		}
+	}
+
+	err = reconcileIndexes(db)
+
+	if err != nil {
+		return errors.Wrap(err, "main.go run function failed in calling reconcileIndexes")
+	}
+
+	if env.BootstrapAdmin != "" {
+		granted, err := token.BootstrapAdmin(context.Background(), db.Collection(database.AgentsCollection), env.BootstrapAdmin)
+
+		if err != nil {
+			return errors.Wrap(err, "main.go run function failed in calling BootstrapAdmin")
+		}
+
+		if granted {
+			logger.Printf("Granted the admin role to BOOTSTRAP_ADMIN %s", env.BootstrapAdmin)
+		} else {
+			logger.Printf("An admin already exists, ignoring BOOTSTRAP_ADMIN")
+		}
+	}
+
+	provider, err := token.ProviderFromEnv()
+
+	if err != nil {
+		return errors.Wrap(err, "main.go run function failed in calling ProviderFromEnv")
+	}
+
+	stateSecret := []byte(env.OAuthStateSecret)
+
+	if len(stateSecret) == 0 {
+		logger.Printf("OAUTH_STATE_SECRET is not set, logins will fail across restarts and server instances")
+		stateSecret = make([]byte, 32)
+		_, err = rand.Read(stateSecret)
+
+		if err != nil {
+			return errors.Wrap(err, "main.go run function failed generating an oauth state secret")
+		}
+	}
+
 	mux := http.NewServeMux()
-	s := server{mux}
+	s := server{mux, make(map[string]map[string]handler), breaker}
 
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
@@ -155,7 +703,11 @@ func run() error {
 		AllowCredentials: true,
 	})
 
-	s.initRoutes(db)
+	s.initRoutes(db, provider, token.NewStateSigner(stateSecret))
+
+	if env.QueryMetrics {
+		mux.Handle("/metrics", metrics)
+	}
 
 	return http.ListenAndServe(":8080", c.Handler(s))
 }
@@ -175,6 +727,29 @@ func index(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Hello World!"))
 }
 
+// ready responds 200 while the database can be reached and 503 while it can't, so a load
+// balancer only sends requests to instances that can serve them
+func ready(db database.Database) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(request.LoggerKey).(*log.Logger)
+
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+
+		err := db.Ping(ctx)
+
+		if err != nil {
+			logger.Printf("Not ready: %v", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Database unavailable"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Ready"))
+	}
+}
+
 type clientLogBody struct {
 	Msg *string `json:"logMessage"`
 }
@@ -14,8 +14,10 @@ type alias Log =
 type ExtMsg
     = LogError Log
     | SetToken Token
+    | SetLoginState { state : String, verifier : String }
     | ReplaceUrl String
     | PushUrl String
+    | LoadUrl String
     | Batch (List ExtMsg)
 
 
@@ -25,6 +27,9 @@ hasRedirect extMsg =
         PushUrl _ ->
             True
 
+        LoadUrl _ ->
+            True
+
         Batch msgList ->
             List.foldl
                 (\cur acc ->
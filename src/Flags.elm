@@ -5,4 +5,6 @@ type alias Flags =
     { apiUrl : String
     , pageUrl : String
     , token : Maybe String
+    , loginState : Maybe String
+    , loginVerifier : Maybe String
     }
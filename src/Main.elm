@@ -32,6 +32,7 @@ type Effect
     | EffLoadUrl String
     | EffLogErrorMessage Flags String
     | EffStoreToken String
+    | EffStoreLoginState { state : String, verifier : String }
 
 
 performEffect : Effect -> Cmd Msg
@@ -55,6 +56,9 @@ performEffect eff =
         EffStoreToken token ->
             storeToken token
 
+        EffStoreLoginState loginState ->
+            storeLoginState loginState
+
         EffLoadUrl url ->
             load url
 
@@ -70,6 +74,9 @@ performEffect eff =
 port storeToken : String -> Cmd msg
 
 
+port storeLoginState : { state : String, verifier : String } -> Cmd msg
+
+
 type Page
     = NotFound
     | LoginPage LoginPage.Model
@@ -187,9 +194,15 @@ handleExternalMsg_ appKey flags ( model, eff ) extMsg =
                     EffStoreToken val
             )
 
+        SetLoginState loginState ->
+            ( model, EffStoreLoginState loginState )
+
         ReplaceUrl nextUrl ->
             ( model, EffReplaceUrl appKey nextUrl )
 
+        LoadUrl nextUrl ->
+            ( model, EffLoadUrl nextUrl )
+
         PushUrl nextUrl ->
             ( model, EffPushUrl appKey nextUrl )
 
@@ -233,10 +246,12 @@ init flagsValue url appKey =
     let
         decodedFlags =
             D.decodeValue
-                (D.map3 Flags
+                (D.map5 Flags
                     (D.field "apiUrl" D.string)
                     (D.field "pageUrl" D.string)
                     (D.field "token" (D.nullable D.string))
+                    (D.maybe (D.field "loginState" D.string))
+                    (D.maybe (D.field "loginVerifier" D.string))
                 )
                 flagsValue
     in
@@ -256,6 +271,8 @@ init flagsValue url appKey =
                     { apiUrl = ""
                     , pageUrl = ""
                     , token = Nothing
+                    , loginState = Nothing
+                    , loginVerifier = Nothing
                     }
         , appFailure =
             decodedFlags
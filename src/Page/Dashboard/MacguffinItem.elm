@@ -35,7 +35,7 @@ getMacguffinItems mToken flags onCompleted =
         , expect =
             Http.expectJson
                 onCompleted
-                (D.list decodeMacguffinItem)
+                (D.field "articles" (D.list decodeMacguffinItem))
         , headers =
             case mToken of
                 Just (Token token) ->
@@ -6,30 +6,22 @@ import ExtMsg exposing (ExtMsg(..), Token(..))
 import Flags exposing (Flags)
 import Html as H
 import Html.Attributes as A
+import Html.Events as E
 import Http
 import Json.Decode as D
-import Json.Encode as E
+import Json.Encode as Encode
 import PageResult exposing (resolveEffects, withEffect)
 import Url exposing (Url)
-import Url.Builder exposing (crossOrigin, string)
+import Url.Builder exposing (crossOrigin)
 import Url.Parser exposing (parse, query)
 import Url.Parser.Query as Q
 
 
-ghUrl : Flags -> String
-ghUrl flags =
-    crossOrigin
-        "https://github.com"
-        [ "login", "oauth", "authorize" ]
-        [ string "client_id" "c03a348dc743e9a1edc6"
-        , string "redirect_uri" flags.pageUrl
-        ]
-
-
 type Effect
     = Eff (Cmd Msg)
     | EffBatch (List Effect)
-    | EffFetchToken Flags String
+    | EffFetchToken Flags String String String
+    | EffFetchLoginState Flags
 
 
 performEffect : Effect -> Cmd Msg
@@ -41,28 +33,69 @@ performEffect effect =
         EffBatch effList ->
             effList |> List.map performEffect |> Cmd.batch
 
-        EffFetchToken flags code ->
-            getToken flags code
+        EffFetchToken flags code state verifier ->
+            getToken flags code state verifier
+
+        EffFetchLoginState flags ->
+            getLoginState flags
 
 
 type alias Model =
     {}
 
 
+type alias LoginState =
+    { state : String
+    , codeVerifier : String
+    , authorizeUrl : String
+    }
+
+
 type Msg
     = FetchedToken (Result Http.Error Token)
+    | LoginClicked Flags
+    | FetchedLoginState (Result Http.Error LoginState)
 
 
 type alias PageResult =
     ComponentResult ( Model, Effect ) Msg ExtMsg Never
 
 
-getToken : Flags -> String -> Cmd Msg
-getToken flags code =
+{-| Before redirecting to the identity provider we ask the server for a signed state,
+which we remember and must get back along with the code, and a PKCE verifier that we
+remember and present with the code so that nobody else can redeem it
+-}
+getLoginState : Flags -> Cmd Msg
+getLoginState flags =
+    Http.request
+        { body = Http.emptyBody
+        , expect =
+            Http.expectJson
+                FetchedLoginState
+                (D.map3 LoginState
+                    (D.field "state" D.string)
+                    (D.field "codeVerifier" D.string)
+                    (D.field "authorizeURL" D.string)
+                )
+        , headers = []
+        , method = "GET"
+        , timeout = Just 5000
+        , tracker = Nothing
+        , url = crossOrigin flags.apiUrl [ "login-state" ] []
+        }
+
+
+getToken : Flags -> String -> String -> String -> Cmd Msg
+getToken flags code state verifier =
     Http.request
         { body =
             Http.jsonBody
-                (E.object [ ( "code", E.string code ) ])
+                (Encode.object
+                    [ ( "code", Encode.string code )
+                    , ( "state", Encode.string state )
+                    , ( "codeVerifier", Encode.string verifier )
+                    ]
+                )
         , expect =
             Http.expectJson
                 FetchedToken
@@ -75,9 +108,9 @@ getToken flags code =
         }
 
 
-queryParser : Q.Parser (Maybe String)
+queryParser : Q.Parser (Maybe ( String, String ))
 queryParser =
-    Q.map (\v -> v) (Q.string "code")
+    Q.map2 (Maybe.map2 Tuple.pair) (Q.string "code") (Q.string "state")
 
 
 init flags url =
@@ -87,15 +120,26 @@ init flags url =
 
 init_ : Flags -> Url -> PageResult
 init_ flags url =
-    let
-        login =
-            parse (query queryParser) url
-                |> Maybe.andThen (\v -> v)
-                |> Maybe.map (EffFetchToken flags)
-                |> Maybe.withDefault (Eff Cmd.none)
-    in
-    withModel {}
-        |> withEffect login
+    case parse (query queryParser) url |> Maybe.andThen (\v -> v) of
+        Just ( code, state ) ->
+            case ( Just state == flags.loginState, flags.loginVerifier ) of
+                ( True, Just verifier ) ->
+                    withModel {}
+                        |> withEffect (EffFetchToken flags code state verifier)
+
+                _ ->
+                    withModel {}
+                        |> withExternalMsg
+                            (LogError
+                                { logMessage = Just "Login state did not match the state we were issued"
+                                , userMessage = Just "Login Failed :("
+                                }
+                            )
+                        |> withEffect (Eff Cmd.none)
+
+        Nothing ->
+            withModel {}
+                |> withEffect (Eff Cmd.none)
 
 
 update msg model =
@@ -115,6 +159,30 @@ update_ msg model =
                     )
                 |> withEffect (Eff Cmd.none)
 
+        LoginClicked flags ->
+            withModel model
+                |> withEffect (EffFetchLoginState flags)
+
+        FetchedLoginState (Result.Err httpErr) ->
+            withModel model
+                |> withExternalMsg
+                    (LogError
+                        { logMessage = Just <| httpErrToString httpErr
+                        , userMessage = Just <| "Login Failed :("
+                        }
+                    )
+                |> withEffect (Eff Cmd.none)
+
+        FetchedLoginState (Result.Ok loginState) ->
+            withModel model
+                |> withExternalMsg
+                    (Batch
+                        [ SetLoginState { state = loginState.state, verifier = loginState.codeVerifier }
+                        , LoadUrl loginState.authorizeUrl
+                        ]
+                    )
+                |> withEffect (Eff Cmd.none)
+
         FetchedToken (Result.Ok tokenResponse) ->
             withModel model
                 |> withExternalMsg
@@ -140,9 +208,10 @@ view flags model =
             []
         , H.div
             []
-            [ H.a
-                [ A.href (ghUrl flags)
+            [ H.button
+                [ E.onClick (LoginClicked flags)
                 , A.class "button"
+                , A.attribute "data-test" "login-button"
                 ]
                 [ H.text "LOGIN" ]
             ]
@@ -24,10 +24,21 @@ try {
   window.console.error(err)
 }
 
+// the oauth state we were issued before redirecting to login, checked when we are redirected back,
+// and the PKCE verifier that only we know, which the server needs to redeem the code
+let loginState = null
+let loginVerifier = null
+try {
+  loginState = window.sessionStorage.getItem("loginState") || null
+  loginVerifier = window.sessionStorage.getItem("loginVerifier") || null
+} catch (err) {
+  window.console.error(err)
+}
+
 const app = Elm.Main.init({
   flags: process.env.NODE_ENV === "development"
-    ? { apiUrl: "http://localhost:8080", pageUrl, token }
-    : { apiUrl: window.location.host, pageUrl, token }
+    ? { apiUrl: "http://localhost:8080", pageUrl, token, loginState, loginVerifier }
+    : { apiUrl: window.location.host, pageUrl, token, loginState, loginVerifier }
 })
 
 app.ports.storeToken.subscribe((token) => {
@@ -38,6 +49,17 @@ app.ports.storeToken.subscribe((token) => {
   }
 })
 
+app.ports.storeLoginState.subscribe(({ state, verifier }) => {
+  try {
+    if (window.sessionStorage) {
+      window.sessionStorage.setItem("loginState", state)
+      window.sessionStorage.setItem("loginVerifier", verifier)
+    }
+  } catch (err) {
+    window.console.error(err)
+  }
+})
+
 // if (window.location.search.includes("code")) {
 //   setTimeout(function () {
 //     window.history.replaceState(null, document.title, "/")
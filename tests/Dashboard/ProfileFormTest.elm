@@ -47,6 +47,8 @@ flags =
     { apiUrl = "apiUrl"
     , pageUrl = "pageUrl"
     , token = Nothing
+    , loginState = Nothing
+    , loginVerifier = Nothing
     }
 
 
@@ -19,6 +19,8 @@ flags =
     { apiUrl = "apiUrl"
     , pageUrl = "pageUrl"
     , token = Nothing
+    , loginState = Nothing
+    , loginVerifier = Nothing
     }
 
 